@@ -0,0 +1,76 @@
+package lshensemble
+
+import (
+	"time"
+)
+
+// QueryAdaptive is like Query, but probes the bands of the partitions
+// incrementally, as the prefixes of an LSH Forest are shortened until
+// enough candidates are found: it probes the first band of every
+// partition at the K and L optimal for the threshold, and then twice as
+// many bands at every step, as long as fewer than minResults distinct
+// candidates are found and the partitions have bands left within their
+// optimal L. A query with enough candidates in its first bands then
+// scans fewer buckets than Query, returning a subset of its candidates.
+// The queries bypass the admission controller and the query cache.
+func (e *LshEnsemble) QueryAdaptive(sig Signature, size int, threshold float64, minResults int) (result []string, dur time.Duration) {
+	start := time.Now()
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	params := e.optimalParams(size, threshold, Supersets)
+	e.stats.record(params)
+	if len(sig) < e.numHash {
+		e.stats.recordShort()
+	}
+	result = make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, key)
+		}
+	}
+	if e.realtime != nil {
+		keys := make(chan string)
+		go func() {
+			e.realtime.probe(e, sig, params, nil, keys)
+			close(keys)
+		}()
+		for key := range keys {
+			add(key)
+		}
+	}
+	forests := make([]*LshForest, len(params))
+	ks := make([]int, len(params))
+	ls := make([]int, len(params))
+	var maxL int
+	for i, p := range params {
+		if p.l == 0 {
+			continue
+		}
+		f, K := e.lshes[i].forest(p.k)
+		if K == -1 {
+			K = f.k
+		}
+		forests[i], ks[i], ls[i] = f, K, f.bands(sig, K, p.l)
+		if ls[i] > maxL {
+			maxL = ls[i]
+		}
+	}
+	for probed, next := 0, 1; probed < maxL && len(result) < minResults; probed, next = next, 2*next {
+		for i, f := range forests {
+			for b := probed; b < next && b < ls[i]; b++ {
+				t := f.table(b)
+				first, last := f.search(t, f.hashKeyFuncs[b](sig[b*f.k:b*f.k+ks[i]]), ks[i])
+				ext := f.extension(sig, b)
+				for x := first; x < last; x++ {
+					scanBucket(t, x, ext, func(key string) bool {
+						add(key)
+						return true
+					})
+				}
+			}
+		}
+	}
+	return result, time.Since(start)
+}
@@ -0,0 +1,129 @@
+package lshensemble
+
+import (
+	"fmt"
+)
+
+// QueryCost is the estimated cost of a query, computed from the LSH
+// parameters of every partition and the sizes of the matched buckets.
+type QueryCost struct {
+	// Probes is the number of hash tables probed.
+	Probes int
+	// Matches is the number of keys in the matched buckets, which bounds
+	// the number of candidates and the work to deduplicate them.
+	Matches int
+}
+
+// AdmissionController decides whether queries are run, so that a service
+// can reject or queue expensive queries during overload.
+type AdmissionController interface {
+	// Admit is called before every query, with the index read-locked.
+	// It returns an error to reject the query, or a function called when
+	// the query completes. It may block to queue the query, which holds
+	// back the updates of the index waiting for the lock: the queues are
+	// better in Enter, of an AdmissionQueue.
+	Admit(cost QueryCost) (release func(), err error)
+}
+
+// AdmissionQueue is an AdmissionController queueing the queries before
+// they lock the index, so the queries queued do not stall its updates.
+type AdmissionQueue interface {
+	AdmissionController
+	// Enter is called before every query locks the index, and blocks
+	// until it can run. It returns the function called when the query
+	// completes, after the release of Admit.
+	Enter() (leave func())
+}
+
+// WithAdmissionController sets the admission controller of the queries.
+func WithAdmissionController(ac AdmissionController) Option {
+	return func(c *config) {
+		c.admission = ac
+	}
+}
+
+// SetAdmissionController sets the admission controller of the queries,
+// or removes it if ac is nil.
+// Rejected queries return an error from QueryE and QueryByKey, and no
+// candidates from the other query functions.
+func (e *LshEnsemble) SetAdmissionController(ac AdmissionController) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.admission = ac
+}
+
+// rlockQuery read-locks the index for a query, once it has entered the
+// queue of the admission controller if it is an AdmissionQueue, and
+// returns the function unlocking the index and leaving the queue.
+func (e *LshEnsemble) rlockQuery() (unlock func()) {
+	e.mu.RLock()
+	q, queued := e.admission.(AdmissionQueue)
+	if !queued {
+		return e.mu.RUnlock
+	}
+	e.mu.RUnlock()
+	leave := q.Enter()
+	e.mu.RLock()
+	return func() {
+		e.mu.RUnlock()
+		leave()
+	}
+}
+
+// admit estimates the cost of a query and asks the admission controller
+// to admit it.
+func (e *LshEnsemble) admit(sig Signature, params []param) (release func(), err error) {
+	if e.admission == nil {
+		return func() {}, nil
+	}
+	var cost QueryCost
+	for i, lsh := range e.lshes {
+		if params[i].l == 0 {
+			continue
+		}
+		f, K := lsh.forest(params[i].k)
+		for _, r := range f.matches(sig, K, params[i].l) {
+			cost.Probes++
+			cost.Matches += r.size()
+		}
+	}
+	return e.admission.Admit(cost)
+}
+
+// AdmissionLimiter is an AdmissionQueue which rejects the queries
+// matching too many keys, and queues the queries above a number of
+// concurrent queries.
+type AdmissionLimiter struct {
+	maxMatches int
+	slots      chan struct{}
+}
+
+// NewAdmissionLimiter creates an admission controller running at most
+// maxConcurrent queries at once, and rejecting the queries matching more
+// than maxMatches keys. Zero means no limit.
+func NewAdmissionLimiter(maxConcurrent, maxMatches int) *AdmissionLimiter {
+	l := &AdmissionLimiter{maxMatches: maxMatches}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// Admit implements AdmissionController, rejecting the queries matching
+// too many keys.
+func (l *AdmissionLimiter) Admit(cost QueryCost) (func(), error) {
+	if l.maxMatches > 0 && cost.Matches > l.maxMatches {
+		return nil, fmt.Errorf("%w: %d keys matched, limit %d", ErrQueryRejected, cost.Matches, l.maxMatches)
+	}
+	return func() {}, nil
+}
+
+// Enter implements AdmissionQueue, queueing the queries above the number
+// of concurrent queries.
+func (l *AdmissionLimiter) Enter() func() {
+	if l.slots == nil {
+		return func() {}
+	}
+	l.slots <- struct{}{}
+	return func() { <-l.slots }
+}
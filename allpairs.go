@@ -0,0 +1,140 @@
+package lshensemble
+
+import "fmt"
+
+// Pair represents a candidate pair found by AllPairs:
+// the domain of Query is likely contained in the domain of Candidate.
+type Pair struct {
+	Query     string `json:"query"`
+	Candidate string `json:"candidate"`
+}
+
+// pairQuery is a domain of a partition joined by AllPairs, with the LSH
+// parameters of its queries of every partition.
+type pairQuery struct {
+	rec    *DomainRecord
+	params []param
+}
+
+// AllPairs self-joins the domains retained by AddDomain, and writes to out
+// every pair of keys whose containment, estimated from their signatures,
+// is no less than the threshold. The candidates of a domain are those
+// sharing a bucket with it in the bands of its LSH parameters, as for
+// Query: the hash tables of the partitions are joined band by band, the
+// domains of a bucket matching the buckets of the other partitions with
+// one search of their shared hash key. Every pair is written once, and
+// pairs of a domain with itself are skipped. Keys indexed in multiple
+// partitions may be paired once per partition, and the keys added by Add
+// are not joined, as their sizes and signatures are not retained.
+// It returns an error wrapping ErrKeyNotRetained if the index retains no
+// records, or the error of a partition of a tiered index failing to load.
+// The domains cannot be added until AllPairs returns.
+func (e *LshEnsemble) AllPairs(threshold float64, out chan<- Pair) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.hasRecords() {
+		return fmt.Errorf("%w: no records retained", ErrKeyNotRetained)
+	}
+	if e.tiers != nil {
+		all := make([]param, len(e.lshes))
+		for i := range all {
+			all[i] = param{e.maxK, 1}
+		}
+		unpin, err := e.tiers.pin(e.lshes, all)
+		if err != nil {
+			return err
+		}
+		defer unpin()
+	}
+	for p, lsh := range e.lshes {
+		queries := make(map[string]*pairQuery)
+		if forests := lshForests(lsh); len(forests) > 0 {
+			forests[0].eachKey(func(key string) {
+				if rec, exist := e.retained(key); exist {
+					queries[key] = &pairQuery{rec, e.optimalParams(rec.Size, threshold, Supersets)}
+				}
+			})
+		}
+		for i := range e.lshes {
+			ks := make(map[int]bool)
+			for _, q := range queries {
+				if q.params[i].l > 0 {
+					ks[q.params[i].k] = true
+				}
+			}
+			for k := range ks {
+				e.joinPairs(p, i, k, queries, threshold, out)
+			}
+		}
+	}
+	return nil
+}
+
+// joinPairs writes the pairs of the queries of partition p whose LSH
+// parameters for partition i have k hash values per band, and the
+// candidates of partition i. The queries are scanned by buckets, so the
+// queries sharing the hash key of a band search the band once.
+func (e *LshEnsemble) joinPairs(p, i, k int, queries map[string]*pairQuery, threshold float64, out chan<- Pair) {
+	fp, _ := e.lshes[p].forest(k)
+	fi, K := e.lshes[i].forest(k)
+	if K == -1 {
+		K = fi.k
+	}
+	for j := 0; j < fp.l && j < fi.l; j++ {
+		tp, ti := fp.table(j), fi.table(j)
+		// The keys added twice are joined once
+		joined := make(map[string]bool)
+		var prefix string
+		var start, end int
+		searched := false
+		for b := 0; b < tp.buckets(); b++ {
+			tp.scan(b, func(key string) bool {
+				q := queries[key]
+				if q == nil || q.params[i].k != k || q.params[i].l <= j || joined[key] {
+					return true
+				}
+				joined[key] = true
+				sig := q.rec.Signature
+				if j*fi.k+K > len(sig) {
+					return true
+				}
+				if h := fi.hashKeyFuncs[j](sig[j*fi.k : j*fi.k+K]); !searched || h != prefix {
+					prefix, searched = h, true
+					start, end = fi.search(ti, prefix, K)
+				}
+				for c := start; c < end; c++ {
+					ti.scan(c, func(candidate string) bool {
+						if candidate == key {
+							return true
+						}
+						rec, exist := e.retained(candidate)
+						// The pairs colliding in an earlier band were written
+						if !exist || collides(fi, j, K, sig, rec.Signature) {
+							return true
+						}
+						if estimateContainment(sig, q.rec.Size, rec.Signature, rec.Size) >= threshold {
+							out <- Pair{Query: key, Candidate: candidate}
+						}
+						return true
+					})
+				}
+				return true
+			})
+		}
+	}
+}
+
+// collides returns whether the signatures share the hash key of the
+// first K hash values of a band of the forest before band j.
+func collides(f *LshForest, j, K int, sig1, sig2 Signature) bool {
+	for b := 0; b < j; b++ {
+		start, end := b*f.k, b*f.k+K
+		if end > len(sig1) || end > len(sig2) {
+			return false
+		}
+		if f.hashKeyFuncs[b](sig1[start:end]) == f.hashKeyFuncs[b](sig2[start:end]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package lshensemble
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// QueryAudit is a query sampled by the audit hook of an index, for the
+// offline analysis of the workload, e.g. to re-tune the partitions or the
+// thresholds from the query sizes and the numbers of candidates.
+type QueryAudit struct {
+	Time time.Time `json:"time"`
+	// Signature is the 64-bit hash of the query signature, identifying
+	// the repeated queries without keeping their signatures.
+	Signature uint64    `json:"signature"`
+	Size      int       `json:"size"`
+	Threshold float64   `json:"threshold"`
+	Direction Direction `json:"direction"`
+	// Params are the K and L of every partition, L being 0 for the
+	// partitions skipped.
+	Params []AuditParam `json:"params"`
+	// Candidates is the number of candidates delivered.
+	Candidates int           `json:"candidates"`
+	Latency    time.Duration `json:"latency"`
+	// Error is the error of the query, e.g. of the admission controller
+	// or of a partial query, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditParam are the LSH parameters of a partition of an audited query.
+type AuditParam struct {
+	K int `json:"k"`
+	L int `json:"l"`
+}
+
+// AuditOptions configures the audit of the queries of an index.
+type AuditOptions struct {
+	// SampleRate is the fraction of the queries audited, in (0, 1].
+	SampleRate float64
+	// Hook is called with every query sampled once it is done, on the
+	// goroutine of the query, so it should be fast, e.g. a JSONAuditHook
+	// of a buffered writer.
+	Hook func(QueryAudit)
+}
+
+// WithAudit sets the audit of the queries of the index: Query, QueryE,
+// QuerySubsets, QueryByKey, QueryStream without a Threshold function and
+// QueryPipeline, including the queries answered by the query cache.
+func WithAudit(opts AuditOptions) Option {
+	return func(c *config) {
+		c.audit = &opts
+	}
+}
+
+// SetAudit sets the audit of the queries of the index, or removes it if
+// opts is nil.
+func (e *LshEnsemble) SetAudit(opts *AuditOptions) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.audit = opts
+}
+
+// JSONAuditHook returns an audit hook writing the queries sampled to w,
+// as JSON lines, which is safe for concurrent use. The errors of w are
+// ignored.
+func JSONAuditHook(w io.Writer) func(QueryAudit) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(a QueryAudit) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(a)
+	}
+}
+
+// auditQuery returns the function recording the query once it is done,
+// with its number of candidates and error, or nil if the query is not
+// sampled.
+func (e *LshEnsemble) auditQuery(sig Signature, size int, threshold float64, dir Direction) func(candidates int, err error) {
+	audit := e.audit
+	if audit == nil || audit.Hook == nil || rand.Float64() >= audit.SampleRate {
+		return nil
+	}
+	start := time.Now()
+	return func(candidates int, err error) {
+		a := QueryAudit{
+			Time:       start,
+			Signature:  newQueryKey(sig, 0, 0, dir, 0).sig,
+			Size:       size,
+			Threshold:  threshold,
+			Direction:  dir,
+			Candidates: candidates,
+			Latency:    time.Since(start),
+		}
+		for _, p := range e.optimalParams(size, threshold, dir) {
+			a.Params = append(a.Params, AuditParam{p.k, p.l})
+		}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		audit.Hook(a)
+	}
+}
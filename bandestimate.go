@@ -0,0 +1,112 @@
+package lshensemble
+
+import (
+	"math"
+	"sort"
+)
+
+// BandEstimate is a candidate domain of QueryBandEstimates, with its
+// containment estimated from the bands it matched.
+type BandEstimate struct {
+	Key string
+	// Matches is the number of the L bands of K hash values of the query
+	// matched by the domain.
+	Matches int
+	K, L    int
+	// Containment is the maximum-likelihood estimate of the containment
+	// of the query domain in the domain, within [Lower, Upper] at the
+	// confidence level.
+	Containment float64
+	Lower       float64
+	Upper       float64
+}
+
+// QueryBandEstimates returns the candidate domains of the query, like
+// Query, with their containments estimated from the number of bands they
+// matched at the K and L chosen for their partitions, a score needing no
+// extra memory when the signatures are not retained.
+// A domain of Jaccard similarity J matches a band with probability J^K,
+// so the maximum-likelihood estimate of J is (m/L)^(1/K) for m matches
+// out of L bands, with the Wilson score interval of m/L at the confidence
+// level, 0.95 if not in (0, 1). The Jaccard similarities are converted to
+// containments with the size of the domain if retained by AddDomain, and
+// the upper bound of its partition otherwise.
+// The estimates are sorted by decreasing containment, then by key.
+// The queries bypass the admission controller, the query cache and the
+// query statistics.
+func (e *LshEnsemble) QueryBandEstimates(sig Signature, size int, threshold, confidence float64) []BandEstimate {
+	if !(confidence > 0 && confidence < 1) {
+		confidence = 0.95
+	}
+	z := math.Sqrt2 * math.Erfinv(confidence)
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	params := e.optimalParams(size, threshold, Supersets)
+	var estimates []BandEstimate
+	for i, lsh := range e.lshes {
+		if params[i].l == 0 {
+			continue
+		}
+		f, K := lsh.forest(params[i].k)
+		if K == -1 {
+			K = f.k
+		}
+		L := params[i].l
+		matches := make(map[string]int)
+		var keys []string
+		for _, r := range f.matches(sig, K, L) {
+			for b := r.start; b < r.end; b++ {
+				r.t.scan(b, func(key string) bool {
+					if matches[key] == 0 {
+						keys = append(keys, key)
+					}
+					matches[key]++
+					return true
+				})
+			}
+		}
+		for _, key := range keys {
+			x := e.Partitions[i].Upper
+			if rec, exist := e.record(key); exist {
+				x = rec.Size
+			}
+			m := matches[key]
+			p := float64(m) / float64(L)
+			center := (p + z*z/(2*float64(L))) / (1 + z*z/float64(L))
+			half := z / (1 + z*z/float64(L)) * math.Sqrt(p*(1-p)/float64(L)+z*z/(4*float64(L*L)))
+			upper := math.Min(center+half, 1)
+			if m == L {
+				// Avoid the rounding of the interval
+				upper = 1
+			}
+			containment := func(p float64) float64 {
+				return jaccardToContainment(math.Pow(math.Max(p, 0), 1/float64(K)), x, size)
+			}
+			estimates = append(estimates, BandEstimate{
+				Key:         key,
+				Matches:     m,
+				K:           K,
+				L:           L,
+				Containment: containment(p),
+				Lower:       containment(center - half),
+				Upper:       containment(upper),
+			})
+		}
+	}
+	sort.SliceStable(estimates, func(i, j int) bool {
+		if estimates[i].Containment != estimates[j].Containment {
+			return estimates[i].Containment > estimates[j].Containment
+		}
+		return estimates[i].Key < estimates[j].Key
+	})
+	return estimates
+}
+
+// jaccardToContainment converts the Jaccard similarity of domains of sizes
+// x and q to the containment of the domain of size q in the other.
+func jaccardToContainment(j float64, x, q int) float64 {
+	if q <= 0 {
+		return 0
+	}
+	return math.Min(j*float64(x+q)/((1+j)*float64(q)), 1)
+}
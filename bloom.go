@@ -0,0 +1,146 @@
+package lshensemble
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// BloomFilter is a Bloom filter of the values of a domain, which can tell
+// whether a value may be in the domain, with false positives but no false
+// negatives, in a fraction of the memory of the values.
+type BloomFilter struct {
+	bits []uint64
+	// k is the number of bits set per value.
+	k int
+}
+
+// NewBloomFilter returns an empty Bloom filter sized for n values and the
+// false positive rate.
+func NewBloomFilter(n int, fpRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if !(fpRate > 0 && fpRate < 1) {
+		fpRate = 0.01
+	}
+	m := int(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{bits: make([]uint64, (m+63)/64), k: k}
+}
+
+// locations returns the two hashes of the value, combined to locate its k
+// bits.
+func (b *BloomFilter) locations(v []byte) (h1, h2 uint64) {
+	h := fnv.New64a()
+	h.Write(v)
+	h1 = h.Sum64()
+	// The second hash must be odd to visit distinct bits
+	h2 = bits.RotateLeft64(h1, 32)*0x9e3779b97f4a7c15 | 1
+	return h1, h2
+}
+
+// Add adds the value to the filter.
+func (b *BloomFilter) Add(v []byte) {
+	m := uint64(len(b.bits) * 64)
+	h1, h2 := b.locations(v)
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Has returns whether the value may have been added to the filter.
+func (b *BloomFilter) Has(v []byte) bool {
+	m := uint64(len(b.bits) * 64)
+	h1, h2 := b.locations(v)
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// FalsePositiveRate estimates the false positive rate of the filter from
+// the fraction of its bits set.
+func (b *BloomFilter) FalsePositiveRate() float64 {
+	var ones int
+	for _, w := range b.bits {
+		ones += bits.OnesCount64(w)
+	}
+	return math.Pow(float64(ones)/float64(len(b.bits)*64), float64(b.k))
+}
+
+// SetBloomFilter sets the Bloom filter of the values of the domain of key,
+// for VerifyElements. The filters are kept in memory with the index, but
+// are not saved by Save.
+func (e *LshEnsemble) SetBloomFilter(key string, filter *BloomFilter) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.blooms == nil {
+		e.blooms = make(map[string]*BloomFilter)
+	}
+	e.blooms[key] = filter
+}
+
+// cloneBlooms returns a copy of the filters of an index, sharing the
+// filters.
+func cloneBlooms(blooms map[string]*BloomFilter) map[string]*BloomFilter {
+	if blooms == nil {
+		return nil
+	}
+	c := make(map[string]*BloomFilter, len(blooms))
+	for key, filter := range blooms {
+		c[key] = filter
+	}
+	return c
+}
+
+// VerifyElements returns a stage of QueryPipeline verifying the results
+// whose domains have a Bloom filter set by SetBloomFilter, by probing the
+// filters with the values of the query domain: the fraction of the values
+// found is an upper bound of the containment of the query domain in the
+// domain of the result, so the results whose fraction is below the
+// threshold are removed as false positives. The containment of the kept
+// results is the fraction corrected for the false positive rate of the
+// filter, which is more precise than the MinHash estimate. The results
+// without a filter are kept as is.
+// The values must be distinct, and serialized like those pushed to the
+// signatures. The stage must be run by QueryPipeline of the index, which
+// guards the filters against SetBloomFilter.
+func (e *LshEnsemble) VerifyElements(values [][]byte, threshold float64) Stage {
+	return func(results []Result) []Result {
+		if len(values) == 0 {
+			return results
+		}
+		kept := results[:0]
+		for _, r := range results {
+			filter, exist := e.blooms[r.Key]
+			if !exist {
+				kept = append(kept, r)
+				continue
+			}
+			var found int
+			for _, v := range values {
+				if filter.Has(v) {
+					found++
+				}
+			}
+			upper := float64(found) / float64(len(values))
+			if upper < threshold {
+				continue
+			}
+			r.Containment = upper
+			if fpRate := filter.FalsePositiveRate(); fpRate < 1 {
+				r.Containment = math.Max(0, (upper-fpRate)/(1-fpRate))
+			}
+			kept = append(kept, r)
+		}
+		return kept
+	}
+}
@@ -3,9 +3,26 @@ package lshensemble
 func bootstrap(index *LshEnsemble, totalNumDomains int, sortedDomains chan *DomainRecord) {
 	numPart := len(index.Partitions)
 	depth := totalNumDomains / numPart
-	var currDepth, currPart int
+	var currDepth, currPart, added int
+	progress := index.progress.Records
 	for rec := range sortedDomains {
-		index.Add(rec.Key, rec.Signature, currPart)
+		index.mu.Lock()
+		isolated, err := index.isolate(rec)
+		index.mu.Unlock()
+		if err != nil {
+			panic(err)
+		}
+		if !isolated {
+			index.Add(rec.Key, rec.Signature, currPart)
+		}
+		added++
+		if progress != nil && added%progressInterval == 0 {
+			progress(int64(added), int64(totalNumDomains))
+		}
+		if isolated {
+			// The isolated domains do not count in the partitions
+			continue
+		}
 		currDepth++
 		index.Partitions[currPart].Upper = rec.Size
 		if currDepth >= depth && currPart < numPart-1 {
@@ -14,9 +31,21 @@ func bootstrap(index *LshEnsemble, totalNumDomains int, sortedDomains chan *Doma
 			currDepth = 0
 		}
 	}
+	if progress != nil && added%progressInterval != 0 {
+		progress(int64(added), int64(totalNumDomains))
+	}
 	index.Index()
 }
 
+// Bootstrap builds the index from a channel of domains, like
+// BootstrapLshEnsemble, for an empty index created by New with the
+// number of partitions to create, e.g. to report the progress with
+// WithProgress. The bounds of the partitions are computed from the domains.
+// sortedDomains is a DomainRecord channel emitting domains in sorted order by their sizes.
+func (e *LshEnsemble) Bootstrap(totalNumDomains int, sortedDomains chan *DomainRecord) {
+	bootstrap(e, totalNumDomains, sortedDomains)
+}
+
 // BoostrapLshEnsemble builds an index from a channel of domains.
 // The returned index consists of MinHash LSH implemented using LshForest.
 // numPart is the number of partitions to create.
@@ -0,0 +1,203 @@
+package lshensemble
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// seededHash hashes a domain value with a seed.
+func seededHash(v []byte, seed uint64) uint64 {
+	h := fnv.New64a()
+	h.Write(v)
+	// FNV is mixed before the seed, for the structure of its values of
+	// similar inputs not to bias the hash values
+	return mix64(mix64(h.Sum64()) ^ seed)
+}
+
+// BottomK computes bottom-k (KMV) sketches of domains: the k smallest
+// hash values of their distinct values, using a single hash function.
+// They estimate the cardinalities, intersections and containments of the
+// domains more accurately than MinHash signatures of the same size, and
+// are converted to signatures for indexing.
+type BottomK struct {
+	k    int
+	seed uint64
+	// h is a max-heap of the smallest hash values, and in the set
+	// of its values.
+	h  maxHeap
+	in map[uint64]bool
+}
+
+// NewBottomK returns a sketch of the k smallest hash values.
+// Sketches are comparable only with the same seed.
+func NewBottomK(seed, k int) *BottomK {
+	if k < 1 {
+		panic("lshensemble: k must be positive")
+	}
+	return &BottomK{k: k, seed: mix64(uint64(seed)), in: make(map[uint64]bool)}
+}
+
+// Push adds a value to the domain.
+func (b *BottomK) Push(v []byte) {
+	x := seededHash(v, b.seed)
+	if b.in[x] {
+		return
+	}
+	if len(b.h) < b.k {
+		heap.Push(&b.h, x)
+		b.in[x] = true
+		return
+	}
+	if x < b.h[0] {
+		delete(b.in, b.h[0])
+		b.h[0] = x
+		heap.Fix(&b.h, 0)
+		b.in[x] = true
+	}
+}
+
+// Sketch returns the sketch of the values pushed so far.
+func (b *BottomK) Sketch() KMV {
+	hashes := append([]uint64(nil), b.h...)
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	return KMV{K: b.k, Hashes: hashes}
+}
+
+type maxHeap []uint64
+
+func (h maxHeap) Len() int            { return len(h) }
+func (h maxHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h maxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *maxHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// KMV is a bottom-k sketch: the K smallest hash values of a domain,
+// in increasing order, or all of them if the domain has fewer values.
+type KMV struct {
+	K      int
+	Hashes []uint64
+}
+
+// exact returns true if the sketch has all the hash values of its domain.
+func (s KMV) exact() bool {
+	return len(s.Hashes) < s.K
+}
+
+// Cardinality estimates the number of distinct values of the domain.
+func (s KMV) Cardinality() float64 {
+	if s.exact() {
+		return float64(len(s.Hashes))
+	}
+	// The k-th smallest of n uniform values is about k/n
+	kth := float64(s.Hashes[s.K-1]) / math.Exp2(64)
+	return float64(s.K-1) / kth
+}
+
+// Jaccard estimates the Jaccard similarity of the domains of two sketches
+// from the smallest hash values of their union.
+func (s KMV) Jaccard(other KMV) float64 {
+	k := s.K
+	if other.K < k {
+		k = other.K
+	}
+	var union, both int
+	i, j := 0, 0
+	for union < k && (i < len(s.Hashes) || j < len(other.Hashes)) {
+		switch {
+		case j == len(other.Hashes) || (i < len(s.Hashes) && s.Hashes[i] < other.Hashes[j]):
+			i++
+		case i == len(s.Hashes) || other.Hashes[j] < s.Hashes[i]:
+			j++
+		default:
+			both++
+			i++
+			j++
+		}
+		union++
+	}
+	if union == 0 {
+		return 0
+	}
+	return float64(both) / float64(union)
+}
+
+// Containment estimates the fraction of the domain of the sketch
+// contained in the domain of other.
+func (s KMV) Containment(other KMV) float64 {
+	q, x := s.Cardinality(), other.Cardinality()
+	if q == 0 {
+		return 0
+	}
+	j := s.Jaccard(other)
+	// |Q ∩ X| = J |Q ∪ X| = J (|Q| + |X|) / (1 + J)
+	c := j * (q + x) / (1 + j) / q
+	return math.Min(c, 1)
+}
+
+// Signature converts the sketch to a signature of numHash values that
+// can be indexed like a MinHash signature, using one permutation hashing:
+// the hash values are divided into numHash bins by their remainders, and
+// the minimum of every bin is its value. Every bin with a value of the
+// sketch has the minimum of the whole domain, and the empty bins are
+// filled from the next non-empty bin, so two signatures agree in a bin
+// with a probability about the Jaccard similarity of their domains, given
+// sketches of several times numHash values.
+func (s KMV) Signature(numHash int) Signature {
+	sig := make(Signature, numHash)
+	filled := make([]bool, numHash)
+	for i := range sig {
+		sig[i] = math.MaxUint64
+	}
+	n := uint64(numHash)
+	for _, x := range s.Hashes {
+		bin := x % n
+		if v := x / n; !filled[bin] || v < sig[bin] {
+			sig[bin] = v
+			filled[bin] = true
+		}
+	}
+	return densify(sig, filled)
+}
+
+// densify fills the empty bins of a one permutation hashing signature
+// from the next non-empty bin by rotation, remixed with the distance
+// to it. A signature with no filled bins is left empty.
+func densify(sig Signature, filled []bool) Signature {
+	nonEmpty := false
+	for _, f := range filled {
+		nonEmpty = nonEmpty || f
+	}
+	if !nonEmpty {
+		return sig
+	}
+	n := len(sig)
+	dense := make(Signature, n)
+	for i := range sig {
+		t := 0
+		for !filled[(i+t)%n] {
+			t++
+		}
+		dense[i] = sig[(i+t)%n]
+		if t > 0 {
+			dense[i] = mix64(dense[i] ^ uint64(t))
+		}
+	}
+	return dense
+}
+
+// Record returns the record of the domain of the sketch, with its
+// estimated size and its signature of numHash values.
+func (s KMV) Record(key string, numHash int) *DomainRecord {
+	return &DomainRecord{
+		Key:       key,
+		Size:      int(math.Round(s.Cardinality())),
+		Signature: s.Signature(numHash),
+	}
+}
@@ -0,0 +1,67 @@
+package lshensemble
+
+// MemoryBudget bounds the memory used to build an index, so building an
+// index from a corpus larger than expected degrades instead of running
+// out of memory.
+type MemoryBudget struct {
+	// Bytes is the memory that the domains added but not yet made
+	// searchable by Index() may use, estimated from the sizes of their
+	// keys and hash keys.
+	Bytes int64
+	// Dir is the directory of the temporary files the domains are
+	// spilled to once the budget is exceeded, as with WithSpill.
+	// The default directory for temporary files is used if empty.
+	Dir string
+	// OnDegrade, if not nil, is called when the budget is exceeded,
+	// with a description of the degradation.
+	OnDegrade func(reason string)
+}
+
+// WithMemoryBudget sets the memory budget of the construction of the
+// index. Once the domains added exceed it, the index switches to spilling
+// the domains to disk, as if created with WithSpill with a buffer of the
+// size of the budget, until it is discarded: the construction is slower,
+// but its memory is bounded. Degraded reports whether it happened.
+// The ReplaceDuplicates policy is not supported.
+func WithMemoryBudget(budget MemoryBudget) Option {
+	return func(c *config) {
+		c.budget = &budget
+	}
+}
+
+// Degraded returns whether the index exceeded its memory budget, and
+// spills the domains added to disk.
+func (e *LshEnsemble) Degraded() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.budget != nil && e.spill != nil
+}
+
+// spillEntrySize is the estimated memory of an entry of a spiller, and
+// initEntrySize the estimated memory of a key in an init hash table,
+// excluding the hash key.
+const (
+	spillEntrySize = 128
+	initEntrySize  = 64
+)
+
+// charge charges the memory budget for a key added to the partition,
+// and starts spilling the keys if the budget is exceeded.
+func (e *LshEnsemble) charge(key string, partInd int) {
+	cost := int64(len(key))
+	for _, f := range lshForests(e.lshes[partInd]) {
+		cost += int64(f.l) * int64(f.keySize()+initEntrySize)
+	}
+	e.pending += cost
+	if e.pending <= e.budget.Bytes {
+		return
+	}
+	max := int(e.budget.Bytes / spillEntrySize)
+	if max < 1 {
+		max = 1
+	}
+	e.spill = &spiller{dir: e.budget.Dir, max: max}
+	if e.budget.OnDegrade != nil {
+		e.budget.OnDegrade("memory budget exceeded, spilling the domains added to disk")
+	}
+}
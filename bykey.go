@@ -0,0 +1,61 @@
+package lshensemble
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Direction is the direction of containment searched by a query.
+type Direction int
+
+const (
+	// Supersets finds the indexed domains containing the query domain,
+	// i.e. |Q ∩ X| / |Q| is no less than the threshold. It is the
+	// direction searched by Query.
+	Supersets Direction = iota
+	// Subsets finds the indexed domains contained in the query domain,
+	// i.e. |Q ∩ X| / |X| is no less than the threshold. It is the
+	// direction searched by QuerySubsets.
+	Subsets
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Supersets:
+		return "supersets"
+	case Subsets:
+		return "subsets"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// ErrKeyNotRetained is returned by QueryByKey for keys whose domain
+// records were not retained by AddDomain.
+var ErrKeyNotRetained = errors.New("lshensemble: domain record of key not retained")
+
+// QueryByKey returns the candidate domains containing, or contained in,
+// depending on the direction, the indexed domain of key, excluding the
+// domain itself, or its entity for indexes created with WithGroupBy.
+// The domain must have been added using AddDomain.
+func (e *LshEnsemble) QueryByKey(key string, threshold float64, dir Direction) ([]string, error) {
+	defer e.rlockQuery()()
+	rec, exist := e.retained(key)
+	if !exist {
+		return nil, ErrKeyNotRetained
+	}
+	candidates, _, err := e.collect(rec.Signature, rec.Size, threshold, dir)
+	if err != nil {
+		return nil, err
+	}
+	if e.groupBy != nil {
+		// Exclude the entity of the domain
+		key = e.groupBy(key)
+	}
+	result := make([]string, 0, len(candidates))
+	for _, k := range candidates {
+		if k != key {
+			result = append(result, k)
+		}
+	}
+	return result, nil
+}
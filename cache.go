@@ -0,0 +1,194 @@
+package lshensemble
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// QueryCacheOptions configures the coalescing and caching of the
+// results of Query, QueryE, QuerySubsets and QueryByKey, for services
+// where the same popular queries arrive concurrently.
+// Queries are identified by a 64-bit hash of their signature, their
+// size, threshold and direction, and the generation of the index, so
+// results are never served from an earlier generation.
+type QueryCacheOptions struct {
+	// Coalesce makes concurrent identical queries probe the index once,
+	// all of them getting its result.
+	Coalesce bool
+	// Size is the maximum number of results cached, the least recently
+	// used being evicted first. The default of 0 caches no results.
+	Size int
+	// TTL is for how long results are cached, forever if 0.
+	TTL time.Duration
+}
+
+// WithQueryCache sets the coalescing and caching of the queries.
+func WithQueryCache(opts QueryCacheOptions) Option {
+	return func(c *config) {
+		c.cache = &opts
+	}
+}
+
+// SetQueryCache sets the coalescing and caching of the queries, or
+// removes them if opts is nil, clearing the cached results.
+func (e *LshEnsemble) SetQueryCache(opts *QueryCacheOptions) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cache = newQueryCache(opts)
+}
+
+// Generation returns the generation of the index, which is incremented
+// whenever the results of its queries may change: by Index(), when a key
+// is replaced by the ReplaceDuplicates policy, and by CheckIntegrity with
+// repair.
+func (e *LshEnsemble) Generation() uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.generation
+}
+
+// queryKey identifies a query on a generation of the index in the cache.
+type queryKey struct {
+	sig        uint64
+	size       int
+	threshold  float64
+	dir        Direction
+	generation uint64
+}
+
+func newQueryKey(sig Signature, size int, threshold float64, dir Direction, generation uint64) queryKey {
+	h := fnv.New64a()
+	var b [HashValueSize]byte
+	for _, v := range sig {
+		for i := range b {
+			b[i] = byte(v >> (8 * i))
+		}
+		h.Write(b[:])
+	}
+	return queryKey{h.Sum64(), size, threshold, dir, generation}
+}
+
+// queryCache coalesces and caches query results. The cached results
+// are never modified, every caller getting a copy.
+type queryCache struct {
+	opts QueryCacheOptions
+	// mu guards the fields below.
+	mu sync.Mutex
+	// lru holds the cache entries, the most recently used first.
+	lru     *list.List
+	entries map[queryKey]*list.Element
+	calls   map[queryKey]*queryCall
+}
+
+type cacheEntry struct {
+	key     queryKey
+	result  []string
+	expires time.Time
+}
+
+// queryCall is a query being run for coalesced callers.
+type queryCall struct {
+	done   chan struct{}
+	result []string
+	err    error
+}
+
+// newQueryCache returns a cache configured by opts, or nil if opts is nil.
+func newQueryCache(opts *QueryCacheOptions) *queryCache {
+	if opts == nil {
+		return nil
+	}
+	return &queryCache{
+		opts:    *opts,
+		lru:     list.New(),
+		entries: make(map[queryKey]*list.Element),
+		calls:   make(map[queryKey]*queryCall),
+	}
+}
+
+// do returns the cached result of the query, or the result of a
+// concurrent identical query, or else runs it using fn.
+// Errors are not cached.
+func (c *queryCache) do(key queryKey, fn func() ([]string, error)) ([]string, error) {
+	c.mu.Lock()
+	if el, exist := c.entries[key]; exist {
+		ent := el.Value.(*cacheEntry)
+		if c.opts.TTL == 0 || time.Now().Before(ent.expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return copyResult(ent.result), nil
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	if !c.opts.Coalesce {
+		c.mu.Unlock()
+		result, err := fn()
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.add(key, result)
+		c.mu.Unlock()
+		return copyResult(result), nil
+	}
+	if call, exist := c.calls[key]; exist {
+		c.mu.Unlock()
+		<-call.done
+		return copyResult(call.result), call.err
+	}
+	call := &queryCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+	call.result, call.err = fn()
+	c.mu.Lock()
+	delete(c.calls, key)
+	if call.err == nil {
+		c.add(key, call.result)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return copyResult(call.result), call.err
+}
+
+// add caches the result of a query, evicting the least recently used
+// results beyond the cache size, such as the results of the earlier
+// generations.
+func (c *queryCache) add(key queryKey, result []string) {
+	if c.opts.Size <= 0 {
+		return
+	}
+	ent := &cacheEntry{key: key, result: result}
+	if c.opts.TTL > 0 {
+		ent.expires = time.Now().Add(c.opts.TTL)
+	}
+	if el, exist := c.entries[key]; exist {
+		el.Value = ent
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(ent)
+	for c.lru.Len() > c.opts.Size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+func copyResult(result []string) []string {
+	if result == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(result)), result...)
+}
+
+// cachedOptions returns the options of the cache, or nil if c is nil.
+func (c *queryCache) cachedOptions() *QueryCacheOptions {
+	if c == nil {
+		return nil
+	}
+	opts := c.opts
+	return &opts
+}
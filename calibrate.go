@@ -0,0 +1,143 @@
+package lshensemble
+
+import (
+	"math"
+	"sync"
+)
+
+// maxObservations is the number of the latest observations a Calibrator
+// keeps.
+const maxObservations = 10000
+
+// Observation is a candidate returned by a query, with its containment
+// verified by the caller, e.g. from the raw sets of the domains.
+type Observation struct {
+	QuerySize int
+	// Size is the size of the candidate domain.
+	Size int
+	// Containment is the verified containment of the query domain in the
+	// candidate domain.
+	Containment float64
+}
+
+// Calibration is the query threshold recommended by a Calibrator.
+type Calibration struct {
+	// Threshold is the highest query threshold whose expected recall of
+	// the observed domains meeting the target containment is at least
+	// the recall of the Calibrator, 0.01 if none is, or the target if no
+	// observed domain meets it.
+	Threshold float64
+	// Recall and Precision are the expected recall and precision of the
+	// queries at Threshold, among the observed domains.
+	Recall    float64
+	Precision float64
+	// Observations and Relevant are the numbers of observations, and of
+	// observed domains meeting the target containment.
+	Observations int
+	Relevant     int
+}
+
+// Calibrator adjusts the query threshold to the containments observed in
+// the corpus: the candidates of queries and their verified containments
+// are fed back with Observe, and Calibrate recommends the query threshold
+// reaching the recall wanted for the domains meeting the target
+// containment, which the threshold of the queries alone does not account
+// for, as the K and L chosen for a threshold assume uniformly distributed
+// containments. A domain of Jaccard similarity j is returned by a query
+// with probability 1-(1-j^K)^L, for the K and L chosen for its partition.
+// The observations should come from queries at a threshold lower than the
+// recommended one, e.g. by sampling queries at a low threshold, so the
+// domains missed at the threshold are observed.
+// A Calibrator is safe for concurrent use, and keeps the latest 10000
+// observations.
+type Calibrator struct {
+	index          *LshEnsemble
+	target, recall float64
+	mu             sync.Mutex
+	observations   []Observation
+	next           int
+}
+
+// NewCalibrator returns a Calibrator of the query threshold of the index,
+// for the target containment and the recall wanted, in (0, 1].
+func (e *LshEnsemble) NewCalibrator(target, recall float64) *Calibrator {
+	return &Calibrator{index: e, target: target, recall: recall}
+}
+
+// Observe records a candidate returned by a query and its verified
+// containment.
+func (c *Calibrator) Observe(o Observation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.observations) < maxObservations {
+		c.observations = append(c.observations, o)
+		return
+	}
+	c.observations[c.next] = o
+	c.next = (c.next + 1) % maxObservations
+}
+
+// Calibrate returns the query threshold recommended from the
+// observations, searched in steps of 0.01.
+func (c *Calibrator) Calibrate() Calibration {
+	c.mu.Lock()
+	observations := append([]Observation(nil), c.observations...)
+	c.mu.Unlock()
+	cal := Calibration{Threshold: c.target, Observations: len(observations)}
+	for _, o := range observations {
+		if o.Containment >= c.target {
+			cal.Relevant++
+		}
+	}
+	if cal.Relevant == 0 {
+		return cal
+	}
+	e := c.index
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for step := 100; step > 0; step-- {
+		threshold := float64(step) / 100
+		var relevant, returned float64
+		params := make(map[int][]param)
+		for _, o := range observations {
+			if o.QuerySize <= 0 {
+				continue
+			}
+			if params[o.QuerySize] == nil {
+				params[o.QuerySize] = e.optimalParams(o.QuerySize, threshold, Supersets)
+			}
+			p := params[o.QuerySize][e.PartitionIndex(o.Size)]
+			prob := returnProbability(o, p)
+			returned += prob
+			if o.Containment >= c.target {
+				relevant += prob
+			}
+		}
+		recall := relevant / float64(cal.Relevant)
+		if recall >= c.recall || step == 1 {
+			cal.Threshold = threshold
+			cal.Recall = recall
+			if returned > 0 {
+				cal.Precision = relevant / returned
+			}
+			break
+		}
+	}
+	return cal
+}
+
+// returnProbability returns the probability of the observed domain to be
+// returned by a query with the parameters of its partition.
+func returnProbability(o Observation, p param) float64 {
+	if p.l == 0 {
+		return 0
+	}
+	// The Jaccard similarity of the domains, from the containment
+	inter := o.Containment * float64(o.QuerySize)
+	union := float64(o.Size+o.QuerySize) - inter
+	if union <= 0 {
+		return 1
+	}
+	j := math.Min(math.Max(inter/union, 0), 1)
+	return 1 - math.Pow(1-math.Pow(j, float64(p.k)), float64(p.l))
+}
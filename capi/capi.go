@@ -0,0 +1,205 @@
+// Command capi exposes LSH Ensemble as a C shared library, so non-Go
+// applications, e.g. Python via ctypes, Rust or C++, can embed an index
+// in-process. Build it with
+//
+//	go build -buildmode=c-shared -o liblshensemble.so ./capi
+//
+// which also writes the C header liblshensemble.h.
+//
+// An index is created with lshe_new, which returns a handle, its domains
+// are added with lshe_add, and it is built with lshe_index, after which it
+// can be queried with lshe_query. The functions returning an int return 0
+// on success and -1 on error, whose message is returned by lshe_error.
+// Handles are released with lshe_free. A handle must not be used by
+// several threads at a time.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+var (
+	errIndexed = errors.New("capi: index already built")
+	errBuilt   = errors.New("capi: index not built")
+)
+
+// index is an index being built or built, with its last error.
+type index struct {
+	numPart, numHash, maxK int
+	recs                   []*lshensemble.DomainRecord
+	e                      *lshensemble.LshEnsemble
+	err                    *C.char
+}
+
+func (x *index) fail(err error) C.int {
+	if x.err != nil {
+		C.free(unsafe.Pointer(x.err))
+	}
+	x.err = C.CString(err.Error())
+	return -1
+}
+
+var (
+	mu      sync.Mutex
+	handles = make(map[C.int64_t]*index)
+	next    C.int64_t
+)
+
+func lookup(h C.int64_t) *index {
+	mu.Lock()
+	defer mu.Unlock()
+	return handles[h]
+}
+
+// signature copies the n hash values at sig, or returns nil if n is not
+// positive.
+func signature(sig *C.uint64_t, n C.int) lshensemble.Signature {
+	if n <= 0 {
+		return nil
+	}
+	values := (*[1 << 28]C.uint64_t)(unsafe.Pointer(sig))[:n:n]
+	s := make(lshensemble.Signature, n)
+	for i, v := range values {
+		s[i] = uint64(v)
+	}
+	return s
+}
+
+// lshe_new returns the handle of a new index, with numPart equi-depth
+// partitions, numHash hash functions and at most maxK hash functions per
+// band, or -1 if the parameters are invalid.
+//
+//export lshe_new
+func lshe_new(numPart, numHash, maxK C.int) C.int64_t {
+	if _, err := lshensemble.NewLshEnsembleE(make([]lshensemble.Partition, numPart), int(numHash), int(maxK)); err != nil {
+		return -1
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	next++
+	handles[next] = &index{numPart: int(numPart), numHash: int(numHash), maxK: int(maxK)}
+	return next
+}
+
+// lshe_add adds the domain of the key, with its size and its signature of
+// n hash values, to the index before it is built. The record is rejected
+// if the key is empty, the size is not positive or n is less than the
+// number of hash functions.
+//
+//export lshe_add
+func lshe_add(h C.int64_t, key *C.char, size C.int, sig *C.uint64_t, n C.int) C.int {
+	x := lookup(h)
+	if x == nil {
+		return -1
+	}
+	if x.e != nil {
+		return x.fail(errIndexed)
+	}
+	rec, err := lshensemble.NewDomainRecord(C.GoString(key), int(size), signature(sig, n), x.numHash)
+	if err != nil {
+		return x.fail(err)
+	}
+	x.recs = append(x.recs, rec)
+	return 0
+}
+
+// lshe_index builds the index from the domains added.
+//
+//export lshe_index
+func lshe_index(h C.int64_t) C.int {
+	x := lookup(h)
+	if x == nil {
+		return -1
+	}
+	if x.e != nil {
+		return x.fail(errIndexed)
+	}
+	sort.Slice(x.recs, func(i, j int) bool { return x.recs[i].Size < x.recs[j].Size })
+	x.e = lshensemble.BootstrapLshEnsemblePlus(x.numPart, x.numHash, x.maxK, len(x.recs), lshensemble.Recs2Chan(x.recs))
+	x.recs = nil
+	return 0
+}
+
+// lshe_query returns the candidate domains of the query domain of the
+// size and the signature of n hash values, for the containment threshold,
+// as an array of *count strings to be released with lshe_free_results,
+// or NULL on error.
+//
+//export lshe_query
+func lshe_query(h C.int64_t, sig *C.uint64_t, n C.int, size C.int, threshold C.double, count *C.int) **C.char {
+	*count = 0
+	x := lookup(h)
+	if x == nil {
+		return nil
+	}
+	if x.e == nil {
+		x.fail(errBuilt)
+		return nil
+	}
+	result, _, err := x.e.QueryE(signature(sig, n), int(size), float64(threshold))
+	if err != nil {
+		x.fail(err)
+		return nil
+	}
+	ptr := unsafe.Sizeof((*C.char)(nil))
+	// Allocate at least one pointer, so no result is not NULL
+	keys := (**C.char)(C.malloc(C.size_t(uintptr(len(result)+1) * ptr)))
+	array := (*[1 << 28]*C.char)(unsafe.Pointer(keys))[: len(result)+1 : len(result)+1]
+	for i, key := range result {
+		array[i] = C.CString(key)
+	}
+	*count = C.int(len(result))
+	return keys
+}
+
+// lshe_free_results releases the count strings returned by lshe_query.
+//
+//export lshe_free_results
+func lshe_free_results(keys **C.char, count C.int) {
+	if keys == nil {
+		return
+	}
+	array := (*[1 << 28]*C.char)(unsafe.Pointer(keys))[:count:count]
+	for _, key := range array {
+		C.free(unsafe.Pointer(key))
+	}
+	C.free(unsafe.Pointer(keys))
+}
+
+// lshe_error returns the message of the last error of the index, or NULL.
+// The message is owned by the index.
+//
+//export lshe_error
+func lshe_error(h C.int64_t) *C.char {
+	x := lookup(h)
+	if x == nil {
+		return nil
+	}
+	return x.err
+}
+
+// lshe_free releases the index.
+//
+//export lshe_free
+func lshe_free(h C.int64_t) {
+	mu.Lock()
+	x := handles[h]
+	delete(handles, h)
+	mu.Unlock()
+	if x != nil && x.err != nil {
+		C.free(unsafe.Pointer(x.err))
+	}
+}
+
+func main() {}
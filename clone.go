@@ -0,0 +1,121 @@
+package lshensemble
+
+// Clone returns a copy of the index that shares the indexed hash tables
+// with it, so the two can diverge, e.g. with extra domains added to one
+// of them, without copying the whole index. A shared hash table is copied
+// only when one of the indexes changes it, by Index() or CheckIntegrity.
+// The domains added to the index since the last Index() are not copied.
+// The clone of an index with a SignatureStore reads the signatures of
+// the domains cloned from the store, and keeps those of the domains added
+// to it in memory, so it does not replace them in the store.
+func (e *LshEnsemble) Clone() *LshEnsemble {
+	// The hash tables of the index are clipped by clone
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	lshes := make([]Lsh, len(e.lshes))
+	for i, lsh := range e.lshes {
+		switch lsh := lsh.(type) {
+		case *tieredLsh:
+			// The partitions of tiered indexes are read-only
+			lshes[i] = lsh
+		case *LshForest:
+			lshes[i] = lsh.clone()
+		case *LshForestArray:
+			array := make([]*LshForest, len(lsh.array))
+			for k, f := range lsh.array {
+				array[k] = f.clone()
+			}
+			lshes[i] = &LshForestArray{
+				maxK:    lsh.maxK,
+				numHash: lsh.numHash,
+				array:   array,
+			}
+		default:
+			panic("lshensemble: cannot clone Lsh")
+		}
+	}
+	var domains map[string]*DomainRecord
+	if e.domains != nil {
+		domains = make(map[string]*DomainRecord, len(e.domains))
+		for key, rec := range e.domains {
+			domains[key] = rec
+		}
+	}
+	parts := make([]Partition, len(e.Partitions))
+	copy(parts, e.Partitions)
+	c := &LshEnsemble{
+		Partitions:    parts,
+		lshes:         lshes,
+		maxK:          e.maxK,
+		numHash:       e.numHash,
+		paramCache:    e.paramCache,
+		admission:     e.admission,
+		domains:       domains,
+		sizes:         e.sizes,
+		audit:         e.audit,
+		blooms:        cloneBlooms(e.blooms),
+		duplicates:    e.duplicates,
+		empty:         e.empty,
+		isolated:      copyRecords(e.isolated),
+		deterministic: e.deterministic,
+		sequential:    e.sequential,
+		parallelism:   e.parallelism,
+		partitioner:   e.partitioner,
+		frozen:        e.frozen,
+		tiers:         e.tiers,
+		cache:         newQueryCache(e.cache.cachedOptions()),
+		generation:    e.generation,
+		numa:          e.numa,
+		progress:      e.progress,
+		groupBy:       e.groupBy,
+	}
+	if e.signatures != nil {
+		c.signatures = newOverlaySignatureStore(e.signatures)
+	}
+	if e.keyParts != nil {
+		c.keyParts = c.indexedKeys()
+	}
+	if e.spill != nil {
+		c.spill = &spiller{dir: e.spill.dir, max: e.spill.max}
+	}
+	c.budget = e.budget
+	c.releaseOnIndex, c.released = e.releaseOnIndex, e.released
+	c.compactSizes = e.compactSizes
+	if e.realtime != nil {
+		c.realtime = &realtimeBuffer{delay: e.realtime.delay}
+	}
+	return c
+}
+
+// clone returns a copy of the forest sharing its hash tables.
+// The hash tables of both forests are clipped to their lengths, so
+// Index() appends the new buckets to a copy of a shared hash table.
+func (f *LshForest) clone() *LshForest {
+	c := &LshForest{
+		k:             f.k,
+		l:             f.l,
+		hashKeyFuncs:  f.hashKeyFuncs,
+		hashValueSize: f.hashValueSize,
+		hashValueBits: f.hashValueBits,
+		trim:          f.trim,
+		split:         f.split,
+		frozen:        f.frozen,
+	}
+	if f.frozen != nil {
+		return c
+	}
+	c.hashTables = make([]hashTable, f.l)
+	c.initHashTables = make([]initHashTable, f.l)
+	if f.tries != nil {
+		// The tries are changed by Index(), so the clone builds its own
+		c.tries = make([]*trie, f.l)
+	}
+	c.setSplit(f.split)
+	for i, ht := range f.hashTables {
+		ht = ht[:len(ht):len(ht)]
+		f.hashTables[i] = ht
+		c.hashTables[i] = ht
+		c.initHashTables[i] = make(initHashTable)
+	}
+	return c
+}
@@ -0,0 +1,92 @@
+package lshensemble
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func Test_Clone(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	extra := randomDomains(50, 64, 2)
+	for _, rec := range extra {
+		rec.Key = "extra" + rec.Key
+	}
+	for _, index := range []*LshEnsemble{
+		BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs)),
+		BootstrapLshEnsemblePlus(4, 64, 4, len(recs), Recs2Chan(recs)),
+	} {
+		want := make(map[string][]string)
+		for _, rec := range recs {
+			want[rec.Key], _ = index.Query(rec.Signature, rec.Size, 0.5)
+		}
+		clone := index.Clone()
+		sameResults(t, index, clone, recs)
+
+		// Query the index while the clone is changed
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, rec := range recs {
+				index.Query(rec.Signature, rec.Size, 0.5)
+			}
+		}()
+		for _, rec := range extra {
+			clone.AddDomain(rec, clone.PartitionIndex(rec.Size))
+		}
+		clone.Index()
+		clone.CheckIntegrity(true)
+		wg.Wait()
+
+		for _, rec := range recs {
+			got, _ := index.Query(rec.Signature, rec.Size, 0.5)
+			if len(got) != len(want[rec.Key]) {
+				t.Fatal(rec.Key, got, want[rec.Key])
+			}
+		}
+		for _, rec := range extra {
+			found := false
+			result, _ := clone.Query(rec.Signature, rec.Size, 0.5)
+			for _, key := range result {
+				if key == rec.Key {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s not found in clone", rec.Key)
+			}
+		}
+	}
+}
+
+func Test_CloneSignatureStore(t *testing.T) {
+	recs := randomDomains(50, 64, 1)
+	store := NewMemorySignatureStore()
+	index, err := New(WithPartitions([]Partition{{0, 1000}}), WithNumHash(64), WithSignatureStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs[:40] {
+		index.AddDomain(rec, 0)
+	}
+	index.Index()
+	clone := index.Clone()
+	// The clone replaces a signature and adds domains of its own
+	replaced := &DomainRecord{Key: recs[0].Key, Size: recs[0].Size, Signature: recs[1].Signature}
+	for _, rec := range append([]*DomainRecord{replaced}, recs[40:]...) {
+		clone.AddDomain(rec, 0)
+	}
+	clone.Index()
+	if sig, err := store.Get(recs[0].Key); err != nil || sig[0] != recs[0].Signature[0] {
+		t.Fatal("signature of the index replaced", err)
+	}
+	if _, err := store.Get(recs[40].Key); !errors.Is(err, ErrKeyNotRetained) {
+		t.Fatal(err)
+	}
+	for _, rec := range []*DomainRecord{replaced, recs[1], recs[40]} {
+		if got, exist := clone.retained(rec.Key); !exist || got.Signature[0] != rec.Signature[0] {
+			t.Fatal(rec.Key, exist)
+		}
+	}
+}
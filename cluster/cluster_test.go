@@ -0,0 +1,96 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+func Test_Ring(t *testing.T) {
+	r := NewRing(50)
+	for i := 0; i < 4; i++ {
+		r.AddNode(fmt.Sprintf("node%d", i))
+	}
+	owners := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners[key] = r.Node(key)
+	}
+	r.RemoveNode("node0")
+	for key, owner := range owners {
+		if owner != "node0" && r.Node(key) != owner {
+			t.Fatal("key moved between remaining nodes", key)
+		}
+		if r.Node(key) == "node0" {
+			t.Fatal("key on removed node", key)
+		}
+	}
+}
+
+func Test_Router(t *testing.T) {
+	parts := []lshensemble.Partition{{Lower: 0, Upper: 1000}}
+	router := NewRouter(10)
+	router.AddNode("local", NewLocalNode(lshensemble.NewLshEnsemble(parts, 64, 4)))
+	server := httptest.NewServer(NewHandler(NewLocalNode(lshensemble.NewLshEnsemble(parts, 64, 4))))
+	defer server.Close()
+	router.AddNode("remote", NewHTTPNode(server.URL))
+
+	r := rand.New(rand.NewSource(1))
+	recs := make([]*lshensemble.DomainRecord, 20)
+	for i := range recs {
+		sig := make(lshensemble.Signature, 64)
+		for j := range sig {
+			sig[j] = uint64(r.Int63())
+		}
+		recs[i] = &lshensemble.DomainRecord{Key: fmt.Sprintf("rec%d", i), Size: 100, Signature: sig}
+		if err := router.Add(recs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := router.Index(); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		result, err := router.Query(rec.Signature, rec.Size, 1.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 1 || result[0] != rec.Key {
+			t.Fatal(rec.Key, result)
+		}
+	}
+
+	// Invalid records are rejected by the nodes
+	short := &lshensemble.DomainRecord{Key: "short", Size: 100, Signature: recs[0].Signature[:1]}
+	if err := NewLocalNode(lshensemble.NewLshEnsemble(parts, 64, 4)).Add(short); !errors.Is(err, lshensemble.ErrInvalidSignature) {
+		t.Fatal(err)
+	}
+	if err := NewHTTPNode(server.URL).Add(short); err == nil {
+		t.Fatal("invalid record added")
+	}
+	router.AddNode("failing", failingNode{})
+	if err := router.Index(); !errors.Is(err, errFailing) {
+		t.Fatal(err)
+	}
+}
+
+var errFailing = errors.New("failing node")
+
+// failingNode is a node failing every operation.
+type failingNode struct{}
+
+func (failingNode) Add(rec *lshensemble.DomainRecord) error {
+	return errFailing
+}
+
+func (failingNode) Index() error {
+	return errFailing
+}
+
+func (failingNode) Query(sig lshensemble.Signature, size int, threshold float64) ([]string, error) {
+	return nil, errFailing
+}
@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+// QueryRequest is the body of a query sent to a node over HTTP.
+type QueryRequest struct {
+	Signature lshensemble.Signature `json:"signature"`
+	Size      int                   `json:"size"`
+	Threshold float64               `json:"threshold"`
+}
+
+// QueryResponse is the body of the response to a query over HTTP.
+type QueryResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// NewHandler returns an HTTP handler serving a node to HTTPNode clients,
+// with the endpoints:
+//
+//	POST /add    adds the domain record in the JSON body
+//	POST /index  makes the added domains searchable
+//	POST /query  answers the QueryRequest in the JSON body with a QueryResponse
+func NewHandler(node Node) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
+		var rec lshensemble.DomainRecord
+		if !decodeRequest(w, r, &rec) {
+			return
+		}
+		if err := node.Add(&rec); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/index", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := node.Index(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		var req QueryRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		keys, err := node.Query(req.Signature, req.Size, req.Threshold)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(QueryResponse{keys})
+	})
+	return mux
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// HTTPNode is a Node served by NewHandler on a remote process.
+type HTTPNode struct {
+	// URL is the base URL of the node, such as "http://10.0.0.1:8080".
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPNode returns a node at the base URL using the default HTTP client.
+func NewHTTPNode(url string) *HTTPNode {
+	return &HTTPNode{
+		URL:    strings.TrimRight(url, "/"),
+		Client: http.DefaultClient,
+	}
+}
+
+func (n *HTTPNode) post(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := n.Client.Post(n.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		var msg bytes.Buffer
+		msg.ReadFrom(r.Body)
+		return fmt.Errorf("%s: %s", r.Status, strings.TrimSpace(msg.String()))
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+func (n *HTTPNode) Add(rec *lshensemble.DomainRecord) error {
+	return n.post("/add", rec, nil)
+}
+
+func (n *HTTPNode) Index() error {
+	return n.post("/index", struct{}{}, nil)
+}
+
+func (n *HTTPNode) Query(sig lshensemble.Signature, size int, threshold float64) ([]string, error) {
+	var resp QueryResponse
+	err := n.post("/query", QueryRequest{sig, size, threshold}, &resp)
+	return resp.Keys, err
+}
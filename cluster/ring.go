@@ -0,0 +1,77 @@
+// Package cluster distributes the domains of an LSH Ensemble index over
+// multiple nodes. Domains are assigned to nodes by consistent hashing of
+// their keys, and queries are broadcast to all nodes.
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+type point struct {
+	hash uint32
+	node string
+}
+
+type points []point
+
+func (p points) Len() int           { return len(p) }
+func (p points) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p points) Less(i, j int) bool { return p[i].hash < p[j].hash }
+
+// Ring is a consistent hashing ring mapping keys to node names.
+// Every node is placed on the ring at a number of virtual points, so keys
+// spread evenly and only the keys of a node move when it joins or leaves.
+type Ring struct {
+	replicas int
+	points   points
+}
+
+// NewRing creates an empty ring placing every node at replicas virtual points.
+func NewRing(replicas int) *Ring {
+	if replicas < 1 {
+		replicas = 1
+	}
+	return &Ring{replicas: replicas}
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// AddNode places a node on the ring.
+func (r *Ring) AddNode(name string) {
+	for i := 0; i < r.replicas; i++ {
+		r.points = append(r.points, point{hashKey(name + "#" + strconv.Itoa(i)), name})
+	}
+	sort.Sort(r.points)
+}
+
+// RemoveNode removes a node from the ring.
+func (r *Ring) RemoveNode(name string) {
+	kept := r.points[:0]
+	for _, p := range r.points {
+		if p.node != name {
+			kept = append(kept, p)
+		}
+	}
+	r.points = kept
+}
+
+// Node returns the name of the node owning the key, that is the node of
+// the first point following the hash of the key on the ring.
+// It returns an empty string if the ring is empty.
+func (r *Ring) Node(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+// Node is a member of the cluster holding part of the domains.
+// The transport to a remote node is up to the implementation,
+// see HTTPNode for one over HTTP.
+type Node interface {
+	// Add adds a domain to the node.
+	Add(rec *lshensemble.DomainRecord) error
+	// Index makes the domains added to the node searchable.
+	Index() error
+	// Query returns the candidate keys of the node.
+	Query(sig lshensemble.Signature, size int, threshold float64) ([]string, error)
+}
+
+// LocalNode is a Node backed by an index in the current process.
+// Domains are added to the partitions covering their sizes.
+type LocalNode struct {
+	Ensemble *lshensemble.LshEnsemble
+}
+
+// NewLocalNode returns a Node adding domains to the index.
+func NewLocalNode(index *lshensemble.LshEnsemble) *LocalNode {
+	return &LocalNode{index}
+}
+
+func (n *LocalNode) Add(rec *lshensemble.DomainRecord) error {
+	return n.Ensemble.AddE(rec.Key, rec.Signature, n.Ensemble.PartitionIndex(rec.Size))
+}
+
+func (n *LocalNode) Index() error {
+	return n.Ensemble.IndexE()
+}
+
+func (n *LocalNode) Query(sig lshensemble.Signature, size int, threshold float64) ([]string, error) {
+	result, _, err := n.Ensemble.QueryE(sig, size, threshold)
+	return result, err
+}
+
+// ErrNoNodes is returned when routing to a cluster without nodes.
+var ErrNoNodes = errors.New("cluster: no nodes")
+
+// Router assigns domains to nodes by consistent hashing of their keys,
+// broadcasts queries to all nodes, and merges the results.
+type Router struct {
+	ring  *Ring
+	nodes map[string]Node
+	mu    sync.RWMutex
+}
+
+// NewRouter creates a router without nodes, placing every node at
+// replicas virtual points on the hash ring.
+func NewRouter(replicas int) *Router {
+	return &Router{
+		ring:  NewRing(replicas),
+		nodes: make(map[string]Node),
+	}
+}
+
+// AddNode adds a node to the cluster. Domains added before the node joined
+// are not moved to it.
+func (r *Router) AddNode(name string, node Node) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exist := r.nodes[name]; !exist {
+		r.ring.AddNode(name)
+	}
+	r.nodes[name] = node
+}
+
+// RemoveNode removes a node from the cluster.
+func (r *Router) RemoveNode(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ring.RemoveNode(name)
+	delete(r.nodes, name)
+}
+
+// Add adds the domain to the node owning its key.
+func (r *Router) Add(rec *lshensemble.DomainRecord) error {
+	r.mu.RLock()
+	node, exist := r.nodes[r.ring.Node(rec.Key)]
+	r.mu.RUnlock()
+	if !exist {
+		return ErrNoNodes
+	}
+	return node.Add(rec)
+}
+
+// each calls f on every node in parallel, and returns the first error,
+// wrapped with the name of its node.
+func (r *Router) each(f func(name string, node Node) error) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.nodes) == 0 {
+		return ErrNoNodes
+	}
+	errs := make(chan error, len(r.nodes))
+	for name, node := range r.nodes {
+		go func(name string, node Node) {
+			if err := f(name, node); err != nil {
+				errs <- fmt.Errorf("cluster: node %s: %w", name, err)
+				return
+			}
+			errs <- nil
+		}(name, node)
+	}
+	var first error
+	for range r.nodes {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Index makes the domains added to all nodes searchable.
+func (r *Router) Index() error {
+	return r.each(func(name string, node Node) error {
+		return node.Index()
+	})
+}
+
+// Query broadcasts the query to all nodes and returns the union of their
+// candidates. If some nodes fail, the candidates from the other nodes are
+// returned together with the first error.
+func (r *Router) Query(sig lshensemble.Signature, size int, threshold float64) ([]string, error) {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	err := r.each(func(name string, node Node) error {
+		keys, err := node.Query(sig, size, threshold)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				result = append(result, key)
+			}
+		}
+		return err
+	})
+	return result, err
+}
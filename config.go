@@ -0,0 +1,68 @@
+package lshensemble
+
+// Config is the configuration of an index, for wrapping code to validate
+// signatures, estimate memory, or store it alongside the data.
+type Config struct {
+	NumHash    int               `json:"numHash"`
+	MaxK       int               `json:"maxK"`
+	Partitions []PartitionConfig `json:"partitions"`
+}
+
+// PartitionConfig is the configuration of a partition of an index.
+type PartitionConfig struct {
+	Partition
+	// Array is true if the LSH of the partition is an LshForestArray,
+	// whose forests are in the order of their K.
+	Array   bool           `json:"array,omitempty"`
+	Forests []ForestConfig `json:"forests"`
+}
+
+// ForestConfig is the configuration of an LshForest.
+type ForestConfig struct {
+	K             int `json:"k"`
+	L             int `json:"l"`
+	HashValueSize int `json:"hashValueSize"`
+	// HashValueBits, if not zero, is the width of the hash values
+	// bit-packed in the hash keys, HashValueSize being rounded up.
+	HashValueBits int        `json:"hashValueBits,omitempty"`
+	Trim          TrimScheme `json:"trim"`
+}
+
+// NumHash returns the number of hash functions in MinHash of the index,
+// which is the length of its signatures.
+func (e *LshEnsemble) NumHash() int {
+	return e.numHash
+}
+
+// MaxK returns the maximum value for the MinHash parameter K of the index.
+func (e *LshEnsemble) MaxK() int {
+	return e.maxK
+}
+
+// Config returns the configuration of the index.
+func (e *LshEnsemble) Config() Config {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	c := Config{
+		NumHash:    e.numHash,
+		MaxK:       e.maxK,
+		Partitions: make([]PartitionConfig, len(e.Partitions)),
+	}
+	for i, part := range e.Partitions {
+		c.Partitions[i].Partition = part
+		if i >= len(e.lshes) {
+			continue
+		}
+		_, c.Partitions[i].Array = resolveLsh(e.lshes[i]).(*LshForestArray)
+		for _, f := range lshForests(e.lshes[i]) {
+			c.Partitions[i].Forests = append(c.Partitions[i].Forests, ForestConfig{
+				K:             f.k,
+				L:             f.l,
+				HashValueSize: f.hashValueSize,
+				HashValueBits: f.hashValueBits,
+				Trim:          f.trim,
+			})
+		}
+	}
+	return c
+}
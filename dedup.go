@@ -0,0 +1,260 @@
+package lshensemble
+
+import "math"
+
+// LshDedup represents a MinHash LSH index for near-duplicate detection
+// by Jaccard similarity.
+// It uses a single LshForest, with the number of bands (L) and the number of
+// hash functions per band (K) chosen from the S-curve of the Jaccard threshold.
+type LshDedup struct {
+	forest    *LshForest
+	k         int
+	l         int
+	threshold float64
+}
+
+// NewLshDedup initializes an index for finding domains with Jaccard
+// similarity above the threshold.
+// numHash is the number of hash functions in MinHash.
+func NewLshDedup(threshold float64, numHash int) *LshDedup {
+	k, l, _, _ := optimalJaccardKL(numHash, threshold)
+	return &LshDedup{
+		forest:    NewLshForest(k, l),
+		k:         k,
+		l:         l,
+		threshold: threshold,
+	}
+}
+
+// Add a key with MinHash signature into the index.
+// The key won't be searchable until Index() is called.
+func (d *LshDedup) Add(key string, sig Signature) {
+	d.forest.Add(key, sig)
+}
+
+// Makes all the keys added searchable.
+func (d *LshDedup) Index() {
+	d.forest.Index()
+}
+
+// Query returns the candidate keys that are near-duplicates of the
+// query signature, which may include false positives.
+func (d *LshDedup) Query(sig Signature) []string {
+	out := make(chan string)
+	go func() {
+		d.forest.Query(sig, d.k, d.l, out)
+		close(out)
+	}()
+	result := make([]string, 0)
+	for key := range out {
+		result = append(result, key)
+	}
+	return result
+}
+
+// Params returns the number of hash functions per band (K) and
+// the number of bands (L) chosen for the threshold.
+func (d *LshDedup) Params() (k, l int) {
+	return d.k, d.l
+}
+
+// optimalJaccardKL returns the K and L minimizing the sum of the false
+// positive and negative probabilities for Jaccard similarity threshold t,
+// and the probabilities themselves.
+func optimalJaccardKL(numHash int, t float64) (optK, optL int, fp, fn float64) {
+	minError := math.MaxFloat64
+	for k := 1; k <= numHash; k++ {
+		for l := 1; l <= numHash/k; l++ {
+			currFp := ProbJaccardFalsePositive(l, k, t, integrationPrecision)
+			currFn := ProbJaccardFalseNegative(l, k, t, integrationPrecision)
+			currErr := currFn + currFp
+			if minError > currErr {
+				minError = currErr
+				optK = k
+				optL = l
+				fp = currFp
+				fn = currFn
+			}
+		}
+	}
+	return
+}
+
+// keySet is a set of keys, bounded to the last window keys added if
+// window is positive.
+type keySet struct {
+	keys map[string]bool
+	// ring holds the keys of a bounded set in the order they were added,
+	// and next is the index of the oldest.
+	ring []string
+	next int
+}
+
+func newKeySet(window int) *keySet {
+	s := &keySet{keys: make(map[string]bool)}
+	if window > 0 {
+		s.ring = make([]string, 0, window)
+	}
+	return s
+}
+
+// add adds the key, evicting the oldest key of a full bounded set, and
+// returns false if the key was in the set.
+func (s *keySet) add(key string) bool {
+	if s.keys[key] {
+		return false
+	}
+	s.keys[key] = true
+	switch {
+	case s.ring == nil:
+	case len(s.ring) < cap(s.ring):
+		s.ring = append(s.ring, key)
+	default:
+		delete(s.keys, s.ring[s.next])
+		s.ring[s.next] = key
+		s.next = (s.next + 1) % len(s.ring)
+	}
+	return true
+}
+
+// DedupScope is the scope within which every candidate of a query is
+// delivered once.
+type DedupScope int
+
+const (
+	// DedupPartition delivers every candidate once per partition: the
+	// keys found in several hash tables of the forest probed in a
+	// partition are delivered once, but the keys indexed in several
+	// partitions once per partition.
+	DedupPartition DedupScope = iota
+	// DedupGlobal delivers every candidate once across the partitions,
+	// tracking the keys delivered in a set.
+	DedupGlobal
+	// DedupBitmap is like DedupGlobal, but tracks the keys delivered in a
+	// bitmap of their ids, a bit per key of the index instead of a set
+	// entry per candidate, for the queries of many candidates. The ids of
+	// a frozen index are those of its key dictionaries, found by binary
+	// search. Those of other indexes are assigned in a map of all the
+	// keys by the first such query after Index(), which pays off only
+	// when it is amortized over many queries. The keys without ids, such
+	// as the keys of the tiered partitions of LoadSnapshotTiered, are
+	// tracked in a set.
+	DedupBitmap
+)
+
+// dedupSet is a set of the keys delivered by a query.
+type dedupSet interface {
+	// add adds the key, and returns false if the key was in the set.
+	add(key string) bool
+}
+
+// keyIDs are the ids of the keys of a generation of an index: those of
+// the key dictionaries of the partitions of a frozen index, offset by the
+// keys of the previous partitions, or else ids assigned in a map.
+type keyIDs struct {
+	generation uint64
+	ids        map[string]int
+	dicts      []*keyDict
+	bases      []int
+	n          int
+}
+
+// id returns the id of the key, or false if it has none. A key of the
+// dictionaries of several partitions has the id of the first.
+func (k *keyIDs) id(key string) (int, bool) {
+	if k.dicts == nil {
+		id, exist := k.ids[key]
+		return id, exist
+	}
+	for i, dict := range k.dicts {
+		if id, exist := dict.id(key); exist {
+			return k.bases[i] + id, true
+		}
+	}
+	return 0, false
+}
+
+// keyIDs returns the ids of the keys of the current generation of the
+// index, assigned once per generation unless the index is frozen. The
+// index must be locked for reading.
+func (e *LshEnsemble) keyIDs() *keyIDs {
+	e.idsMu.Lock()
+	defer e.idsMu.Unlock()
+	if e.ids != nil && e.ids.generation == e.generation {
+		return e.ids
+	}
+	if dicts := e.keyDicts(); dicts != nil {
+		ids := &keyIDs{generation: e.generation, dicts: dicts, bases: make([]int, len(dicts))}
+		for i, dict := range dicts {
+			ids.bases[i] = ids.n
+			ids.n += dict.len()
+		}
+		e.ids = ids
+		return ids
+	}
+	ids := make(map[string]int)
+	for _, lsh := range e.lshes {
+		if _, tiered := lsh.(*tieredLsh); tiered {
+			// The tiered partitions are not loaded for the ids
+			continue
+		}
+		if forests := lshForests(lsh); len(forests) > 0 {
+			forests[0].eachKey(func(key string) {
+				if _, exist := ids[key]; !exist {
+					ids[key] = len(ids)
+				}
+			})
+		}
+	}
+	e.ids = &keyIDs{generation: e.generation, ids: ids, n: len(ids)}
+	return e.ids
+}
+
+// keyDicts returns the key dictionaries of the partitions of a frozen
+// index, or nil if a partition has none.
+func (e *LshEnsemble) keyDicts() []*keyDict {
+	if !e.frozen {
+		return nil
+	}
+	dicts := make([]*keyDict, 0, len(e.lshes))
+	for _, lsh := range e.lshes {
+		if _, tiered := lsh.(*tieredLsh); tiered {
+			return nil
+		}
+		forests := lshForests(lsh)
+		if len(forests) == 0 || len(forests[0].frozen) == 0 {
+			return nil
+		}
+		dicts = append(dicts, forests[0].frozen[0].dict)
+	}
+	return dicts
+}
+
+// bitmapSet is a set of the keys with ids as a bitmap, and of the other
+// keys as a keySet.
+type bitmapSet struct {
+	ids    *keyIDs
+	bits   []uint64
+	others *keySet
+}
+
+func newBitmapSet(ids *keyIDs, window int) *bitmapSet {
+	return &bitmapSet{
+		ids:    ids,
+		bits:   make([]uint64, (ids.n+63)/64),
+		others: newKeySet(window),
+	}
+}
+
+func (s *bitmapSet) add(key string) bool {
+	id, exist := s.ids.id(key)
+	if !exist {
+		return s.others.add(key)
+	}
+	w, bit := id/64, uint64(1)<<uint(id%64)
+	if s.bits[w]&bit != 0 {
+		return false
+	}
+	s.bits[w] |= bit
+	return true
+}
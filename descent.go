@@ -0,0 +1,53 @@
+package lshensemble
+
+// QueryDescent returns at least m candidate keys of the query signature,
+// if the forest has as many, by the prefix descent of LSH Forest: the
+// keys matching the longest prefixes of the bands of the signature in any
+// hash table, of K = k hash values, and then the keys matching shorter
+// prefixes, until m keys are found or K = 1.
+// The keys are ordered by decreasing length of the prefix they match, so
+// the nearest candidates come first, and the number of candidates wanted
+// controls the recall of every query, without choosing K and L.
+func (f *LshForest) QueryDescent(sig Signature, m int) []string {
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for K := f.k; K >= 1 && len(result) < m; K-- {
+		for _, key := range f.candidates(sig, K, f.l) {
+			if !seen[key] {
+				seen[key] = true
+				result = append(result, key)
+			}
+		}
+	}
+	return result
+}
+
+// QueryDescent is like QueryDescent of LshForest for all the partitions
+// at once: it returns the candidates of every partition matching the
+// bands of the signature in prefixes of K = maxK hash values, and then of
+// shorter prefixes, until at least m candidates are found or K = 1,
+// in the order of the descent.
+// The partitions of an index of LshForestArrays probe the forest of every
+// K with all its bands. The queries bypass the admission controller, the
+// query cache and the query statistics.
+func (e *LshEnsemble) QueryDescent(sig Signature, m int) []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for k := e.maxK; k >= 1 && len(result) < m; k-- {
+		for _, lsh := range e.lshes {
+			f, K := lsh.forest(k)
+			if K == -1 {
+				K = f.k
+			}
+			for _, key := range f.candidates(sig, K, f.l) {
+				if !seen[key] {
+					seen[key] = true
+					result = append(result, key)
+				}
+			}
+		}
+	}
+	return result
+}
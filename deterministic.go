@@ -0,0 +1,86 @@
+package lshensemble
+
+import (
+	"sort"
+)
+
+// WithDeterministicBuild makes the layout of the hash tables depend only
+// on the domains added, so two indexes built from the same domains are
+// saved as byte-identical files, whatever the scheduling of the
+// goroutines and the number of calls to Index(). Index() then merges the
+// buckets with equal hash keys created by different calls, and removes
+// the empty ones, at the cost of copying the merged buckets.
+func WithDeterministicBuild() Option {
+	return func(c *config) {
+		c.deterministic = true
+	}
+}
+
+// Compact merges the buckets with equal hash keys created by different
+// calls to Index(), and removes the empty ones, as Index() does for the
+// indexes built with WithDeterministicBuild, so the queries of a long-lived
+// index updated by many calls to Index() probe fewer buckets. The domains
+// added since the last Index() are not made searchable.
+func (e *LshEnsemble) Compact() error {
+	if e.frozen {
+		return ErrFrozenIndex
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.canonicalize()
+	return nil
+}
+
+// canonicalize merges the buckets of the hash tables of every forest.
+func (e *LshEnsemble) canonicalize() {
+	var tables []tableRef
+	for _, lsh := range e.lshes {
+		if _, tiered := lsh.(*tieredLsh); tiered {
+			continue
+		}
+		for _, f := range lshForests(lsh) {
+			for t := range f.hashTables {
+				tables = append(tables, tableRef{f, t})
+			}
+		}
+	}
+	parallel(len(tables), e.parallelism, func(i int) {
+		f, t := tables[i].f, tables[i].t
+		f.setTable(t, canonicalTable(f.hashTables[t]))
+	})
+}
+
+// canonicalTable returns the hash table with one non-empty bucket per
+// hash key, and the keys sorted within every bucket. The table is
+// returned as is if it is canonical already, and copied otherwise,
+// as it may be shared with a clone.
+func canonicalTable(ht hashTable) hashTable {
+	canonical := true
+	for i := range ht {
+		if len(ht[i].keys) == 0 || (i > 0 && ht[i-1].hashKey == ht[i].hashKey) {
+			canonical = false
+			break
+		}
+	}
+	if canonical {
+		return ht
+	}
+	sorted := append(hashTable(nil), ht...)
+	sort.Stable(sorted)
+	merged := make(hashTable, 0, len(sorted))
+	for _, b := range sorted {
+		if len(b.keys) == 0 {
+			continue
+		}
+		last := len(merged) - 1
+		if last < 0 || merged[last].hashKey != b.hashKey {
+			merged = append(merged, b)
+			continue
+		}
+		ks := make(keys, 0, len(merged[last].keys)+len(b.keys))
+		ks = append(append(ks, merged[last].keys...), b.keys...)
+		sort.Strings(ks)
+		merged[last].keys = ks
+	}
+	return merged
+}
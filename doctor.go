@@ -0,0 +1,188 @@
+package lshensemble
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// DoctorOptions controls the health checks of Doctor.
+type DoctorOptions struct {
+	// Samples is the number of retained domains sampled, 100 by default.
+	Samples int
+	// Threshold is the containment threshold of the queries of the
+	// sampled domains, 0.5 by default.
+	Threshold float64
+	// BucketFraction is the fraction of the keys of a hash table above
+	// which a bucket is suspicious, 0.05 by default.
+	BucketFraction float64
+	// Rand is the source of the samples. By default the top-level
+	// functions of math/rand are used.
+	Rand *rand.Rand
+}
+
+// HealthReport is the health of an index found by Doctor.
+type HealthReport struct {
+	// Sampled is the number of domains sampled and queried.
+	Sampled int
+	// SelfRecall is the fraction of the sampled domains returned by the
+	// queries of their own signatures, which is 1 for a healthy index.
+	// Missed are the keys of the domains that were not.
+	SelfRecall float64
+	Missed     []string
+	// MeanCandidates is the mean number of distinct candidates of the
+	// queries.
+	MeanCandidates float64
+	// Buckets are the suspicious buckets, holding a large fraction of
+	// the keys of their hash tables, by decreasing number of keys.
+	Buckets []SuspiciousBucket
+}
+
+// SuspiciousBucket is a bucket holding a large fraction of the keys of its
+// hash table, e.g. because of degenerate signatures or hash values
+// trimmed too much, which makes every query matching it slow.
+type SuspiciousBucket struct {
+	Partition int
+	// K is the number of hash functions per band of the forest, and
+	// Table the index of the hash table in the forest.
+	K     int
+	Table int
+	// Keys is the number of keys in the bucket, and Fraction the
+	// fraction of the keys of the hash table they are.
+	Keys     int
+	Fraction float64
+}
+
+// Doctor checks the health of the index, e.g. after an upgrade or a
+// change of parameters: it samples the domains retained by AddDomain,
+// queries the index with their own signatures, which must return them,
+// and scans the hash tables for suspicious buckets.
+// The queries bypass the admission controller, the query cache and the
+// query statistics. Only the domains made searchable by Index() are
+// checked.
+func (e *LshEnsemble) Doctor(opts *DoctorOptions) *HealthReport {
+	if opts == nil {
+		opts = &DoctorOptions{}
+	}
+	samples := opts.Samples
+	if samples <= 0 {
+		samples = 100
+	}
+	threshold := opts.Threshold
+	if threshold <= 0 || threshold > 1 {
+		threshold = 0.5
+	}
+	fraction := opts.BucketFraction
+	if fraction <= 0 || fraction > 1 {
+		fraction = 0.05
+	}
+	perm := rand.Perm
+	if opts.Rand != nil {
+		perm = opts.Rand.Perm
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	r := &HealthReport{}
+	// The domains added after the last Index() are not sampled
+	searchable := e.searchableKeys()
+	keys := make([]string, 0, len(e.domains)+e.sizes.len())
+	e.eachRecord(func(rec *DomainRecord) {
+		if searchable[rec.Key] {
+			keys = append(keys, rec.Key)
+		}
+	})
+	// The samples only depend on the source
+	sort.Strings(keys)
+	if len(keys) > samples {
+		sample := make([]string, samples)
+		for i, j := range perm(len(keys))[:samples] {
+			sample[i] = keys[j]
+		}
+		keys = sample
+	}
+	var total int
+	for _, key := range keys {
+		rec, exist := e.retained(key)
+		if !exist {
+			continue
+		}
+		out := make(chan string)
+		go func() {
+			e.probe(rec.Signature, e.optimalParams(rec.Size, threshold, Supersets), nil, out)
+			close(out)
+		}()
+		found := false
+		seen := make(map[string]bool)
+		for candidate := range out {
+			seen[candidate] = true
+			found = found || candidate == key
+		}
+		r.Sampled++
+		total += len(seen)
+		if !found {
+			r.Missed = append(r.Missed, key)
+		}
+	}
+	if r.Sampled > 0 {
+		r.SelfRecall = float64(r.Sampled-len(r.Missed)) / float64(r.Sampled)
+		r.MeanCandidates = float64(total) / float64(r.Sampled)
+	}
+	for i, lsh := range e.lshes {
+		for _, f := range lshForests(lsh) {
+			for x := 0; x < f.l; x++ {
+				t := f.table(x)
+				var n int
+				for b := 0; b < t.buckets(); b++ {
+					n += t.bucketLen(b)
+				}
+				for b := 0; b < t.buckets(); b++ {
+					if keys := t.bucketLen(b); keys > 1 && float64(keys) > fraction*float64(n) {
+						r.Buckets = append(r.Buckets, SuspiciousBucket{
+							Partition: i,
+							K:         f.k,
+							Table:     x,
+							Keys:      keys,
+							Fraction:  float64(keys) / float64(n),
+						})
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(r.Buckets, func(i, j int) bool { return r.Buckets[i].Keys > r.Buckets[j].Keys })
+	return r
+}
+
+// searchableKeys returns the keys in the hash tables of the index, which
+// exclude the keys added since the last Index().
+func (e *LshEnsemble) searchableKeys() map[string]bool {
+	keys := make(map[string]bool)
+	for _, lsh := range e.lshes {
+		if forests := lshForests(lsh); len(forests) > 0 && forests[0].l > 0 {
+			t := forests[0].table(0)
+			for b := 0; b < t.buckets(); b++ {
+				t.scan(b, func(key string) bool {
+					keys[key] = true
+					return true
+				})
+			}
+		}
+	}
+	return keys
+}
+
+// String formats the report, with a line per suspicious bucket.
+func (r *HealthReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d domains sampled: self-recall %.3f, %.1f candidates per query\n",
+		r.Sampled, r.SelfRecall, r.MeanCandidates)
+	if len(r.Missed) > 0 {
+		fmt.Fprintf(&b, "missed: %s\n", strings.Join(r.Missed, ", "))
+	}
+	for _, bucket := range r.Buckets {
+		fmt.Fprintf(&b, "partition %d, K=%d table %d: bucket of %d keys (%.1f%% of the table)\n",
+			bucket.Partition, bucket.K, bucket.Table, bucket.Keys, 100*bucket.Fraction)
+	}
+	return b.String()
+}
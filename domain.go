@@ -1,6 +1,7 @@
 package lshensemble
 
 import (
+	"fmt"
 	"sort"
 )
 
@@ -14,6 +15,33 @@ type DomainRecord struct {
 	Signature  Signature
 }
 
+// NewDomainRecord returns the record of a domain, or an error wrapping
+// ErrInvalidRecord if it is invalid for an index of numHash hash
+// functions, as checked by Validate.
+func NewDomainRecord(key string, size int, sig Signature, numHash int) (*DomainRecord, error) {
+	rec := &DomainRecord{Key: key, Size: size, Signature: sig}
+	if err := rec.Validate(numHash); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Validate returns an error wrapping ErrInvalidRecord if the key of the
+// record is empty, its size is not positive, or its signature has fewer
+// than numHash hash values, so invalid records are rejected before they
+// are added to an index of numHash hash functions.
+func (rec *DomainRecord) Validate(numHash int) error {
+	switch {
+	case rec.Key == "":
+		return fmt.Errorf("%w: empty key", ErrInvalidRecord)
+	case rec.Size <= 0:
+		return fmt.Errorf("%w: %q has size %d", ErrInvalidRecord, rec.Key, rec.Size)
+	case len(rec.Signature) < numHash:
+		return fmt.Errorf("%w: %q has %d hash values, need %d", ErrInvalidRecord, rec.Key, len(rec.Signature), numHash)
+	}
+	return nil
+}
+
 // A wrapper for sorting domains.
 type BySize []*DomainRecord
 
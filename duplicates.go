@@ -0,0 +1,220 @@
+package lshensemble
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DuplicatePolicy is applied when a key already in the index is added
+// again, e.g. by a pipeline retrying a batch.
+type DuplicatePolicy int
+
+const (
+	// AllowDuplicates indexes the key again, so it may be returned by
+	// queries matching either signature. It is the default.
+	AllowDuplicates DuplicatePolicy = iota
+	// RejectDuplicates makes AddE return ErrDuplicateKey, and Add and
+	// AddDomain panic with it.
+	RejectDuplicates
+	// IgnoreDuplicates keeps the key as it was first added.
+	IgnoreDuplicates
+	// ReplaceDuplicates removes the key before adding it again, which
+	// costs a scan of the hash tables of the partition it was added to.
+	ReplaceDuplicates
+)
+
+func (p DuplicatePolicy) valid() bool {
+	return p >= AllowDuplicates && p <= ReplaceDuplicates
+}
+
+// WithDuplicatePolicy sets the policy applied when a key is added twice,
+// AllowDuplicates by default.
+func WithDuplicatePolicy(p DuplicatePolicy) Option {
+	return func(c *config) {
+		c.duplicates = p
+	}
+}
+
+// SetDuplicatePolicy sets the policy applied when a key is added twice.
+// Unless the policy is AllowDuplicates, the index keeps a dictionary of
+// the keys added to it, built from the hash tables when the policy is set.
+// It panics if the policy is unknown, or is ReplaceDuplicates for an
+// index created with WithSpill or WithMemoryBudget.
+func (e *LshEnsemble) SetDuplicatePolicy(p DuplicatePolicy) {
+	if !p.valid() {
+		panic(fmt.Sprintf("lshensemble: unknown duplicate policy %d", p))
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if p == ReplaceDuplicates && (e.spill != nil || e.budget != nil) {
+		panic("lshensemble: duplicates cannot be replaced in spilled indexes")
+	}
+	e.duplicates = p
+	if p == AllowDuplicates {
+		e.keyParts = nil
+		return
+	}
+	if e.keyParts == nil {
+		e.keyParts = e.indexedKeys()
+	}
+}
+
+// indexedKeys returns the partition of every key in the index.
+func (e *LshEnsemble) indexedKeys() map[string]int {
+	keyParts := make(map[string]int)
+	for i, lsh := range e.lshes {
+		if forests := lshForests(lsh); len(forests) > 0 {
+			// Every forest has the same keys
+			forests[0].eachKey(func(key string) {
+				keyParts[key] = i
+			})
+		}
+	}
+	return keyParts
+}
+
+// eachKey calls fn for every key added to the forest, indexed or not,
+// once per time it was added.
+func (f *LshForest) eachKey(fn func(key string)) {
+	if f.l == 0 {
+		return
+	}
+	// Every key is in the first hash table
+	t := f.table(0)
+	for b := 0; b < t.buckets(); b++ {
+		t.scan(b, func(key string) bool {
+			fn(key)
+			return true
+		})
+	}
+	if f.initHashTables != nil {
+		for _, ks := range f.initHashTables[0] {
+			for _, key := range ks {
+				fn(key)
+			}
+		}
+	}
+}
+
+// add adds the key to the partition applying the duplicate policy,
+// and returns false if the key is ignored. The hash keys of its bands
+// are computed from sig, unless bandKeys, added by AddHashed, are given.
+func (e *LshEnsemble) add(key string, sig Signature, bandKeys [][]byte, partInd int) (bool, error) {
+	if e.released {
+		return false, ErrFrozenIndex
+	}
+	if e.keyParts != nil {
+		if part, exist := e.keyParts[key]; exist {
+			switch e.duplicates {
+			case RejectDuplicates:
+				return false, fmt.Errorf("%w: %q", ErrDuplicateKey, key)
+			case IgnoreDuplicates:
+				return false, nil
+			case ReplaceDuplicates:
+				for _, f := range lshForests(e.lshes[part]) {
+					f.remove(key)
+				}
+				if e.realtime != nil {
+					e.realtime.remove(key)
+				}
+				// The key may have been indexed
+				e.generation++
+			}
+		}
+	}
+	if e.budget != nil && e.spill == nil {
+		e.charge(key, partInd)
+	}
+	band := signatureBand(sig)
+	if bandKeys != nil {
+		band = precomputedBand(bandKeys)
+	}
+	if e.spill != nil {
+		if err := e.spill.add(e, key, band, partInd); err != nil {
+			return false, err
+		}
+	} else if e.sequential || bandKeys != nil {
+		e.addSequential(key, band, partInd)
+	} else {
+		e.lshes[partInd].Add(key, sig)
+	}
+	if e.keyParts != nil {
+		e.keyParts[key] = partInd
+	}
+	if e.realtime != nil {
+		e.realtime.add(e, key, sig, bandKeys, partInd)
+	}
+	return true, nil
+}
+
+// lshForests returns the forests of an Lsh.
+func lshForests(lsh Lsh) []*LshForest {
+	switch lsh := resolveLsh(lsh).(type) {
+	case *LshForest:
+		return []*LshForest{lsh}
+	case *LshForestArray:
+		return lsh.array
+	}
+	return nil
+}
+
+// remove removes the key from the forest, whether indexed or not.
+// The hash tables with the key are copied, as they may be shared with
+// a clone.
+func (f *LshForest) remove(key string) {
+	for i, initHt := range f.initHashTables {
+		for hk, ks := range initHt {
+			rest := without(ks, key)
+			if f.split != nil && len(rest) < len(ks) {
+				f.removeExtensions(i, hk, ks, key)
+			}
+			if len(rest) == 0 {
+				delete(initHt, hk)
+			} else if len(rest) < len(ks) {
+				initHt[hk] = rest
+			}
+		}
+	}
+	for i, ht := range f.hashTables {
+		var copied hashTable
+		for b, bk := range ht {
+			j := sort.SearchStrings(bk.keys, key)
+			if j == len(bk.keys) || bk.keys[j] != key {
+				if copied != nil {
+					copied = append(copied, bk)
+				}
+				continue
+			}
+			if copied == nil {
+				copied = append(make(hashTable, 0, len(ht)), ht[:b]...)
+			}
+			if rest := without(bk.keys, key); len(rest) > 0 {
+				copied = append(copied, bucket{hashKey: bk.hashKey, keys: rest, split: bk.split.without(key)})
+			}
+		}
+		if copied != nil {
+			f.setTable(i, copied)
+		}
+	}
+}
+
+// without returns the keys other than key, in a new slice if key is
+// in the keys.
+func without(ks keys, key string) keys {
+	var rest keys
+	for j, k := range ks {
+		if k == key {
+			if rest == nil {
+				rest = append(make(keys, 0, len(ks)-1), ks[:j]...)
+			}
+			continue
+		}
+		if rest != nil {
+			rest = append(rest, k)
+		}
+	}
+	if rest == nil {
+		return ks
+	}
+	return rest
+}
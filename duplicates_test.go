@@ -0,0 +1,62 @@
+package lshensemble
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_DuplicatePolicy(t *testing.T) {
+	recs := randomDomains(100, 64, 1)
+	parts := []Partition{{0, 100}, {101, 300}}
+	count := func(index *LshEnsemble, key string) int {
+		var n int
+		for _, f := range lshForests(index.lshes[index.PartitionIndex(recs[0].Size)]) {
+			f.eachKey(func(k string) {
+				if k == key {
+					n++
+				}
+			})
+		}
+		return n
+	}
+	for _, policy := range []DuplicatePolicy{AllowDuplicates, RejectDuplicates, IgnoreDuplicates, ReplaceDuplicates} {
+		index, err := New(WithPartitions(parts), WithNumHash(64), WithDuplicatePolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			index.AddDomain(rec, index.PartitionIndex(rec.Size))
+		}
+		index.Index()
+		rec := recs[0]
+		err = index.AddE(rec.Key, recs[1].Signature, index.PartitionIndex(rec.Size))
+		if (policy == RejectDuplicates) != errors.Is(err, ErrDuplicateKey) {
+			t.Errorf("policy %d: %v", policy, err)
+		}
+		index.Index()
+		want := 1
+		if policy == AllowDuplicates {
+			want = 2
+		}
+		if n := count(index, rec.Key); n != want {
+			t.Errorf("policy %d: key indexed %d times", policy, n)
+		}
+		if anomalies := index.CheckIntegrity(false); len(anomalies) != 0 {
+			t.Error(anomalies)
+		}
+	}
+
+	// The key dictionary of an existing index
+	index := NewLshEnsemble(parts, 64, 4)
+	for _, rec := range recs {
+		index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	index.SetDuplicatePolicy(RejectDuplicates)
+	if err := index.AddE(recs[0].Key, recs[0].Signature, 0); !errors.Is(err, ErrDuplicateKey) {
+		t.Error(err)
+	}
+	if _, err := New(WithPartitions(parts), WithDuplicatePolicy(-1)); !errors.Is(err, ErrInvalidParameter) {
+		t.Error(err)
+	}
+}
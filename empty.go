@@ -0,0 +1,106 @@
+package lshensemble
+
+import (
+	"fmt"
+	"sort"
+)
+
+// EmptyDomainPolicy is applied when a domain of at most one value is
+// added by AddDomain, AddDomainE or Bootstrap: the MinHash signatures of
+// such domains are degenerate, and collide with those of many others.
+type EmptyDomainPolicy int
+
+const (
+	// IndexEmptyDomains indexes the empty domains as the others. It is
+	// the default.
+	IndexEmptyDomains EmptyDomainPolicy = iota
+	// RejectEmptyDomains makes AddDomainE return ErrEmptyDomain, and
+	// AddDomain and Bootstrap panic with it.
+	RejectEmptyDomains
+	// IsolateEmptyDomains keeps the empty domains out of the partitions,
+	// in an isolated partition whose domains are only candidates of the
+	// queries with IncludeEmpty set.
+	IsolateEmptyDomains
+)
+
+func (p EmptyDomainPolicy) valid() bool {
+	return p >= IndexEmptyDomains && p <= IsolateEmptyDomains
+}
+
+// WithEmptyDomainPolicy sets the policy applied when a domain of at most
+// one value is added, IndexEmptyDomains by default. The domains added by
+// Add, without their sizes, are always indexed.
+func WithEmptyDomainPolicy(p EmptyDomainPolicy) Option {
+	return func(c *config) {
+		c.empty = p
+	}
+}
+
+// emptyDomain returns whether the empty domain policy applies to the
+// domain, i.e. whether it is of at most one value and the policy is not
+// IndexEmptyDomains.
+func (e *LshEnsemble) emptyDomain(rec *DomainRecord) bool {
+	return e.empty != IndexEmptyDomains && rec.Key != "" && (rec.Size == 0 || rec.Size == 1)
+}
+
+// isolate applies the empty domain policy to the domain, and returns
+// whether it is kept out of the partitions, with the error of a rejected
+// domain.
+func (e *LshEnsemble) isolate(rec *DomainRecord) (bool, error) {
+	if !e.emptyDomain(rec) {
+		return false, nil
+	}
+	switch e.empty {
+	case RejectEmptyDomains:
+		return true, fmt.Errorf("%w: %q of size %d", ErrEmptyDomain, rec.Key, rec.Size)
+	case IsolateEmptyDomains:
+		if e.isolated == nil {
+			e.isolated = make(map[string]*DomainRecord)
+		}
+		e.isolated[rec.Key] = rec
+		e.generation++
+		return true, nil
+	}
+	return false, nil
+}
+
+// EmptyDomains returns the keys of the domains isolated by the
+// IsolateEmptyDomains policy, sorted. They are saved by Save and
+// SaveSnapshot, but not by SaveShared.
+func (e *LshEnsemble) EmptyDomains() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	keys := make([]string, 0, len(e.isolated))
+	for key := range e.isolated {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// copyRecords returns a copy of the records, or nil.
+func copyRecords(recs map[string]*DomainRecord) map[string]*DomainRecord {
+	if recs == nil {
+		return nil
+	}
+	c := make(map[string]*DomainRecord, len(recs))
+	for key, rec := range recs {
+		c[key] = rec
+	}
+	return c
+}
+
+// probeIsolated writes the keys of the isolated domains whose sizes are
+// within the bounds to out, until all are written or done is closed.
+func (e *LshEnsemble) probeIsolated(lower, upper int, done <-chan struct{}, out chan<- string) {
+	for key, rec := range e.isolated {
+		if rec.Size < lower || rec.Size > upper {
+			continue
+		}
+		select {
+		case out <- key:
+		case <-done:
+			return
+		}
+	}
+}
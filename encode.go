@@ -0,0 +1,64 @@
+package lshensemble
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// The canonical encoders of domain values of numeric types make the
+// values hashed by different producers of signatures identical, whatever
+// their types and formatting: 1, int8(1), 1.0 and "1e0" parsed as a float
+// are all encoded as "1". The encodings are those of NumericProfile.
+
+// EncodeInt returns the canonical encoding of an integer, the same as
+// the float of equal value for the integers exactly representable as
+// float64.
+func EncodeInt(v int64) []byte {
+	// The floats of 2^63 and more overflow int64
+	if f := float64(v); f < 1<<63 && int64(f) == v {
+		return EncodeFloat(f, -1)
+	}
+	return strconv.AppendInt(nil, v, 10)
+}
+
+// EncodeUint is like EncodeInt for unsigned integers.
+func EncodeUint(v uint64) []byte {
+	if f := float64(v); f < 1<<64 && uint64(f) == v {
+		return EncodeFloat(f, -1)
+	}
+	return strconv.AppendUint(nil, v, 10)
+}
+
+// EncodeFloat returns the canonical encoding of a float rounded to
+// precision decimal places, or not rounded if precision is negative,
+// so floats computed with different rounding errors can be the same.
+// Negative zero is encoded as zero, and all NaNs the same.
+func EncodeFloat(v float64, precision int) []byte {
+	if precision >= 0 && !math.IsInf(v, 0) && !math.IsNaN(v) {
+		// Rounding the decimal representation is exact, unlike
+		// scaling the float
+		v, _ = strconv.ParseFloat(strconv.FormatFloat(v, 'f', precision, 64), 64)
+	}
+	if v == 0 {
+		v = 0
+	}
+	return strconv.AppendFloat(nil, v, 'g', -1, 64)
+}
+
+// EncodeDate returns the canonical encoding of the calendar date of t
+// in its location, as YYYY-MM-DD.
+func EncodeDate(t time.Time) []byte {
+	return t.AppendFormat(nil, "2006-01-02")
+}
+
+// EncodeTime returns the canonical encoding of t truncated to a multiple
+// of precision since the zero time, if precision is positive, as RFC 3339
+// with nanoseconds in UTC, so the same instant in different locations is
+// the same.
+func EncodeTime(t time.Time, precision time.Duration) []byte {
+	if precision > 0 {
+		t = t.Truncate(precision)
+	}
+	return t.UTC().AppendFormat(nil, time.RFC3339Nano)
+}
@@ -0,0 +1,312 @@
+package lshensemble
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// An encrypted index starts with encryptedMagic and the encryption format
+// version, followed by the wrapped data key, prefixed by its length, and
+// the 8 random bytes prefixing the nonces. The index is then written in
+// blocks of at most encryptedBlockSize bytes, each sealed with AES-GCM and
+// prefixed by its sealed length. The nonce of a block is the prefix and
+// the big endian block number, and its additional data is 1 for the last
+// block, which may be empty, and 0 otherwise, so an index truncated at a
+// block boundary is detected.
+const (
+	encryptedMagic     = "LSHC"
+	encryptedVersion   = 1
+	encryptedBlockSize = 64 << 10
+	// dataKeySize is the size of the AES-256 data keys of StaticKey.
+	dataKeySize = 32
+)
+
+// KeyProvider provides the keys encrypting the persisted indexes: every
+// index is encrypted with its own data key, stored wrapped with the index,
+// e.g. by the master key of a KMS.
+type KeyProvider interface {
+	// NewDataKey returns a new AES key of 16, 24 or 32 bytes, and its
+	// wrapped form stored with the index.
+	NewDataKey() (key, wrapped []byte, err error)
+	// DataKey returns the AES key of the wrapped key of an index.
+	DataKey(wrapped []byte) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider wrapping random AES-256 data keys with the
+// AES-GCM key of its 16, 24 or 32 bytes, provided by the caller.
+type StaticKey []byte
+
+func (k StaticKey) NewDataKey() (key, wrapped []byte, err error) {
+	aead, err := newGCM(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	key = make([]byte, dataKeySize)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return key, aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (k StaticKey) DataKey(wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: wrapped key of %d bytes", ErrCorruptIndex, len(wrapped))
+	}
+	nonce := wrapped[:aead.NonceSize()]
+	key, err := aead.Open(nil, nonce, wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot unwrap the data key", ErrCorruptIndex)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, invalidParameter("%v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptWriter seals the bytes written in blocks.
+type encryptWriter struct {
+	w      *bufio.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	block  uint32
+	buf    []byte
+	sealed []byte
+	err    error
+}
+
+// NewEncryptWriter returns a writer encrypting the bytes written to w with
+// a new data key of keys, e.g. an index written by Save or SaveShared.
+// The writer must be closed to write the last block, which does not close
+// w. The bytes are read back by NewDecryptReader.
+func NewEncryptWriter(w io.Writer, keys KeyProvider) (io.WriteCloser, error) {
+	key, wrapped, err := keys.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	ew := &encryptWriter{
+		w:     bufio.NewWriter(w),
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, 0, encryptedBlockSize),
+	}
+	if _, err := rand.Read(ew.nonce[:8]); err != nil {
+		return nil, err
+	}
+	enc := encoder{buf: []byte(encryptedMagic)}
+	enc.int(encryptedVersion)
+	enc.string(string(wrapped))
+	enc.buf = append(enc.buf, ew.nonce[:8]...)
+	if _, err := ew.w.Write(enc.buf); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		if len(w.buf) == cap(w.buf) {
+			if w.err = w.seal(false); w.err != nil {
+				return n - len(p), w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// seal writes the buffered bytes as a block.
+func (w *encryptWriter) seal(last bool) error {
+	if w.block == ^uint32(0) {
+		return errors.New("lshensemble: encrypted index too large")
+	}
+	binary.BigEndian.PutUint32(w.nonce[8:], w.block)
+	w.block++
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+	w.sealed = w.aead.Seal(w.sealed[:0], w.nonce, w.buf, ad)
+	w.buf = w.buf[:0]
+	enc := encoder{}
+	enc.int(len(w.sealed))
+	if _, err := w.w.Write(enc.buf); err != nil {
+		return err
+	}
+	_, err := w.w.Write(w.sealed)
+	return err
+}
+
+// Close writes the last block.
+func (w *encryptWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.err = w.seal(true); w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("lshensemble: encrypt writer closed")
+	return w.w.Flush()
+}
+
+// decryptReader opens the blocks read.
+type decryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	block uint32
+	buf   []byte
+	last  bool
+}
+
+// NewDecryptReader returns a reader of the bytes written by
+// NewEncryptWriter to r, decrypted block by block with the data key of
+// keys. The reads return an error wrapping ErrCorruptIndex if a block was
+// altered or the bytes were truncated.
+func NewDecryptReader(r io.Reader, keys KeyProvider) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(encryptedMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != encryptedMagic {
+		return nil, fmt.Errorf("%w: not encrypted", ErrCorruptIndex)
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, ErrCorruptIndex
+	}
+	if version != encryptedVersion {
+		return nil, fmt.Errorf("lshensemble: unsupported encryption format version %d", version)
+	}
+	wrapped, err := readSegment(br)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys.DataKey(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	dr := &decryptReader{r: br, aead: aead, nonce: make([]byte, aead.NonceSize())}
+	if _, err := io.ReadFull(br, dr.nonce[:8]); err != nil {
+		return nil, ErrCorruptIndex
+	}
+	return dr, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next block.
+func (r *decryptReader) open() error {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil || n > encryptedBlockSize+uint64(r.aead.Overhead()) {
+		return fmt.Errorf("%w: invalid encrypted block %d", ErrCorruptIndex, r.block)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return fmt.Errorf("%w: truncated encrypted block %d", ErrCorruptIndex, r.block)
+	}
+	binary.BigEndian.PutUint32(r.nonce[8:], r.block)
+	// A failed Open clears its output, so the block is not opened in place
+	buf, err := r.aead.Open(r.buf[:0], r.nonce, sealed, []byte{0})
+	if err != nil {
+		if buf, err = r.aead.Open(r.buf[:0], r.nonce, sealed, []byte{1}); err != nil {
+			return fmt.Errorf("%w: cannot decrypt block %d", ErrCorruptIndex, r.block)
+		}
+		r.last = true
+	}
+	r.block++
+	r.buf = buf
+	return nil
+}
+
+// SaveEncrypted is like Save, but encrypts the index with a new data key
+// of keys.
+func (e *LshEnsemble) SaveEncrypted(w io.Writer, keys KeyProvider) error {
+	ew, err := NewEncryptWriter(w, keys)
+	if err != nil {
+		return err
+	}
+	if err := e.Save(ew); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// LoadEncrypted reads an index written by SaveEncrypted from r,
+// decrypting it as it is decoded.
+func LoadEncrypted(r io.Reader, keys KeyProvider) (*LshEnsemble, error) {
+	dr, err := NewDecryptReader(r, keys)
+	if err != nil {
+		return nil, err
+	}
+	return Load(dr)
+}
+
+// MapSharedEncrypted is like MapShared, for a file written by SaveShared
+// through NewEncryptWriter: the file is mapped and decrypted block by
+// block into memory, so the index decrypted is never written to disk, but
+// its memory is not shared by the processes.
+func MapSharedEncrypted(path string, keys KeyProvider) (*SharedIndex, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unmap(data)
+	dr, err := NewDecryptReader(bytes.NewReader(data), keys)
+	if err != nil {
+		return nil, err
+	}
+	var plain bytes.Buffer
+	if _, err := plain.ReadFrom(dr); err != nil {
+		return nil, err
+	}
+	e, sections, err := parseShared(plain.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	unmapped := func([]byte) error { return nil }
+	return &SharedIndex{LshEnsemble: e, data: plain.Bytes(), unmap: unmapped, sections: sections}, nil
+}
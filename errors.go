@@ -0,0 +1,45 @@
+package lshensemble
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the error-returning variants of the constructors
+// and methods, whose names end with E. The returned errors wrap them
+// with the details, and can be checked using errors.Is.
+var (
+	// ErrInvalidParameter is returned for invalid index parameters.
+	ErrInvalidParameter = errors.New("lshensemble: invalid parameter")
+	// ErrInvalidSignature is returned for signatures too short for the
+	// index, or buffers that are not serialized signatures.
+	ErrInvalidSignature = errors.New("lshensemble: invalid signature")
+	// ErrPartitionOutOfRange is returned for partition indexes out of
+	// the range of the partitions.
+	ErrPartitionOutOfRange = errors.New("lshensemble: partition index out of range")
+	// ErrDuplicateKey is returned when adding a key already in an index
+	// with the RejectDuplicates policy.
+	ErrDuplicateKey = errors.New("lshensemble: duplicate key")
+	// ErrFrozenIndex is returned when adding domains to a frozen index.
+	ErrFrozenIndex = errors.New("lshensemble: index is frozen")
+	// ErrQueryRejected is returned for queries rejected by an
+	// AdmissionController.
+	ErrQueryRejected = errors.New("lshensemble: query rejected")
+	// ErrInvalidRecord is returned for domain records with an empty key,
+	// a size that is not positive or a signature too short for the index.
+	ErrInvalidRecord = errors.New("lshensemble: invalid domain record")
+	// ErrEmptyDomain is returned when adding a domain of at most one
+	// value to an index with the RejectEmptyDomains policy.
+	ErrEmptyDomain = errors.New("lshensemble: empty domain")
+)
+
+func invalidParameter(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidParameter, fmt.Sprintf(format, args...))
+}
+
+func checkSignature(sig Signature, length int) error {
+	if len(sig) < length {
+		return fmt.Errorf("%w: %d hash values, need %d", ErrInvalidSignature, len(sig), length)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package lshensemble
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// EstimateOptions controls the sampling of EstimateCandidates.
+type EstimateOptions struct {
+	// Samples is the number of candidates sampled, 100 by default and
+	// at least 2 per partition probed. If there are fewer matches than
+	// samples, the count is exact.
+	Samples int
+	// Confidence is the confidence level of the interval,
+	// 0.95 by default.
+	Confidence float64
+	// Rand is the source of the samples. By default the top-level
+	// functions of math/rand are used.
+	Rand *rand.Rand
+}
+
+// Estimate is an estimated number of candidates with its confidence interval.
+type Estimate struct {
+	Count float64
+	Lower float64
+	Upper float64
+	// Exact is true if Count is the exact number of candidates.
+	Exact bool
+}
+
+// sampledBand is a band probed by a query in a partition, with the
+// cumulative numbers of keys of its matched buckets, counted once the
+// band is sampled.
+type sampledBand struct {
+	r   tableRange
+	cum []int
+}
+
+// matches returns the number of keys of the matched buckets.
+func (b *sampledBand) matches() int {
+	if b.cum == nil {
+		b.cum = make([]int, 0, b.r.end-b.r.start)
+		var n int
+		for bucket := b.r.start; bucket < b.r.end; bucket++ {
+			n += b.r.t.bucketLen(bucket)
+			b.cum = append(b.cum, n)
+		}
+	}
+	if len(b.cum) == 0 {
+		return 0
+	}
+	return b.cum[len(b.cum)-1]
+}
+
+// key returns the j-th key of the matched buckets.
+func (b *sampledBand) key(j int) string {
+	i := sort.Search(len(b.cum), func(i int) bool { return b.cum[i] > j })
+	if i > 0 {
+		j -= b.cum[i-1]
+	}
+	return b.r.t.key(b.r.start+i, j)
+}
+
+// EstimateCandidates estimates the number of candidate domains Query
+// would return, without enumerating them, for analytics such as how many
+// domains likely contain the query domain. Keys indexed in multiple
+// partitions are counted once per partition.
+//
+// The samples are spread evenly over the partitions probed, and the
+// candidates of a partition are sampled in two stages: a band uniformly
+// among its B bands probed, then a key uniformly among the m keys of the
+// buckets the band matched. A candidate x matched c_x times in the
+// partition contributes 1/c_x to its count, so the mean over the samples
+// of B*m/c_x is an unbiased estimate of the number of distinct candidates
+// of the partition. Only the buckets of the bands sampled are counted,
+// and the candidates are counted exactly if there are at most as many
+// matches as samples.
+func (e *LshEnsemble) EstimateCandidates(sig Signature, size int, threshold float64, opts *EstimateOptions) Estimate {
+	if opts == nil {
+		opts = &EstimateOptions{}
+	}
+	samples := opts.Samples
+	if samples <= 0 {
+		samples = 100
+	}
+	confidence := opts.Confidence
+	if confidence <= 0 || confidence >= 1 {
+		confidence = 0.95
+	}
+	int63n := rand.Int63n
+	if opts.Rand != nil {
+		int63n = opts.Rand.Int63n
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	params := e.optimalParams(size, threshold, Supersets)
+	matched := make([][]tableRange, len(e.lshes))
+	probed := make([][]*sampledBand, len(e.lshes))
+	var parts, total int
+	for i, lsh := range e.lshes {
+		if params[i].l == 0 {
+			continue
+		}
+		f, K := lsh.forest(params[i].k)
+		matched[i] = f.matches(sig, K, params[i].l)
+		for _, r := range matched[i] {
+			probed[i] = append(probed[i], &sampledBand{r: r})
+			// The matches are only counted up to the samples
+			for b := r.start; b < r.end && total <= samples; b++ {
+				total += r.t.bucketLen(b)
+			}
+		}
+		if len(probed[i]) > 0 {
+			parts++
+		}
+	}
+	if total <= samples {
+		var count int
+		for _, bands := range matched {
+			seen := make(map[string]bool)
+			for _, r := range bands {
+				for b := r.start; b < r.end; b++ {
+					r.t.scan(b, func(key string) bool {
+						seen[key] = true
+						return true
+					})
+				}
+			}
+			count += len(seen)
+		}
+		c := float64(count)
+		return Estimate{Count: c, Lower: c, Upper: c, Exact: true}
+	}
+
+	// The samples are spread over the partitions, whose bands match
+	// similar numbers of keys, and their estimates summed
+	var count, variance float64
+	var sampled int
+	for i, bands := range probed {
+		if len(bands) == 0 {
+			continue
+		}
+		n := samples / parts
+		if sampled < samples%parts {
+			n++
+		}
+		if n < 2 {
+			n = 2
+		}
+		sampled++
+		var sum, sumSq float64
+		for s := 0; s < n; s++ {
+			b := bands[int63n(int64(len(bands)))]
+			var y float64
+			if m := b.matches(); m > 0 {
+				key := b.key(int(int63n(int64(m))))
+				y = float64(len(bands)) * float64(m) / float64(countMatches(matched[i], key))
+			}
+			sum += y
+			sumSq += y * y
+		}
+		mean := sum / float64(n)
+		count += mean
+		if v := (sumSq - sum*mean) / float64(n-1); v > 0 {
+			variance += v / float64(n)
+		}
+	}
+	half := math.Sqrt2 * math.Erfinv(confidence) * math.Sqrt(variance)
+	return Estimate{
+		Count: count,
+		Lower: math.Max(count-half, 0),
+		Upper: count + half,
+	}
+}
+
+// countSamples is the number of candidates sampled by CountCandidates.
+const countSamples = 256
+
+// CountCandidates returns the approximate number of candidate domains
+// Query would return, for the queries whose answer is just how many: the
+// matches of countSamples bands sampled are corrected for the domains
+// matched in several bands, as by EstimateCandidates, so the cost grows
+// with the number of bands probed and the buckets matched in the bands
+// sampled instead of the number of candidates. The count is exact if
+// there are at most countSamples matches.
+func (e *LshEnsemble) CountCandidates(sig Signature, size int, threshold float64) int {
+	est := e.EstimateCandidates(sig, size, threshold, &EstimateOptions{Samples: countSamples})
+	return int(math.Round(est.Count))
+}
+
+// countMatches returns the number of times key is matched in the bands.
+func countMatches(bands []tableRange, key string) int {
+	var c int
+	for _, r := range bands {
+		c += r.count(key)
+	}
+	return c
+}
@@ -0,0 +1,146 @@
+package lshensemble
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func Test_EstimateCandidates(t *testing.T) {
+	recs := randomDomains(1000, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	q := recs[500]
+	result, _ := index.Query(q.Signature, q.Size, 0.1)
+	exact := float64(len(result))
+
+	est := index.EstimateCandidates(q.Signature, q.Size, 0.1, &EstimateOptions{
+		Samples: 1 << 20,
+	})
+	if !est.Exact || est.Count != exact {
+		t.Fatal(est, exact)
+	}
+	est = index.EstimateCandidates(q.Signature, q.Size, 0.1, &EstimateOptions{
+		Samples:    200,
+		Confidence: 0.999,
+		Rand:       rand.New(rand.NewSource(1)),
+	})
+	if est.Exact || est.Lower > exact || est.Upper < exact {
+		t.Fatal(est, exact)
+	}
+	// A single sample still has a confidence interval
+	est = index.EstimateCandidates(q.Signature, q.Size, 0.1, &EstimateOptions{Samples: 1})
+	if math.IsNaN(est.Lower) || math.IsNaN(est.Upper) {
+		t.Fatal(est)
+	}
+}
+
+func Test_QueryBandEstimates(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := NewLshEnsemble([]Partition{{0, 100}, {101, 300}, {301, 1000}}, 64, 4)
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	for _, rec := range recs[:20] {
+		estimates := index.QueryBandEstimates(rec.Signature, rec.Size, 0.5, 0)
+		if len(estimates) == 0 {
+			t.Fatal("no estimates", rec.Key)
+		}
+		var found bool
+		for _, est := range estimates {
+			if est.Lower > est.Containment || est.Containment > est.Upper || est.Matches > est.L {
+				t.Fatalf("%+v", est)
+			}
+			if est.Key == rec.Key {
+				found = true
+				if est.Matches != est.L || est.Containment != 1 || est.Upper != 1 || est.Lower >= 1 {
+					t.Fatalf("%+v", est)
+				}
+			}
+		}
+		if !found {
+			t.Fatal("domain not found", rec.Key)
+		}
+	}
+}
+
+func Test_QueryPostings(t *testing.T) {
+	recs := randomDomains(500, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	for _, q := range recs[:20] {
+		result, _ := index.Query(q.Signature, q.Size, 0.5)
+		postings := index.QueryPostings(q.Signature, q.Size, 0.5)
+		seen := make(map[string]bool)
+		var found bool
+		for _, p := range postings {
+			var n int
+			p.Scan(func(key string) bool {
+				if p.Count(key) == 0 {
+					t.Fatal("key not counted", key)
+				}
+				seen[key] = true
+				found = found || key == q.Key
+				n++
+				return true
+			})
+			if n != p.Len() {
+				t.Fatal(n, p.Len())
+			}
+			for b := 0; b < p.Buckets(); b++ {
+				if p.BucketLen(b) > 0 && !seen[p.Key(b, p.BucketLen(b)-1)] {
+					t.Fatal("key not scanned")
+				}
+			}
+		}
+		if !found {
+			t.Fatal("domain not found", q.Key)
+		}
+		unique := make(map[string]bool)
+		for _, key := range result {
+			unique[key] = true
+		}
+		if len(seen) != len(unique) {
+			t.Fatal(len(seen), len(unique))
+		}
+	}
+}
+
+func Test_CountCandidates(t *testing.T) {
+	recs := randomDomains(1000, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	for _, q := range recs[:50] {
+		for _, threshold := range []float64{0.1, 0.9} {
+			result, _ := index.Query(q.Signature, q.Size, threshold)
+			count := index.CountCandidates(q.Signature, q.Size, threshold)
+			if diff := count - len(result); diff > len(result)/2 || -diff > len(result)/2 {
+				t.Fatal(q.Key, threshold, count, len(result))
+			}
+		}
+	}
+}
+
+func Test_Calibrator(t *testing.T) {
+	index := NewLshEnsemble([]Partition{{0, 100}, {101, 300}, {301, 1000}}, 64, 4)
+	r := rand.New(rand.NewSource(1))
+	loose := index.NewCalibrator(0.5, 0.5)
+	strict := index.NewCalibrator(0.5, 0.9)
+	if cal := strict.Calibrate(); cal.Threshold != 0.5 || cal.Relevant != 0 {
+		t.Fatalf("%+v", cal)
+	}
+	for i := 0; i < 200; i++ {
+		o := Observation{
+			QuerySize:   50 * (1 + r.Intn(2)),
+			Size:        100 + r.Intn(200),
+			Containment: r.Float64(),
+		}
+		loose.Observe(o)
+		strict.Observe(o)
+	}
+	l, s := loose.Calibrate(), strict.Calibrate()
+	if s.Observations != 200 || s.Relevant == 0 || s.Recall < 0.9 || s.Precision <= 0 || s.Precision > 1 {
+		t.Fatalf("%+v", s)
+	}
+	if s.Threshold >= 0.5 || l.Threshold < s.Threshold || l.Recall < 0.5 {
+		t.Fatalf("%+v %+v", l, s)
+	}
+}
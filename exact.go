@@ -0,0 +1,147 @@
+package lshensemble
+
+import (
+	"sort"
+	"time"
+)
+
+// ExactIndex is an exact containment index over the values of the domains,
+// for validating the results of LshEnsemble, and for corpora small enough
+// not to need the approximation. It is queried like LshEnsemble, with the
+// values of the query domain instead of its signature, and returns no
+// false positives nor false negatives.
+// Domains are represented as map[string]bool, whose keys are distinct values.
+type ExactIndex struct {
+	records map[string]*DomainRecord
+	values  map[string]map[string]bool
+	// postings are the keys of the domains having every value.
+	postings map[string][]string
+}
+
+// NewExactIndex returns an empty exact containment index.
+func NewExactIndex() *ExactIndex {
+	return &ExactIndex{
+		records:  make(map[string]*DomainRecord),
+		values:   make(map[string]map[string]bool),
+		postings: make(map[string][]string),
+	}
+}
+
+// Add adds the domain of the record, with its values. The signature of the
+// record is not used, and its size is the number of values.
+// A key added twice replaces the domain.
+func (x *ExactIndex) Add(rec *DomainRecord, values map[string]bool) {
+	if _, exist := x.values[rec.Key]; exist {
+		x.remove(rec.Key)
+	}
+	x.records[rec.Key] = &DomainRecord{Key: rec.Key, Size: len(values), Signature: rec.Signature}
+	x.values[rec.Key] = values
+	for v := range values {
+		x.postings[v] = append(x.postings[v], rec.Key)
+	}
+}
+
+func (x *ExactIndex) remove(key string) {
+	for v := range x.values[key] {
+		x.postings[v] = without(x.postings[v], key)
+		if len(x.postings[v]) == 0 {
+			delete(x.postings, v)
+		}
+	}
+	delete(x.values, key)
+	delete(x.records, key)
+}
+
+// Query returns the domains containing the query domain, i.e. the domains
+// X such that |Q ∩ X| / |Q| is no less than the threshold, sorted by key,
+// as well as the running time.
+func (x *ExactIndex) Query(values map[string]bool, threshold float64) ([]string, time.Duration) {
+	start := time.Now()
+	return x.query(values, threshold, Supersets), time.Since(start)
+}
+
+// QuerySubsets is the reverse of Query: it returns the domains contained
+// in the query domain, i.e. the domains X such that |Q ∩ X| / |X| is no
+// less than the threshold.
+func (x *ExactIndex) QuerySubsets(values map[string]bool, threshold float64) ([]string, time.Duration) {
+	start := time.Now()
+	return x.query(values, threshold, Subsets), time.Since(start)
+}
+
+// QueryByKey is like QueryByKey of LshEnsemble, using the values of the
+// domain of key as the query domain. It returns ErrKeyNotRetained if the
+// key was not added.
+func (x *ExactIndex) QueryByKey(key string, threshold float64, dir Direction) ([]string, error) {
+	values, exist := x.values[key]
+	if !exist {
+		return nil, ErrKeyNotRetained
+	}
+	return without(x.query(values, threshold, dir), key), nil
+}
+
+// AllPairs is like AllPairs of LshEnsemble, for the domains added. It
+// writes to out every pair of keys whose containment is no less than the
+// threshold.
+func (x *ExactIndex) AllPairs(threshold float64, out chan<- Pair) error {
+	keys := make([]string, 0, len(x.values))
+	for key := range x.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		candidates, err := x.QueryByKey(key, threshold, Supersets)
+		if err != nil {
+			return err
+		}
+		for _, candidate := range candidates {
+			out <- Pair{Query: key, Candidate: candidate}
+		}
+	}
+	return nil
+}
+
+// Containment returns the containment |Q ∩ X| / |Q| of the domain of
+// query in the domain of key, both of which must have been added.
+func (x *ExactIndex) Containment(query, key string) float64 {
+	q, d := x.values[query], x.values[key]
+	if len(q) == 0 {
+		return 0
+	}
+	var overlap int
+	for v := range q {
+		if d[v] {
+			overlap++
+		}
+	}
+	return float64(overlap) / float64(len(q))
+}
+
+// query returns the keys of the domains whose containment in the
+// direction is no less than the threshold, sorted.
+func (x *ExactIndex) query(values map[string]bool, threshold float64, dir Direction) []string {
+	overlaps := make(map[string]int)
+	for v := range values {
+		for _, key := range x.postings[v] {
+			overlaps[key]++
+		}
+	}
+	result := make([]string, 0)
+	if threshold <= 0 {
+		// Every domain is contained, with or without overlap
+		for key := range x.records {
+			result = append(result, key)
+		}
+	} else {
+		for key, overlap := range overlaps {
+			size := len(values)
+			if dir == Subsets {
+				size = x.records[key].Size
+			}
+			if float64(overlap)/float64(size) >= threshold {
+				result = append(result, key)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,51 @@
+package lshensemble
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func Test_ExactIndex(t *testing.T) {
+	set := func(from, to int) map[string]bool {
+		values := make(map[string]bool)
+		for v := from; v < to; v++ {
+			values["value"+strconv.Itoa(v)] = true
+		}
+		return values
+	}
+	domains := map[string]map[string]bool{
+		"a": set(0, 100),
+		"b": set(0, 50),
+		"c": set(40, 200),
+		"d": set(500, 600),
+	}
+	index := NewExactIndex()
+	for key, values := range domains {
+		index.Add(&DomainRecord{Key: key}, values)
+	}
+	if got, _ := index.Query(set(0, 50), 1.0); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatal(got)
+	}
+	if got, _ := index.QuerySubsets(set(0, 100), 1.0); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatal(got)
+	}
+	if got, _ := index.QueryByKey("a", 0.6, Supersets); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Fatal(got)
+	}
+	if got, _ := index.QueryByKey("b", 0.5, Subsets); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatal(got)
+	}
+	if _, err := index.QueryByKey("x", 0.5, Supersets); err != ErrKeyNotRetained {
+		t.Fatal(err)
+	}
+	if c := index.Containment("b", "c"); c != 0.2 {
+		t.Fatal(c)
+	}
+	// Replace the domain of d
+	index.Add(&DomainRecord{Key: "d"}, set(0, 10))
+	if got, _ := index.Query(set(500, 600), 0.1); len(got) != 0 {
+		t.Fatal(got)
+	}
+
+}
@@ -0,0 +1,43 @@
+package lshensemble
+
+import (
+	"math"
+	"sync"
+)
+
+// Exclude returns a stage of QueryPipeline of the index removing the
+// results which are candidates of a second query, of the exclusion domain
+// of the signature and size, e.g. to find the columns similar to a column
+// A but not dominated by the values of a column B, excluded in the
+// Subsets direction. The results whose domains were retained by AddDomain
+// are removed if their containments estimated from their signatures in
+// the direction, as by Verify, are at least the threshold; the others if
+// they are candidates of the query of the exclusion domain, run once by
+// the stage, so they may be false positives.
+// The stage must run within QueryPipeline of the index.
+func (e *LshEnsemble) Exclude(sig Signature, size int, threshold float64, dir Direction) Stage {
+	var once sync.Once
+	var excluded map[string]bool
+	// minus returns the candidates of the query of the exclusion domain
+	minus := func() map[string]bool {
+		once.Do(func() {
+			excluded = make(map[string]bool)
+			keys := make(chan string)
+			go func() {
+				e.query(sig, size, e.optimalParams(size, threshold, dir), &QueryOptions{Direction: dir}, keys)
+				close(keys)
+			}()
+			for key := range keys {
+				excluded[key] = true
+			}
+		})
+		return excluded
+	}
+	return Filter(func(r Result) bool {
+		c := e.verified(sig, size, dir, r.Key).Containment
+		if math.IsNaN(c) {
+			return !minus()[r.Key]
+		}
+		return c < threshold
+	})
+}
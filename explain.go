@@ -0,0 +1,158 @@
+package lshensemble
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Explanation describes how a query was answered by every partition, for
+// finding out why a domain was or was not a candidate.
+type Explanation struct {
+	Size      int
+	Threshold float64
+	Direction Direction
+	// Partitions are the explanations of the partitions, in order.
+	Partitions []PartitionExplanation
+	// Candidates are the candidate domains the query returns.
+	Candidates []string
+}
+
+// PartitionExplanation describes how a query was answered by a partition.
+type PartitionExplanation struct {
+	Partition Partition
+	// Skipped is the reason why the partition was not probed, or empty
+	// if it was.
+	Skipped string
+	// K and L are the parameters of the LSH probed: the number of hash
+	// functions per band and the number of bands.
+	K, L int
+	// Bands are the bands probed.
+	Bands []BandExplanation
+	// Candidates are the candidates contributed by the partition, and
+	// Filtered the number of candidates whose retained domains are
+	// outside the size bounds of the query.
+	Candidates []string
+	Filtered   int
+}
+
+// BandExplanation describes a band probed by a query.
+type BandExplanation struct {
+	// Buckets is the number of buckets hit in the hash table of the
+	// band, and Keys the number of keys in them.
+	Buckets int
+	Keys    int
+}
+
+// Explain runs a query like QueryStream, without the admission controller
+// and the query cache, and explains how every partition answered it.
+// opts.Buffer and opts.Done are ignored.
+func (e *LshEnsemble) Explain(sig Signature, size int, threshold float64, opts *QueryOptions) *Explanation {
+	if opts == nil {
+		opts = &QueryOptions{}
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	x := &Explanation{
+		Size:       size,
+		Threshold:  threshold,
+		Direction:  opts.Direction,
+		Partitions: make([]PartitionExplanation, len(e.Partitions)),
+		Candidates: make([]string, 0),
+	}
+	params := e.optimalParams(size, threshold, opts.Direction)
+	if opts.Threshold != nil {
+		params = e.partitionParams(size, opts.Threshold, opts.Direction)
+	}
+	lower, upper := opts.sizeBounds(size)
+	selected := opts.selected(len(e.Partitions))
+	seen := newKeySet(opts.DedupWindow)
+	for i, p := range e.Partitions {
+		px := &x.Partitions[i]
+		px.Partition = p
+		th := threshold
+		if opts.Threshold != nil {
+			th = opts.Threshold(p.Upper)
+		}
+		switch {
+		case selected != nil && !selected[i]:
+			px.Skipped = "not selected"
+		case !withinBounds(p, i == len(e.Partitions)-1, lower, upper):
+			px.Skipped = "outside the size bounds"
+		case !feasible(p, i == len(e.Partitions)-1, size, th, opts.Direction):
+			px.Skipped = "domains too small to contain the query domain"
+			if opts.Direction == Subsets {
+				px.Skipped = "domains too large to be contained in the query domain"
+			}
+		case params[i].l == 0:
+			px.Skipped = "no LSH parameters for the threshold"
+		}
+		if px.Skipped != "" {
+			continue
+		}
+		px.K, px.L = params[i].k, params[i].l
+		f, K := e.lshes[i].forest(params[i].k)
+		partSeen := make(map[string]bool)
+		for _, r := range f.matches(sig, K, params[i].l) {
+			px.Bands = append(px.Bands, BandExplanation{Buckets: r.end - r.start, Keys: r.size()})
+			for b := r.start; b < r.end; b++ {
+				r.t.scan(b, func(key string) bool {
+					if partSeen[key] {
+						return true
+					}
+					partSeen[key] = true
+					if rec, exist := e.record(key); exist && (rec.Size < lower || rec.Size > upper) {
+						px.Filtered++
+						return true
+					}
+					px.Candidates = append(px.Candidates, key)
+					if !opts.Dedup || seen.add(key) {
+						x.Candidates = append(x.Candidates, key)
+					}
+					return true
+				})
+			}
+		}
+	}
+	return x
+}
+
+// Partition returns the indexes of the partitions contributing key as a
+// candidate.
+func (x *Explanation) Partition(key string) []int {
+	var parts []int
+	for i, px := range x.Partitions {
+		for _, candidate := range px.Candidates {
+			if candidate == key {
+				parts = append(parts, i)
+				break
+			}
+		}
+	}
+	return parts
+}
+
+// String formats the explanation as a report, with a line per partition.
+func (x *Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "query of size %d, threshold %v, direction %v: %d candidates\n",
+		x.Size, x.Threshold, x.Direction, len(x.Candidates))
+	for i, px := range x.Partitions {
+		fmt.Fprintf(&b, "partition %d [%d, %d]: ", i, px.Partition.Lower, px.Partition.Upper)
+		if px.Skipped != "" {
+			fmt.Fprintf(&b, "skipped, %s\n", px.Skipped)
+			continue
+		}
+		var buckets, keys int
+		for _, band := range px.Bands {
+			buckets += band.Buckets
+			keys += band.Keys
+		}
+		fmt.Fprintf(&b, "K=%d L=%d, %d buckets hit with %d keys, %d candidates",
+			px.K, px.L, buckets, keys, len(px.Candidates))
+		if px.Filtered > 0 {
+			fmt.Fprintf(&b, ", %d filtered by size", px.Filtered)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
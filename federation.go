@@ -0,0 +1,94 @@
+package lshensemble
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Member is an index queried by a Federator.
+type Member struct {
+	// Name identifies the index in the results.
+	Name  string
+	Index *LshEnsemble
+	// Seed is the seed of the MinHash signatures of the index, computed
+	// by NewMinhash with the number of hash functions of the index.
+	Seed int
+	// Signature, if set, computes the signature of the distinct values of
+	// the query instead, e.g. with NewSparkMinhash for an index built by
+	// a Spark job.
+	Signature func(values [][]byte) Signature
+	// Threshold, if set, converts the threshold of the federated query to
+	// the threshold of the index, e.g. to a lower threshold for an index
+	// of sampled domains to keep its recall.
+	Threshold func(threshold float64) float64
+}
+
+// FederatedResult is a candidate domain of a federated query.
+type FederatedResult struct {
+	Member string
+	Key    string
+}
+
+// Federator queries several indexes built with different parameters, e.g.
+// a legacy index per data source with its own seed and number of hash
+// functions, as one index. The query is given the values of the query
+// domain, from which the signature of every index is computed, and the
+// results of the indexes are merged.
+type Federator struct {
+	members []Member
+}
+
+// NewFederator returns a federator of the indexes.
+func NewFederator(members ...Member) *Federator {
+	return &Federator{members: members}
+}
+
+// Query returns the candidate domains of every index containing the
+// domain of the distinct values, in the order of the members, e.g. to
+// verify them with the indexes. It returns the first error of the
+// indexes, wrapped with the name of the member.
+func (f *Federator) Query(values [][]byte, threshold float64) ([]FederatedResult, error) {
+	// The signatures of the members sharing a seed and number of
+	// hash functions are computed once
+	type sigParams struct{ seed, numHash int }
+	sigs := make(map[sigParams]Signature)
+	results := make([][]string, len(f.members))
+	errs := make([]error, len(f.members))
+	var wg sync.WaitGroup
+	for i, m := range f.members {
+		var sig Signature
+		if m.Signature != nil {
+			sig = m.Signature(values)
+		} else {
+			params := sigParams{m.Seed, m.Index.NumHash()}
+			if sig = sigs[params]; sig == nil {
+				mh := NewMinhash(m.Seed, params.numHash)
+				for _, v := range values {
+					mh.Push(v)
+				}
+				sig = mh.Signature()
+				sigs[params] = sig
+			}
+		}
+		t := threshold
+		if m.Threshold != nil {
+			t = m.Threshold(threshold)
+		}
+		wg.Add(1)
+		go func(i int, index *LshEnsemble, sig Signature, t float64) {
+			defer wg.Done()
+			results[i], _, errs[i] = index.QueryE(sig, len(values), t)
+		}(i, m.Index, sig, t)
+	}
+	wg.Wait()
+	var merged []FederatedResult
+	for i, m := range f.members {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%s: %w", m.Name, errs[i])
+		}
+		for _, key := range results[i] {
+			merged = append(merged, FederatedResult{Member: m.Name, Key: key})
+		}
+	}
+	return merged, nil
+}
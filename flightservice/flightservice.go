@@ -0,0 +1,168 @@
+//go:build flight
+// +build flight
+
+// Package flightservice serves an lshensemble index over Arrow Flight, for
+// bulk-uploading domain signatures and streaming query results from data
+// engineering stacks where Arrow Flight is the norm.
+// It is only built with the "flight" build tag.
+//
+// Domains are uploaded with DoPut as record batches of DomainSchema, and
+// are made searchable at the end of every upload. Queries are sent with
+// DoExchange as record batches of QuerySchema, and the candidates of the
+// queries are streamed back as record batches of ResultSchema.
+package flightservice
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/flight"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+var (
+	// DomainSchema is the schema of the domains uploaded: their keys,
+	// sizes and MinHash signatures.
+	DomainSchema = arrow.NewSchema([]arrow.Field{
+		{Name: "key", Type: arrow.BinaryTypes.String},
+		{Name: "size", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "signature", Type: arrow.ListOf(arrow.PrimitiveTypes.Uint64)},
+	}, nil)
+	// QuerySchema is the schema of the queries: the keys identifying the
+	// queries in the results, the sizes and MinHash signatures of the
+	// query domains, and the containment thresholds.
+	QuerySchema = arrow.NewSchema([]arrow.Field{
+		{Name: "key", Type: arrow.BinaryTypes.String},
+		{Name: "size", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "signature", Type: arrow.ListOf(arrow.PrimitiveTypes.Uint64)},
+		{Name: "threshold", Type: arrow.PrimitiveTypes.Float64},
+	}, nil)
+	// ResultSchema is the schema of the results: the key of a query and
+	// the key of one of its candidates.
+	ResultSchema = arrow.NewSchema([]arrow.Field{
+		{Name: "query", Type: arrow.BinaryTypes.String},
+		{Name: "candidate", Type: arrow.BinaryTypes.String},
+	}, nil)
+)
+
+// Server is an Arrow Flight service of an index.
+type Server struct {
+	flight.BaseFlightServer
+	Index *lshensemble.LshEnsemble
+	// BatchSize is the number of results per record batch streamed,
+	// 4096 by default.
+	BatchSize int
+	Alloc     memory.Allocator
+}
+
+// New returns a Server of the index.
+func New(index *lshensemble.LshEnsemble) *Server {
+	return &Server{
+		Index:     index,
+		BatchSize: 4096,
+		Alloc:     memory.DefaultAllocator,
+	}
+}
+
+// DoPut adds the domains of the record batches to the index, using
+// AddDomain so they can be queried by key, and indexes them at the end of
+// the stream.
+func (s *Server) DoPut(stream flight.FlightService_DoPutServer) error {
+	r, err := flight.NewRecordReader(stream)
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+	if !r.Schema().Equal(DomainSchema) {
+		return fmt.Errorf("flightservice: unexpected schema %s", r.Schema())
+	}
+	for r.Next() {
+		rec := r.Record()
+		keys := rec.Column(0).(*array.String)
+		sizes := rec.Column(1).(*array.Int64)
+		sigs := rec.Column(2).(*array.List)
+		for i := 0; i < int(rec.NumRows()); i++ {
+			size := int(sizes.Value(i))
+			s.Index.AddDomain(&lshensemble.DomainRecord{
+				Key:       keys.Value(i),
+				Size:      size,
+				Signature: signature(sigs, i),
+			}, s.Index.PartitionIndex(size))
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	s.Index.Index()
+	return nil
+}
+
+// DoExchange answers the queries of the record batches, and streams
+// their candidates in record batches of ResultSchema.
+func (s *Server) DoExchange(stream flight.FlightService_DoExchangeServer) error {
+	r, err := flight.NewRecordReader(stream)
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+	if !r.Schema().Equal(QuerySchema) {
+		return fmt.Errorf("flightservice: unexpected schema %s", r.Schema())
+	}
+	w := flight.NewRecordWriter(stream, ipc.WithSchema(ResultSchema), ipc.WithAllocator(s.Alloc))
+	defer w.Close()
+	b := array.NewRecordBuilder(s.Alloc, ResultSchema)
+	defer b.Release()
+	queries := b.Field(0).(*array.StringBuilder)
+	candidates := b.Field(1).(*array.StringBuilder)
+	var n int
+	flush := func() error {
+		rec := b.NewRecord()
+		defer rec.Release()
+		n = 0
+		return w.Write(rec)
+	}
+	for r.Next() {
+		rec := r.Record()
+		keys := rec.Column(0).(*array.String)
+		sizes := rec.Column(1).(*array.Int64)
+		sigs := rec.Column(2).(*array.List)
+		thresholds := rec.Column(3).(*array.Float64)
+		for i := 0; i < int(rec.NumRows()); i++ {
+			result, _, err := s.Index.QueryE(signature(sigs, i), int(sizes.Value(i)), thresholds.Value(i))
+			if err != nil {
+				return err
+			}
+			for _, key := range result {
+				queries.Append(keys.Value(i))
+				candidates.Append(key)
+				if n++; n >= s.BatchSize {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	if n > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// signature returns the signature in row i of a list column.
+func signature(sigs *array.List, i int) lshensemble.Signature {
+	values := sigs.ListValues().(*array.Uint64)
+	start, end := sigs.ValueOffsets(i)
+	sig := make(lshensemble.Signature, end-start)
+	for j := range sig {
+		sig[j] = values.Value(int(start) + j)
+	}
+	return sig
+}
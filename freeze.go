@@ -0,0 +1,160 @@
+package lshensemble
+
+import (
+	"sort"
+)
+
+// Freeze returns an immutable copy of the index for read-heavy
+// deployments, which supports all the queries but no Add.
+// The hash tables of the copy are flattened into arrays, with the keys
+// stored once per partition and referenced by ids, delta-compressed
+// within every bucket, so it uses less memory and has better cache
+// locality than the index.
+// The domains added to the index since the last Index() are not copied.
+// It panics if a hash table holds 2^32 keys or more.
+func (e *LshEnsemble) Freeze() *LshEnsemble {
+	return e.freeze((*LshForest).freeze)
+}
+
+// freeze returns an immutable copy of the index, with the forests frozen
+// by freezeForest.
+func (e *LshEnsemble) freeze(freezeForest func(*LshForest) *LshForest) *LshEnsemble {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	lshes := make([]Lsh, len(e.lshes))
+	for i, lsh := range e.lshes {
+		switch lsh := resolveLsh(lsh).(type) {
+		case *LshForest:
+			lshes[i] = freezeForest(lsh)
+		case *LshForestArray:
+			array := make([]*LshForest, len(lsh.array))
+			for k, f := range lsh.array {
+				array[k] = freezeForest(f)
+			}
+			lshes[i] = &LshForestArray{
+				maxK:    lsh.maxK,
+				numHash: lsh.numHash,
+				array:   array,
+			}
+		default:
+			panic("lshensemble: cannot freeze Lsh")
+		}
+	}
+	var domains map[string]*DomainRecord
+	if e.domains != nil {
+		domains = make(map[string]*DomainRecord, len(e.domains))
+		for key, rec := range e.domains {
+			domains[key] = rec
+		}
+	}
+	parts := make([]Partition, len(e.Partitions))
+	copy(parts, e.Partitions)
+	return &LshEnsemble{
+		Partitions: parts,
+		lshes:      lshes,
+		maxK:       e.maxK,
+		numHash:    e.numHash,
+		// The optimal parameters are the same
+		paramCache:    e.paramCache,
+		admission:     e.admission,
+		domains:       domains,
+		sizes:         e.sizes,
+		isolated:      copyRecords(e.isolated),
+		signatures:    e.signatures,
+		audit:         e.audit,
+		blooms:        cloneBlooms(e.blooms),
+		deterministic: e.deterministic,
+		sequential:    e.sequential,
+		parallelism:   e.parallelism,
+		partitioner:   e.partitioner,
+		cache:         newQueryCache(e.cache.cachedOptions()),
+		generation:    e.generation,
+		numa:          e.numa,
+		progress:      e.progress,
+		groupBy:       e.groupBy,
+		frozen:        true,
+	}
+}
+
+// freeze returns a frozen copy of the forest.
+func (f *LshForest) freeze() *LshForest {
+	// Assign the ids in the order of the keys, so the postings sorted
+	// by ids are sorted by keys.
+	ids := make(map[string]uint32)
+	for i := 0; i < f.l; i++ {
+		t := f.table(i)
+		for b := 0; b < t.buckets(); b++ {
+			t.scan(b, func(key string) bool {
+				ids[key] = 0
+				return true
+			})
+		}
+	}
+	sorted := make([]string, 0, len(ids))
+	for key := range ids {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	dict := &keyDict{offsets: make([]uint32, 1, len(sorted)+1)}
+	var size int
+	for _, key := range sorted {
+		size += len(key)
+	}
+	data := make([]byte, 0, size)
+	for id, key := range sorted {
+		ids[key] = checkedUint32(id)
+		data = append(data, key...)
+		dict.offsets = append(dict.offsets, checkedUint32(len(data)))
+	}
+	dict.data = string(data)
+
+	keySize := f.keySize()
+	frozen := make([]*frozenTable, f.l)
+	for i := range frozen {
+		t := f.table(i)
+		ft := &frozenTable{
+			keySize:  keySize,
+			hashKeys: make([]byte, 0, t.buckets()*keySize),
+			offsets:  make([]uint32, 1, t.buckets()+1),
+			dict:     dict,
+		}
+		postings := encoder{}
+		var bucketIds []uint32
+		for b := 0; b < t.buckets(); b++ {
+			ft.hashKeys = append(ft.hashKeys, t.bucketKey(b)...)
+			bucketIds = bucketIds[:0]
+			t.scan(b, func(key string) bool {
+				bucketIds = append(bucketIds, ids[key])
+				return true
+			})
+			postings.postings(bucketIds)
+			ft.offsets = append(ft.offsets, checkedUint32(len(postings.buf)))
+			// The sub-buckets are immutable, so they are shared
+			if split := splitOf(t, b); split != nil {
+				if ft.splits == nil {
+					ft.splits = make(map[int]hashTable)
+				}
+				ft.splits[b] = split
+			}
+		}
+		ft.postings = postings.buf
+		frozen[i] = ft
+	}
+	return &LshForest{
+		k:             f.k,
+		l:             f.l,
+		hashKeyFuncs:  f.hashKeyFuncs,
+		hashValueSize: f.hashValueSize,
+		hashValueBits: f.hashValueBits,
+		trim:          f.trim,
+		split:         f.split,
+		frozen:        frozen,
+	}
+}
+
+func checkedUint32(v int) uint32 {
+	if uint64(v) > 1<<32-1 {
+		panic("lshensemble: hash table too large to freeze")
+	}
+	return uint32(v)
+}
@@ -0,0 +1,234 @@
+package lshensemble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_Freeze(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	for _, index := range []*LshEnsemble{
+		BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs)),
+		BootstrapLshEnsemblePlus(4, 64, 4, len(recs), Recs2Chan(recs)),
+	} {
+		frozen := index.Freeze()
+		sameResults(t, index, frozen, recs)
+		if anomalies := frozen.CheckIntegrity(true); len(anomalies) != 0 {
+			t.Fatal(anomalies)
+		}
+		rec := recs[0]
+		est := frozen.EstimateCandidates(rec.Signature, rec.Size, 0.5,
+			&EstimateOptions{Rand: rand.New(rand.NewSource(1))})
+		want := index.EstimateCandidates(rec.Signature, rec.Size, 0.5,
+			&EstimateOptions{Rand: rand.New(rand.NewSource(1))})
+		if est != want {
+			t.Errorf("estimate %v, want %v", est, want)
+		}
+		if err := frozen.AddE("new", rec.Signature, 0); !errors.Is(err, ErrFrozenIndex) {
+			t.Errorf("AddE: %v", err)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Add did not panic")
+				}
+			}()
+			frozen.Add("new", rec.Signature, 0)
+		}()
+
+		var buf bytes.Buffer
+		if err := frozen.Save(&buf); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := Load(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameResults(t, index, loaded, recs)
+	}
+}
+
+func Test_FreezeCompact(t *testing.T) {
+	recs := randomDomains(1000, 64, 1)
+	for _, index := range []*LshEnsemble{
+		BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs)),
+		BootstrapLshEnsemblePlus(4, 64, 4, len(recs), Recs2Chan(recs)),
+	} {
+		frozen := index.Freeze()
+		compact := index.FreezeCompact()
+		sameResults(t, index, compact, recs)
+		if anomalies := compact.CheckIntegrity(true); len(anomalies) != 0 {
+			t.Fatal(anomalies)
+		}
+		var frozenSize, compactSize int
+		for i, lsh := range compact.lshes {
+			forests := lshForests(frozen.lshes[i])
+			for j, f := range lshForests(lsh) {
+				for x, ft := range f.frozen {
+					want := forests[j].frozen[x]
+					frozenSize += len(want.hashKeys) + 4*len(want.offsets)
+					compactSize += ft.compact.size()
+					for b := 0; b < want.buckets(); b++ {
+						if ft.bucketKey(b) != want.bucketKey(b) || ft.bucketLen(b) != want.bucketLen(b) {
+							t.Fatal("bucket", b)
+						}
+					}
+				}
+			}
+		}
+		if compactSize >= frozenSize {
+			t.Errorf("compact tables of %d bytes, frozen tables of %d bytes", compactSize, frozenSize)
+		}
+		var buf bytes.Buffer
+		if err := compact.SaveShared(&buf); err != nil {
+			t.Fatal(err)
+		}
+		shared, err := ParseShared(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameResults(t, index, shared, recs)
+	}
+}
+
+func Test_CompactKeys(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 2, 100, 1000} {
+		const keySize = 8
+		keys := make([]string, n)
+		for i := range keys {
+			b := make([]byte, keySize)
+			r.Read(b)
+			if i > 0 && r.Intn(4) == 0 {
+				// Hash keys sharing a prefix
+				copy(b, keys[i-1][:r.Intn(keySize)])
+			}
+			keys[i] = string(b)
+		}
+		sort.Strings(keys)
+		ft := &frozenTable{
+			keySize:  keySize,
+			hashKeys: []byte(strings.Join(keys, "")),
+			offsets:  make([]uint32, n+1),
+		}
+		for i := range ft.offsets {
+			ft.offsets[i] = uint32(i * r.Intn(5))
+			if i > 0 && ft.offsets[i] < ft.offsets[i-1] {
+				ft.offsets[i] = ft.offsets[i-1]
+			}
+		}
+		c := &compactTable{keys: newCompactKeys(ft.hashKeys, keySize), offsets: newEliasFano(ft.offsets)}
+		for i, v := range ft.offsets {
+			if got := c.offsets.get(i); got != v {
+				t.Fatal(n, i, got, v)
+			}
+		}
+		for i, key := range keys {
+			if got := string(c.keys.key(i, make([]byte, keySize))); got != key {
+				t.Fatal(n, i)
+			}
+		}
+		for x := 0; x < 100; x++ {
+			prefix := string([]byte{byte(r.Intn(256))})
+			if n > 0 {
+				prefix = keys[r.Intn(n)][:r.Intn(keySize+1)]
+			}
+			s1, e1 := ft.search(prefix)
+			s2, e2 := c.keys.search(prefix)
+			if s1 != s2 || e1 != e2 {
+				t.Fatal(n, []byte(prefix), s1, e1, s2, e2)
+			}
+		}
+	}
+}
+
+func Test_FrozenPostings(t *testing.T) {
+	f := NewLshForest(2, 1)
+	var ht hashTable
+	for b, n := range []int{1, 64, 65, 300} {
+		var ks keys
+		for j := 0; j < n; j++ {
+			// Popular keys are in several buckets
+			ks = append(ks, fmt.Sprintf("key%05d", j*(b+1)))
+		}
+		ht = append(ht, bucket{hashKey: fmt.Sprintf("hashkey%d", b), keys: ks})
+	}
+	f.hashTables[0] = ht
+	frozen := f.freeze().table(0)
+	for b := range ht {
+		if frozen.bucketLen(b) != len(ht[b].keys) {
+			t.Fatal(b, frozen.bucketLen(b))
+		}
+		var scanned keys
+		frozen.scan(b, func(key string) bool {
+			scanned = append(scanned, key)
+			return true
+		})
+		if !reflect.DeepEqual(scanned, ht[b].keys) {
+			t.Fatal(b, scanned)
+		}
+		for j, key := range ht[b].keys {
+			if got := frozen.key(b, j); got != key {
+				t.Fatalf("bucket %d key %d: got %s, want %s", b, j, got, key)
+			}
+		}
+	}
+}
+
+func Test_MapShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lshensemble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recs := randomDomains(200, 64, 1)
+	for i, index := range []*LshEnsemble{
+		BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs)),
+		BootstrapLshEnsemblePlus(4, 64, 4, len(recs), Recs2Chan(recs)),
+	} {
+		var buf bytes.Buffer
+		if err := index.SaveShared(&buf); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		path := filepath.Join(dir, fmt.Sprint("index", i))
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		shared, err := MapShared(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameResults(t, index, shared.LshEnsemble, recs)
+		if err := shared.AddE("new", recs[0].Signature, 0); !errors.Is(err, ErrFrozenIndex) {
+			t.Errorf("AddE: %v", err)
+		}
+		rec := recs[0]
+		result, _ := shared.Query(rec.Signature, rec.Size, 0.5)
+		if err := shared.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// The keys returned remain valid once the file is unmapped
+		found := false
+		for _, key := range result {
+			found = found || key == rec.Key
+		}
+		if !found {
+			t.Fatal(rec.Key, result)
+		}
+		for n := 0; n < len(data); n += 1 + n/8 {
+			if _, err := ParseShared(data[:n]); err == nil {
+				t.Fatal("truncated index parsed", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package lshensemble
+
+// fuzzIndex parses data as a persisted index and queries it,
+// returning whether data is an index. It is shared by the fuzz tests
+// and the go-fuzz harnesses.
+func fuzzIndex(data []byte) bool {
+	e, err := ParseIndex(data)
+	if err != nil {
+		return false
+	}
+	// Bound the signature allocated for the query
+	if e.numHash > 1<<12 {
+		return true
+	}
+	sig := make(Signature, e.numHash)
+	for i := range sig {
+		if i < len(data) {
+			sig[i] = uint64(data[i])
+		}
+	}
+	e.QueryE(sig, len(data), 0.5)
+	e.QuerySubsets(sig, len(data), 0.5)
+	e.EstimateCandidates(sig, len(data), 0.5, nil)
+	e.CheckIntegrity(false)
+	return true
+}
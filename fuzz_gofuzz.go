@@ -0,0 +1,27 @@
+//go:build gofuzz
+// +build gofuzz
+
+package lshensemble
+
+// Harnesses for go-fuzz, which can also be built for libFuzzer using
+// go-fuzz-build -libfuzzer. Run with, e.g.:
+//
+//	go-fuzz-build -func FuzzIndex
+//	go-fuzz -func FuzzIndex
+
+// FuzzSignature fuzzes the signature deserialization.
+func FuzzSignature(data []byte) int {
+	if _, err := DeserializeSignatureE(data); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzIndex fuzzes the parsing of persisted indexes and the queries of
+// the indexes parsed.
+func FuzzIndex(data []byte) int {
+	if !fuzzIndex(data) {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package lshensemble
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDeserializeSignature(f *testing.F) {
+	f.Add(SerializeSignature(randomSignature(4, 1)))
+	f.Add([]byte{1, 2, 3})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sig, err := DeserializeSignatureE(data)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(SerializeSignature(sig), data) {
+			t.Fatal("signature does not round trip")
+		}
+	})
+}
+
+func FuzzParseIndex(f *testing.F) {
+	recs := randomDomains(20, 16, 1)
+	for _, plus := range []bool{false, true} {
+		var index *LshEnsemble
+		if plus {
+			index = BootstrapLshEnsemblePlus(2, 16, 4, len(recs), Recs2Chan(recs))
+		} else {
+			index = BootstrapLshEnsemble(2, 16, 4, len(recs), Recs2Chan(recs))
+		}
+		data, err := index.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzIndex(data)
+	})
+}
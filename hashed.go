@@ -0,0 +1,121 @@
+package lshensemble
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bandKey returns the hash key of band t of the forest f of a partition,
+// whose bands are numbered n across the forests of the partition.
+type bandKey func(n int, f *LshForest, t int) string
+
+// signatureBand computes the hash keys of the bands from the signature.
+func signatureBand(sig Signature) bandKey {
+	return func(_ int, f *LshForest, t int) string {
+		return f.hashKeyFuncs[t](sig[t*f.k : (t+1)*f.k])
+	}
+}
+
+// precomputedBand returns the hash keys given to AddHashed.
+func precomputedBand(bandKeys [][]byte) bandKey {
+	return func(n int, _ *LshForest, _ int) string {
+		return string(bandKeys[n])
+	}
+}
+
+// BandKeys returns the hash keys of the bands of the signature in the
+// forest, one per band. The hash key of a band is its k hash values,
+// salted with the band if the trim scheme has SaltBands set, trimmed to
+// the hash value size by the trim scheme, and written in little-endian
+// order, so pipelines can compute it upstream.
+func (f *LshForest) BandKeys(sig Signature) [][]byte {
+	bandKeys := make([][]byte, f.l)
+	for t := range bandKeys {
+		bandKeys[t] = []byte(f.hashKeyFuncs[t](sig[t*f.k : (t+1)*f.k]))
+	}
+	return bandKeys
+}
+
+// AddHashed is like Add, but is given the hash keys of the bands of the
+// key, computed as by BandKeys, instead of its signature, bypassing the
+// hashing of the signature.
+// It returns an error if the number or the lengths of the hash keys do
+// not match the bands of the forest.
+func (f *LshForest) AddHashed(key string, bandKeys [][]byte) error {
+	if f.frozen != nil {
+		return ErrFrozenIndex
+	}
+	if err := checkBandKeys([]*LshForest{f}, bandKeys); err != nil {
+		return err
+	}
+	for t, ht := range f.initHashTables {
+		hk := string(bandKeys[t])
+		ht[hk] = append(ht[hk], key)
+	}
+	return nil
+}
+
+// BandKeys returns the hash keys of the bands of the signature in the
+// partition, for AddHashed: the hash keys of every forest of the
+// partition, in the order of their K, as returned by BandKeys of
+// LshForest.
+func (e *LshEnsemble) BandKeys(sig Signature, partInd int) ([][]byte, error) {
+	if partInd < 0 || partInd >= len(e.lshes) {
+		return nil, fmt.Errorf("%w: %d", ErrPartitionOutOfRange, partInd)
+	}
+	if err := checkSignature(sig, e.numHash); err != nil {
+		return nil, err
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	var bandKeys [][]byte
+	for _, f := range lshForests(e.lshes[partInd]) {
+		bandKeys = append(bandKeys, f.BandKeys(sig)...)
+	}
+	return bandKeys, nil
+}
+
+// AddHashed is like AddE, but is given the hash keys of the bands of the
+// key, computed as by BandKeys, instead of its signature, for pipelines
+// computing them externally, e.g. in a Spark job.
+// It returns an error if the number or the lengths of the hash keys do
+// not match the bands of the partition.
+func (e *LshEnsemble) AddHashed(key string, bandKeys [][]byte, partInd int) error {
+	if e.frozen {
+		return ErrFrozenIndex
+	}
+	if partInd < 0 || partInd >= len(e.lshes) {
+		return fmt.Errorf("%w: %d", ErrPartitionOutOfRange, partInd)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := checkBandKeys(lshForests(e.lshes[partInd]), bandKeys); err != nil {
+		return err
+	}
+	_, err := e.add(key, nil, bandKeys, partInd)
+	return err
+}
+
+// checkBandKeys checks that the hash keys are those of the bands of the
+// forests.
+func checkBandKeys(forests []*LshForest, bandKeys [][]byte) error {
+	var n int
+	var lengths []string
+	for _, f := range forests {
+		n += f.l
+		lengths = append(lengths, fmt.Sprintf("%d of %d bytes", f.l, f.keySize()))
+	}
+	if len(bandKeys) != n {
+		return fmt.Errorf("%w: %d band keys, need %s", ErrInvalidSignature, len(bandKeys), strings.Join(lengths, ", "))
+	}
+	n = 0
+	for _, f := range forests {
+		for t := 0; t < f.l; t++ {
+			if len(bandKeys[n]) != f.keySize() {
+				return fmt.Errorf("%w: band key %d of %d bytes, need %d", ErrInvalidSignature, n, len(bandKeys[n]), f.keySize())
+			}
+			n++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package lshensemble
+
+import (
+	"math"
+	"math/bits"
+)
+
+// hyperMinHashMantissa is the number of mantissa bits of the registers
+// of HyperMinHash sketches.
+const hyperMinHashMantissa = 10
+
+// HyperMinHash is a HyperMinHash sketch of a domain, which provides both
+// the estimated cardinality of the domain, as HyperLogLog does, and a
+// signature for indexing, so a single sketch per column is computed.
+// Every value is hashed once into one of numHash registers, which keeps
+// the minimum hash value of the register in a floating point form of
+// 6 exponent and 10 mantissa bits: the number of leading zeros and the
+// bits following them.
+//
+// The empty registers of the signatures of small domains are filled like
+// those of KMV signatures, so the indexes of HyperMinHash signatures
+// should use the SaltBands trim schemes.
+type HyperMinHash struct {
+	seed uint64
+	// registers hold the minimum hash values, encoded so that larger
+	// registers hold smaller values, and 0 for empty registers.
+	registers []uint16
+}
+
+// NewHyperMinHash returns a sketch with numHash registers, whose
+// signatures have numHash values.
+// Sketches are comparable only with the same seed and number of registers.
+func NewHyperMinHash(seed, numHash int) *HyperMinHash {
+	if numHash < 1 {
+		panic("lshensemble: numHash must be positive")
+	}
+	return &HyperMinHash{seed: mix64(uint64(seed)), registers: make([]uint16, numHash)}
+}
+
+// Push adds a value to the domain.
+func (h *HyperMinHash) Push(v []byte) {
+	x := seededHash(v, h.seed)
+	reg := x % uint64(len(h.registers))
+	// The bits of the value independent of the register
+	w := mix64(x)
+	lz := bits.LeadingZeros64(w)
+	if lz > 63-hyperMinHashMantissa {
+		lz = 63 - hyperMinHashMantissa
+	}
+	const mask = 1<<hyperMinHashMantissa - 1
+	mantissa := (w << uint(lz+1)) >> (64 - hyperMinHashMantissa)
+	r := uint16(lz+1)<<hyperMinHashMantissa | uint16(mask-mantissa)
+	if r > h.registers[reg] {
+		h.registers[reg] = r
+	}
+}
+
+// Merge adds the values of the domain of other, sketched with the same
+// seed and number of registers, to the domain of the sketch.
+func (h *HyperMinHash) Merge(other *HyperMinHash) {
+	if len(other.registers) != len(h.registers) {
+		panic("lshensemble: HyperMinHash sketches of different sizes")
+	}
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Cardinality estimates the number of distinct values of the domain
+// using the HyperLogLog estimator, with linear counting for small domains.
+func (h *HyperMinHash) Cardinality() float64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var empty int
+	for _, r := range h.registers {
+		rank := int(r >> hyperMinHashMantissa)
+		if rank == 0 {
+			empty++
+		}
+		sum += math.Exp2(-float64(rank))
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && empty > 0 {
+		estimate = m * math.Log(m/float64(empty))
+	}
+	return estimate
+}
+
+// Jaccard estimates the Jaccard similarity of the domains of two
+// sketches, as the fraction of their non-empty registers that are equal.
+func (h *HyperMinHash) Jaccard(other *HyperMinHash) float64 {
+	var equal, nonEmpty int
+	for i, r := range h.registers {
+		if r == 0 && other.registers[i] == 0 {
+			continue
+		}
+		nonEmpty++
+		if r == other.registers[i] {
+			equal++
+		}
+	}
+	if nonEmpty == 0 {
+		return 0
+	}
+	return float64(equal) / float64(nonEmpty)
+}
+
+// Signature returns the signature of the sketch, whose values are equal
+// for two sketches where their registers are.
+func (h *HyperMinHash) Signature() Signature {
+	sig := make(Signature, len(h.registers))
+	filled := make([]bool, len(h.registers))
+	for i, r := range h.registers {
+		sig[i] = math.MaxUint64
+		if r != 0 {
+			// Spread the bits of the registers for trimming
+			sig[i] = mix64(uint64(r))
+			filled[i] = true
+		}
+	}
+	return densify(sig, filled)
+}
+
+// Record returns the record of the domain of the sketch, with its
+// estimated size and its signature.
+func (h *HyperMinHash) Record(key string) *DomainRecord {
+	return &DomainRecord{
+		Key:       key,
+		Size:      int(math.Round(h.Cardinality())),
+		Signature: h.Signature(),
+	}
+}
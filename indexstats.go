@@ -0,0 +1,102 @@
+package lshensemble
+
+import (
+	"expvar"
+	"math/bits"
+)
+
+// IndexStats are the statistics of the hash tables of an index, for
+// capacity planning and anomaly detection, e.g. of exploding hash key
+// collisions.
+type IndexStats struct {
+	Partitions []PartitionStats `json:"partitions"`
+}
+
+// PartitionStats are the statistics of a partition of an index.
+type PartitionStats struct {
+	Partition
+	// Keys is the number of keys indexed in the partition, as every key
+	// is in every hash table.
+	Keys int `json:"keys"`
+	// Tiered is true for the partitions of an index loaded by
+	// LoadSnapshotTiered, which are not loaded for the statistics and
+	// have no forests.
+	Tiered  bool          `json:"tiered,omitempty"`
+	Forests []ForestStats `json:"forests,omitempty"`
+}
+
+// ForestStats are the statistics of the hash tables of a forest.
+type ForestStats struct {
+	K      int          `json:"k"`
+	L      int          `json:"l"`
+	Tables []TableStats `json:"tables"`
+}
+
+// TableStats are the statistics of a hash table.
+type TableStats struct {
+	Buckets   int `json:"buckets"`
+	Keys      int `json:"keys"`
+	MaxBucket int `json:"maxBucket"`
+	// BucketSizes is the histogram of the bucket sizes: BucketSizes[i] is
+	// the number of buckets of 2^i to 2^(i+1)-1 keys.
+	BucketSizes []int `json:"bucketSizes"`
+}
+
+// IndexStats returns the statistics of the hash tables of the index. Only
+// the domains made searchable by Index() are counted.
+func (e *LshEnsemble) IndexStats() IndexStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	stats := IndexStats{Partitions: make([]PartitionStats, len(e.lshes))}
+	for i, lsh := range e.lshes {
+		ps := &stats.Partitions[i]
+		if i < len(e.Partitions) {
+			ps.Partition = e.Partitions[i]
+		}
+		if _, tiered := lsh.(*tieredLsh); tiered {
+			ps.Tiered = true
+			continue
+		}
+		for _, f := range lshForests(lsh) {
+			fs := ForestStats{K: f.k, L: f.l, Tables: make([]TableStats, f.l)}
+			for x := range fs.Tables {
+				fs.Tables[x] = tableStats(f.table(x))
+			}
+			if len(fs.Tables) > 0 {
+				ps.Keys = fs.Tables[0].Keys
+			}
+			ps.Forests = append(ps.Forests, fs)
+		}
+	}
+	return stats
+}
+
+// tableStats returns the statistics of the hash table.
+func tableStats(t table) TableStats {
+	ts := TableStats{Buckets: t.buckets()}
+	for b := 0; b < t.buckets(); b++ {
+		n := t.bucketLen(b)
+		if n == 0 {
+			continue
+		}
+		ts.Keys += n
+		if n > ts.MaxBucket {
+			ts.MaxBucket = n
+		}
+		i := bits.Len(uint(n)) - 1
+		for len(ts.BucketSizes) <= i {
+			ts.BucketSizes = append(ts.BucketSizes, 0)
+		}
+		ts.BucketSizes[i]++
+	}
+	return ts
+}
+
+// PublishExpvar publishes the IndexStats of the index as the expvar
+// variable name, computed when the variable is read. Like expvar.Publish,
+// it panics if the name is already published.
+func (e *LshEnsemble) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return e.IndexStats()
+	}))
+}
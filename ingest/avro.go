@@ -0,0 +1,57 @@
+//go:build avro
+// +build avro
+
+package ingest
+
+import (
+	"bufio"
+	"os"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+func init() {
+	fileReaders[".avro"] = readAvroFile
+}
+
+// readAvroFile reads the Avro object container files of records, whose
+// columns are the fields of the records. The values of the union fields
+// are the values of their branches.
+// It is only built with the "avro" build tag.
+func readAvroFile(path string, column func(name string) *columnSketch) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ocf, err := goavro.NewOCFReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	for ocf.Scan() {
+		datum, err := ocf.Read()
+		if err != nil {
+			return err
+		}
+		record, ok := datum.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for name, v := range record {
+			c := column(name)
+			if c == nil {
+				continue
+			}
+			// The non-null values of unions are maps of their type name
+			if union, ok := v.(map[string]interface{}); ok && len(union) == 1 {
+				for _, branch := range union {
+					v = branch
+				}
+			}
+			if b := valueBytes(v); len(b) > 0 {
+				c.push(b)
+			}
+		}
+	}
+	return ocf.Err()
+}
@@ -0,0 +1,168 @@
+package ingest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// CatalogTable is a table listed by a Catalog.
+type CatalogTable struct {
+	Database, Name string
+	Columns        []string
+	// Version changes whenever the table changes, e.g. the time of its
+	// last change.
+	Version string
+}
+
+// key returns the qualified name of the table, and the prefix of the keys
+// of the domains of its columns.
+func (t CatalogTable) key() string {
+	return t.Database + "." + t.Name
+}
+
+// Catalog lists the tables of a warehouse, such as a Hive Metastore or an
+// AWS Glue Data Catalog.
+type Catalog interface {
+	Tables(ctx context.Context) ([]CatalogTable, error)
+}
+
+// CatalogSync keeps an index in sync with the tables of a Catalog: every
+// Sync indexes the columns of the tables new or changed since the last
+// Sync, whose versions are kept in Versions. The domain of a column is
+// keyed by "database.table.column", and the index should replace the
+// domains of the keys added again, with lshensemble.ReplaceDuplicates,
+// so the domains of the changed columns replace the old ones.
+type CatalogSync struct {
+	Catalog Catalog
+	// Source returns the Source of the domains of columns, e.g. an
+	// SQLSource of the warehouse engine.
+	Source func(columns []Column) Source
+	// Indexer indexes the domains, whose OnBatch, if not nil, is still
+	// called.
+	Indexer *Indexer
+	// Versions are the versions of the tables indexed, by their qualified
+	// names, which can be saved with the index and restored to resume the
+	// sync of another process.
+	Versions map[string]string
+}
+
+// SyncStats are the tables of a Sync.
+type SyncStats struct {
+	// Indexed are the tables whose columns were all indexed.
+	Indexed []string
+	// Dropped are the tables of Versions no longer listed, whose domains
+	// are kept in the index.
+	Dropped []string
+}
+
+// Sync indexes the columns of the new and changed tables of the catalog,
+// and records the versions of the tables whose columns were all indexed,
+// including before an error, so the next Sync resumes from them.
+func (s *CatalogSync) Sync(ctx context.Context) (SyncStats, error) {
+	var stats SyncStats
+	tables, err := s.Catalog.Tables(ctx)
+	if err != nil {
+		return stats, err
+	}
+	if s.Versions == nil {
+		s.Versions = make(map[string]string)
+	}
+	listed := make(map[string]bool)
+	var columns []Column
+	// The columns not yet indexed of every changed table, and its version
+	pending := make(map[string]int)
+	versions := make(map[string]string)
+	tableOf := make(map[string]string)
+	for _, t := range tables {
+		name := t.key()
+		listed[name] = true
+		if version, exist := s.Versions[name]; exist && version == t.Version {
+			continue
+		}
+		versions[name] = t.Version
+		if len(t.Columns) == 0 {
+			s.Versions[name] = t.Version
+			stats.Indexed = append(stats.Indexed, name)
+			continue
+		}
+		for _, c := range t.Columns {
+			col := Column{Table: name, Name: c, Key: name + "." + c}
+			columns = append(columns, col)
+			tableOf[col.Key] = name
+			pending[name]++
+		}
+	}
+	for name := range s.Versions {
+		if !listed[name] {
+			delete(s.Versions, name)
+			stats.Dropped = append(stats.Dropped, name)
+		}
+	}
+	sort.Strings(stats.Dropped)
+	if len(columns) == 0 {
+		return stats, nil
+	}
+	ix := *s.Indexer
+	ix.OnBatch = func(keys []string) {
+		for _, key := range keys {
+			name, exist := tableOf[key]
+			if !exist {
+				continue
+			}
+			if pending[name]--; pending[name] == 0 {
+				s.Versions[name] = versions[name]
+				stats.Indexed = append(stats.Indexed, name)
+			}
+		}
+		if s.Indexer.OnBatch != nil {
+			s.Indexer.OnBatch(keys)
+		}
+	}
+	err = ix.Run(s.Source(columns))
+	sort.Strings(stats.Indexed)
+	return stats, err
+}
+
+// hiveMetastoreQuery lists the columns of the tables of a Hive Metastore,
+// with the last DDL times of the tables.
+const hiveMetastoreQuery = `SELECT d.NAME, t.TBL_NAME, c.COLUMN_NAME, COALESCE(p.PARAM_VALUE, '')
+FROM TBLS t
+JOIN DBS d ON t.DB_ID = d.DB_ID
+JOIN SDS s ON t.SD_ID = s.SD_ID
+JOIN COLUMNS_V2 c ON s.CD_ID = c.CD_ID
+LEFT JOIN TABLE_PARAMS p ON p.TBL_ID = t.TBL_ID AND p.PARAM_KEY = 'transient_lastDdlTime'
+ORDER BY d.NAME, t.TBL_NAME, c.INTEGER_IDX`
+
+// HiveCatalog is the Catalog of a Hive Metastore, read from its backing
+// database, e.g. MySQL or PostgreSQL. The version of a table is its last
+// DDL time, which Hive updates when the table is altered or loaded, but
+// not when the files of an external table change.
+type HiveCatalog struct {
+	DB *sql.DB
+}
+
+func (c *HiveCatalog) Tables(ctx context.Context) ([]CatalogTable, error) {
+	rows, err := c.DB.QueryContext(ctx, hiveMetastoreQuery)
+	if err != nil {
+		return nil, fmt.Errorf("ingest: hive metastore: %w", err)
+	}
+	defer rows.Close()
+	var tables []CatalogTable
+	for rows.Next() {
+		var db, table, column, version string
+		if err := rows.Scan(&db, &table, &column, &version); err != nil {
+			return nil, fmt.Errorf("ingest: hive metastore: %w", err)
+		}
+		if n := len(tables); n == 0 || tables[n-1].Database != db || tables[n-1].Name != table {
+			tables = append(tables, CatalogTable{Database: db, Name: table, Version: version})
+		}
+		t := &tables[len(tables)-1]
+		t.Columns = append(t.Columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ingest: hive metastore: %w", err)
+	}
+	return tables, nil
+}
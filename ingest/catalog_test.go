@@ -0,0 +1,79 @@
+package ingest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+func Test_CatalogSync(t *testing.T) {
+	db, err := sql.Open("ingestfake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fakeTables["SELECT DISTINCT name FROM hr.users"] = fakeTables["SELECT DISTINCT name FROM users"]
+	fakeTables["SELECT DISTINCT city FROM hr.users"] = fakeTables["SELECT DISTINCT city FROM users"]
+	fakeTables["SELECT DISTINCT author FROM blog.posts"] = fakeTables["SELECT DISTINCT author FROM posts"]
+	metastore := [][]string{
+		{"blog", "posts", "author", "100"},
+		{"hr", "users", "name", "200"},
+		{"hr", "users", "city", "200"},
+	}
+	fakeQueries[hiveMetastoreQuery] = metastore
+	defer delete(fakeQueries, hiveMetastoreQuery)
+
+	parts := []lshensemble.Partition{{Lower: 0, Upper: 3}, {Lower: 4, Upper: 10}}
+	index, _ := lshensemble.New(lshensemble.WithPartitions(parts), lshensemble.WithNumHash(64),
+		lshensemble.WithDuplicatePolicy(lshensemble.ReplaceDuplicates))
+	var indexed []string
+	s := &CatalogSync{
+		Catalog: &HiveCatalog{DB: db},
+		Source: func(columns []Column) Source {
+			return &SQLSource{DB: db, Columns: columns, Seed: 1, NumHash: 64}
+		},
+		Indexer: &Indexer{
+			Index:     index,
+			BatchSize: 1,
+			OnBatch:   func(keys []string) { indexed = append(indexed, keys...) },
+		},
+	}
+	stats, err := s.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(stats.Indexed) != "[blog.posts hr.users]" || len(indexed) != 3 {
+		t.Fatal(stats, indexed)
+	}
+	if s.Versions["hr.users"] != "200" {
+		t.Fatal(s.Versions)
+	}
+
+	// Only the changed table is indexed again
+	indexed = nil
+	metastore[1][3], metastore[2][3] = "300", "300"
+	fakeQueries[hiveMetastoreQuery] = metastore[1:]
+	stats, err = s.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(stats.Indexed) != "[hr.users]" || fmt.Sprint(stats.Dropped) != "[blog.posts]" || len(indexed) != 2 {
+		t.Fatal(stats, indexed)
+	}
+	stats, err = s.Sync(context.Background())
+	if err != nil || len(stats.Indexed) != 0 {
+		t.Fatal(stats, err)
+	}
+
+	// A table whose columns fail is indexed again by the next sync
+	fakeQueries[hiveMetastoreQuery] = append(metastore[1:], []string{"hr", "salaries", "amount", "1"})
+	if _, err := s.Sync(context.Background()); err == nil {
+		t.Fatal("missing column indexed")
+	}
+	if _, exist := s.Versions["hr.salaries"]; exist {
+		t.Fatal(s.Versions)
+	}
+}
@@ -0,0 +1,265 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+// distinctSketchSize is the number of the smallest hash values of the
+// values of a column kept by DirSource to estimate its size, which is
+// exact for the columns of fewer distinct values.
+const distinctSketchSize = 1024
+
+// DirSource is a Source of the domains of the columns of the CSV, TSV and
+// JSONL files of a directory tree, to find the joinable columns of a data
+// lake: the files with the extensions .csv, .tsv and .jsonl (or .ndjson)
+// are read by Workers at a time, and every column is sketched into the
+// record of the domain of its distinct values, with the key "file:column"
+// of the path of the file relative to Dir. The columns of the CSV and TSV
+// files are named by their first row, and those of the JSONL files are the
+// fields of the objects of their lines.
+// The memory used by a column is bounded, whatever the number of its
+// values: the values are hashed into its MinHash signature, and its size
+// is estimated from the 1024 smallest hash values of its values.
+// The empty and the JSON null values are skipped, and the JSON values
+// other than strings are the JSON texts of the values.
+// The Avro object container files (.avro) are also read when built with
+// the "avro" tag, and the ORC files (.orc) with the "orc" tag.
+type DirSource struct {
+	Dir string
+	// Seed and NumHash are the parameters of the MinHash signatures.
+	Seed, NumHash int
+	// Workers is the number of files read in parallel, 1 if not positive.
+	Workers int
+	// Skip, if not nil, returns whether the column of a key is already
+	// indexed, to resume an interrupted ingestion. The files are read even
+	// if all their columns are skipped.
+	Skip func(key string) bool
+
+	parallelSource
+}
+
+// Next returns the record of the next column sketched, or the first
+// error of walking the directory or reading a file, after which the
+// other files are abandoned.
+func (s *DirSource) Next() (*lshensemble.DomainRecord, error) {
+	return s.next(func() {
+		var files []string
+		err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && fileReaders[strings.ToLower(filepath.Ext(path))] != nil {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			go func() {
+				s.records <- next{nil, err}
+				close(s.records)
+			}()
+			return
+		}
+		s.run(len(files), s.Workers, func(job int, emit func(*lshensemble.DomainRecord, error) bool) {
+			columns, err := s.sketchFile(files[job])
+			if err != nil {
+				emit(nil, fmt.Errorf("ingest: %s: %w", files[job], err))
+				return
+			}
+			for _, c := range columns {
+				if !emit(c.record(), nil) {
+					return
+				}
+			}
+		})
+	})
+}
+
+// fileReader pushes the values of the file at path to the sketches of
+// their columns, returned by column, or nil for the columns skipped.
+type fileReader func(path string, column func(name string) *columnSketch) error
+
+// fileReaders are the readers of the files by their lowercase extensions,
+// to which the readers of the formats built with a tag are added.
+var fileReaders = map[string]fileReader{
+	".csv":    readCSVFile(false),
+	".tsv":    readCSVFile(true),
+	".jsonl":  readJSONLFile,
+	".ndjson": readJSONLFile,
+}
+
+// columnSketch is the sketch of the values of a column.
+type columnSketch struct {
+	key      string
+	mh       *lshensemble.Minhash
+	distinct *lshensemble.BottomK
+	empty    bool
+}
+
+func (c *columnSketch) push(v []byte) {
+	c.mh.Push(v)
+	c.distinct.Push(v)
+	c.empty = false
+}
+
+func (c *columnSketch) record() *lshensemble.DomainRecord {
+	return &lshensemble.DomainRecord{
+		Key:       c.key,
+		Size:      int(math.Round(c.distinct.Sketch().Cardinality())),
+		Signature: c.mh.Signature(),
+	}
+}
+
+// sketchFile returns the sketches of the non-empty columns of the file,
+// in the order of their keys.
+func (s *DirSource) sketchFile(path string) ([]*columnSketch, error) {
+	rel, err := filepath.Rel(s.Dir, path)
+	if err != nil {
+		return nil, err
+	}
+	rel = filepath.ToSlash(rel)
+	columns := make(map[string]*columnSketch)
+	column := func(name string) *columnSketch {
+		c, exist := columns[name]
+		if !exist {
+			c = &columnSketch{key: rel + ":" + name, empty: true}
+			if s.Skip == nil || !s.Skip(c.key) {
+				c.mh = lshensemble.NewMinhash(s.Seed, s.NumHash)
+				c.distinct = lshensemble.NewBottomK(s.Seed, distinctSketchSize)
+			}
+			columns[name] = c
+		}
+		if c.mh == nil {
+			return nil
+		}
+		return c
+	}
+	read := fileReaders[strings.ToLower(filepath.Ext(path))]
+	if err := read(path, column); err != nil {
+		return nil, err
+	}
+	var sketches []*columnSketch
+	for _, c := range columns {
+		if c.mh != nil && !c.empty {
+			sketches = append(sketches, c)
+		}
+	}
+	sort.Slice(sketches, func(i, j int) bool {
+		return sketches[i].key < sketches[j].key
+	})
+	return sketches, nil
+}
+
+// readCSVFile returns the reader of the CSV or TSV files, whose columns
+// are named by their first row.
+func readCSVFile(tsv bool) fileReader {
+	return func(path string, column func(name string) *columnSketch) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return readCSV(bufio.NewReader(f), tsv, column)
+	}
+}
+
+func readCSV(r io.Reader, tsv bool, column func(name string) *columnSketch) error {
+	cr := csv.NewReader(r)
+	if tsv {
+		cr.Comma = '\t'
+	}
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sketches := make([]*columnSketch, len(header))
+	for i, name := range header {
+		sketches[i] = column(name)
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, v := range row {
+			if i < len(sketches) && sketches[i] != nil && v != "" {
+				sketches[i].push([]byte(v))
+			}
+		}
+	}
+}
+
+// readJSONLFile reads the JSONL files, whose columns are the fields of the
+// objects of their lines.
+func readJSONLFile(path string, column func(name string) *columnSketch) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readJSONL(bufio.NewReader(f), column)
+}
+
+func readJSONL(r io.Reader, column func(name string) *columnSketch) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		var object map[string]json.RawMessage
+		if err := dec.Decode(&object); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for name, raw := range object {
+			c := column(name)
+			if c == nil {
+				continue
+			}
+			var str string
+			switch {
+			case string(raw) == "null":
+			case json.Unmarshal(raw, &str) == nil:
+				if str != "" {
+					c.push([]byte(str))
+				}
+			default:
+				c.push(raw)
+			}
+		}
+	}
+}
+
+// valueBytes returns the bytes of a value decoded from a file, the bytes
+// of strings and byte slices and the text of fmt.Sprint for the other
+// values, or nil for the nil values.
+func valueBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	}
+	return []byte(fmt.Sprint(v))
+}
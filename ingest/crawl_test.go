@@ -0,0 +1,102 @@
+package ingest
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+func Test_DirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"users.csv":      "id,name\n1,ann\n2,bob\n3,cid\n3,cid\n4,\n",
+		"sub/posts.tsv":  "author\tlikes\nann\t3\nbob\t\"4\"\n",
+		"events.jsonl":   "{\"user\": \"ann\", \"n\": 1}\n{\"user\": \"cid\", \"n\": null}\n",
+		"notes.txt":      "not a table\n",
+		"sub/empty.csv":  "",
+		"sub/header.csv": "a,b\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sizes := make(map[string]int)
+	src := &DirSource{Dir: dir, Seed: 1, NumHash: 64, Workers: 2}
+	for {
+		rec, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[rec.Key] = rec.Size
+	}
+	want := map[string]int{
+		"users.csv:id":         4,
+		"users.csv:name":       3,
+		"sub/posts.tsv:author": 2,
+		"sub/posts.tsv:likes":  2,
+		"events.jsonl:user":    2,
+		"events.jsonl:n":       1,
+	}
+	if len(sizes) != len(want) {
+		t.Fatal(sizes)
+	}
+	for key, size := range want {
+		if sizes[key] != size {
+			t.Fatal(key, sizes[key], size)
+		}
+	}
+
+	parts := []lshensemble.Partition{{Lower: 0, Upper: 2}, {Lower: 3, Upper: 10}}
+	index := lshensemble.NewLshEnsemble(parts, 64, 4)
+	var indexed []string
+	ix := &Indexer{
+		Index:     index,
+		BatchSize: 10,
+		OnBatch:   func(keys []string) { indexed = append(indexed, keys...) },
+	}
+	src = &DirSource{
+		Dir:     dir,
+		Seed:    1,
+		NumHash: 64,
+		Skip:    func(key string) bool { return key == "users.csv:id" },
+	}
+	if err := ix.Run(src); err != nil {
+		t.Fatal(err)
+	}
+	if len(indexed) != len(want)-1 {
+		t.Fatal(indexed)
+	}
+	mh := lshensemble.NewMinhash(1, 64)
+	for _, v := range []string{"ann", "bob"} {
+		mh.Push([]byte(v))
+	}
+	result, _ := index.Query(mh.Signature(), 2, 1.0)
+	var found bool
+	for _, key := range result {
+		found = found || key == "sub/posts.tsv:author"
+	}
+	if !found {
+		t.Fatal("column not found", result)
+	}
+
+	src = &DirSource{Dir: filepath.Join(dir, "missing"), NumHash: 64}
+	if _, err := src.Next(); err == nil || err == io.EOF {
+		t.Fatal(err)
+	}
+}
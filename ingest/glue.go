@@ -0,0 +1,65 @@
+//go:build glue
+// +build glue
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/glue"
+)
+
+// GlueCatalog is the Catalog of an AWS Glue Data Catalog. The version of
+// a table is its Glue version id, which changes with every update of the
+// table, and the columns of a table include its partition keys.
+// It is only built with the "glue" build tag.
+type GlueCatalog struct {
+	Client *glue.Client
+	// Databases are the databases listed, all the databases if empty.
+	Databases []string
+}
+
+func (c *GlueCatalog) Tables(ctx context.Context) ([]CatalogTable, error) {
+	databases := c.Databases
+	if len(databases) == 0 {
+		p := glue.NewGetDatabasesPaginator(c.Client, &glue.GetDatabasesInput{})
+		for p.HasMorePages() {
+			out, err := p.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("ingest: glue: %w", err)
+			}
+			for _, db := range out.DatabaseList {
+				databases = append(databases, aws.ToString(db.Name))
+			}
+		}
+	}
+	var tables []CatalogTable
+	for _, db := range databases {
+		p := glue.NewGetTablesPaginator(c.Client, &glue.GetTablesInput{DatabaseName: aws.String(db)})
+		for p.HasMorePages() {
+			out, err := p.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("ingest: glue: %w", err)
+			}
+			for _, t := range out.TableList {
+				table := CatalogTable{
+					Database: db,
+					Name:     aws.ToString(t.Name),
+					Version:  aws.ToString(t.VersionId),
+				}
+				if t.StorageDescriptor != nil {
+					for _, col := range t.StorageDescriptor.Columns {
+						table.Columns = append(table.Columns, aws.ToString(col.Name))
+					}
+				}
+				for _, col := range t.PartitionKeys {
+					table.Columns = append(table.Columns, aws.ToString(col.Name))
+				}
+				tables = append(tables, table)
+			}
+		}
+	}
+	return tables, nil
+}
@@ -0,0 +1,135 @@
+// Package ingest feeds domain records from external sources into an
+// LSH Ensemble index, so the index can be updated continuously while
+// it is being queried.
+package ingest
+
+import (
+	"io"
+	"time"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+// Source is a stream of domain records to be indexed.
+type Source interface {
+	// Next returns the next domain record, blocking until one is
+	// available. It returns io.EOF when the source is exhausted.
+	Next() (*lshensemble.DomainRecord, error)
+}
+
+type chanSource chan *lshensemble.DomainRecord
+
+func (c chanSource) Next() (*lshensemble.DomainRecord, error) {
+	rec, ok := <-c
+	if !ok {
+		return nil, io.EOF
+	}
+	return rec, nil
+}
+
+// ChanSource returns a Source reading from a DomainRecord channel,
+// such as the one returned by lshensemble.Recs2Chan.
+func ChanSource(c chan *lshensemble.DomainRecord) Source {
+	return chanSource(c)
+}
+
+// Indexer adds records from a Source to an index in batches,
+// making each batch searchable by calling Index() after it.
+// Records are assigned to partitions by their sizes.
+type Indexer struct {
+	// Index is the index to update.
+	Index *lshensemble.LshEnsemble
+	// BatchSize is the maximum number of records added between two
+	// calls to Index().
+	BatchSize int
+	// FlushInterval, if positive, is the maximum time a record waits
+	// before it becomes searchable, when the batch fills up slowly.
+	FlushInterval time.Duration
+	// OnIndex, if not nil, is called with the number of records
+	// indexed after every batch.
+	OnIndex func(n int)
+	// OnBatch, if not nil, is called with the keys of the records indexed
+	// after every batch, e.g. to record the progress of an ingestion.
+	OnBatch func(keys []string)
+	// OnReject, if not nil, is called with the records rejected by the
+	// AddE of the index, e.g. of short signatures or duplicate keys, and
+	// their errors: Run skips a record if it returns nil, and returns its
+	// error otherwise. If OnReject is nil, Run returns the error of the
+	// first record rejected.
+	OnReject func(rec *lshensemble.DomainRecord, err error) error
+}
+
+type next struct {
+	rec *lshensemble.DomainRecord
+	err error
+}
+
+// Run consumes src until it returns io.EOF or an error, or a record is
+// rejected, as handled by OnReject. The records received so far are
+// indexed before Run returns.
+// A nil error is returned when src is exhausted.
+func (ix *Indexer) Run(src Source) error {
+	records := make(chan next)
+	go func() {
+		for {
+			rec, err := src.Next()
+			records <- next{rec, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	var tick <-chan time.Time
+	if ix.FlushInterval > 0 {
+		ticker := time.NewTicker(ix.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var pending int
+	var keys []string
+	flush := func() {
+		if pending == 0 {
+			return
+		}
+		ix.Index.Index()
+		if ix.OnIndex != nil {
+			ix.OnIndex(pending)
+		}
+		if ix.OnBatch != nil {
+			ix.OnBatch(keys)
+		}
+		pending = 0
+		keys = nil
+	}
+	for {
+		select {
+		case n := <-records:
+			if n.err != nil {
+				flush()
+				if n.err == io.EOF {
+					return nil
+				}
+				return n.err
+			}
+			if err := ix.Index.AddE(n.rec.Key, n.rec.Signature, ix.Index.PartitionIndex(n.rec.Size)); err != nil {
+				if ix.OnReject != nil {
+					err = ix.OnReject(n.rec, err)
+				}
+				if err != nil {
+					flush()
+					return err
+				}
+				continue
+			}
+			pending++
+			if ix.OnBatch != nil {
+				keys = append(keys, n.rec.Key)
+			}
+			if pending >= ix.BatchSize {
+				flush()
+			}
+		case <-tick:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package ingest
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+func randomRecord(key string, size int, seed int64) *lshensemble.DomainRecord {
+	r := rand.New(rand.NewSource(seed))
+	sig := make(lshensemble.Signature, 64)
+	for i := range sig {
+		sig[i] = uint64(r.Int63())
+	}
+	return &lshensemble.DomainRecord{Key: key, Size: size, Signature: sig}
+}
+
+func Test_Message(t *testing.T) {
+	rec := randomRecord("rec", 42, 1)
+	key, value := EncodeMessage(rec)
+	rec2, err := DecodeMessage(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec2.Key != rec.Key || rec2.Size != rec.Size {
+		t.Fatal(rec2)
+	}
+	for i := range rec.Signature {
+		if rec.Signature[i] != rec2.Signature[i] {
+			t.Fatal("signature mismatch")
+		}
+	}
+	if _, err := DecodeMessage(key, value[:len(value)-1]); err != ErrMalformedMessage {
+		t.Fatal(err)
+	}
+}
+
+func Test_Indexer(t *testing.T) {
+	parts := []lshensemble.Partition{{Lower: 0, Upper: 10}, {Lower: 10, Upper: 100}}
+	index := lshensemble.NewLshEnsemble(parts, 64, 4)
+	recs := []*lshensemble.DomainRecord{
+		randomRecord("a", 5, 1),
+		randomRecord("b", 50, 2),
+		randomRecord("c", 500, 3),
+	}
+	var indexed int
+	ix := &Indexer{
+		Index:     index,
+		BatchSize: 2,
+		OnIndex:   func(n int) { indexed += n },
+	}
+	if err := ix.Run(ChanSource(lshensemble.Recs2Chan(recs))); err != nil {
+		t.Fatal(err)
+	}
+	if indexed != len(recs) {
+		t.Fatal(indexed)
+	}
+	for _, rec := range recs {
+		result, _ := index.Query(rec.Signature, rec.Size, 1.0)
+		var found bool
+		for _, key := range result {
+			found = found || key == rec.Key
+		}
+		if !found {
+			t.Fatal("record not indexed", rec.Key)
+		}
+	}
+}
+
+func Test_IndexerReject(t *testing.T) {
+	parts := []lshensemble.Partition{{Lower: 0, Upper: 100}}
+	index, err := lshensemble.New(lshensemble.WithPartitions(parts), lshensemble.WithNumHash(64),
+		lshensemble.WithDuplicatePolicy(lshensemble.RejectDuplicates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := randomRecord("short", 5, 2)
+	short.Signature = short.Signature[:1]
+	recs := []*lshensemble.DomainRecord{randomRecord("a", 5, 1), short, randomRecord("a", 5, 3), randomRecord("b", 5, 4)}
+
+	// The first record rejected stops the indexer
+	ix := &Indexer{Index: index, BatchSize: 10}
+	if err := ix.Run(ChanSource(lshensemble.Recs2Chan(recs))); !errors.Is(err, lshensemble.ErrInvalidSignature) {
+		t.Fatal(err)
+	}
+
+	var rejected []string
+	ix.OnReject = func(rec *lshensemble.DomainRecord, err error) error {
+		rejected = append(rejected, rec.Key)
+		return nil
+	}
+	if err := ix.Run(ChanSource(lshensemble.Recs2Chan(recs[2:]))); err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 1 || rejected[0] != "a" {
+		t.Fatal(rejected)
+	}
+	if result, _ := index.Query(recs[3].Signature, 5, 1.0); len(result) != 1 || result[0] != "b" {
+		t.Fatal(result)
+	}
+}
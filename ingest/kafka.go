@@ -0,0 +1,65 @@
+//go:build kafka
+// +build kafka
+
+package ingest
+
+import (
+	"io"
+
+	"github.com/Shopify/sarama"
+	"github.com/ekzhu/lshensemble"
+)
+
+// KafkaSource is a Source consuming domain records from a partition of
+// a Kafka topic. The messages must be encoded with EncodeMessage.
+// It is only built with the "kafka" build tag.
+type KafkaSource struct {
+	consumer  sarama.Consumer
+	partition sarama.PartitionConsumer
+}
+
+// NewKafkaSource starts consuming the given topic partition from offset,
+// which can also be sarama.OffsetOldest or sarama.OffsetNewest.
+func NewKafkaSource(brokers []string, topic string, partition int32, offset int64) (*KafkaSource, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+	consumer, err := sarama.NewConsumer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := consumer.ConsumePartition(topic, partition, offset)
+	if err != nil {
+		consumer.Close()
+		return nil, err
+	}
+	return &KafkaSource{
+		consumer:  consumer,
+		partition: pc,
+	}, nil
+}
+
+// Next returns the record in the next message. It returns io.EOF
+// once the source is closed.
+func (s *KafkaSource) Next() (*lshensemble.DomainRecord, error) {
+	select {
+	case msg, ok := <-s.partition.Messages():
+		if !ok {
+			return nil, io.EOF
+		}
+		return DecodeMessage(msg.Key, msg.Value)
+	case err, ok := <-s.partition.Errors():
+		if !ok {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+}
+
+// Close stops consuming the topic partition.
+func (s *KafkaSource) Close() error {
+	if err := s.partition.Close(); err != nil {
+		s.consumer.Close()
+		return err
+	}
+	return s.consumer.Close()
+}
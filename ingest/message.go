@@ -0,0 +1,40 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+// ErrMalformedMessage is returned when a message cannot be decoded
+// into a domain record.
+var ErrMalformedMessage = errors.New("ingest: malformed domain record message")
+
+// EncodeMessage serializes a domain record into a message key and value,
+// as expected by DecodeMessage. The key is the domain key, and the value
+// is the domain size as a uvarint followed by the serialized signature.
+func EncodeMessage(rec *lshensemble.DomainRecord) (key, value []byte) {
+	value = make([]byte, binary.MaxVarintLen64+rec.Signature.ByteLen())
+	n := binary.PutUvarint(value, uint64(rec.Size))
+	rec.Signature.Write(value[n:])
+	return []byte(rec.Key), value[:n+rec.Signature.ByteLen()]
+}
+
+// DecodeMessage deserializes a domain record from a message key and
+// value written by EncodeMessage.
+func DecodeMessage(key, value []byte) (*lshensemble.DomainRecord, error) {
+	size, n := binary.Uvarint(value)
+	if n <= 0 || len(key) == 0 {
+		return nil, ErrMalformedMessage
+	}
+	value = value[n:]
+	if len(value) == 0 || len(value)%lshensemble.HashValueSize != 0 {
+		return nil, ErrMalformedMessage
+	}
+	return &lshensemble.DomainRecord{
+		Key:       string(key),
+		Size:      int(size),
+		Signature: lshensemble.DeserializeSignature(value),
+	}, nil
+}
@@ -0,0 +1,46 @@
+//go:build orc
+// +build orc
+
+package ingest
+
+import (
+	"github.com/scritchley/orc"
+)
+
+func init() {
+	fileReaders[".orc"] = readORCFile
+}
+
+// readORCFile reads the ORC files, whose columns are the top-level columns
+// of their schemas, stripe by stripe.
+// It is only built with the "orc" build tag.
+func readORCFile(path string, column func(name string) *columnSketch) error {
+	r, err := orc.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// The rows of the cursor have the selected columns only
+	var selected []string
+	var sketches []*columnSketch
+	for _, name := range r.Schema().Columns() {
+		if c := column(name); c != nil {
+			selected = append(selected, name)
+			sketches = append(sketches, c)
+		}
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+	c := r.Select(selected...)
+	for c.Stripes() {
+		for c.Next() {
+			for i, v := range c.Row() {
+				if b := valueBytes(v); len(b) > 0 {
+					sketches[i].push(b)
+				}
+			}
+		}
+	}
+	return c.Err()
+}
@@ -0,0 +1,79 @@
+package ingest
+
+import (
+	"io"
+	"sync"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+// parallelSource is a Source of the records produced by workers, for the
+// sources sketching several columns at a time.
+type parallelSource struct {
+	once    sync.Once
+	records chan next
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+// next returns the next record produced, or the first error, after which
+// the workers are stopped. The workers are started by start on the first
+// call.
+func (s *parallelSource) next(start func()) (*lshensemble.DomainRecord, error) {
+	s.once.Do(func() {
+		s.records = make(chan next)
+		s.stop = make(chan struct{})
+		start()
+	})
+	n, ok := <-s.records
+	if !ok {
+		return nil, io.EOF
+	}
+	if n.err != nil {
+		s.stopped.Do(func() { close(s.stop) })
+		return nil, n.err
+	}
+	return n.rec, nil
+}
+
+// run calls produce for the jobs 0 to n-1 on the workers, and closes the
+// records once all are done. produce passes its records and errors to
+// emit, which returns false once the workers are stopped.
+func (s *parallelSource) run(n, workers int, produce func(job int, emit func(*lshensemble.DomainRecord, error) bool)) {
+	if workers <= 0 {
+		workers = 1
+	}
+	emit := func(rec *lshensemble.DomainRecord, err error) bool {
+		select {
+		case s.records <- next{rec, err}:
+			return err == nil
+		case <-s.stop:
+			return false
+		}
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				produce(job, emit)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for job := 0; job < n; job++ {
+			select {
+			case jobs <- job:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(s.records)
+	}()
+}
@@ -0,0 +1,108 @@
+package ingest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+// Column is a column of a SQL database whose distinct values are a domain.
+type Column struct {
+	// Table and Name are the table and the name of the column, used as
+	// is in the query, so they must be quoted if needed by the database.
+	Table, Name string
+	// Query, if not empty, replaces the query of the distinct values of
+	// the column, e.g. for a dialect or a filter. It must return a single
+	// column.
+	Query string
+	// Key is the key of the domain, "Table.Name" if empty.
+	Key string
+}
+
+func (c Column) key() string {
+	if c.Key != "" {
+		return c.Key
+	}
+	return c.Table + "." + c.Name
+}
+
+func (c Column) query() string {
+	if c.Query != "" {
+		return c.Query
+	}
+	return fmt.Sprintf("SELECT DISTINCT %s FROM %s", c.Name, c.Table)
+}
+
+// SQLSource is a Source of the domains of the columns of a SQL database,
+// the bootstrap of data discovery in a database: the distinct values of
+// every column are streamed from the database and sketched into a domain
+// record, by Workers columns at a time. The NULL values are skipped, and
+// the other values are hashed as the bytes scanned by database/sql.
+// The records are returned in the order the columns are sketched.
+type SQLSource struct {
+	DB      *sql.DB
+	Columns []Column
+	// Seed and NumHash are the parameters of the MinHash signatures.
+	Seed, NumHash int
+	// SampleRate, if in (0, 1), is the rate at which the values are
+	// sampled, using a Sampler.
+	SampleRate float64
+	// Workers is the number of columns sketched in parallel, 1 if not
+	// positive.
+	Workers int
+	// Skip, if not nil, returns whether the column of a key is already
+	// indexed, to resume an interrupted ingestion, e.g. from the keys
+	// recorded by the OnBatch of the Indexer of the previous run.
+	Skip func(key string) bool
+	// Context, if not nil, cancels the queries.
+	Context context.Context
+
+	parallelSource
+}
+
+// Next returns the record of the next column sketched, or the first
+// error of a query, after which the other columns are abandoned.
+func (s *SQLSource) Next() (*lshensemble.DomainRecord, error) {
+	return s.next(func() {
+		s.run(len(s.Columns), s.Workers, func(job int, emit func(*lshensemble.DomainRecord, error) bool) {
+			c := s.Columns[job]
+			if s.Skip != nil && s.Skip(c.key()) {
+				return
+			}
+			emit(s.sketch(c))
+		})
+	})
+}
+
+// sketch returns the domain record of the distinct values of the column.
+func (s *SQLSource) sketch(c Column) (*lshensemble.DomainRecord, error) {
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	rows, err := s.DB.QueryContext(ctx, c.query())
+	if err != nil {
+		return nil, fmt.Errorf("ingest: column %s: %w", c.key(), err)
+	}
+	defer rows.Close()
+	var sampler *lshensemble.Sampler
+	if s.SampleRate > 0 && s.SampleRate < 1 {
+		sampler = lshensemble.NewSampler(s.SampleRate, s.Seed)
+	}
+	b := lshensemble.NewDomainBuilder(c.key(), s.Seed, s.NumHash, sampler)
+	var v sql.RawBytes
+	for rows.Next() {
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("ingest: column %s: %w", c.key(), err)
+		}
+		if v != nil {
+			b.Push(v)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ingest: column %s: %w", c.key(), err)
+	}
+	return b.Record(), nil
+}
@@ -0,0 +1,155 @@
+package ingest
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+// fakeDriver serves the queries of the distinct values of the columns of
+// fakeTables, "SELECT DISTINCT column FROM table".
+type fakeDriver struct{}
+
+var fakeTables = map[string][]string{
+	"SELECT DISTINCT name FROM users":   {"ann", "bob", "cid", "dan"},
+	"SELECT DISTINCT author FROM posts": {"ann", "bob", "cid"},
+	"SELECT DISTINCT city FROM users":   {"paris", "rome"},
+}
+
+func (fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+// fakeQueries are the rows of the other queries.
+var fakeQueries = map[string][][]string{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if rows, exist := fakeQueries[query]; exist {
+		return fakeStmt(rows), nil
+	}
+	values, exist := fakeTables[query]
+	if !exist {
+		return nil, errors.New("no such column")
+	}
+	rows := make([][]string, len(values))
+	for i, v := range values {
+		rows[i] = []string{v}
+	}
+	return fakeStmt(rows), nil
+}
+func (fakeConn) Close() error              { return nil }
+func (fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+type fakeStmt [][]string
+
+func (s fakeStmt) Close() error                               { return nil }
+func (s fakeStmt) NumInput() int                              { return 0 }
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) { return nil, errors.New("read-only") }
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error)  { return &fakeRows{rows: s}, nil }
+
+type fakeRows struct {
+	rows [][]string
+	i    int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{"value"}
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i == len(r.rows) {
+		return io.EOF
+	}
+	for j, v := range r.rows[r.i] {
+		dest[j] = []byte(v)
+	}
+	r.i++
+	return nil
+}
+
+func init() {
+	sql.Register("ingestfake", fakeDriver{})
+}
+
+func Test_SQLSource(t *testing.T) {
+	db, err := sql.Open("ingestfake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	columns := []Column{
+		{Table: "users", Name: "name"},
+		{Table: "posts", Name: "author"},
+		{Table: "users", Name: "city", Key: "city"},
+	}
+	parts := []lshensemble.Partition{{Lower: 0, Upper: 3}, {Lower: 4, Upper: 10}}
+	index := lshensemble.NewLshEnsemble(parts, 64, 4)
+	indexed := make(map[string]bool)
+	ix := &Indexer{
+		Index:     index,
+		BatchSize: 1,
+		OnBatch: func(keys []string) {
+			for _, key := range keys {
+				indexed[key] = true
+			}
+		},
+	}
+	src := &SQLSource{DB: db, Columns: columns[:2], Seed: 1, NumHash: 64, Workers: 2}
+	if err := ix.Run(src); err != nil {
+		t.Fatal(err)
+	}
+	if !indexed["users.name"] || !indexed["posts.author"] {
+		t.Fatal(indexed)
+	}
+	// Resume with all the columns
+	var sketched []string
+	src = &SQLSource{
+		DB:      db,
+		Columns: columns,
+		Seed:    1,
+		NumHash: 64,
+		Skip:    func(key string) bool { return indexed[key] },
+	}
+	for {
+		rec, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sketched = append(sketched, rec.Key)
+		if rec.Size != 2 {
+			t.Fatal(rec.Size)
+		}
+	}
+	if fmt.Sprint(sketched) != "[city]" {
+		t.Fatal(sketched)
+	}
+
+	mh := lshensemble.NewMinhash(1, 64)
+	for _, v := range fakeTables["SELECT DISTINCT name FROM users"] {
+		mh.Push([]byte(v))
+	}
+	result, _ := index.Query(mh.Signature(), 4, 1.0)
+	var found bool
+	for _, key := range result {
+		found = found || key == "users.name"
+	}
+	if !found {
+		t.Fatal("column not found", result)
+	}
+
+	src = &SQLSource{DB: db, Columns: []Column{{Table: "users", Name: "age"}}, NumHash: 64}
+	if err := ix.Run(src); err == nil {
+		t.Fatal("missing column indexed")
+	}
+}
@@ -0,0 +1,215 @@
+package lshensemble
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Anomaly is a problem found in an index by CheckIntegrity.
+type Anomaly struct {
+	// Partition is the index of the partition with the anomaly,
+	// or -1 for the whole index.
+	Partition   int
+	Description string
+	// Repaired is true if the anomaly was repaired.
+	Repaired bool
+}
+
+func (a Anomaly) String() string {
+	s := a.Description
+	if a.Partition >= 0 {
+		s = fmt.Sprintf("partition %d: %s", a.Partition, s)
+	}
+	if a.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// CheckIntegrity validates the index, and returns the anomalies found:
+// hash tables or buckets out of order, hash keys of the wrong length,
+// keys not indexed in every hash table, partitions out of order, and
+// retained domains outside the size bounds of their partition.
+// If repair is true, the anomalies that can be repaired are: hash tables
+// and buckets are sorted, and the partition bounds are widened to the
+// sizes of their retained domains.
+func (e *LshEnsemble) CheckIntegrity(repair bool) []Anomaly {
+	if repair {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.generation++
+	} else {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+	}
+	var anomalies []Anomaly
+	report := func(part int, repaired bool, format string, args ...interface{}) {
+		anomalies = append(anomalies, Anomaly{
+			Partition:   part,
+			Description: fmt.Sprintf(format, args...),
+			Repaired:    repaired,
+		})
+	}
+	if len(e.lshes) != len(e.Partitions) {
+		report(-1, false, "%d LSHs for %d partitions", len(e.lshes), len(e.Partitions))
+		return anomalies
+	}
+	// The partitions of a partitioner may overlap
+	for i := 1; i < len(e.Partitions) && e.partitioner == nil; i++ {
+		if e.Partitions[i-1].Upper > e.Partitions[i].Lower {
+			report(i, false, "lower bound %d less than upper bound %d of previous partition",
+				e.Partitions[i].Lower, e.Partitions[i-1].Upper)
+		}
+	}
+	// The keys indexed in every partition
+	indexed := make([]map[string]int, len(e.lshes))
+	for i, lsh := range e.lshes {
+		var forests []*LshForest
+		switch lsh := resolveLsh(lsh).(type) {
+		case *LshForest:
+			forests = []*LshForest{lsh}
+		case *LshForestArray:
+			forests = lsh.array
+		default:
+			report(i, false, "cannot check Lsh of type %T", lsh)
+			continue
+		}
+		for _, f := range forests {
+			forestAnomalies, keys := f.checkIntegrity(repair)
+			for _, desc := range forestAnomalies {
+				report(i, desc.repaired, "forest k=%d: %s", f.k, desc.description)
+			}
+			if indexed[i] == nil {
+				indexed[i] = keys
+			}
+		}
+	}
+	e.eachRecord(func(rec *DomainRecord) {
+		key := rec.Key
+		part := -1
+		for i := range indexed {
+			if _, exist := indexed[i][key]; exist {
+				part = i
+				break
+			}
+		}
+		if part == -1 {
+			// The domain may be waiting for Index()
+			return
+		}
+		p := &e.Partitions[part]
+		if rec.Size >= p.Lower && rec.Size <= p.Upper {
+			return
+		}
+		report(part, repair, "domain %q of size %d outside bounds [%d, %d]", key, rec.Size, p.Lower, p.Upper)
+		if repair {
+			if rec.Size < p.Lower {
+				p.Lower = rec.Size
+			} else {
+				p.Upper = rec.Size
+			}
+		}
+	})
+	return anomalies
+}
+
+type forestAnomaly struct {
+	description string
+	repaired    bool
+}
+
+// checkIntegrity checks the hash tables of the forest, and returns the
+// anomalies and the number of times every key is indexed.
+// The tables of frozen forests are not repaired.
+func (f *LshForest) checkIntegrity(repair bool) ([]forestAnomaly, map[string]int) {
+	var anomalies []forestAnomaly
+	var keys map[string]int
+	report := func(repaired bool, format string, args ...interface{}) {
+		anomalies = append(anomalies, forestAnomaly{fmt.Sprintf(format, args...), repaired})
+	}
+	numTables := len(f.hashTables)
+	if f.frozen != nil {
+		numTables = len(f.frozen)
+	}
+	if numTables != f.l {
+		report(false, "%d hash tables for l=%d", numTables, f.l)
+		return anomalies, nil
+	}
+	keySize := f.keySize()
+	for i := 0; i < f.l; i++ {
+		t := f.table(i)
+		if tt, ok := t.(trieTable); ok {
+			t = tt.hashTable
+		}
+		ht, mutable := t.(hashTable)
+		// The hash table may be shared with a clone, so it is copied
+		// before being repaired.
+		copied := false
+		copyTable := func() {
+			if !copied {
+				ht = append(hashTable(nil), ht...)
+				f.setTable(i, ht)
+				copied = true
+			}
+		}
+		counts := make(map[string]int)
+		var badKeys, unsortedBuckets int
+		bucketsSorted := true
+		for b := 0; b < t.buckets(); b++ {
+			if len(t.bucketKey(b)) != keySize {
+				badKeys++
+			}
+			if b > 0 && t.bucketKey(b-1) > t.bucketKey(b) {
+				bucketsSorted = false
+			}
+			var prev string
+			sorted := true
+			t.scan(b, func(key string) bool {
+				sorted = sorted && prev <= key
+				prev = key
+				counts[key]++
+				return true
+			})
+			if !sorted {
+				unsortedBuckets++
+				if repair && mutable {
+					copyTable()
+					ht[b].keys = append([]string(nil), ht[b].keys...)
+					sort.Strings(ht[b].keys)
+				}
+			}
+		}
+		if badKeys > 0 {
+			report(false, "table %d: %d hash keys not of length %d", i, badKeys, keySize)
+		}
+		if unsortedBuckets > 0 {
+			report(repair && mutable, "table %d: %d buckets with keys out of order", i, unsortedBuckets)
+		}
+		if badKeys == 0 && !bucketsSorted {
+			report(repair && mutable, "table %d: buckets out of order", i)
+			if repair && mutable {
+				copyTable()
+				sort.Sort(ht)
+			}
+		}
+		if i == 0 {
+			keys = counts
+			continue
+		}
+		var mismatched int
+		for key, c := range counts {
+			if keys[key] != c {
+				mismatched++
+			}
+		}
+		for key := range keys {
+			if _, exist := counts[key]; !exist {
+				mismatched++
+			}
+		}
+		if mismatched > 0 {
+			report(false, "table %d: %d keys indexed a different number of times than in table 0", i, mismatched)
+		}
+	}
+	return anomalies, keys
+}
@@ -0,0 +1,37 @@
+package lshensemble
+
+import (
+	"testing"
+)
+
+func Test_CheckIntegrity(t *testing.T) {
+	recs := randomDomains(100, 64, 1)
+	index := NewLshEnsemble([]Partition{{0, 100}, {101, 300}}, 64, 4)
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	if anomalies := index.CheckIntegrity(false); len(anomalies) != 0 {
+		t.Fatal(anomalies)
+	}
+
+	f := index.lshes[0].(*LshForest)
+	ht := f.hashTables[1]
+	ht[0], ht[len(ht)-1] = ht[len(ht)-1], ht[0]
+	f.hashTables[2] = f.hashTables[2][1:]
+	index.Partitions[1].Upper = 150
+	anomalies := index.CheckIntegrity(true)
+	var repaired int
+	for _, a := range anomalies {
+		if a.Repaired {
+			repaired++
+		}
+	}
+	if len(anomalies) < 3 || repaired < 2 {
+		t.Fatal(anomalies)
+	}
+	// Only the missing bucket remains
+	if anomalies := index.CheckIntegrity(false); len(anomalies) != 1 || anomalies[0].Partition != 0 {
+		t.Fatal(anomalies)
+	}
+}
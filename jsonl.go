@@ -0,0 +1,264 @@
+package lshensemble
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/streamrail/concurrent-map"
+)
+
+// The JSON-lines format of ExportJSON has one JSON object per line, whose
+// "type" is one of
+//
+//	index:     {"type":"index","numHash":256,"maxK":4,"partitions":[{"lower":1,"upper":10},...]}
+//	partition: {"type":"partition","partition":0,"kind":"forest"}
+//	           {"type":"partition","partition":0,"kind":"array","maxK":4,"numHash":256}
+//	forest:    {"type":"forest","partition":0,"forest":0,"k":4,"l":64,"hashValueSize":4,"trim":0}
+//	           {"type":"forest",...,"hashValueSize":3,"hashValueBits":20,"trim":0}
+//	bucket:    {"type":"bucket","partition":0,"forest":0,"table":0,"hashKey":"0a1b...","keys":["a","b"]}
+//	domain:    {"type":"domain","key":"a","size":10,"signature":[...]}
+//
+// The index line comes first, and a partition line and its forests come
+// before their buckets. Forests are numbered from 0 in their partition,
+// and the forest of every K of an array is K-1. Hash keys are hex-encoded.
+// The domains are the records retained by AddDomain.
+type jsonLine struct {
+	Type          string      `json:"type"`
+	NumHash       int         `json:"numHash,omitempty"`
+	MaxK          int         `json:"maxK,omitempty"`
+	Partitions    []Partition `json:"partitions,omitempty"`
+	Partition     *int        `json:"partition,omitempty"`
+	Kind          string      `json:"kind,omitempty"`
+	Forest        *int        `json:"forest,omitempty"`
+	K             int         `json:"k,omitempty"`
+	L             int         `json:"l,omitempty"`
+	HashValueSize int         `json:"hashValueSize,omitempty"`
+	HashValueBits int         `json:"hashValueBits,omitempty"`
+	Trim          *TrimScheme `json:"trim,omitempty"`
+	Table         *int        `json:"table,omitempty"`
+	HashKey       string      `json:"hashKey,omitempty"`
+	Keys          []string    `json:"keys,omitempty"`
+	Key           string      `json:"key,omitempty"`
+	Size          int         `json:"size,omitempty"`
+	Signature     Signature   `json:"signature,omitempty"`
+}
+
+func intp(v int) *int { return &v }
+
+// ExportJSON writes the index to w in a human-readable JSON-lines format,
+// with one line per bucket and per domain retained by AddDomain, for
+// debugging, testing with small corpora, and migrating indexes between
+// incompatible versions of the binary format. It can be read back using
+// ImportJSON. Only the domains made searchable by Index() are exported.
+func (e *LshEnsemble) ExportJSON(w io.Writer) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(jsonLine{Type: "index", NumHash: e.numHash, MaxK: e.maxK, Partitions: e.Partitions}); err != nil {
+		return err
+	}
+	for i, lsh := range e.lshes {
+		var forests []*LshForest
+		switch lsh := resolveLsh(lsh).(type) {
+		case *LshForest:
+			forests = []*LshForest{lsh}
+			if err := enc.Encode(jsonLine{Type: "partition", Partition: intp(i), Kind: "forest"}); err != nil {
+				return err
+			}
+		case *LshForestArray:
+			forests = lsh.array
+			if err := enc.Encode(jsonLine{Type: "partition", Partition: intp(i), Kind: "array", MaxK: lsh.maxK, NumHash: lsh.numHash}); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("lshensemble: cannot export Lsh of type %T", lsh)
+		}
+		for j, f := range forests {
+			trim := f.trim
+			if err := enc.Encode(jsonLine{Type: "forest", Partition: intp(i), Forest: intp(j),
+				K: f.k, L: f.l, HashValueSize: f.hashValueSize, HashValueBits: f.hashValueBits, Trim: &trim}); err != nil {
+				return err
+			}
+			for x := 0; x < f.l; x++ {
+				t := f.table(x)
+				for b := 0; b < t.buckets(); b++ {
+					keys := make([]string, 0, t.bucketLen(b))
+					t.scan(b, func(key string) bool {
+						keys = append(keys, key)
+						return true
+					})
+					if err := enc.Encode(jsonLine{Type: "bucket", Partition: intp(i), Forest: intp(j), Table: intp(x),
+						HashKey: hex.EncodeToString([]byte(t.bucketKey(b))), Keys: keys}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	recs := make([]*DomainRecord, 0, len(e.domains)+e.sizes.len())
+	e.eachRecord(func(rec *DomainRecord) {
+		recs = append(recs, rec)
+	})
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Key < recs[j].Key
+	})
+	for _, rec := range recs {
+		sig, err := e.signature(rec)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(jsonLine{Type: "domain", Key: rec.Key, Size: rec.Size, Signature: sig}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ImportJSON reads an index written by ExportJSON from r, which may have
+// been edited by hand. It returns an error wrapping ErrCorruptIndex with
+// the line number if a line is malformed or inconsistent with the index.
+func ImportJSON(r io.Reader) (*LshEnsemble, error) {
+	var e *LshEnsemble
+	// forests are the forests of every partition
+	forests := make(map[int][]*LshForest)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+	var n int
+	corrupt := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: line %d: %s", ErrCorruptIndex, n, fmt.Sprintf(format, args...))
+	}
+	// part returns the partition of a line
+	part := func(line *jsonLine) (int, error) {
+		if line.Partition == nil || *line.Partition < 0 || *line.Partition >= len(e.lshes) {
+			return 0, corrupt("invalid partition")
+		}
+		return *line.Partition, nil
+	}
+	for scanner.Scan() {
+		n++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line jsonLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, corrupt("%v", err)
+		}
+		if e == nil && line.Type != "index" {
+			return nil, corrupt("index line expected, got %q", line.Type)
+		}
+		switch line.Type {
+		case "index":
+			if e != nil {
+				return nil, corrupt("duplicate index line")
+			}
+			if err := checkEnsembleParams(line.Partitions, line.NumHash, line.MaxK); err != nil {
+				return nil, corrupt("%v", err)
+			}
+			e = &LshEnsemble{
+				Partitions: line.Partitions,
+				lshes:      make([]Lsh, len(line.Partitions)),
+				maxK:       line.MaxK,
+				numHash:    line.NumHash,
+				paramCache: cmap.New(),
+			}
+		case "partition":
+			i, err := part(&line)
+			if err != nil {
+				return nil, err
+			}
+			if e.lshes[i] != nil {
+				return nil, corrupt("duplicate partition %d", i)
+			}
+			switch line.Kind {
+			case "forest":
+				forests[i] = make([]*LshForest, 1)
+				e.lshes[i] = &LshForest{}
+			case "array":
+				if line.MaxK < 1 || line.MaxK > e.maxK {
+					return nil, corrupt("invalid maxK %d", line.MaxK)
+				}
+				forests[i] = make([]*LshForest, line.MaxK)
+				e.lshes[i] = &LshForestArray{maxK: line.MaxK, numHash: line.NumHash, array: forests[i]}
+			default:
+				return nil, corrupt("unknown partition kind %q", line.Kind)
+			}
+		case "forest":
+			i, err := part(&line)
+			if err != nil {
+				return nil, err
+			}
+			if line.Forest == nil || *line.Forest < 0 || *line.Forest >= len(forests[i]) || forests[i][*line.Forest] != nil {
+				return nil, corrupt("invalid forest")
+			}
+			trim := DefaultTrimScheme
+			if line.Trim != nil {
+				trim = *line.Trim
+			}
+			bits := line.HashValueBits
+			if bits == 0 {
+				bits = 8 * line.HashValueSize
+			} else if !validPacking(bits, line.HashValueSize) {
+				return nil, corrupt("invalid hash value bits %d", bits)
+			}
+			f, err := NewLshForestBits(line.K, line.L, bits, trim)
+			if err != nil {
+				return nil, corrupt("%v", err)
+			}
+			forests[i][*line.Forest] = f
+			if _, ok := e.lshes[i].(*LshForest); ok {
+				e.lshes[i] = f
+			}
+		case "bucket":
+			i, err := part(&line)
+			if err != nil {
+				return nil, err
+			}
+			if line.Forest == nil || *line.Forest < 0 || *line.Forest >= len(forests[i]) || forests[i][*line.Forest] == nil {
+				return nil, corrupt("invalid forest")
+			}
+			f := forests[i][*line.Forest]
+			if line.Table == nil || *line.Table < 0 || *line.Table >= f.l {
+				return nil, corrupt("invalid table")
+			}
+			hashKey, err := hex.DecodeString(line.HashKey)
+			if err != nil || len(hashKey) != f.keySize() {
+				return nil, corrupt("invalid hash key %q", line.HashKey)
+			}
+			ks := append(keys(nil), line.Keys...)
+			sort.Strings(ks)
+			f.hashTables[*line.Table] = append(f.hashTables[*line.Table], bucket{hashKey: string(hashKey), keys: ks})
+		case "domain":
+			if e.domains == nil {
+				e.domains = make(map[string]*DomainRecord)
+			}
+			e.domains[line.Key] = &DomainRecord{Key: line.Key, Size: line.Size, Signature: line.Signature}
+		default:
+			return nil, corrupt("unknown line type %q", line.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, fmt.Errorf("%w: no index line", ErrCorruptIndex)
+	}
+	for i, lsh := range e.lshes {
+		if lsh == nil || !e.consistent(lsh) {
+			return nil, fmt.Errorf("%w: partition %d is missing or inconsistent", ErrCorruptIndex, i)
+		}
+		if f, ok := lsh.(*LshForest); ok && f.l == 0 {
+			return nil, fmt.Errorf("%w: partition %d has no forest", ErrCorruptIndex, i)
+		}
+		for _, f := range forests[i] {
+			for _, ht := range f.hashTables {
+				sort.Sort(ht)
+			}
+		}
+	}
+	return e, nil
+}
@@ -28,9 +28,31 @@ func NewLshForestArray(maxK, numHash int) *LshForestArray {
 	}
 }
 
+// NewLshForestArrayE is like NewLshForestArray, but returns an error
+// if the parameters are invalid.
+func NewLshForestArrayE(maxK, numHash int) (*LshForestArray, error) {
+	if maxK < 1 || numHash < maxK {
+		return nil, invalidParameter("need 1 <= maxK <= numHash, got maxK=%d numHash=%d", maxK, numHash)
+	}
+	return NewLshForestArray(maxK, numHash), nil
+}
+
+// MaxK returns the maximum value of K of the array.
+func (a *LshForestArray) MaxK() int {
+	return a.maxK
+}
+
+// NumHash returns the number of hash functions in MinHash of the array.
+func (a *LshForestArray) NumHash() int {
+	return a.numHash
+}
+
 // Add a key with MinHash signature into the index.
 // The key won't be searchable until Index() is called.
 func (a *LshForestArray) Add(key string, sig Signature) {
+	if len(a.array) > 0 && a.array[0].frozen != nil {
+		panic(ErrFrozenIndex)
+	}
 	var wg sync.WaitGroup
 	wg.Add(len(a.array))
 	for i := range a.array {
@@ -42,17 +64,25 @@ func (a *LshForestArray) Add(key string, sig Signature) {
 	wg.Wait()
 }
 
+// AddE is like Add, but returns an error if the signature is too short
+// for the forests.
+func (a *LshForestArray) AddE(key string, sig Signature) error {
+	if len(a.array) > 0 && a.array[0].frozen != nil {
+		return ErrFrozenIndex
+	}
+	for _, f := range a.array {
+		if err := checkSignature(sig, f.k*f.l); err != nil {
+			return err
+		}
+	}
+	a.Add(key, sig)
+	return nil
+}
+
 // Makes all the keys added searchable.
+// At most runtime.GOMAXPROCS(0) hash tables are indexed at once.
 func (a *LshForestArray) Index() {
-	var wg sync.WaitGroup
-	wg.Add(len(a.array))
-	for i := range a.array {
-		go func(lsh *LshForest) {
-			lsh.Index()
-			wg.Done()
-		}(a.array[i])
-	}
-	wg.Wait()
+	indexForests(a.array, 0)
 }
 
 // Return candidate keys given the query signature and parameters.
@@ -60,6 +90,11 @@ func (a *LshForestArray) Query(sig Signature, K, L int, out chan string) {
 	a.array[K-1].Query(sig, -1, L, out)
 }
 
+// forest returns the forest using K hash functions per band.
+func (a *LshForestArray) forest(K int) (*LshForest, int) {
+	return a.array[K-1], -1
+}
+
 // OptimalKL returns the optimal K and L for containment search,
 // and the false positive and negative probabilities.
 // where x is the indexed domain size, q is the query domain size,
@@ -71,8 +106,8 @@ func (a *LshForestArray) OptimalKL(x, q int, t float64) (optK, optL int, fp, fn
 			if k*l > a.numHash {
 				continue
 			}
-			currFp := probFalsePositive(x, q, l, k, t, integrationPrecision)
-			currFn := probFalseNegative(x, q, l, k, t, integrationPrecision)
+			currFp := ProbFalsePositive(x, q, l, k, t, integrationPrecision)
+			currFn := ProbFalseNegative(x, q, l, k, t, integrationPrecision)
 			currErr := currFn + currFp
 			if minError > currErr {
 				minError = currErr
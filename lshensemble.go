@@ -2,7 +2,10 @@ package lshensemble
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/streamrail/concurrent-map"
@@ -35,111 +38,711 @@ type Lsh interface {
 	// the containment threshold. The resulting false positive (fp)
 	// and false negative (fn) probabilities are returned as well.
 	OptimalKL(x, q int, t float64) (optK, optL int, fp, fn float64)
+	// forest returns the LshForest queried for the parameter k,
+	// and the prefix size to use in its hash tables.
+	forest(k int) (*LshForest, int)
 }
 
 // LshEnsemble represents an LSH Ensemble index.
+// It is safe to add domains and call Index() while other
+// goroutines are querying it.
 type LshEnsemble struct {
 	Partitions []Partition
 	lshes      []Lsh
 	maxK       int
 	numHash    int
 	paramCache cmap.ConcurrentMap
+	admission  AdmissionController
+	// domains are the records retained by AddDomain, whose signatures
+	// are kept in signatures instead if it is set.
+	domains    map[string]*DomainRecord
+	signatures SignatureStore
+	// sizes are the sizes of the records moved from domains by Index() if
+	// compactSizes is set, but while rebalancing is positive.
+	sizes        *sizeStore
+	compactSizes bool
+	rebalancing  int32
+	// blooms are the Bloom filters of the values of the domains.
+	blooms map[string]*BloomFilter
+	// duplicates is the policy applied when a key is added twice, and
+	// keyParts is the key dictionary it is checked against: the
+	// partition of every key added, unless duplicates are allowed.
+	duplicates DuplicatePolicy
+	keyParts   map[string]int
+	// empty is the policy applied when an empty domain is added, and
+	// isolated are the records of the domains it isolated.
+	empty    EmptyDomainPolicy
+	isolated map[string]*DomainRecord
+	// frozen is true for the read-only indexes, created by Freeze and
+	// LoadSnapshotTiered.
+	frozen bool
+	// cache coalesces and caches the query results of the generation,
+	// which is incremented whenever the results may change.
+	cache      *queryCache
+	generation uint64
+	// deterministic makes Index() canonicalize the hash tables.
+	deterministic bool
+	// sequential makes the partitions run on the calling goroutine.
+	sequential bool
+	// parallelism is the maximum number of hash tables indexed at once,
+	// runtime.GOMAXPROCS(0) if 0.
+	parallelism int
+	// partitioner, if set, assigns the domains to the partitions.
+	partitioner Partitioner
+	// realtime, if set, buffers the domains added since the last Index()
+	// to make them searchable at once.
+	realtime *realtimeBuffer
+	// numa are the NUMA nodes the partitions are scanned on, if any.
+	numa []*numaNode
+	// spill buffers the domains added to an index created with WithSpill,
+	// or exceeding its memory budget, and pending is the estimated
+	// memory of the domains added since the last Index().
+	spill   *spiller
+	budget  *MemoryBudget
+	pending int64
+	// groupBy maps the keys of the candidates to their entities.
+	groupBy func(key string) string
+	// progress reports the progress of the operations, and audit samples
+	// the queries.
+	progress Progress
+	audit    *AuditOptions
+	// stats counts the queries run.
+	stats queryStats
+	// tiers tracks the partitions of the indexes created by
+	// LoadSnapshotTiered.
+	tiers *tierManager
+	// ids are the ids of the keys of the generation, for DedupBitmap,
+	// guarded by idsMu as they are assigned by the queries.
+	ids   *keyIDs
+	idsMu sync.Mutex
+	// releaseOnIndex makes Index() release the bootstrapping structures,
+	// and released is true once they are.
+	releaseOnIndex bool
+	released       bool
+	// mu guards the LSHs against indexing while being queried.
+	mu sync.RWMutex
 }
 
 // NewLshEnsemble initializes a new index consists of MinHash LSH implemented using LshForest.
 // numHash is the number of hash functions in MinHash.
 // maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band". 
 func NewLshEnsemble(parts []Partition, numHash, maxK int) *LshEnsemble {
-	lshes := make([]Lsh, len(parts))
-	for i := range lshes {
-		lshes[i] = NewLshForest(maxK, numHash/maxK)
-	}
-	return &LshEnsemble{
-		lshes:      lshes,
-		Partitions: parts,
-		maxK:       maxK,
-		numHash:    numHash,
-		paramCache: cmap.New(),
-	}
+	return newEnsemble(&config{parts: parts, numHash: numHash, maxK: maxK})
+}
+
+// NewLshEnsembleE is like NewLshEnsemble, but returns an error if the
+// parameters are invalid.
+func NewLshEnsembleE(parts []Partition, numHash, maxK int) (*LshEnsemble, error) {
+	return New(WithPartitions(parts), WithNumHash(numHash), WithMaxK(maxK))
 }
 
 // NewLshEnsemblePlus initializes a new index consists of MinHash LSH implemented using LshForestArray.
 // numHash is the number of hash functions in MinHash.
 // maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band". 
 func NewLshEnsemblePlus(parts []Partition, numHash, maxK int) *LshEnsemble {
-	lshes := make([]Lsh, len(parts))
-	for i := range lshes {
-		lshes[i] = NewLshForestArray(maxK, numHash)
+	return newEnsemble(&config{parts: parts, numHash: numHash, maxK: maxK, array: true})
+}
+
+// NewLshEnsemblePlusE is like NewLshEnsemblePlus, but returns an error
+// if the parameters are invalid.
+func NewLshEnsemblePlusE(parts []Partition, numHash, maxK int) (*LshEnsemble, error) {
+	return New(WithPartitions(parts), WithNumHash(numHash), WithMaxK(maxK), WithForestArray())
+}
+
+func checkEnsembleParams(parts []Partition, numHash, maxK int) error {
+	if len(parts) == 0 {
+		return invalidParameter("no partitions")
 	}
-	return &LshEnsemble{
-		lshes:      lshes,
-		Partitions: parts,
-		maxK:       maxK,
-		numHash:    numHash,
-		paramCache: cmap.New(),
+	if maxK < 1 || numHash < maxK {
+		return invalidParameter("need 1 <= maxK <= numHash, got maxK=%d numHash=%d", maxK, numHash)
+	}
+	for i, p := range parts {
+		if p.Lower > p.Upper {
+			return invalidParameter("partition %d has lower bound %d greater than upper bound %d", i, p.Lower, p.Upper)
+		}
 	}
+	return nil
 }
 
 // Add a new domain to the index given its partition ID - the index of the partition.
 // The added domain won't be searchable until the Index() function is called.
+// Keys added twice are handled according to the DuplicatePolicy.
 func (e *LshEnsemble) Add(key string, sig Signature, partInd int) {
-	e.lshes[partInd].Add(key, sig)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.add(key, sig, nil, partInd); err != nil {
+		panic(err)
+	}
+}
+
+// AddE is like Add, but returns an error if the signature is too short,
+// the partition index is out of range, or the key is a rejected duplicate.
+func (e *LshEnsemble) AddE(key string, sig Signature, partInd int) error {
+	if e.frozen {
+		return ErrFrozenIndex
+	}
+	if partInd < 0 || partInd >= len(e.lshes) {
+		return fmt.Errorf("%w: %d", ErrPartitionOutOfRange, partInd)
+	}
+	if err := checkSignature(sig, e.numHash); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.add(key, sig, nil, partInd)
+	return err
+}
+
+// AddDomain is like Add, but also retains the domain record in the index,
+// so the domain can be queried by its key using QueryByKey.
+// Retained records are not saved by Save.
+func (e *LshEnsemble) AddDomain(rec *DomainRecord, partInd int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.addDomain(rec, partInd); err != nil {
+		panic(err)
+	}
+}
+
+// AddDomainE is like AddDomain, but returns an error wrapping
+// ErrInvalidRecord if the record is invalid for the index, as checked by
+// Validate, and the errors of AddE otherwise.
+func (e *LshEnsemble) AddDomainE(rec *DomainRecord, partInd int) error {
+	if e.frozen {
+		return ErrFrozenIndex
+	}
+	if partInd < 0 || partInd >= len(e.lshes) {
+		return fmt.Errorf("%w: %d", ErrPartitionOutOfRange, partInd)
+	}
+	// The empty domains are checked by the policy instead
+	if err := rec.Validate(e.numHash); err != nil && !e.emptyDomain(rec) {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.addDomain(rec, partInd)
+}
+
+// addDomain adds the domain to the partition, and retains its record.
+func (e *LshEnsemble) addDomain(rec *DomainRecord, partInd int) error {
+	if isolated, err := e.isolate(rec); isolated || err != nil {
+		return err
+	}
+	added, err := e.add(rec.Key, rec.Signature, nil, partInd)
+	if err != nil || !added {
+		return err
+	}
+	if e.domains == nil {
+		e.domains = make(map[string]*DomainRecord)
+	}
+	if e.signatures != nil {
+		if err := e.signatures.Put(rec.Key, rec.Signature); err != nil {
+			return err
+		}
+		rec = &DomainRecord{Key: rec.Key, Size: rec.Size}
+	}
+	e.domains[rec.Key] = rec
+	return nil
+}
+
+// PartitionIndex returns the index of the first partition whose
+// upper bound is no less than size, or the last partition if size is
+// greater than all upper bounds. The partitioner of an index created with
+// WithPartitioner assigns the partition instead.
+func (e *LshEnsemble) PartitionIndex(size int) int {
+	if e.partitioner != nil {
+		return e.partitioner.AssignPartition(size)
+	}
+	i := sort.Search(len(e.Partitions), func(i int) bool {
+		return e.Partitions[i].Upper >= size
+	})
+	if i == len(e.Partitions) {
+		i--
+	}
+	return i
 }
 
 // Makes all added domains searchable.
 func (e *LshEnsemble) Index() {
-	var wg sync.WaitGroup
-	wg.Add(len(e.lshes))
-	for i := range e.lshes {
-		go func(lsh Lsh) {
-			lsh.Index()
-			wg.Done()
-		}(e.lshes[i])
+	if err := e.IndexE(); err != nil {
+		panic(err)
 	}
-	wg.Wait()
+}
+
+// IndexE is like Index, but returns the error of merging the runs of an
+// index created with WithSpill, in which case the domains spilled since
+// the last Index() may be partially indexed.
+func (e *LshEnsemble) IndexE() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.generation++
+	e.pending = 0
+	if e.realtime != nil {
+		e.realtime.reset()
+	}
+	if e.spill != nil {
+		if err := e.spill.merge(e); err != nil {
+			return err
+		}
+	}
+	progress := e.tableProgress()
+	if e.numa != nil {
+		e.indexNUMA(progress)
+	} else if e.sequential {
+		e.indexSequential(progress)
+	} else {
+		e.indexParallel(progress)
+	}
+	if e.deterministic {
+		e.canonicalize()
+	}
+	if e.compactSizes && atomic.LoadInt32(&e.rebalancing) == 0 {
+		e.packSizes()
+	}
+	if e.releaseOnIndex {
+		e.release()
+	}
+	return nil
 }
 
 // Query returns the candidate domains as well as the running time.
 // This function is given the MinHash signature of the query domain, sig, the domain size,
 // and the containment threshold.
 // The query signature must be generated using the same seed as the signatures of the indexed domains,
-// and have the same number of hash functions.
+// and have the same number of hash functions. A shorter signature is queried with the bands it is
+// long enough for, and counted in the ShortSignatures of QueryStats; QueryE returns an error instead.
 func (e *LshEnsemble) Query(sig Signature, size int, threshold float64) (result []string, dur time.Duration) {
-	// Compute the optimal k and l for each partition
+	defer e.rlockQuery()()
+	result, dur, _ = e.collect(sig, size, threshold, Supersets)
+	return result, dur
+}
+
+// QueryE is like Query, but returns an error if the signature is too
+// short, the size is negative or the threshold is not in [0, 1].
+func (e *LshEnsemble) QueryE(sig Signature, size int, threshold float64) ([]string, time.Duration, error) {
+	if !(threshold >= 0 && threshold <= 1) {
+		return nil, 0, invalidParameter("threshold must be in [0, 1], got %v", threshold)
+	}
+	if size < 0 {
+		return nil, 0, invalidParameter("negative query domain size %d", size)
+	}
+	if err := checkSignature(sig, e.numHash); err != nil {
+		return nil, 0, err
+	}
+	defer e.rlockQuery()()
+	return e.collect(sig, size, threshold, Supersets)
+}
+
+// QuerySubsets is the reverse of Query: it returns the candidate domains
+// contained in the query domain, i.e. the indexed domains X such that
+// |Q ∩ X| / |X| is no less than the threshold, as well as the running time.
+func (e *LshEnsemble) QuerySubsets(sig Signature, size int, threshold float64) (result []string, dur time.Duration) {
+	defer e.rlockQuery()()
+	result, dur, _ = e.collect(sig, size, threshold, Subsets)
+	return result, dur
+}
+
+// ThresholdFunc returns the containment threshold of a query in the
+// partition of domains with sizes up to upper, for size-dependent
+// policies such as stricter thresholds for larger domains.
+type ThresholdFunc func(upper int) float64
+
+// QueryFunc is like Query, but the containment threshold of every
+// partition is given by threshold, so the partitions of a single query
+// can have different thresholds. The results are not cached.
+func (e *LshEnsemble) QueryFunc(sig Signature, size int, threshold ThresholdFunc) (result []string, dur time.Duration) {
+	start := time.Now()
+	defer e.rlockQuery()()
+	result, _ = e.gather(sig, size, e.partitionParams(size, threshold, Supersets))
+	return result, time.Since(start)
+}
+
+// collect returns the candidates from all partitions, using the query
+// cache if the index has one.
+func (e *LshEnsemble) collect(sig Signature, size int, threshold float64, dir Direction) (result []string, dur time.Duration, err error) {
+	start := time.Now()
+	audited := e.auditQuery(sig, size, threshold, dir)
+	run := func() ([]string, error) {
+		return e.gather(sig, size, e.optimalParams(size, threshold, dir))
+	}
+	// NaN thresholds cannot be looked up
+	if e.cache != nil && threshold == threshold {
+		result, err = e.cache.do(newQueryKey(sig, size, threshold, dir, e.generation), run)
+	} else {
+		result, err = run()
+	}
+	if audited != nil {
+		audited(len(result), err)
+	}
+	return result, time.Since(start), err
+}
+
+// gather returns the candidates from all partitions.
+func (e *LshEnsemble) gather(sig Signature, size int, params []param) (result []string, err error) {
+	keyChan := make(chan string)
+	result = make([]string, 0)
+	go func() {
+		err = e.query(sig, size, params, &QueryOptions{}, keyChan)
+		close(keyChan)
+	}()
+	for key := range keyChan {
+		result = append(result, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// QueryOptions controls how the candidates of QueryStream are found and delivered.
+type QueryOptions struct {
+	// Direction is the direction of containment searched,
+	// Supersets by default, as in Query.
+	Direction Direction
+	// Threshold, if not nil, gives the threshold of every partition
+	// as in QueryFunc, instead of the threshold of the query.
+	Threshold ThresholdFunc
+	// MinSize and MaxSize, if not zero, bound the sizes of the candidate
+	// domains. MinRatio and MaxRatio, if not zero, bound them relative to
+	// the query domain size. The partitions outside the bounds are not
+	// probed; candidates of the partitions across a bound are filtered
+	// only if their domains were retained by AddDomain.
+	MinSize  int
+	MaxSize  int
+	MinRatio float64
+	MaxRatio float64
+	// Partitions, if not nil, restricts the query to the partitions of
+	// the indexes, e.g. those of PartitionsBetween when the candidates
+	// are known to be in a range of sizes, pruning the others without
+	// filtering the candidates of those probed. The indexes out of the
+	// range of the partitions are ignored.
+	Partitions []int
+	// Dedup makes every candidate delivered exactly once, even if its key
+	// was indexed in multiple partitions, as DedupGlobal. Keys are always
+	// deduplicated within a partition.
+	Dedup bool
+	// DedupScope is the scope within which every candidate is delivered
+	// once, DedupPartition by default, or DedupGlobal if Dedup is set.
+	DedupScope DedupScope
+	// DedupWindow, if positive, bounds the memory of Dedup and GroupBy to
+	// the last DedupWindow distinct keys delivered: a key is suppressed
+	// only if it is one of them, so a duplicate further down the stream
+	// is delivered again. It is meant for queries of tens of millions of
+	// candidates, whose duplicates are mostly within a few partitions.
+	DedupWindow int
+	// GroupBy, if not nil, maps the key of every candidate to its
+	// entity, such as the table of replicated columns, and the entities
+	// are delivered instead of the keys, each once. It overrides the
+	// GroupBy of the index set by WithGroupBy.
+	GroupBy func(key string) string
+	// Limit, if positive, stops the query once Limit candidates are
+	// delivered, for top-k queries. The partitions are then probed one
+	// after the other, in decreasing order of their yields in the past
+	// queries with a Limit: the mean numbers of candidates they had, as
+	// reported by QueryStats.
+	Limit int
+	// Buffer is the capacity of the output channel.
+	// Once the buffer is full, the query blocks until the consumer
+	// receives more candidates, with all partitions waiting on it.
+	// The default of 0 makes every candidate wait for the consumer.
+	Buffer int
+	// Done, if not nil, abandons the query when closed: the query stops
+	// probing the partitions, and closes the output channel without
+	// sending the remaining candidates.
+	Done <-chan struct{}
+	// Timeout, if positive, abandons the probing of the partitions once
+	// it elapses, as if Done was closed then, so interactive queries
+	// return in bounded time with the candidates found so far.
+	// QueryTimeout reports whether its results are partial.
+	Timeout time.Duration
+	// Verifiers, if greater than 1, is the number of goroutines
+	// estimating the containments of the candidates of QueryPipeline and
+	// QueryScored from their retained signatures, so the verification,
+	// e.g. reading a SignatureStore, does not serialize a query of many
+	// candidates. The candidates are still delivered in the order they
+	// are found, unless UnorderedVerify delivers them as soon as they are
+	// verified.
+	Verifiers       int
+	UnorderedVerify bool
+	// IncludeEmpty makes the domains isolated by IsolateEmptyDomains
+	// candidates of the query as well, after those of the partitions,
+	// within the size bounds of the query.
+	IncludeEmpty bool
+}
+
+// QueryStream is like Query, but streams the candidate domains to the
+// returned channel as they are found, which is closed at the end of the
+// query. With opts.Done, the consumer can abandon the query mid-stream.
+// The index cannot be updated until the channel is closed,
+// so a consumer must receive all the candidates or abandon the query.
+func (e *LshEnsemble) QueryStream(sig Signature, size int, threshold float64, opts *QueryOptions) <-chan string {
+	if opts == nil {
+		opts = &QueryOptions{}
+	}
+	out := make(chan string, opts.Buffer)
+	unlock := e.rlockQuery()
+	go func() {
+		defer unlock()
+		defer close(out)
+		e.stream(sig, size, threshold, opts, out)
+	}()
+	return out
+}
+
+// stream writes the candidates of the query to out as QueryStream, with
+// the thresholds of opts.Threshold if it is set, and returns the error of
+// the query. The index must be read-locked.
+func (e *LshEnsemble) stream(sig Signature, size int, threshold float64, opts *QueryOptions, out chan<- string) error {
+	if opts.Threshold != nil {
+		return e.query(sig, size, e.partitionParams(size, opts.Threshold, opts.Direction), opts, out)
+	}
+	params := e.optimalParams(size, threshold, opts.Direction)
+	audited := e.auditQuery(sig, size, threshold, opts.Direction)
+	if audited == nil {
+		return e.query(sig, size, params, opts, out)
+	}
+	// The candidates of an audited query are counted
+	keys := make(chan string)
+	var err error
+	go func() {
+		err = e.query(sig, size, params, opts, keys)
+		close(keys)
+	}()
+	var n int
+	for key := range keys {
+		select {
+		case out <- key:
+			n++
+		case <-opts.Done:
+		}
+	}
+	audited(n, err)
+	return err
+}
+
+// optimalParams computes the optimal k and l for each partition,
+// given the query domain size and the direction of containment.
+func (e *LshEnsemble) optimalParams(size int, threshold float64, dir Direction) []param {
+	return e.partitionParams(size, func(int) float64 { return threshold }, dir)
+}
+
+// partitionParams is like optimalParams, with the threshold of every
+// partition given by thresholds.
+func (e *LshEnsemble) partitionParams(size int, thresholds ThresholdFunc, dir Direction) []param {
 	params := make([]param, len(e.Partitions))
 	for i, p := range e.Partitions {
-		x := p.Upper
-		key := cacheKey(x, size, threshold)
+		threshold := thresholds(p.Upper)
+		// The containment is computed as if the contained domain was the
+		// query, and the partition bound used is the one giving the lower
+		// Jaccard similarity, so no domains are missed within the partition.
+		if !feasible(p, i == len(e.Partitions)-1, size, threshold, dir) {
+			params[i] = param{1, 0}
+			continue
+		}
+		x, q := p.Upper, size
+		if dir == Subsets {
+			x, q = size, p.Lower
+			if q < 1 {
+				q = 1
+			}
+		}
+		key := cacheKey(x, q, threshold)
 		if cached, exist := e.paramCache.Get(key); exist {
 			params[i] = cached.(param)
 		} else {
-			optK, optL, _, _ := e.lshes[i].OptimalKL(x, size, threshold)
+			optK, optL, _, _ := e.lshes[i].OptimalKL(x, q, threshold)
 			computed := param{optK, optL}
+			if optK == 0 {
+				// No parameters are possible, e.g. for a NaN threshold
+				computed = param{1, 0}
+			}
 			e.paramCache.Set(key, computed)
 			params[i] = computed
 		}
 	}
-	// Collect candidates from all partitions
-	keyChan := make(chan string)
-	result = make([]string, 0)
+	return params
+}
+
+// feasible returns whether any domain of the partition can meet the
+// containment threshold, given the query domain size: a domain
+// containing the query domain has at least threshold*size values, and a
+// domain contained in it at most size/threshold. The last partition also
+// holds the domains larger than its upper bound.
+func feasible(p Partition, last bool, size int, threshold float64, dir Direction) bool {
+	if dir == Subsets {
+		return !(threshold > 0 && float64(p.Lower) > float64(size)/threshold)
+	}
+	return last || !(float64(p.Upper) < threshold*float64(size))
+}
+
+// withinBounds returns whether the partition can hold domains of sizes
+// from lower to upper, the last partition also holding the domains larger
+// than its upper bound.
+func withinBounds(p Partition, last bool, lower, upper int) bool {
+	return p.Lower <= upper && (last || p.Upper >= lower)
+}
+
+// sizeBounds returns the bounds of the candidate domain sizes
+// given the query domain size.
+func (opts *QueryOptions) sizeBounds(size int) (lower, upper int) {
+	lower, upper = opts.MinSize, maxInt
+	if opts.MaxSize > 0 {
+		upper = opts.MaxSize
+	}
+	if opts.MinRatio > 0 {
+		if r := int(math.Ceil(opts.MinRatio * float64(size))); r > lower {
+			lower = r
+		}
+	}
+	if opts.MaxRatio > 0 {
+		if r := int(math.Floor(opts.MaxRatio * float64(size))); r < upper {
+			upper = r
+		}
+	}
+	return lower, upper
+}
+
+// query writes the candidates from all partitions to out, until all are
+// written or opts.Done is closed. size is the query domain size.
+// It returns an error if the query is rejected by the admission controller,
+// or if a partition of a tiered index fails to load.
+func (e *LshEnsemble) query(sig Signature, size int, params []param, opts *QueryOptions, out chan<- string) error {
+	lower, upper := opts.sizeBounds(size)
+	bounded := lower > 0 || upper < maxInt
+	if bounded {
+		for i, p := range e.Partitions {
+			if !withinBounds(p, i == len(e.Partitions)-1, lower, upper) {
+				params[i] = param{1, 0}
+			}
+		}
+	}
+	if selected := opts.selected(len(params)); selected != nil {
+		for i := range params {
+			if !selected[i] {
+				params[i] = param{1, 0}
+			}
+		}
+	}
+	e.stats.record(params)
+	if len(sig) < e.numHash {
+		e.stats.recordShort()
+	}
+	release, err := e.admit(sig, params)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if e.tiers != nil {
+		unpin, err := e.tiers.pin(e.lshes, params)
+		if err != nil {
+			return err
+		}
+		defer unpin()
+	}
+	filter := bounded && e.hasRecords()
+	groupBy := opts.GroupBy
+	if groupBy == nil {
+		groupBy = e.groupBy
+	}
+	done, stop := opts.deadline()
+	dedup := opts.Dedup || opts.DedupScope != DedupPartition
+	if !dedup && !filter && groupBy == nil && opts.Limit <= 0 {
+		e.probe(sig, params, done, out)
+		if opts.IncludeEmpty {
+			e.probeIsolated(lower, upper, done, out)
+		}
+		if stop() {
+			return errPartial
+		}
+		return nil
+	}
+	probe := e.probe
+	// limited is closed once the limit of candidates is delivered
+	limited := make(chan struct{})
+	if opts.Limit > 0 {
+		probe = e.probeOrdered
+		done = anyDone(done, limited)
+	}
+	var once sync.Once
+	stopProbe := func() { once.Do(func() { close(limited) }) }
+	defer stopProbe()
+	keys := make(chan string)
+	var partial bool
+	go func() {
+		probe(sig, params, done, keys)
+		if opts.IncludeEmpty {
+			e.probeIsolated(lower, upper, done, keys)
+		}
+		partial = stop()
+		close(keys)
+	}()
+	var delivered int
+	var seen dedupSet = newKeySet(opts.DedupWindow)
+	if opts.DedupScope == DedupBitmap && groupBy == nil {
+		seen = newBitmapSet(e.keyIDs(), opts.DedupWindow)
+	}
+	for key := range keys {
+		if filter {
+			if rec, exist := e.record(key); exist && (rec.Size < lower || rec.Size > upper) {
+				continue
+			}
+		}
+		if groupBy != nil {
+			key = groupBy(key)
+		}
+		if dedup || groupBy != nil {
+			if !seen.add(key) {
+				continue
+			}
+		}
+		select {
+		case out <- key:
+		case <-opts.Done:
+			for range keys {
+			}
+			return nil
+		}
+		if delivered++; delivered == opts.Limit {
+			stopProbe()
+			for range keys {
+			}
+			return nil
+		}
+	}
+	if partial {
+		return errPartial
+	}
+	return nil
+}
+
+// probe writes the candidates of every partition to out, until all are
+// written or done is closed.
+func (e *LshEnsemble) probe(sig Signature, params []param, done <-chan struct{}, out chan<- string) {
+	if e.realtime != nil && !e.realtime.probe(e, sig, params, done, out) {
+		return
+	}
+	if e.numa != nil {
+		e.probeNUMA(sig, params, done, out)
+		return
+	}
+	if e.sequential {
+		e.probeSequential(sig, params, done, out)
+		return
+	}
 	var wg sync.WaitGroup
 	wg.Add(len(e.lshes))
-	start := time.Now()
 	for i := range e.lshes {
 		go func(lsh Lsh, k, l int) {
-			lsh.Query(sig, k, l, keyChan)
-			wg.Done()
+			defer wg.Done()
+			if l == 0 {
+				// The partition is skipped
+				return
+			}
+			f, K := lsh.forest(k)
+			f.query(sig, K, l, out, done)
 		}(e.lshes[i], params[i].k, params[i].l)
 	}
-	go func() {
-		wg.Wait()
-		close(keyChan)
-	}()
-	for key := range keyChan {
-		result = append(result, key)
-	}
-	dur = time.Since(start)
-	return result, dur
+	wg.Wait()
 }
 
 // Make a cache key with threshold precision to 2 decimal points
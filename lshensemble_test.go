@@ -0,0 +1,1875 @@
+package lshensemble
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// randomDomains generates domains of random sizes drawn from a shared
+// pool of values, sorted by size.
+func randomDomains(n, numHash int, seed int64) []*DomainRecord {
+	r := rand.New(rand.NewSource(seed))
+	recs := make([]*DomainRecord, n)
+	for i := range recs {
+		size := 10 + r.Intn(200)
+		mh := NewMinhash(benchmarkSeed, numHash)
+		for j := 0; j < size; j++ {
+			mh.Push([]byte(fmt.Sprintf("v%d", r.Intn(1000))))
+		}
+		recs[i] = &DomainRecord{
+			Key:       fmt.Sprintf("domain%d", i),
+			Size:      size,
+			Signature: mh.Signature(),
+		}
+	}
+	sort.Sort(BySize(recs))
+	return recs
+}
+
+func Test_AllPairs(t *testing.T) {
+	recs := randomDomains(100, 256, 1)
+	orig := recs[50]
+	dup := &DomainRecord{
+		Key:       "duplicate",
+		Size:      orig.Size,
+		Signature: orig.Signature,
+	}
+	recs = append(recs, dup)
+	// Most domains contain a fifth of the values of the smaller ones
+	const threshold = 0.2
+	sort.Sort(BySize(recs))
+	parts := BootstrapLshEnsemble(4, 256, 4, len(recs), Recs2Chan(recs)).Partitions
+	for _, options := range [][]Option{nil, {WithForestArray()}} {
+		index, _ := New(append(options, WithPartitions(parts), WithNumHash(256))...)
+		for _, rec := range recs {
+			index.AddDomain(rec, index.PartitionIndex(rec.Size))
+		}
+		index.Index()
+
+		pairs := make(chan Pair)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- index.AllPairs(threshold, pairs)
+			close(pairs)
+		}()
+		got := make(map[Pair]bool)
+		for p := range pairs {
+			if p.Query == p.Candidate || got[p] {
+				t.Fatal("self or repeated pair", p)
+			}
+			got[p] = true
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if !got[Pair{dup.Key, orig.Key}] || !got[Pair{orig.Key, dup.Key}] {
+			t.Fatal("duplicate domain not paired")
+		}
+		// The pairs are the candidates of the queries of every domain
+		var want int
+		for _, rec := range recs {
+			result, _ := index.Query(rec.Signature, rec.Size, threshold)
+			seen := make(map[string]bool)
+			for _, key := range result {
+				x := index.domains[key]
+				if key == rec.Key || seen[key] || estimateContainment(rec.Signature, rec.Size, x.Signature, x.Size) < threshold {
+					continue
+				}
+				seen[key] = true
+				if !got[Pair{rec.Key, key}] {
+					t.Fatal("pair not found", rec.Key, key)
+				}
+				want++
+			}
+		}
+		if len(got) != want {
+			t.Fatal(len(got), want)
+		}
+	}
+	if err := NewLshEnsemble([]Partition{{0, 10}}, 64, 4).AllPairs(0.8, make(chan Pair)); !errors.Is(err, ErrKeyNotRetained) {
+		t.Fatal(err)
+	}
+}
+
+func Test_QueryStream(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	expected, _ := index.Query(recs[10].Signature, recs[10].Size, 0.1)
+	var count int
+	for range index.QueryStream(recs[10].Signature, recs[10].Size, 0.1, &QueryOptions{Buffer: 10}) {
+		count++
+	}
+	if count != len(expected) {
+		t.Fatal(count, len(expected))
+	}
+	// Abandon the query after the first candidate
+	done := make(chan struct{})
+	out := index.QueryStream(recs[10].Signature, recs[10].Size, 0.1, &QueryOptions{Done: done})
+	<-out
+	close(done)
+	for range out {
+	}
+	// The index can be updated once the query is abandoned
+	index.Index()
+}
+
+func Test_QueryTimeout(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	expected, _ := index.Query(recs[10].Signature, recs[10].Size, 0.1)
+	result, partial := index.QueryTimeout(recs[10].Signature, recs[10].Size, 0.1, time.Hour)
+	if partial || len(result) != len(expected) {
+		t.Fatal(partial, len(result), len(expected))
+	}
+	done, stop := (&QueryOptions{Timeout: time.Millisecond}).deadline()
+	<-done
+	if !stop() {
+		t.Fatal("timeout not reported")
+	}
+	// A stalled consumer does not hold the query past the timeout
+	out := index.QueryStream(recs[10].Signature, recs[10].Size, 0.1, &QueryOptions{Timeout: 10 * time.Millisecond})
+	<-out
+	time.Sleep(50 * time.Millisecond)
+	for range out {
+	}
+	index.Index()
+}
+
+func Test_QueryDedup(t *testing.T) {
+	recs := randomDomains(10, 64, 1)
+	parts := []Partition{{0, 100}, {100, 1000}}
+	index := NewLshEnsemble(parts, 64, 4)
+	// Index the same key in both partitions
+	index.Add("key", recs[0].Signature, 0)
+	index.Add("key", recs[0].Signature, 1)
+	index.Index()
+	var count int
+	for range index.QueryStream(recs[0].Signature, recs[0].Size, 1.0, &QueryOptions{Dedup: true}) {
+		count++
+	}
+	if count != 1 {
+		t.Fatal(count)
+	}
+	count = 0
+	for range index.QueryStream(recs[0].Signature, recs[0].Size, 1.0, &QueryOptions{Dedup: true, DedupWindow: 1}) {
+		count++
+	}
+	if count != 1 {
+		t.Fatal(count)
+	}
+	// The frozen index uses the ids of its key dictionaries
+	frozen := index.Freeze()
+	for _, index := range []*LshEnsemble{index, frozen} {
+		for _, scope := range []DedupScope{DedupPartition, DedupGlobal, DedupBitmap} {
+			count = 0
+			for range index.QueryStream(recs[0].Signature, recs[0].Size, 1.0, &QueryOptions{DedupScope: scope}) {
+				count++
+			}
+			want := 1
+			if scope == DedupPartition {
+				want = 2
+			}
+			if count != want {
+				t.Fatal(scope, count)
+			}
+		}
+	}
+	if ids := frozen.keyIDs(); ids.ids != nil || ids.dicts == nil {
+		t.Fatal("ids assigned to a frozen index")
+	}
+	// The keys without ids are tracked in a set
+	b := newBitmapSet(&keyIDs{ids: map[string]int{"a": 0, "b": 1}, n: 2}, 0)
+	for i, key := range []string{"a", "b", "c", "a", "b", "c"} {
+		if got, want := b.add(key), i < 3; got != want {
+			t.Fatal(i, key, got)
+		}
+	}
+	// A key is suppressed only within the window
+	s := newKeySet(2)
+	for i, key := range []string{"a", "b", "a", "c", "a", "b"} {
+		if got, want := s.add(key), i != 2; got != want {
+			t.Fatal(i, key, got)
+		}
+	}
+}
+
+func Test_QueryByKey(t *testing.T) {
+	recs := randomDomains(200, 256, 1)
+	index := NewLshEnsemble([]Partition{{0, 100}, {101, 300}}, 256, 4)
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	// An identical domain is found in both directions
+	twin := &DomainRecord{Key: "twin", Size: recs[50].Size, Signature: recs[50].Signature}
+	index.AddDomain(twin, index.PartitionIndex(twin.Size))
+	index.Index()
+	for _, dir := range []Direction{Supersets, Subsets} {
+		result, err := index.QueryByKey(recs[50].Key, 0.9, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, key := range result {
+			if key == recs[50].Key {
+				t.Fatal("domain queried returned")
+			}
+			found = found || key == twin.Key
+		}
+		if !found {
+			t.Fatal("identical domain not found", dir)
+		}
+	}
+	if _, err := index.QueryByKey("unknown", 0.5, Supersets); err != ErrKeyNotRetained {
+		t.Fatal(err)
+	}
+}
+
+func Test_QuerySubsets(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	query := NewMinhash(benchmarkSeed, 256)
+	for i := 0; i < 500; i++ {
+		query.Push([]byte(fmt.Sprintf("v%d", i)))
+	}
+	// Domains contained in the query, and larger domains disjoint from it
+	var recs []*DomainRecord
+	for i := 0; i < 100; i++ {
+		size := 300 + r.Intn(200)
+		mh := NewMinhash(benchmarkSeed, 256)
+		for _, v := range r.Perm(500)[:size] {
+			mh.Push([]byte(fmt.Sprintf("v%d", v)))
+		}
+		recs = append(recs, &DomainRecord{Key: fmt.Sprintf("subset%d", i), Size: size, Signature: mh.Signature()})
+	}
+	for i := 0; i < 100; i++ {
+		size := 1000 + r.Intn(1000)
+		mh := NewMinhash(benchmarkSeed, 256)
+		for j := 0; j < size; j++ {
+			mh.Push([]byte(fmt.Sprintf("w%d", r.Int())))
+		}
+		recs = append(recs, &DomainRecord{Key: fmt.Sprintf("other%d", i), Size: size, Signature: mh.Signature()})
+	}
+	sort.Sort(BySize(recs))
+	index := BootstrapLshEnsemble(4, 256, 4, len(recs), Recs2Chan(recs))
+
+	result, _ := index.QuerySubsets(query.Signature(), 500, 0.8)
+	var subsets int
+	for _, key := range result {
+		if strings.HasPrefix(key, "other") {
+			t.Fatal("domain too large to be contained", key)
+		}
+		subsets++
+	}
+	if subsets < 90 {
+		t.Fatal("subsets found", subsets)
+	}
+	var streamed int
+	for range index.QueryStream(query.Signature(), 500, 0.8, &QueryOptions{Direction: Subsets}) {
+		streamed++
+	}
+	if streamed != len(result) {
+		t.Fatal(streamed, len(result))
+	}
+}
+
+func Test_QuerySizeBounds(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	sizes := make(map[string]int)
+	index := NewLshEnsemble([]Partition{{0, 50}, {51, 100}, {101, 150}, {151, 300}}, 64, 4)
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+		sizes[rec.Key] = rec.Size
+	}
+	index.Index()
+	q := recs[100]
+	opts := &QueryOptions{MinSize: 60, MaxRatio: 1.5}
+	var count int
+	for key := range index.QueryStream(q.Signature, q.Size, 0.1, opts) {
+		if sizes[key] < 60 || float64(sizes[key]) > 1.5*float64(q.Size) {
+			t.Fatal(key, sizes[key])
+		}
+		count++
+	}
+	if count == 0 {
+		t.Fatal("no candidates")
+	}
+
+	// The last partition holds the domains larger than its upper bound
+	big := &DomainRecord{Key: "big", Size: 500, Signature: q.Signature}
+	index = NewLshEnsemble([]Partition{{0, 50}, {51, 100}}, 64, 4)
+	index.AddDomain(big, index.PartitionIndex(big.Size))
+	index.Index()
+	var streamed []string
+	for key := range index.QueryStream(big.Signature, big.Size, 0.9, &QueryOptions{MinSize: 300}) {
+		streamed = append(streamed, key)
+	}
+	if len(streamed) != 1 || streamed[0] != "big" {
+		t.Fatal(streamed)
+	}
+}
+
+func Test_LshEnsembleE(t *testing.T) {
+	if _, err := NewLshEnsembleE(nil, 64, 4); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+	if _, err := NewLshEnsemblePlusE([]Partition{{10, 0}}, 64, 4); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+	index, err := NewLshEnsembleE([]Partition{{0, 10}}, 64, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := randomSignature(64, 1)
+	if err := index.AddE("key", sig, 1); !errors.Is(err, ErrPartitionOutOfRange) {
+		t.Fatal(err)
+	}
+	if err := index.AddE("key", sig[:32], 0); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatal(err)
+	}
+	if _, _, err := index.QueryE(sig, 10, 1.5); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_New(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}}
+	if _, err := New(WithNumHash(64)); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+	if _, err := New(WithPartitions(parts), WithHashValueSize(3)); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+	recs := randomDomains(100, 64, 1)
+	for _, opts := range [][]Option{
+		{WithPartitions(parts), WithNumHash(64)},
+		{WithPartitions(parts), WithNumHash(64), WithForestArray(), WithHashValueSize(2)},
+		{WithPartitions(parts), WithNumHash(64), WithTrimScheme(TrimRehash | SaltBands)},
+		{WithPartitions(parts), WithNumHash(64), WithForestArray(), WithTrieTables()},
+	} {
+		index, err := New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+		}
+		index.Index()
+		result, _ := index.Query(recs[0].Signature, recs[0].Size, 1.0)
+		var found bool
+		for _, key := range result {
+			found = found || key == recs[0].Key
+		}
+		if !found {
+			t.Fatal("query domain not found")
+		}
+	}
+}
+
+type countingAdmission struct {
+	limiter  AdmissionController
+	admitted int
+	released int
+}
+
+func (c *countingAdmission) Admit(cost QueryCost) (func(), error) {
+	release, err := c.limiter.Admit(cost)
+	if err != nil {
+		return nil, err
+	}
+	c.admitted++
+	return func() {
+		c.released++
+		release()
+	}, nil
+}
+
+func (c *countingAdmission) Enter() func() {
+	return c.limiter.(AdmissionQueue).Enter()
+}
+
+func Test_AdmissionController(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	ac := &countingAdmission{limiter: NewAdmissionLimiter(1, 50)}
+	index.SetAdmissionController(ac)
+	// A selective query is admitted, an unselective one rejected
+	if _, _, err := index.QueryE(recs[100].Signature, recs[100].Size, 1.0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := index.QueryE(recs[100].Signature, recs[100].Size, 0.01); !errors.Is(err, ErrQueryRejected) {
+		t.Fatal(err)
+	}
+	for range index.QueryStream(recs[100].Signature, recs[100].Size, 0.01, nil) {
+		t.Fatal("candidate of rejected query")
+	}
+	if ac.admitted != 1 || ac.released != 1 {
+		t.Fatal(ac.admitted, ac.released)
+	}
+	// A query queued does not hold the lock of the index
+	leave := ac.Enter()
+	queried := make(chan struct{})
+	go func() {
+		index.Query(recs[100].Signature, recs[100].Size, 1.0)
+		close(queried)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	indexed := make(chan struct{})
+	go func() {
+		index.Index()
+		close(indexed)
+	}()
+	select {
+	case <-indexed:
+	case <-time.After(time.Second):
+		t.Fatal("index locked by a queued query")
+	}
+	leave()
+	<-queried
+}
+
+// blockingAdmission counts the queries admitted, once unblocked.
+type blockingAdmission struct {
+	unblock  chan struct{}
+	admitted int32
+}
+
+func (b *blockingAdmission) Admit(cost QueryCost) (func(), error) {
+	atomic.AddInt32(&b.admitted, 1)
+	<-b.unblock
+	return func() {}, nil
+}
+
+func Test_QueryCache(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	rec := recs[100]
+	want, _ := index.Query(rec.Signature, rec.Size, 0.5)
+	ac := &blockingAdmission{unblock: make(chan struct{})}
+	index.SetAdmissionController(ac)
+	index.SetQueryCache(&QueryCacheOptions{Coalesce: true, Size: 10})
+
+	// Concurrent identical queries are run once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, _ := index.Query(rec.Signature, rec.Size, 0.5); len(got) != len(want) {
+				t.Error(got, want)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(ac.unblock)
+	wg.Wait()
+	if ac.admitted != 1 {
+		t.Fatal(ac.admitted)
+	}
+	// The result is cached, and copied to the callers
+	got, _ := index.Query(rec.Signature, rec.Size, 0.5)
+	got[0] = ""
+	if got, _ := index.Query(rec.Signature, rec.Size, 0.5); ac.admitted != 1 || got[0] == "" {
+		t.Fatal(ac.admitted, got)
+	}
+	index.QuerySubsets(rec.Signature, rec.Size, 0.5)
+	if ac.admitted != 2 {
+		t.Fatal(ac.admitted)
+	}
+	// The results of the earlier generations are not served
+	gen := index.Generation()
+	index.Index()
+	if index.Generation() != gen+1 {
+		t.Fatal(index.Generation(), gen)
+	}
+	index.Query(rec.Signature, rec.Size, 0.5)
+	if ac.admitted != 3 {
+		t.Fatal(ac.admitted)
+	}
+	// Expired results are not used
+	index.SetQueryCache(&QueryCacheOptions{Size: 10, TTL: time.Nanosecond})
+	index.Query(rec.Signature, rec.Size, 0.5)
+	time.Sleep(time.Millisecond)
+	index.Query(rec.Signature, rec.Size, 0.5)
+	if ac.admitted != 5 {
+		t.Fatal(ac.admitted)
+	}
+}
+
+func Test_NUMANodes(t *testing.T) {
+	if cpus, err := parseCPUList("0-2,5"); err != nil || !reflect.DeepEqual(cpus, []int{0, 1, 2, 5}) {
+		t.Fatal(cpus, err)
+	}
+	if _, err := parseCPUList("3-1"); err == nil {
+		t.Fatal("invalid CPU list parsed")
+	}
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	var indexes []*LshEnsemble
+	for _, opts := range [][]Option{
+		{WithPartitions(parts), WithNumHash(64)},
+		{WithPartitions(parts), WithNumHash(64), WithNUMANodes([][]int{{0}, {0}})},
+	} {
+		index, err := New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+		}
+		index.Index()
+		indexes = append(indexes, index)
+	}
+	sameResults(t, indexes[0], indexes[1], recs)
+	// The index queries without its workers once closed
+	frozen := indexes[1].Freeze()
+	for i := 0; i < 2; i++ {
+		if err := indexes[1].Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sameResults(t, indexes[0], indexes[1], recs)
+	sameResults(t, indexes[0], frozen, recs)
+}
+
+func Test_Sequential(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	for _, array := range []bool{false, true} {
+		var indexes []*LshEnsemble
+		for _, sequential := range []bool{false, true} {
+			opts := []Option{WithPartitions(parts), WithNumHash(64)}
+			if array {
+				opts = append(opts, WithForestArray())
+			}
+			if sequential {
+				opts = append(opts, WithSequential())
+			}
+			index, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rec := range recs {
+				index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+			}
+			index.Index()
+			indexes = append(indexes, index)
+		}
+		sameResults(t, indexes[0], indexes[1], recs)
+	}
+}
+
+func Test_AddHashed(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	for _, array := range []bool{false, true} {
+		opts := []Option{WithPartitions(parts), WithNumHash(64), WithDeterministicBuild()}
+		if array {
+			opts = append(opts, WithForestArray())
+		}
+		index, _ := New(opts...)
+		hashed, _ := New(opts...)
+		for _, rec := range recs {
+			part := index.PartitionIndex(rec.Size)
+			index.Add(rec.Key, rec.Signature, part)
+			bandKeys, err := hashed.BandKeys(rec.Signature, part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := hashed.AddHashed(rec.Key, bandKeys, part); err != nil {
+				t.Fatal(err)
+			}
+		}
+		index.Index()
+		hashed.Index()
+		var want, got bytes.Buffer
+		index.Save(&want)
+		hashed.Save(&got)
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatal("different hashed index")
+		}
+		bandKeys, _ := hashed.BandKeys(recs[0].Signature, 0)
+		if err := hashed.AddHashed("key", bandKeys[1:], 0); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatal(err)
+		}
+		bandKeys[0] = bandKeys[0][1:]
+		if err := hashed.AddHashed("key", bandKeys, 0); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatal(err)
+		}
+	}
+	f := NewLshForest(4, 16)
+	f.AddHashed("key", f.BandKeys(recs[0].Signature))
+	f.Index()
+	out := make(chan string, 1)
+	f.Query(recs[0].Signature, 4, 16, out)
+	if key := <-out; key != "key" {
+		t.Fatal(key)
+	}
+}
+
+func Test_Rebalance(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := NewLshEnsemble([]Partition{{0, 20}, {21, 40}, {41, 1000}}, 64, 4)
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	if err := index.Rebalance(); err != nil {
+		t.Fatal(err)
+	}
+	counts := make([]int, len(index.Partitions))
+	for _, part := range index.indexedKeys() {
+		counts[part]++
+	}
+	for i, count := range counts {
+		if count < len(recs)/len(counts)-1 {
+			t.Fatal(i, counts, index.Partitions)
+		}
+	}
+	for _, rec := range recs {
+		result, _ := index.Query(rec.Signature, rec.Size, 1)
+		var found bool
+		for _, key := range result {
+			found = found || key == rec.Key
+		}
+		if !found {
+			t.Fatal("domain not found", rec.Key)
+		}
+	}
+	index.Add("key", recs[0].Signature, 0)
+	if err := index.Rebalance(); !errors.Is(err, ErrKeyNotRetained) {
+		t.Fatal(err)
+	}
+}
+
+func Test_Explain(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	index, err := New(WithPartitions(parts), WithNumHash(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	rec := recs[0]
+	want, _ := index.Query(rec.Signature, rec.Size, 0.5)
+	x := index.Explain(rec.Signature, rec.Size, 0.5, nil)
+	if len(x.Candidates) != len(want) {
+		t.Fatal(x.Candidates, want)
+	}
+	if got := x.Partition(rec.Key); len(got) != 1 || got[0] != index.PartitionIndex(rec.Size) {
+		t.Fatal(got)
+	}
+	for i, px := range x.Partitions {
+		if px.Skipped == "" && len(px.Bands) != px.L {
+			t.Errorf("partition %d: %d bands probed, L=%d", i, len(px.Bands), px.L)
+		}
+	}
+	x = index.Explain(rec.Signature, rec.Size, 0.5, &QueryOptions{MinSize: 301})
+	if x.Partitions[0].Skipped == "" || x.Partitions[2].Skipped != "" {
+		t.Fatal(x)
+	}
+	for _, key := range x.Candidates {
+		if index.domains[key].Size < 301 {
+			t.Fatal(key, index.domains[key].Size)
+		}
+	}
+	// The last partition holds the domains larger than its upper bound
+	x = index.Explain(rec.Signature, rec.Size, 0.5, &QueryOptions{MinSize: 1001})
+	if x.Partitions[1].Skipped == "" || x.Partitions[2].Skipped != "" {
+		t.Fatal(x)
+	}
+}
+
+func Test_QueryFunc(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	index, _ := New(WithPartitions(parts), WithNumHash(64))
+	for _, rec := range recs {
+		index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	threshold := func(upper int) float64 {
+		if upper > 300 {
+			return 1.0
+		}
+		return 0.5
+	}
+	for _, rec := range recs[:20] {
+		loose := index.Explain(rec.Signature, rec.Size, 0.5, nil)
+		strict := index.Explain(rec.Signature, rec.Size, 1.0, nil)
+		want := make(map[string]bool)
+		for i, px := range loose.Partitions {
+			if parts[i].Upper > 300 {
+				px = strict.Partitions[i]
+			}
+			for _, key := range px.Candidates {
+				want[key] = true
+			}
+		}
+		got, _ := index.QueryFunc(rec.Signature, rec.Size, threshold)
+		if len(got) != len(want) {
+			t.Fatal(rec.Key, len(got), len(want))
+		}
+		for _, key := range got {
+			if !want[key] {
+				t.Fatal(rec.Key, key)
+			}
+		}
+	}
+}
+
+func Test_QueryStats(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	index, _ := New(WithPartitions(parts), WithNumHash(64))
+	for _, rec := range recs {
+		index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	// No domain of the first partition can contain 250 values
+	index.Query(recs[0].Signature, 500, 0.5)
+	if stats := index.QueryStats(); stats.Queries != 1 || stats.Skipped != 1 || stats.Probed != 2 {
+		t.Fatalf("%+v", stats)
+	}
+	if x := index.Explain(recs[0].Signature, 500, 0.5, nil); x.Partitions[0].Skipped == "" {
+		t.Fatal(x)
+	}
+}
+
+func Test_GroupBy(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(50, 64, 1)
+	entity := func(key string) string { return strings.SplitN(key, "/", 2)[0] }
+	index, _ := New(WithPartitions(parts), WithNumHash(64), WithGroupBy(entity))
+	for _, rec := range recs {
+		// Three replicas of every domain
+		for i := 0; i < 3; i++ {
+			replica := *rec
+			replica.Key = fmt.Sprintf("%s/%d", rec.Key, i)
+			index.AddDomain(&replica, index.PartitionIndex(rec.Size))
+		}
+	}
+	index.Index()
+	rec := recs[0]
+	result, _ := index.Query(rec.Signature, rec.Size, 1.0)
+	var found int
+	for _, key := range result {
+		if key == rec.Key {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Fatal(result)
+	}
+	result, _ = index.QueryByKey(rec.Key+"/0", 1.0, Supersets)
+	for _, key := range result {
+		if key == rec.Key {
+			t.Fatal("entity of the query domain returned", result)
+		}
+	}
+	// The keys are returned with a GroupBy of the query
+	var keys int
+	for key := range index.QueryStream(rec.Signature, rec.Size, 1.0, &QueryOptions{
+		GroupBy: func(key string) string { return key },
+	}) {
+		if entity(key) == rec.Key {
+			keys++
+		}
+	}
+	if keys != 3 {
+		t.Fatal(keys)
+	}
+	// The frozen copies group the keys as well
+	for _, frozen := range []*LshEnsemble{index.Freeze(), index.FreezeCompact()} {
+		result, _ := frozen.Query(rec.Signature, rec.Size, 1.0)
+		for _, key := range result {
+			if strings.Contains(key, "/") {
+				t.Fatal("key not grouped", result)
+			}
+		}
+	}
+}
+
+func Test_QueryPipeline(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	// The query domain comes first among the ties of containment 1
+	recs[0].Key = "domain"
+	index, _ := New(WithPartitions(parts), WithNumHash(64))
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	rec := recs[0]
+	results := index.QueryPipeline(rec.Signature, rec.Size, 0.2, nil,
+		Dedup(), Verify(0.2), Filter(func(r Result) bool { return r.Key != "x" }), Rank(), Limit(5))
+	if len(results) == 0 || len(results) > 5 || results[0].Key != rec.Key || results[0].Containment != 1 {
+		t.Fatal(results)
+	}
+	sizes := make(map[string]int)
+	for _, rec := range recs {
+		sizes[rec.Key] = rec.Size
+	}
+	for i, r := range results {
+		if r.Containment < 0.2 || (i > 0 && r.Containment > results[i-1].Containment) {
+			t.Fatal(results)
+		}
+		if r.Size != sizes[r.Key] {
+			t.Fatal(r, sizes[r.Key])
+		}
+	}
+	ranked := RankBy(func(r Result) float64 { return r.Containment })([]Result{{"a", math.NaN(), 0}, {"b", 0.5, 0}, {"c", 0.9, 0}})
+	if ranked[0].Key != "c" || ranked[1].Key != "b" || ranked[2].Key != "a" {
+		t.Fatal(ranked)
+	}
+}
+
+func Test_QueryPipelineExclude(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	retained, _ := New(WithPartitions(parts), WithNumHash(64))
+	index, _ := New(WithPartitions(parts), WithNumHash(64))
+	for _, rec := range recs {
+		retained.AddDomain(rec, retained.PartitionIndex(rec.Size))
+		index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+	}
+	retained.Index()
+	index.Index()
+	q, x := recs[0], recs[1]
+	// The query domain is excluded by its own signature
+	for _, e := range []*LshEnsemble{retained, index} {
+		for _, r := range e.QueryPipeline(q.Signature, q.Size, 0.2, nil, e.Exclude(q.Signature, q.Size, 0.5, Supersets)) {
+			if r.Key == q.Key {
+				t.Fatal("excluded domain returned")
+			}
+		}
+	}
+	// The results are those without the estimated containment, or not
+	// candidates of the query of the exclusion domain
+	for _, r := range retained.QueryPipeline(q.Signature, q.Size, 0.2, nil, retained.Exclude(x.Signature, x.Size, 0.3, Subsets)) {
+		if retained.verified(x.Signature, x.Size, Subsets, r.Key).Containment >= 0.3 {
+			t.Fatal(r.Key)
+		}
+	}
+	minus := make(map[string]bool)
+	for key := range index.QueryStream(x.Signature, x.Size, 0.3, nil) {
+		minus[key] = true
+	}
+	all := index.QueryPipeline(q.Signature, q.Size, 0.2, nil, Dedup())
+	kept := index.QueryPipeline(q.Signature, q.Size, 0.2, nil, index.Exclude(x.Signature, x.Size, 0.3, Supersets), Dedup())
+	var want int
+	for _, r := range all {
+		if !minus[r.Key] {
+			want++
+		}
+	}
+	if len(kept) != want {
+		t.Fatal(len(kept), want)
+	}
+}
+
+func Test_QueryPipelineVerifiers(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(500, 64, 1)
+	// The candidates are found in the same order by a sequential index
+	index, _ := New(WithPartitions(parts), WithNumHash(64), WithSequential())
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	for _, rec := range recs[:10] {
+		want := index.QueryPipeline(rec.Signature, rec.Size, 0.1, nil)
+		got := index.QueryPipeline(rec.Signature, rec.Size, 0.1, &QueryOptions{Verifiers: 4})
+		if !reflect.DeepEqual(got, want) {
+			t.Fatal("verified out of order", got, want)
+		}
+		unordered := index.QueryPipeline(rec.Signature, rec.Size, 0.1, &QueryOptions{Verifiers: 4, UnorderedVerify: true})
+		byKey := func(results []Result) []Result {
+			sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+			return results
+		}
+		if !reflect.DeepEqual(byKey(unordered), byKey(want)) {
+			t.Fatal(unordered, want)
+		}
+	}
+}
+
+func Test_SignatureStore(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	path := t.TempDir() + "/signatures"
+	file, err := OpenFileSignatureStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCachedSignatureStore(file, 10)
+	// The candidates are found in the same order by sequential indexes
+	stored, _ := New(WithPartitions(parts), WithNumHash(64), WithSequential(), WithSignatureStore(cache))
+	index, _ := New(WithPartitions(parts), WithNumHash(64), WithSequential())
+	for _, rec := range recs {
+		stored.AddDomain(rec, stored.PartitionIndex(rec.Size))
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	stored.Index()
+	index.Index()
+	for _, rec := range stored.domains {
+		if rec.Signature != nil {
+			t.Fatal("signature retained in memory", rec.Key)
+		}
+	}
+	for _, rec := range recs[:20] {
+		want := index.QueryPipeline(rec.Signature, rec.Size, 0.5, nil, Verify(0.5), Rank())
+		got := stored.QueryPipeline(rec.Signature, rec.Size, 0.5, nil, Verify(0.5), Rank())
+		if !reflect.DeepEqual(got, want) {
+			t.Fatal(got, want)
+		}
+	}
+	if hits, misses := cache.Stats(); hits == 0 || misses == 0 || cache.Len() != 10 {
+		t.Fatal(hits, misses, cache.Len())
+	}
+	if _, err := stored.QueryByKey(recs[0].Key, 0.5, Supersets); err != nil {
+		t.Fatal(err)
+	}
+	if err := stored.Rebalance(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The signatures are indexed again when the file is reopened, without
+	// the incomplete record at its end
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{3, 'a', 'b'})
+	f.Close()
+	file, err = OpenFileSignatureStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, rec := range recs {
+		sig, err := file.Get(rec.Key)
+		if err != nil || !reflect.DeepEqual(sig, rec.Signature) {
+			t.Fatal(rec.Key, err)
+		}
+	}
+	if _, err := file.Get("ab"); !errors.Is(err, ErrKeyNotRetained) {
+		t.Fatal(err)
+	}
+
+	blobs := &BlobSignatureStore{Store: DirStore(t.TempDir()), Prefix: "signatures"}
+	if err := blobs.Put("a/../b", recs[0].Signature); err != nil {
+		t.Fatal(err)
+	}
+	if sig, err := blobs.Get("a/../b"); err != nil || !reflect.DeepEqual(sig, recs[0].Signature) {
+		t.Fatal(sig, err)
+	}
+}
+
+func Test_CompactSizes(t *testing.T) {
+	if _, err := New(WithPartitions(make([]Partition, 2)), WithCompactSizes()); err == nil {
+		t.Fatal("expected an error without a signature store")
+	}
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	compact, _ := New(WithPartitions(parts), WithNumHash(64), WithSequential(), WithSignatureStore(NewMemorySignatureStore()), WithCompactSizes())
+	index, _ := New(WithPartitions(parts), WithNumHash(64), WithSequential())
+	// The sizes are merged by every Index()
+	for _, batch := range [][]*DomainRecord{recs[:150], recs[100:]} {
+		for _, rec := range batch {
+			compact.AddDomain(rec, compact.PartitionIndex(rec.Size))
+			index.AddDomain(rec, index.PartitionIndex(rec.Size))
+		}
+		compact.Index()
+		index.Index()
+	}
+	if len(compact.domains) != 0 || compact.sizes.len() != len(recs) {
+		t.Fatal(len(compact.domains), compact.sizes.len())
+	}
+	for _, rec := range recs {
+		got, exist := compact.record(rec.Key)
+		if !exist || got.Size != rec.Size {
+			t.Fatal(rec.Key, got)
+		}
+	}
+	if _, exist := compact.record("missing"); exist {
+		t.Fatal("missing key found")
+	}
+	for _, rec := range recs[:20] {
+		want := index.QueryPipeline(rec.Signature, rec.Size, 0.5, nil, Verify(0.5), Rank())
+		got := compact.QueryPipeline(rec.Signature, rec.Size, 0.5, nil, Verify(0.5), Rank())
+		if !reflect.DeepEqual(got, want) {
+			t.Fatal(got, want)
+		}
+		wantKeys, _ := index.QueryByKey(rec.Key, 0.5, Supersets)
+		gotKeys, _ := compact.QueryByKey(rec.Key, 0.5, Supersets)
+		sort.Strings(wantKeys)
+		sort.Strings(gotKeys)
+		if !reflect.DeepEqual(gotKeys, wantKeys) {
+			t.Fatal(gotKeys, wantKeys)
+		}
+	}
+	var b1, b2 bytes.Buffer
+	if err := index.ExportJSON(&b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := compact.ExportJSON(&b2); err != nil {
+		t.Fatal(err)
+	}
+	// The buckets of equal hash keys may be in another order
+	domainLines := func(b bytes.Buffer) []string {
+		var lines []string
+		for _, line := range strings.Split(b.String(), "\n") {
+			if strings.Contains(line, `"type":"domain"`) {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+	if lines := domainLines(b2); len(lines) != len(recs) || !reflect.DeepEqual(lines, domainLines(b1)) {
+		t.Fatal("exported domains differ")
+	}
+	if err := compact.Rebalance(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Doctor(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := NewLshEnsemble([]Partition{{0, 20}, {21, 40}, {41, 1000}}, 64, 4)
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	// Degenerate domains sharing a signature fill a bucket
+	for i := 0; i < 30; i++ {
+		index.AddDomain(&DomainRecord{Key: fmt.Sprintf("same-%d", i), Size: 500, Signature: recs[0].Signature}, 2)
+	}
+	index.Index()
+	index.AddDomain(&DomainRecord{Key: "pending", Size: 10, Signature: recs[1].Signature}, 0)
+	report := index.Doctor(&DoctorOptions{Samples: 300, Rand: rand.New(rand.NewSource(1))})
+	if report.Sampled != len(recs)+30 || report.SelfRecall != 1 || report.MeanCandidates < 1 {
+		t.Fatal(report)
+	}
+	if len(report.Buckets) == 0 || report.Buckets[0].Keys < 30 || report.Buckets[0].Partition != 2 {
+		t.Fatal(report)
+	}
+	report = index.Doctor(&DoctorOptions{Samples: 10})
+	if report.Sampled != 10 {
+		t.Fatal(report)
+	}
+}
+
+func Test_Config(t *testing.T) {
+	parts := []Partition{{0, 20}, {21, 1000}}
+	index := NewLshEnsemblePlus(parts, 64, 4)
+	c := index.Config()
+	if c.NumHash != 64 || c.MaxK != 4 || index.NumHash() != 64 || index.MaxK() != 4 || len(c.Partitions) != 2 {
+		t.Fatal(c)
+	}
+	for i, part := range c.Partitions {
+		if part.Partition != parts[i] || !part.Array || len(part.Forests) != 4 {
+			t.Fatal(part)
+		}
+		for j, f := range part.Forests {
+			if f.K != j+1 || f.L != 64/(j+1) || f.HashValueSize != 4 {
+				t.Fatal(f)
+			}
+		}
+	}
+	f := NewLshForest(4, 16)
+	if f.K() != 4 || f.L() != 16 || f.HashValueSize() != 4 {
+		t.Fatal(f.K(), f.L(), f.HashValueSize())
+	}
+	a := NewLshForestArray(4, 64)
+	if a.MaxK() != 4 || a.NumHash() != 64 {
+		t.Fatal(a.MaxK(), a.NumHash())
+	}
+}
+
+func Test_Parallelism(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	if _, err := New(WithPartitions(parts), WithParallelism(-1)); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+	var indexes []*LshEnsemble
+	for _, parallelism := range []int{0, 1, 3} {
+		var tables int64
+		index, err := New(WithPartitions(parts), WithNumHash(64), WithForestArray(),
+			WithParallelism(parallelism), WithProgress(Progress{Tables: func(done, total int64) {
+				atomic.StoreInt64(&tables, done)
+			}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+		}
+		index.Index()
+		if atomic.LoadInt64(&tables) == 0 {
+			t.Fatal("no progress reported")
+		}
+		indexes = append(indexes, index)
+	}
+	sameResults(t, indexes[0], indexes[1], recs)
+	sameResults(t, indexes[0], indexes[2], recs)
+}
+
+func Test_VerifyElements(t *testing.T) {
+	values := func(from, to int) [][]byte {
+		var vs [][]byte
+		for v := from; v < to; v++ {
+			vs = append(vs, []byte(fmt.Sprintf("value%d", v)))
+		}
+		return vs
+	}
+	domains := map[string][][]byte{
+		"a": values(0, 100),
+		"b": values(0, 50),
+		"c": values(40, 200),
+		"d": values(30, 130),
+	}
+	index := NewLshEnsemble([]Partition{{0, 1000}}, 256, 4)
+	for key, vs := range domains {
+		mh := NewMinhash(1, 256)
+		filter := NewBloomFilter(len(vs), 0.01)
+		for _, v := range vs {
+			mh.Push(v)
+			filter.Add(v)
+		}
+		index.AddDomain(&DomainRecord{Key: key, Size: len(vs), Signature: mh.Signature()}, 0)
+		index.SetBloomFilter(key, filter)
+	}
+	index.Index()
+	query := values(0, 50)
+	mh := NewMinhash(1, 256)
+	for _, v := range query {
+		mh.Push(v)
+	}
+	results := index.QueryPipeline(mh.Signature(), len(query), 0.1, nil,
+		Dedup(), index.VerifyElements(query, 0.9), Rank())
+	var keys []string
+	for _, r := range results {
+		keys = append(keys, r.Key)
+		if r.Containment < 0.9 {
+			t.Fatal(r)
+		}
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Fatal(results)
+	}
+	filter := NewBloomFilter(100, 0.01)
+	for _, v := range domains["a"] {
+		filter.Add(v)
+	}
+	var fp int
+	for _, v := range values(1000, 2000) {
+		if filter.Has(v) {
+			fp++
+		}
+	}
+	if fp > 50 || filter.FalsePositiveRate() > 0.05 {
+		t.Fatal(fp, filter.FalsePositiveRate())
+	}
+}
+
+func Test_MultisetBuilder(t *testing.T) {
+	// Multisets of 20 templates repeated (1 + i%5) times
+	multiset := func(from, to, repeat int) map[string]int {
+		m := make(map[string]int)
+		for v := from; v < to; v++ {
+			m[fmt.Sprintf("template%d", v)] = 1 + (v+repeat)%5
+		}
+		return m
+	}
+	build := func(key string, m map[string]int) *DomainRecord {
+		b := NewMultisetBuilder(key, 1, 256)
+		for v, n := range m {
+			b.PushCount([]byte(v), n-1)
+			b.Push([]byte(v))
+		}
+		return b.Record()
+	}
+	q, x := multiset(0, 40, 0), multiset(10, 60, 0)
+	qRec, xRec := build("q", q), build("x", x)
+	exact := MultisetContainment(q, x)
+	if size := qRec.Size; size != 120 {
+		t.Fatal(size)
+	}
+	if est := estimateContainment(qRec.Signature, qRec.Size, xRec.Signature, xRec.Size); math.Abs(est-exact) > 0.15 {
+		t.Fatal(est, exact)
+	}
+	if c := MultisetContainment(q, q); c != 1 {
+		t.Fatal(c)
+	}
+	// A multiset of distinct values has the signature of its set
+	b := NewMultisetBuilder("s", 1, 64)
+	mh := NewMinhash(1, 64)
+	for _, v := range []string{"a", "b", "c"} {
+		b.Push([]byte(v))
+		mh.Push([]byte(v))
+	}
+	if !reflect.DeepEqual(b.Record().Signature, mh.Signature()) {
+		t.Fatal("signature differs from the set")
+	}
+	// The repeats are hashed alike however they are pushed, and not as
+	// values
+	pushed, counted := NewMultisetBuilder("p", 1, 64), NewMultisetBuilder("c", 1, 64)
+	for i := 0; i < 3; i++ {
+		pushed.Push([]byte("a"))
+	}
+	counted.PushCount([]byte("a"), 3)
+	if !reflect.DeepEqual(pushed.Record().Signature, counted.Record().Signature) {
+		t.Fatal("signature differs between Push and PushCount")
+	}
+	set := NewMultisetBuilder("s", 1, 64)
+	for _, v := range []string{"a", "a\x00\x02", "a\x00\x03"} {
+		set.Push([]byte(v))
+	}
+	if reflect.DeepEqual(counted.Record().Signature, set.Record().Signature) {
+		t.Fatal("repeats hashed as values")
+	}
+	// Multiplicities in the millions
+	half, full := NewMultisetBuilder("h", 1, 256), NewMultisetBuilder("f", 1, 256)
+	half.PushCount([]byte("a"), 1000000)
+	full.PushCount([]byte("a"), 2000000)
+	hRec, fRec := half.Record(), full.Record()
+	if est := estimateContainment(fRec.Signature, fRec.Size, hRec.Signature, hRec.Size); math.Abs(est-0.5) > 0.15 {
+		t.Fatal(est)
+	}
+}
+
+func Test_Federator(t *testing.T) {
+	values := func(from, to int) [][]byte {
+		var vs [][]byte
+		for v := from; v < to; v++ {
+			vs = append(vs, []byte(fmt.Sprintf("value%d", v)))
+		}
+		return vs
+	}
+	// Two indexes with different seeds and numbers of hash functions
+	build := func(seed, numHash int) *LshEnsemble {
+		index := NewLshEnsemble([]Partition{{0, 100}}, numHash, 4)
+		for i := 0; i < 10; i++ {
+			mh := NewMinhash(seed, numHash)
+			for _, v := range values(i*100, i*100+100) {
+				mh.Push(v)
+			}
+			index.Add(fmt.Sprintf("domain%d", i), mh.Signature(), 0)
+		}
+		index.Index()
+		return index
+	}
+	var thresholds []float64
+	f := NewFederator(
+		Member{Name: "a", Index: build(1, 256), Seed: 1},
+		Member{Name: "b", Index: build(2, 64), Seed: 2, Threshold: func(threshold float64) float64 {
+			thresholds = append(thresholds, threshold)
+			return threshold / 2
+		}},
+	)
+	results, err := f.Query(values(300, 350), 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, r := range results {
+		found[r.Member+"/"+r.Key] = true
+	}
+	if !found["a/domain3"] || !found["b/domain3"] || !reflect.DeepEqual(thresholds, []float64{0.1}) {
+		t.Fatal(results, thresholds)
+	}
+	if _, err := f.Query(values(0, 10), 2); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+// parityPartitioner assigns the domains of even and odd sizes to two
+// partitions of overlapping bounds.
+type parityPartitioner struct{}
+
+func (parityPartitioner) AssignPartition(size int) int { return size % 2 }
+
+func (parityPartitioner) Bounds(i int) (lower, upper int) { return 0, 1000 }
+
+func Test_Partitioner(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index, err := New(WithPartitioner(parityPartitioner{}, 2), WithNumHash(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(index.Partitions, []Partition{{0, 1000}, {0, 1000}}) {
+		t.Fatal(index.Partitions)
+	}
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	parts := index.indexedKeys()
+	for _, rec := range recs {
+		if part := parts[rec.Key]; part != rec.Size%2 {
+			t.Fatal(rec.Key, part)
+		}
+		result, _ := index.Query(rec.Signature, rec.Size, 1)
+		var found bool
+		for _, key := range result {
+			found = found || key == rec.Key
+		}
+		if !found {
+			t.Fatal("domain not found", rec.Key)
+		}
+	}
+	if anomalies := index.CheckIntegrity(false); len(anomalies) != 0 {
+		t.Fatal(anomalies)
+	}
+	if err := index.Rebalance(); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_QueryShortSignature(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	for _, index := range []*LshEnsemble{
+		NewLshEnsemble([]Partition{{0, 100}, {101, 300}, {301, 1000}}, 64, 4),
+		NewLshEnsemblePlus([]Partition{{0, 100}, {101, 300}, {301, 1000}}, 64, 4),
+	} {
+		for _, rec := range recs {
+			index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+		}
+		index.Index()
+		for _, n := range []int{0, 3, 32, 63} {
+			for _, rec := range recs[:10] {
+				index.Query(rec.Signature[:n], rec.Size, 0.5)
+				index.QueryPipeline(rec.Signature[:n], rec.Size, 0.5, nil)
+				index.Explain(rec.Signature[:n], rec.Size, 0.5, nil)
+			}
+		}
+		// A signature missing the last hash values still finds its domain
+		rec := recs[0]
+		result, _ := index.Query(rec.Signature[:48], rec.Size, 1)
+		var found bool
+		for _, key := range result {
+			found = found || key == rec.Key
+		}
+		if !found {
+			t.Fatal("domain not found", rec.Key)
+		}
+		if stats := index.QueryStats(); stats.ShortSignatures != 81 {
+			t.Fatalf("%+v", stats)
+		}
+		if _, _, err := index.QueryE(rec.Signature[:48], rec.Size, 1); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_IndexStats(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := NewLshEnsemble([]Partition{{0, 100}, {101, 300}, {301, 1000}}, 64, 4)
+	counts := make([]int, 3)
+	for _, rec := range recs {
+		index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+		counts[index.PartitionIndex(rec.Size)]++
+	}
+	index.Index()
+	stats := index.IndexStats()
+	for i, ps := range stats.Partitions {
+		if ps.Partition != index.Partitions[i] || ps.Keys != counts[i] || len(ps.Forests) != 1 || len(ps.Forests[0].Tables) != 16 {
+			t.Fatalf("%+v", ps)
+		}
+		for _, ts := range ps.Forests[0].Tables {
+			var buckets, keys int
+			for j, n := range ts.BucketSizes {
+				buckets += n
+				keys += n << j
+			}
+			if ts.Keys != counts[i] || buckets > ts.Buckets || keys > ts.Keys || (ts.Keys > 0) != (ts.MaxBucket > 0) {
+				t.Fatalf("%+v", ts)
+			}
+		}
+	}
+	index.PublishExpvar("lshensemble_test")
+	if v := expvar.Get("lshensemble_test").String(); !strings.Contains(v, `"bucketSizes"`) {
+		t.Fatal(v)
+	}
+}
+
+func Test_Realtime(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	for _, array := range []bool{false, true} {
+		opts := []Option{WithPartitions(parts), WithNumHash(64)}
+		if array {
+			opts = append(opts, WithForestArray())
+		}
+		index, err := New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		realtime, err := New(append(opts, WithRealtime(time.Hour))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+			realtime.Add(rec.Key, rec.Signature, realtime.PartitionIndex(rec.Size))
+		}
+		index.Index()
+		// The domains are searchable before Index()
+		sameResults(t, index, realtime, recs)
+		realtime.Index()
+		if len(realtime.realtime.domains) != 0 {
+			t.Fatal("buffer not emptied")
+		}
+		sameResults(t, index, realtime, recs)
+	}
+
+	index, err := New(WithPartitions(parts), WithNumHash(64), WithRealtime(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := recs[0]
+	index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+	for deadline := time.Now().Add(10 * time.Second); index.IndexStats().Partitions[index.PartitionIndex(rec.Size)].Keys == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("buffer not merged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := New(WithPartitions(parts), WithSpill(os.TempDir(), 10), WithRealtime(time.Second)); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_ValidateDomainRecord(t *testing.T) {
+	rec := randomDomains(1, 64, 1)[0]
+	if _, err := NewDomainRecord(rec.Key, rec.Size, rec.Signature, 64); err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []*DomainRecord{
+		{Key: "", Size: rec.Size, Signature: rec.Signature},
+		{Key: rec.Key, Size: 0, Signature: rec.Signature},
+		{Key: rec.Key, Size: rec.Size, Signature: rec.Signature[:32]},
+	} {
+		if _, err := NewDomainRecord(invalid.Key, invalid.Size, invalid.Signature, 64); !errors.Is(err, ErrInvalidRecord) {
+			t.Errorf("%+v: %v", invalid, err)
+		}
+	}
+	index := NewLshEnsemble([]Partition{{0, 1000}}, 64, 4)
+	if err := index.AddDomainE(&DomainRecord{Key: rec.Key, Size: -1, Signature: rec.Signature}, 0); !errors.Is(err, ErrInvalidRecord) {
+		t.Fatal(err)
+	}
+	if err := index.AddDomainE(rec, 1); !errors.Is(err, ErrPartitionOutOfRange) {
+		t.Fatal(err)
+	}
+	if err := index.AddDomainE(rec, 0); err != nil {
+		t.Fatal(err)
+	}
+	index.Index()
+	if result, _ := index.Query(rec.Signature, rec.Size, 1); len(result) != 1 || result[0] != rec.Key {
+		t.Fatal(result)
+	}
+}
+
+func Test_QueryLimit(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := NewLshEnsemble([]Partition{{0, 100}, {101, 300}, {301, 1000}}, 64, 4)
+	for _, rec := range recs {
+		index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	rec := recs[0]
+	all, _ := index.Query(rec.Signature, rec.Size, 0.1)
+	if len(all) <= 3 {
+		t.Fatal("too few candidates", len(all))
+	}
+	candidates := make(map[string]bool)
+	for _, key := range all {
+		candidates[key] = true
+	}
+	for i := 0; i < 2; i++ {
+		var limited []string
+		for key := range index.QueryStream(rec.Signature, rec.Size, 0.1, &QueryOptions{Limit: 3}) {
+			limited = append(limited, key)
+		}
+		if len(limited) != 3 {
+			t.Fatal(limited)
+		}
+		for _, key := range limited {
+			if !candidates[key] {
+				t.Fatal("not a candidate", key)
+			}
+		}
+	}
+	if yields := index.QueryStats().PartitionYields; len(yields) == 0 {
+		t.Fatal(yields)
+	}
+	// The partitions of the highest yields are probed first
+	var s queryStats
+	s.recordYield(0, 1)
+	s.recordYield(2, 10)
+	params := []param{{4, 1}, {4, 1}, {4, 1}, {4, 0}}
+	if order := s.order(params); !reflect.DeepEqual(order, []int{1, 2, 0}) {
+		t.Fatal(order)
+	}
+}
+
+func Test_QueryAdaptive(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	for _, index := range []*LshEnsemble{
+		BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs)),
+		BootstrapLshEnsemblePlus(4, 64, 4, len(recs), Recs2Chan(recs)),
+	} {
+		for _, rec := range recs[:20] {
+			all, _ := index.Query(rec.Signature, rec.Size, 0.5)
+			sort.Strings(all)
+			// All the bands are probed for too many results
+			result, _ := index.QueryAdaptive(rec.Signature, rec.Size, 0.5, len(recs)+1)
+			sort.Strings(result)
+			if !reflect.DeepEqual(result, all) {
+				t.Fatal(rec.Key, result, all)
+			}
+			// The domain itself matches the first band
+			result, _ = index.QueryAdaptive(rec.Signature, rec.Size, 0.5, 1)
+			var found bool
+			for _, key := range result {
+				found = found || key == rec.Key
+			}
+			if !found || len(result) > len(all) {
+				t.Fatal(rec.Key, result)
+			}
+		}
+	}
+}
+
+func Test_EnsembleQueryDescent(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	for _, index := range []*LshEnsemble{
+		BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs)),
+		BootstrapLshEnsemblePlus(4, 64, 4, len(recs), Recs2Chan(recs)),
+	} {
+		rec := recs[0]
+		// The domain matches the longest prefixes
+		few := index.QueryDescent(rec.Signature, 1)
+		var found bool
+		for _, key := range few {
+			found = found || key == rec.Key
+		}
+		if !found {
+			t.Fatal(few)
+		}
+		// Shorter prefixes find more candidates
+		many := index.QueryDescent(rec.Signature, len(recs))
+		if len(many) < len(few) || !reflect.DeepEqual(many[:len(few)], few) {
+			t.Fatal(few, many)
+		}
+	}
+}
+
+func Test_EnsembleTrieTables(t *testing.T) {
+	recs := randomDomains(300, 64, 1)
+	parts := []Partition{{0, 100}, {101, 300}}
+	index, _ := New(WithPartitions(parts), WithNumHash(64))
+	tries, _ := New(WithPartitions(parts), WithNumHash(64), WithTrieTables())
+	for i := 0; i < len(recs); i += 100 {
+		for _, rec := range recs[i : i+100] {
+			index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+			tries.Add(rec.Key, rec.Signature, tries.PartitionIndex(rec.Size))
+		}
+		index.Index()
+		tries.Index()
+		sameResults(t, index, tries, recs)
+	}
+	sameResults(t, index.Clone(), tries.Clone(), recs)
+}
+
+func Test_Audit(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	var buf bytes.Buffer
+	index, err := New(WithPartitions([]Partition{{0, 100}, {101, 1000}}), WithNumHash(64),
+		WithAudit(AuditOptions{SampleRate: 1, Hook: JSONAuditHook(&buf)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	q := recs[10]
+	result, _ := index.Query(q.Signature, q.Size, 0.5)
+	var streamed int
+	for range index.QueryStream(q.Signature, q.Size, 0.5, &QueryOptions{Direction: Subsets}) {
+		streamed++
+	}
+	index.QueryPipeline(q.Signature, q.Size, 0.5, nil)
+	dec := json.NewDecoder(&buf)
+	var audits []QueryAudit
+	for {
+		var a QueryAudit
+		if err := dec.Decode(&a); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		audits = append(audits, a)
+	}
+	if len(audits) != 3 {
+		t.Fatal(audits)
+	}
+	if a := audits[0]; a.Candidates != len(result) || a.Size != q.Size || a.Threshold != 0.5 || len(a.Params) != 2 || a.Latency <= 0 {
+		t.Fatal(a)
+	}
+	if a := audits[1]; a.Direction != Subsets || a.Candidates != streamed || a.Signature != audits[0].Signature {
+		t.Fatal(a)
+	}
+
+	// No query is audited at a low rate
+	var n int
+	index.SetAudit(&AuditOptions{SampleRate: 1e-9, Hook: func(QueryAudit) { n++ }})
+	for _, rec := range recs {
+		index.Query(rec.Signature, rec.Size, 0.5)
+	}
+	if n != 0 {
+		t.Fatal(n)
+	}
+	if _, err := New(WithPartitions([]Partition{{0, 100}}), WithAudit(AuditOptions{})); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_BucketSplitting(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	// The first band of half the domains is the same
+	for _, rec := range recs[1:100] {
+		copy(rec.Signature[:8], recs[0].Signature[:8])
+	}
+	parts := []Partition{{0, 1000}}
+	plain, _ := New(WithPartitions(parts), WithNumHash(64), WithMaxK(8))
+	split, err := New(WithPartitions(parts), WithNumHash(64), WithMaxK(8), WithBucketSplitting(10, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tries, _ := New(WithPartitions(parts), WithNumHash(64), WithMaxK(8), WithBucketSplitting(10, 4), WithTrieTables())
+	for _, index := range []*LshEnsemble{plain, split, tries} {
+		for _, rec := range recs {
+			index.AddDomain(rec, 0)
+		}
+		index.Index()
+	}
+	q := recs[0]
+	all, _ := plain.Query(q.Signature, q.Size, 0.5)
+	if len(all) < 100 {
+		t.Fatal(len(all))
+	}
+	for _, index := range []*LshEnsemble{split, tries} {
+		result, _ := index.Query(q.Signature, q.Size, 0.5)
+		if len(result) >= len(all) {
+			t.Fatal(len(result), len(all))
+		}
+		var found bool
+		for _, key := range result {
+			found = found || key == q.Key
+		}
+		if !found {
+			t.Fatal(result)
+		}
+		// The splits are kept by the frozen copies, but not persisted
+		sameResults(t, index, index.Freeze(), recs)
+		sameResults(t, index, index.FreezeCompact(), recs)
+		if err := index.Save(new(bytes.Buffer)); !errors.Is(err, ErrSplitBuckets) {
+			t.Fatal(err)
+		}
+		if err := index.SaveShared(new(bytes.Buffer)); !errors.Is(err, ErrSplitBuckets) {
+			t.Fatal(err)
+		}
+	}
+	if _, err := New(WithPartitions(parts), WithBucketSplitting(0, 4)); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_EmptyDomainPolicy(t *testing.T) {
+	recs := randomDomains(100, 64, 1)
+	var empties []*DomainRecord
+	for i := 0; i < 3; i++ {
+		mh := NewMinhash(benchmarkSeed, 64)
+		mh.Push([]byte("v1"))
+		empties = append(empties, &DomainRecord{Key: fmt.Sprintf("empty%d", i), Size: 1, Signature: mh.Signature()})
+	}
+	sorted := append(append([]*DomainRecord{}, empties...), recs...)
+
+	rejecting, _ := New(WithPartitions([]Partition{{0, 1000}}), WithNumHash(64), WithEmptyDomainPolicy(RejectEmptyDomains))
+	if err := rejecting.AddDomainE(empties[0], 0); !errors.Is(err, ErrEmptyDomain) {
+		t.Fatal(err)
+	}
+	if err := rejecting.AddDomainE(&DomainRecord{Key: "null", Size: 0}, 0); !errors.Is(err, ErrEmptyDomain) {
+		t.Fatal(err)
+	}
+	if err := rejecting.AddDomainE(recs[0], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	index, _ := New(WithPartitions(make([]Partition, 4)), WithNumHash(64), WithEmptyDomainPolicy(IsolateEmptyDomains))
+	index.Bootstrap(len(sorted), Recs2Chan(sorted))
+	if keys := index.EmptyDomains(); len(keys) != 3 || keys[0] != "empty0" {
+		t.Fatal(keys)
+	}
+	q := empties[0]
+	result, _ := index.Query(q.Signature, 10, 0)
+	included := make(map[string]bool)
+	for key := range index.QueryStream(q.Signature, 10, 0, &QueryOptions{IncludeEmpty: true}) {
+		included[key] = true
+	}
+	for _, key := range result {
+		if strings.HasPrefix(key, "empty") {
+			t.Fatal(result)
+		}
+	}
+	if len(included) != len(result)+3 || !included["empty2"] {
+		t.Fatal(len(included), len(result))
+	}
+
+	// The isolated domains are saved
+	data, err := index.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := DirStore(t.TempDir())
+	if err := index.SaveSnapshot(store, "snap"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ParseIndex(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := LoadSnapshot(store, "snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []*LshEnsemble{loaded, snapshot} {
+		if keys := l.EmptyDomains(); !reflect.DeepEqual(keys, index.EmptyDomains()) {
+			t.Fatal(keys)
+		}
+		n := 0
+		for range l.QueryStream(q.Signature, 10, 0, &QueryOptions{IncludeEmpty: true}) {
+			n++
+		}
+		if n != len(included) {
+			t.Fatal(n, len(included))
+		}
+	}
+
+	// The size 0 domains are still invalid records by default
+	plain, _ := New(WithPartitions([]Partition{{0, 1000}}), WithNumHash(64))
+	if err := plain.AddDomainE(&DomainRecord{Key: "null", Size: 0}, 0); !errors.Is(err, ErrInvalidRecord) {
+		t.Fatal(err)
+	}
+}
+
+func Test_MultiEnsemble(t *testing.T) {
+	recs := randomDomains(300, 64, 1)
+	m, err := NewMultiEnsemble(
+		Parameterization{0.9, []Option{WithPartitions(make([]Partition, 2)), WithNumHash(64), WithMaxK(16)}},
+		Parameterization{0.5, []Option{WithPartitions(make([]Partition, 8)), WithNumHash(64), WithMaxK(4)}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Bootstrap(len(recs), Recs2Chan(recs))
+	indexes := m.Indexes()
+	if len(indexes[0].Partitions) != 8 || m.Route(0.3) != indexes[0] || m.Route(0.8) != indexes[1] {
+		t.Fatal(indexes)
+	}
+	q := recs[100]
+	for _, threshold := range []float64{0.4, 0.95} {
+		result, _ := m.Query(q.Signature, q.Size, threshold)
+		expected, _ := m.Route(threshold).Query(q.Signature, q.Size, threshold)
+		sort.Strings(result)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatal(threshold, result, expected)
+		}
+	}
+	if _, err := NewMultiEnsemble(
+		Parameterization{0.5, []Option{WithPartitions(make([]Partition, 2)), WithNumHash(64)}},
+		Parameterization{0.9, []Option{WithPartitions(make([]Partition, 2)), WithNumHash(128)}},
+	); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_ReleaseOnIndex(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	options := []Option{WithPartitions(make([]Partition, 4)), WithNumHash(64), WithDuplicatePolicy(RejectDuplicates), WithTrieTables()}
+	index, _ := New(options...)
+	index.Bootstrap(len(recs), Recs2Chan(recs))
+	released, _ := New(append(options, WithReleaseOnIndex())...)
+	released.Bootstrap(len(recs), Recs2Chan(recs))
+	for _, lsh := range released.lshes {
+		for _, f := range lshForests(lsh) {
+			if f.initHashTables != nil {
+				t.Fatal("init hash tables not released")
+			}
+		}
+	}
+	if released.keyParts != nil {
+		t.Fatal("key dictionary not released")
+	}
+	sameResults(t, index, released, recs)
+	if err := released.AddDomainE(randomDomains(1, 64, 2)[0], 0); !errors.Is(err, ErrFrozenIndex) {
+		t.Fatal(err)
+	}
+	released.Index()
+	sameResults(t, index, released.Clone(), recs)
+}
+
+func Test_QueryPartitions(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	index, _ := New(WithPartitions(parts), WithNumHash(64))
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	if got := index.PartitionsBetween(150, 2000); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Fatal(got)
+	}
+	if got := index.PartitionsBetween(5000, 6000); !reflect.DeepEqual(got, []int{2}) {
+		t.Fatal(got)
+	}
+	for _, rec := range recs[:20] {
+		all := make(map[string]bool)
+		for key := range index.QueryStream(rec.Signature, rec.Size, 0.2, nil) {
+			all[key] = true
+		}
+		opts := &QueryOptions{Partitions: []int{0, 2, 7}}
+		for key := range index.QueryStream(rec.Signature, rec.Size, 0.2, opts) {
+			if p := index.PartitionIndex(index.domains[key].Size); p == 1 || !all[key] {
+				t.Fatal(key, p)
+			}
+		}
+		for key := range index.QueryStream(rec.Signature, rec.Size, 0.2, &QueryOptions{Partitions: []int{}}) {
+			t.Fatal("candidate of no partition", key)
+		}
+	}
+	x := index.Explain(recs[0].Signature, recs[0].Size, 0.2, &QueryOptions{Partitions: []int{1}})
+	if x.Partitions[0].Skipped != "not selected" || x.Partitions[1].Skipped == "not selected" {
+		t.Fatal(x.Partitions[0].Skipped, x.Partitions[1].Skipped)
+	}
+}
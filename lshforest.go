@@ -21,6 +21,9 @@ type initHashTable map[string]keys
 type bucket struct {
 	hashKey string
 	keys    keys
+	// split, if not nil, are the sub-buckets of the keys of a bucket split
+	// by WithBucketSplitting, keyed by their extensions.
+	split hashTable
 }
 
 type hashTable []bucket
@@ -39,11 +42,25 @@ type LshForest struct {
 	l              int
 	initHashTables []initHashTable
 	hashTables     []hashTable
-	hashKeyFunc    hashKeyFunc
-	hashValueSize  int
+	// hashKeyFuncs are the hash key functions of the bands.
+	hashKeyFuncs  []hashKeyFunc
+	hashValueSize int
+	// hashValueBits, if not zero, is the width of the hash values
+	// bit-packed in the hash keys, instead of hashValueSize bytes each.
+	hashValueBits int
+	trim          TrimScheme
+	// frozen replaces the hash tables of a frozen forest.
+	frozen []*frozenTable
+	// tries, if not nil, are the tries of the hash tables, created with
+	// WithTrieTables, or nil for the tables to index.
+	tries []*trie
+	// split, if not nil, splits the hot buckets, and initExtensions are
+	// then the extensions of the keys of initHashTables, in their order.
+	split          *bucketSplit
+	initExtensions []map[string][]string
 }
 
-func newLshForest(k, l, hashValueSize int) *LshForest {
+func newLshForest(k, l, hashValueSize int, trim TrimScheme) *LshForest {
 	if k < 0 || l < 0 {
 		panic("k and l must be positive")
 	}
@@ -55,118 +72,211 @@ func newLshForest(k, l, hashValueSize int) *LshForest {
 	for i := range initHashTables {
 		initHashTables[i] = make(initHashTable)
 	}
+	hashKeyFuncs := make([]hashKeyFunc, l)
+	for i := range hashKeyFuncs {
+		hashKeyFuncs[i] = hashKeyFuncGen(hashValueSize, trim, bandSalt(i))
+	}
 	return &LshForest{
 		k:              k,
 		l:              l,
 		hashValueSize:  hashValueSize,
+		trim:           trim,
 		initHashTables: initHashTables,
 		hashTables:     hashTables,
-		hashKeyFunc:    hashKeyFuncGen(hashValueSize),
+		hashKeyFuncs:   hashKeyFuncs,
+	}
+}
+
+// NewLshForestTrimmed uses hash values of hashValueSize bytes
+// (2, 4 or 8), trimmed from the MinHash values using the scheme.
+// It panics if the parameters are invalid.
+func NewLshForestTrimmed(k, l, hashValueSize int, scheme TrimScheme) *LshForest {
+	f, err := NewLshForestE(k, l, hashValueSize, scheme)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// NewLshForestE is like NewLshForestTrimmed, but returns an error
+// if the parameters are invalid.
+func NewLshForestE(k, l, hashValueSize int, scheme TrimScheme) (*LshForest, error) {
+	if k < 1 || l < 1 {
+		return nil, invalidParameter("k and l must be positive, got k=%d l=%d", k, l)
+	}
+	if hashValueSize != 2 && hashValueSize != 4 && hashValueSize != 8 {
+		return nil, invalidParameter("hash value size must be 2, 4 or 8, got %d", hashValueSize)
+	}
+	if !scheme.valid() {
+		return nil, invalidParameter("unknown trim scheme %d", scheme)
 	}
+	return newLshForest(k, l, hashValueSize, scheme), nil
 }
 
 // NewLshForest64 uses 64-bit hash values.
 func NewLshForest64(k, l int) *LshForest {
-	return newLshForest(k, l, 8)
+	return newLshForest(k, l, 8, DefaultTrimScheme)
 }
 
 // NewLshForest32 uses 32-bit hash values.
 // MinHash signatures with 64 bit hash values will have
-// their hash values trimed.
+// their hash values trimed using DefaultTrimScheme.
 func NewLshForest32(k, l int) *LshForest {
-	return newLshForest(k, l, 4)
+	return newLshForest(k, l, 4, DefaultTrimScheme)
 }
 
 // NewLshForest16 uses 16-bit hash values.
 // MinHash signatures with 64 or 32 bit hash values will have
-// their hash values trimed.
+// their hash values trimed using DefaultTrimScheme.
 func NewLshForest16(k, l int) *LshForest {
-	return newLshForest(k, l, 2)
+	return newLshForest(k, l, 2, DefaultTrimScheme)
 }
 
 // Add a key with MinHash signature into the index.
 // The key won't be searchable until Index() is called.
 func (f *LshForest) Add(key string, sig Signature) {
+	if f.frozen != nil {
+		panic(ErrFrozenIndex)
+	}
 	// Generate hash keys
 	Hs := make([]string, f.l)
 	for i := 0; i < f.l; i++ {
-		Hs[i] = f.hashKeyFunc(sig[i*f.k : (i+1)*f.k])
+		Hs[i] = f.hashKeyFuncs[i](sig[i*f.k : (i+1)*f.k])
+	}
+	var Es []string
+	if f.split != nil {
+		Es = make([]string, f.l)
+		for i := range Es {
+			Es[i] = f.extension(sig, i)
+		}
 	}
 	// Insert keys into the bootstrapping tables
 	var wg sync.WaitGroup
 	wg.Add(len(f.initHashTables))
 	for i := range f.initHashTables {
-		go func(ht initHashTable, hk, key string) {
+		go func(i int, ht initHashTable, hk, key string) {
 			if _, exist := ht[hk]; exist {
 				ht[hk] = append(ht[hk], key)
 			} else {
 				ht[hk] = make(keys, 1)
 				ht[hk][0] = key
 			}
+			if Es != nil {
+				f.initExtensions[i][hk] = append(f.initExtensions[i][hk], Es[i])
+			}
 			wg.Done()
-		}(f.initHashTables[i], Hs[i], key)
+		}(i, f.initHashTables[i], Hs[i], key)
 	}
 	wg.Wait()
 }
 
+// AddE is like Add, but returns an error if the signature is too short
+// for the forest.
+func (f *LshForest) AddE(key string, sig Signature) error {
+	if f.frozen != nil {
+		return ErrFrozenIndex
+	}
+	if err := checkSignature(sig, f.k*f.l); err != nil {
+		return err
+	}
+	f.Add(key, sig)
+	return nil
+}
+
 // Makes all the keys added searchable.
+// At most runtime.GOMAXPROCS(0) hash tables are indexed at once.
 func (f *LshForest) Index() {
-	var wg sync.WaitGroup
-	wg.Add(len(f.hashTables))
-	for i := range f.hashTables {
-		go func(htPtr *hashTable, initHtPtr *initHashTable) {
-			// Build sorted hash table using buckets from init hash tables
-			initHt := *initHtPtr
-			ht := *htPtr
-			for hashKey := range initHt {
-				ks, _ := initHt[hashKey]
-				ht = append(ht, bucket{
-					hashKey: hashKey,
-					keys:    ks,
-				})
-			}
-			sort.Sort(ht)
-			*htPtr = ht
-			// Reset the init hash tables
-			*initHtPtr = make(initHashTable)
-			wg.Done()
-		}(&(f.hashTables[i]), &(f.initHashTables[i]))
+	indexForests([]*LshForest{f}, 0)
+}
+
+// indexTable makes the keys added to the i-th hash table searchable.
+func (f *LshForest) indexTable(i int) {
+	if f.tries != nil {
+		f.indexTrie(i)
+		return
+	}
+	// Build sorted hash table using buckets from init hash tables
+	initHt := f.initTable(i)
+	if len(initHt) == 0 {
+		// Leave the hash table untouched, it may be
+		// shared with a clone
+		return
+	}
+	ht := f.hashTables[i]
+	for hashKey := range initHt {
+		ks, _ := initHt[hashKey]
+		ht = append(ht, f.newBucket(i, hashKey, ks))
+	}
+	sort.Sort(ht)
+	f.hashTables[i] = ht
+	// Reset the init hash tables
+	f.resetInitTable(i)
+}
+
+// resetInitTable resets the i-th init hash table, and its extensions.
+func (f *LshForest) resetInitTable(i int) {
+	f.initHashTables[i] = make(initHashTable)
+	if f.split != nil {
+		f.initExtensions[i] = make(map[string][]string)
 	}
-	wg.Wait()
 }
 
 // Return candidate keys given the query signature and parameters.
 func (f *LshForest) Query(sig Signature, K, L int, out chan string) {
+	f.query(sig, K, L, out, nil)
+}
+
+// QueryE is like Query, but returns an error if the parameters or the
+// signature are invalid for the forest, without writing to out.
+func (f *LshForest) QueryE(sig Signature, K, L int, out chan string) error {
+	if K != -1 && (K < 1 || K > f.k) {
+		return invalidParameter("K must be in [1, %d], got %d", f.k, K)
+	}
+	if L != -1 && (L < 1 || L > f.l) {
+		return invalidParameter("L must be in [1, %d], got %d", f.l, L)
+	}
+	if err := checkSignature(sig, f.k*f.l); err != nil {
+		return err
+	}
+	f.Query(sig, K, L, out)
+	return nil
+}
+
+// query writes the candidate keys to out, until all are written or
+// done is closed.
+func (f *LshForest) query(sig Signature, K, L int, out chan<- string, done <-chan struct{}) {
 	if K == -1 {
 		K = f.k
 	}
 	if L == -1 {
 		L = f.l
 	}
-	prefixSize := f.hashValueSize * K
+	L = f.bands(sig, K, L)
 	// Generate hash keys
 	Hs := make([]string, L)
 	for i := 0; i < L; i++ {
-		Hs[i] = f.hashKeyFunc(sig[i*f.k : i*f.k+K])
+		Hs[i] = f.hashKeyFuncs[i](sig[i*f.k : i*f.k+K])
 	}
 	// Query hash tables in parallel
 	keyChan := make(chan string)
 	var wg sync.WaitGroup
 	wg.Add(L)
 	for i := 0; i < L; i++ {
-		go func(ht hashTable, hk string) {
-			k := sort.Search(len(ht), func(x int) bool {
-				return ht[x].hashKey[:prefixSize] >= hk
-			})
-			if k < len(ht) && ht[k].hashKey[:prefixSize] == hk {
-				for j := k; j < len(ht) && ht[j].hashKey[:prefixSize] == hk; j++ {
-					for _, key := range ht[j].keys {
-						keyChan <- key
+		go func(t table, hk, ext string) {
+			defer wg.Done()
+			start, end := f.search(t, hk, K)
+			open := true
+			for b := start; b < end && open; b++ {
+				scanBucket(t, b, ext, func(key string) bool {
+					select {
+					case keyChan <- key:
+					case <-done:
+						open = false
 					}
-				}
+					return open
+				})
 			}
-			wg.Done()
-		}(f.hashTables[i], Hs[i])
+		}(f.table(i), Hs[i], f.extension(sig, i))
 	}
 	go func() {
 		wg.Wait()
@@ -177,11 +287,87 @@ func (f *LshForest) Query(sig Signature, K, L int, out chan string) {
 		if _, seen := seens[key]; seen {
 			continue
 		}
-		out <- key
+		select {
+		case out <- key:
+		case <-done:
+			// Let the table goroutines exit
+			for range keyChan {
+			}
+			return
+		}
 		seens[key] = true
 	}
 }
 
+// matches returns, for each of the first L hash tables, the buckets
+// matching the first K hash values of the band of the query signature.
+func (f *LshForest) matches(sig Signature, K, L int) []tableRange {
+	if K == -1 {
+		K = f.k
+	}
+	if L == -1 {
+		L = f.l
+	}
+	L = f.bands(sig, K, L)
+	matched := make([]tableRange, L)
+	for i := 0; i < L; i++ {
+		t := f.table(i)
+		start, end := f.search(t, f.hashKeyFuncs[i](sig[i*f.k:i*f.k+K]), K)
+		matched[i] = tableRange{t, start, end}
+	}
+	return matched
+}
+
+// bands returns the number of the first L bands of K hash values the
+// signature is long enough for, so a short query signature probes fewer
+// bands instead of panicking.
+func (f *LshForest) bands(sig Signature, K, L int) int {
+	if len(sig) < K {
+		return 0
+	}
+	if n := (len(sig)-K)/f.k + 1; n < L {
+		return n
+	}
+	return L
+}
+
+// table returns the i-th hash table.
+func (f *LshForest) table(i int) table {
+	if f.frozen != nil {
+		return f.frozen[i]
+	}
+	if f.tries != nil && f.tries[i] != nil {
+		return trieTable{f.hashTables[i], f.tries[i]}
+	}
+	return f.hashTables[i]
+}
+
+// TrimScheme returns the scheme trimming the MinHash values of the forest.
+func (f *LshForest) TrimScheme() TrimScheme {
+	return f.trim
+}
+
+// K returns the number of hash functions per band of the forest.
+func (f *LshForest) K() int {
+	return f.k
+}
+
+// L returns the number of bands, i.e. hash tables, of the forest.
+func (f *LshForest) L() int {
+	return f.l
+}
+
+// HashValueSize returns the number of bytes each hash value is trimmed to
+// in the hash keys of the forest, rounded up for bit-packed hash values.
+func (f *LshForest) HashValueSize() int {
+	return f.hashValueSize
+}
+
+// forest returns the forest itself.
+func (f *LshForest) forest(K int) (*LshForest, int) {
+	return f, K
+}
+
 // OptimalKL returns the optimal K and L for containment search,
 // and the false positive and negative probabilities.
 // where x is the indexed domain size, q is the query domain size,
@@ -190,8 +376,8 @@ func (f *LshForest) OptimalKL(x, q int, t float64) (optK, optL int, fp, fn float
 	minError := math.MaxFloat64
 	for l := 1; l <= f.l; l++ {
 		for k := 1; k <= f.k; k++ {
-			currFp := probFalsePositive(x, q, l, k, t, integrationPrecision)
-			currFn := probFalseNegative(x, q, l, k, t, integrationPrecision)
+			currFp := ProbFalsePositive(x, q, l, k, t, integrationPrecision)
+			currFn := ProbFalseNegative(x, q, l, k, t, integrationPrecision)
 			currErr := currFn + currFp
 			if minError > currErr {
 				minError = currErr
@@ -17,3 +17,51 @@ func Benchmark_LshForest_Insert10000(b *testing.B) {
 	}
 	f.Index()
 }
+
+// benchmarkForest returns a forest of 10000 keys indexed in 10 batches,
+// with tries if withTries is true.
+func benchmarkForest(withTries bool) (*LshForest, []Signature) {
+	sigs := make([]Signature, 10000)
+	for i := range sigs {
+		sigs[i] = randomSignature(64, int64(i))
+	}
+	f := NewLshForest16(2, 32)
+	if withTries {
+		f.tries = make([]*trie, f.l)
+	}
+	for i := range sigs {
+		f.Add(strconv.Itoa(i), sigs[i])
+		if (i+1)%1000 == 0 {
+			f.Index()
+		}
+	}
+	return f, sigs
+}
+
+func benchmarkForestIndex(b *testing.B, trie bool) {
+	for n := 0; n < b.N; n++ {
+		benchmarkForest(trie)
+	}
+}
+
+func Benchmark_LshForest_IndexBatches(b *testing.B) { benchmarkForestIndex(b, false) }
+
+func Benchmark_LshForest_IndexBatchesTrie(b *testing.B) { benchmarkForestIndex(b, true) }
+
+func benchmarkForestQuery(b *testing.B, trie bool) {
+	f, sigs := benchmarkForest(trie)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		out := make(chan string)
+		go func() {
+			f.Query(sigs[n%len(sigs)], 1, 32, out)
+			close(out)
+		}()
+		for range out {
+		}
+	}
+}
+
+func Benchmark_LshForest_Query(b *testing.B) { benchmarkForestQuery(b, false) }
+
+func Benchmark_LshForest_QueryTrie(b *testing.B) { benchmarkForestQuery(b, true) }
@@ -1,7 +1,12 @@
 package lshensemble
 
 import (
+	"errors"
+	"math"
 	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
 	"testing"
 )
 
@@ -16,7 +21,7 @@ func randomSignature(size int, seed int64) Signature {
 
 func Test_HashKeyFunc16(t *testing.T) {
 	sig := randomSignature(2, 1)
-	f := hashKeyFuncGen(2)
+	f := hashKeyFuncGen(2, TrimHigh, 0)
 	hashKey := f(sig)
 	if len(hashKey) != 2*2 {
 		t.Fatal(len(hashKey))
@@ -25,7 +30,7 @@ func Test_HashKeyFunc16(t *testing.T) {
 
 func Test_HashKeyFunc64(t *testing.T) {
 	sig := randomSignature(2, 1)
-	f := hashKeyFuncGen(8)
+	f := hashKeyFuncGen(8, TrimHigh, 0)
 	hashKey := f(sig)
 	if len(hashKey) != 8*2 {
 		t.Fatal(len(hashKey))
@@ -64,7 +69,291 @@ func Test_LshForest(t *testing.T) {
 	}
 }
 
+func Test_QueryDescent(t *testing.T) {
+	f := NewLshForest16(2, 4)
+	sig := randomSignature(8, 1)
+	// near matches the first hash value of every band, far no hash value
+	near := randomSignature(8, 2)
+	for b := 0; b < 4; b++ {
+		near[2*b] = sig[2*b]
+	}
+	f.Add("sig", sig)
+	f.Add("near", near)
+	f.Add("far", randomSignature(8, 3))
+	f.Index()
+	if result := f.QueryDescent(sig, 1); len(result) != 1 || result[0] != "sig" {
+		t.Fatal(result)
+	}
+	if result := f.QueryDescent(sig, 3); len(result) != 2 || result[0] != "sig" || result[1] != "near" {
+		t.Fatal(result)
+	}
+}
+
 func Test_LshForest_OptimalKL(t *testing.T) {
 	f := NewLshForest16(2, 32)
 	t.Log(f.OptimalKL(32, 12, 0.5))
 }
+
+func Test_Probabilities(t *testing.T) {
+	if area := Integral(func(x float64) float64 { return x }, 0, 1, DefaultIntegrationPrecision); math.Abs(area-0.5) > 1e-9 {
+		t.Fatal(area)
+	}
+	for _, c := range []float64{0.1, 0.5, 0.9} {
+		if p := FalsePositive(100, 50, 8, 4)(c) + FalseNegative(100, 50, 8, 4)(c); math.Abs(p-1) > 1e-9 {
+			t.Fatal(c, p)
+		}
+		if p := JaccardFalsePositive(8, 4)(c) + JaccardFalseNegative(8, 4)(c); math.Abs(p-1) > 1e-9 {
+			t.Fatal(c, p)
+		}
+	}
+	// No domain smaller than threshold*q is a false negative
+	if fn := ProbFalseNegative(10, 100, 8, 4, 0.5, DefaultIntegrationPrecision); fn != 0 {
+		t.Fatal(fn)
+	}
+	// More bands trade false negatives for false positives
+	fp1 := ProbFalsePositive(100, 50, 4, 4, 0.5, DefaultIntegrationPrecision)
+	fn1 := ProbFalseNegative(100, 50, 4, 4, 0.5, DefaultIntegrationPrecision)
+	fp2 := ProbFalsePositive(100, 50, 16, 4, 0.5, DefaultIntegrationPrecision)
+	fn2 := ProbFalseNegative(100, 50, 16, 4, 0.5, DefaultIntegrationPrecision)
+	if !(fp2 > fp1 && fn2 < fn1) {
+		t.Fatal(fp1, fn1, fp2, fn2)
+	}
+	jfp1 := ProbJaccardFalsePositive(4, 4, 0.5, DefaultIntegrationPrecision)
+	jfn1 := ProbJaccardFalseNegative(4, 4, 0.5, DefaultIntegrationPrecision)
+	jfp2 := ProbJaccardFalsePositive(16, 4, 0.5, DefaultIntegrationPrecision)
+	jfn2 := ProbJaccardFalseNegative(16, 4, 0.5, DefaultIntegrationPrecision)
+	if !(jfp2 > jfp1 && jfn2 < jfn1) {
+		t.Fatal(jfp1, jfn1, jfp2, jfn2)
+	}
+}
+
+func Test_LshDedup(t *testing.T) {
+	d := NewLshDedup(0.9, 128)
+	k, l := d.Params()
+	if k*l > 128 {
+		t.Fatal(k, l)
+	}
+	sig1 := randomSignature(128, 1)
+	sig2 := randomSignature(128, 2)
+	d.Add("sig1", sig1)
+	d.Add("sig2", sig2)
+	d.Index()
+	result := d.Query(sig1)
+	if len(result) != 1 || result[0] != "sig1" {
+		t.Fatal(result)
+	}
+}
+
+func Test_CollisionRate(t *testing.T) {
+	sample := make([]Signature, 1000)
+	for i := range sample {
+		sample[i] = randomSignature(16, int64(i))
+	}
+	for _, scheme := range []TrimScheme{TrimLow, TrimHigh, TrimRehash} {
+		if rate := CollisionRate(sample, 2, scheme); rate > 10.0/65536 {
+			t.Error(scheme, rate)
+		}
+	}
+	// Hash values without entropy in the low-order bits
+	for _, sig := range sample {
+		for i := range sig {
+			sig[i] <<= 16
+		}
+	}
+	if rate := CollisionRate(sample, 2, TrimLow); rate != 1 {
+		t.Error(rate)
+	}
+	if rate := CollisionRate(sample, 2, TrimHigh); rate > 10.0/65536 {
+		t.Error(rate)
+	}
+	if rate := CollisionRate(sample, 2, TrimRehash); rate > 10.0/65536 {
+		t.Error(rate)
+	}
+}
+
+func Test_SaltBands(t *testing.T) {
+	// A signature whose bands are all equal
+	sig := make(Signature, 8)
+	for i := range sig {
+		sig[i] = uint64(i % 2)
+	}
+	plain := newLshForest(2, 4, 2, TrimHigh)
+	salted := newLshForest(2, 4, 2, TrimHigh|SaltBands)
+	for i := 1; i < 4; i++ {
+		band := sig[i*2 : (i+1)*2]
+		if plain.hashKeyFuncs[i](band) != plain.hashKeyFuncs[0](band) {
+			t.Error("unsalted bands differ")
+		}
+		if salted.hashKeyFuncs[i](band) == salted.hashKeyFuncs[0](band) {
+			t.Error("salted bands collide")
+		}
+	}
+	salted.Add("key", sig)
+	salted.Index()
+	out := make(chan string)
+	go func() {
+		salted.Query(sig, 1, 4, out)
+		close(out)
+	}()
+	if key := <-out; key != "key" {
+		t.Fatal(key)
+	}
+	for range out {
+	}
+}
+
+func Test_LshForestE(t *testing.T) {
+	if _, err := NewLshForestE(0, 4, 4, TrimHigh); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+	if _, err := NewLshForestE(2, 4, 3, TrimHigh); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+	f, err := NewLshForestE(2, 4, 4, TrimHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddE("key", randomSignature(7, 1)); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatal(err)
+	}
+	if err := f.QueryE(randomSignature(8, 1), 3, 4, nil); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_TrieTables(t *testing.T) {
+	f := NewLshForest16(2, 4)
+	f.tries = make([]*trie, f.l)
+	r := rand.New(rand.NewSource(1))
+	for batch := 0; batch < 3; batch++ {
+		for i := 0; i < 200; i++ {
+			f.Add(strconv.Itoa(batch*200+i), randomSignature(8, r.Int63()))
+		}
+		f.Index()
+		for i := range f.hashTables {
+			ht := f.hashTables[i]
+			if !sort.IsSorted(ht) {
+				t.Fatal("unsorted hash table")
+			}
+			tt := f.table(i)
+			for n := 0; n < 100; n++ {
+				b := ht[r.Intn(len(ht))].hashKey
+				prefix := b[:r.Intn(len(b)+1)]
+				if r.Intn(2) == 0 && len(prefix) > 0 {
+					// A prefix of no hash key
+					prefix = prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]^0x55)
+				}
+				s1, e1 := ht.search(prefix)
+				s2, e2 := tt.search(prefix)
+				if s1 != s2 || e1 != e2 {
+					t.Fatal(prefix, s1, e1, s2, e2)
+				}
+			}
+		}
+	}
+}
+
+func Test_HashValueBits(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	// The top 20 bits of the hash values take 4 values, kept by TrimHigh
+	sigs := make([]Signature, 200)
+	for x := range sigs {
+		sigs[x] = make(Signature, 4*8)
+		for i := range sigs[x] {
+			sigs[x][i] = uint64(r.Intn(4))<<44 | uint64(r.Int63n(1<<44))
+		}
+	}
+	f, err := NewLshForestBits(4, 8, 20, TrimHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x, sig := range sigs {
+		f.Add(strconv.Itoa(x), sig)
+	}
+	f.Index()
+	if f.HashValueBits() != 20 || f.keySize() != 10 || len(f.hashTables[0][0].hashKey) != 10 {
+		t.Fatal(f.HashValueBits(), f.keySize())
+	}
+	frozen := f.freeze()
+	q := sigs[0]
+	for K := 1; K <= 4; K++ {
+		expected := make(map[string]bool)
+		for x, sig := range sigs {
+			for i := 0; i < 3; i++ {
+				match := true
+				for j := i * 4; j < i*4+K; j++ {
+					match = match && sig[j]>>44 == q[j]>>44
+				}
+				if match {
+					expected[strconv.Itoa(x)] = true
+				}
+			}
+		}
+		for _, forest := range []*LshForest{f, frozen} {
+			found := make(map[string]bool)
+			for _, key := range forest.candidates(q, K, 3) {
+				found[key] = true
+			}
+			if !reflect.DeepEqual(found, expected) {
+				t.Fatal(K, len(found), len(expected))
+			}
+		}
+	}
+	if _, err := NewLshForestBits(4, 8, 4, TrimHigh); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_Simhash(t *testing.T) {
+	if _, err := NewSimhashIndex(9); err == nil {
+		t.Fatal("expected an error for 9 bands")
+	}
+	text := func(words []string) uint64 {
+		s := NewSimhash(1)
+		for _, w := range words {
+			s.Push([]byte(w))
+		}
+		return s.Fingerprint()
+	}
+	words := make([]string, 100)
+	for i := range words {
+		words[i] = "word" + strconv.Itoa(i)
+	}
+	fp := text(words)
+	if fp != text(words) {
+		t.Fatal("fingerprints differ for the same text")
+	}
+	near := text(append(append([]string(nil), words[:99]...), "other"))
+	if d := HammingDistance(fp, near); d > 16 {
+		t.Errorf("distance %d of near-duplicate texts", d)
+	}
+	for _, bands := range []int{1, 3, 4, 8} {
+		index, err := NewSimhashIndex(bands)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := rand.New(rand.NewSource(int64(bands)))
+		index.Add("far", ^fp)
+		// Fingerprints within a distance less than the bands are all found
+		flipped := make(map[string]uint64)
+		for i := 0; i < 100; i++ {
+			q := fp
+			for _, b := range r.Perm(64)[:bands-1] {
+				q ^= 1 << uint(b)
+			}
+			key := "flip" + strconv.Itoa(i)
+			flipped[key] = q
+			index.Add(key, q)
+		}
+		index.Index()
+		result := index.Query(fp, bands-1)
+		if len(result) != len(flipped) {
+			t.Fatalf("%d bands: %d results", bands, len(result))
+		}
+		for _, key := range result {
+			if _, exist := flipped[key]; !exist {
+				t.Fatalf("%d bands: unexpected %s", bands, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package lshensemble
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Migrate upgrades an index written by Save with an earlier version of
+// the persisted format, read from r, to the current version, written to
+// w, without sketching its domains again: every partition is decoded
+// as Load does and encoded again, one at a time, so the memory used is
+// bounded by the largest partition. It returns the format version of the
+// index read, and errors wrapping ErrCorruptIndex naming the partitions
+// that cannot be decoded. An index of the current version is rewritten
+// unchanged.
+func Migrate(w io.Writer, r io.Reader) (uint64, error) {
+	br := bufio.NewReader(r)
+	e, version, err := readHeader(br)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(w)
+	if err := writeHeader(bw, e); err != nil {
+		return version, err
+	}
+	for i := range e.lshes {
+		seg, err := readSegment(br)
+		if err == nil {
+			err = checkSegment(br, seg, version)
+		}
+		if err != nil {
+			return version, fmt.Errorf("%w in partition %d", err, i)
+		}
+		dec := decoder{buf: seg, version: version}
+		lsh := dec.partition(e)
+		if dec.err != nil {
+			return version, fmt.Errorf("%w in partition %d", dec.err, i)
+		}
+		if err := writeSegment(bw, lsh); err != nil {
+			return version, err
+		}
+	}
+	return version, bw.Flush()
+}
+
+// MigrateSnapshot upgrades the snapshot saved under prefix in the store
+// with an earlier version of the persisted format, as Migrate does, to a
+// snapshot of the current version saved under newPrefix, part by part.
+// The manifest is written last, so the new snapshot is only visible to
+// LoadSnapshot once all its parts are upgraded, and the old snapshot can
+// be deleted then.
+func MigrateSnapshot(store BlobStore, prefix, newPrefix string) (uint64, error) {
+	e, refs, version, err := readManifest(store, prefix)
+	if err != nil {
+		return 0, err
+	}
+	err = saveSnapshot(store, newPrefix, e, func(i int) (Lsh, error) {
+		return loadPart(store, refs[i], version, e)
+	})
+	return version, err
+}
@@ -2,6 +2,7 @@ package lshensemble
 
 import (
 	"encoding/binary"
+	"fmt"
 	"hash/fnv"
 	"math/rand"
 
@@ -85,6 +86,15 @@ func SerializeSignature(sig Signature) []byte {
 	return buffer
 }
 
+// DeserializeSignatureE is like DeserializeSignature, but returns
+// an error if the buffer length is not a multiple of HashValueSize.
+func DeserializeSignatureE(buffer []byte) (Signature, error) {
+	if len(buffer)%HashValueSize != 0 {
+		return nil, fmt.Errorf("%w: buffer of %d bytes", ErrInvalidSignature, len(buffer))
+	}
+	return DeserializeSignature(buffer), nil
+}
+
 func DeserializeSignature(buffer []byte) Signature {
 	if len(buffer)%HashValueSize != 0 {
 		panic("Incorrect length of buffer")
@@ -3,7 +3,9 @@ package lshensemble
 import (
 	"fmt"
 	"math"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMinhash(t *testing.T) {
@@ -75,3 +77,169 @@ func BenchmarkMinWise256(b *testing.B) {
 func BenchmarkMinWise512(b *testing.B) {
 	benchmark(512, b.N, b)
 }
+
+func TestEncode(t *testing.T) {
+	for _, c := range []struct {
+		got  []byte
+		want string
+	}{
+		{EncodeInt(1), "1"},
+		{EncodeUint(1), "1"},
+		{EncodeFloat(1.0, -1), "1"},
+		{EncodeFloat(math.Copysign(0, -1), -1), "0"},
+		{EncodeInt(123456789), "1.23456789e+08"},
+		{EncodeInt(1<<62 + 1), "4611686018427387905"},
+		{EncodeInt(1e18), string(EncodeFloat(1e18, -1))},
+		{EncodeInt(math.MinInt64), string(EncodeFloat(math.MinInt64, -1))},
+		{EncodeInt(math.MaxInt64), "9223372036854775807"},
+		{EncodeUint(1 << 63), string(EncodeFloat(1<<63, -1))},
+		{EncodeUint(math.MaxUint64), "18446744073709551615"},
+		{EncodeFloat(0.1+0.2, 2), "0.3"},
+		{EncodeFloat(2.675, 2), "2.67"},
+		{EncodeFloat(math.Inf(-1), 2), "-Inf"},
+		{EncodeDate(time.Date(2021, 3, 4, 23, 0, 0, 0, time.UTC)), "2021-03-04"},
+		{EncodeTime(time.Date(2021, 3, 4, 23, 0, 1, 500, time.FixedZone("", 3600)), time.Second),
+			"2021-03-04T22:00:01Z"},
+	} {
+		if string(c.got) != c.want {
+			t.Errorf("got %s, want %s", c.got, c.want)
+		}
+	}
+	if tokens := tokenizeNumeric("1e0"); tokens[0] != string(EncodeInt(1)) {
+		t.Error(tokens)
+	}
+}
+
+func TestBottomK(t *testing.T) {
+	// The query domain is half contained in the other domain, which is
+	// four times larger
+	q, x := NewBottomK(1, 1024), NewBottomK(1, 1024)
+	for i := 0; i < 10000; i++ {
+		q.Push([]byte(fmt.Sprintf("q%d", i)))
+		q.Push([]byte(fmt.Sprintf("q%d", i)))
+	}
+	for i := 0; i < 40000; i++ {
+		if i < 5000 {
+			x.Push([]byte(fmt.Sprintf("q%d", i)))
+		} else {
+			x.Push([]byte(fmt.Sprintf("x%d", i)))
+		}
+	}
+	qs, xs := q.Sketch(), x.Sketch()
+	if c := qs.Cardinality(); math.Abs(c-10000) > 1000 {
+		t.Error("cardinality", c)
+	}
+	if c := qs.Containment(xs); math.Abs(c-0.5) > 0.15 {
+		t.Error("containment", c)
+	}
+	small := NewBottomK(1, 1024)
+	small.Push([]byte("a"))
+	if c := small.Sketch().Cardinality(); c != 1 {
+		t.Error("exact cardinality", c)
+	}
+
+	// The signatures agree in a fraction of the bins about the Jaccard
+	// similarity, 5000 / 45000
+	sq, sx := qs.Signature(128), xs.Signature(128)
+	var agree int
+	for i := range sq {
+		if sq[i] == sx[i] {
+			agree++
+		}
+	}
+	if j := float64(agree) / 128; math.Abs(j-1.0/9) > 0.1 {
+		t.Error("signature agreement", j)
+	}
+	index := NewLshEnsemble([]Partition{{0, 100000}}, 128, 4)
+	xr := xs.Record("x", 128)
+	index.Add(xr.Key, xr.Signature, 0)
+	index.Index()
+	qr := qs.Record("q", 128)
+	if result, _ := index.Query(qr.Signature, qr.Size, 0.3); len(result) != 1 {
+		t.Error(result)
+	}
+}
+
+func TestHyperMinHash(t *testing.T) {
+	q, x := NewHyperMinHash(1, 256), NewHyperMinHash(1, 256)
+	for i := 0; i < 10000; i++ {
+		q.Push([]byte(fmt.Sprintf("q%d", i)))
+	}
+	for i := 0; i < 40000; i++ {
+		if i < 5000 {
+			x.Push([]byte(fmt.Sprintf("q%d", i)))
+		} else {
+			x.Push([]byte(fmt.Sprintf("x%d", i)))
+		}
+	}
+	if c := q.Cardinality(); math.Abs(c-10000) > 1000 {
+		t.Error("cardinality", c)
+	}
+	if j := q.Jaccard(x); math.Abs(j-1.0/9) > 0.07 {
+		t.Error("jaccard", j)
+	}
+	small := NewHyperMinHash(1, 256)
+	for i := 0; i < 20; i++ {
+		small.Push([]byte(fmt.Sprintf("s%d", i)))
+	}
+	if c := small.Cardinality(); math.Abs(c-20) > 2 {
+		t.Error("small cardinality", c)
+	}
+	union := NewHyperMinHash(1, 256)
+	union.Merge(q)
+	union.Merge(x)
+	if c := union.Cardinality(); math.Abs(c-45000) > 4500 {
+		t.Error("union cardinality", c)
+	}
+
+	index, err := New(WithPartitions([]Partition{{0, 100000}}), WithNumHash(256),
+		WithTrimScheme(TrimHigh|SaltBands))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xr := x.Record("x")
+	index.Add(xr.Key, xr.Signature, 0)
+	index.Index()
+	qr := q.Record("q")
+	if result, _ := index.Query(qr.Signature, qr.Size, 0.3); len(result) != 1 {
+		t.Error(result)
+	}
+}
+
+func Test_SparkMinhash(t *testing.T) {
+	// The first values of java.util.Random
+	if got := newJavaRandom(42).next(32); got != -1170105035 {
+		t.Fatal(got)
+	}
+	if got := newJavaRandom(0).next(32); got != -1155484576 {
+		t.Fatal(got)
+	}
+	if got := newJavaRandom(42).nextInt(10); got != 0 {
+		t.Fatal(got)
+	}
+	a, b := NewSparkMinhash(SparkDefaultSeed, 256), NewSparkMinhash(SparkDefaultSeed, 256)
+	for i := 0; i < 100; i++ {
+		a.Push(i)
+		b.Push(i + 50)
+	}
+	sigA, sigB := a.Signature(), b.Signature()
+	var equal int
+	for i := range sigA {
+		if sigA[i] >= sparkHashPrime {
+			t.Fatal(sigA[i])
+		}
+		if sigA[i] == sigB[i] {
+			equal++
+		}
+	}
+	if jaccard := float64(equal) / float64(len(sigA)); math.Abs(jaccard-1.0/3) > 0.1 {
+		t.Fatal(jaccard)
+	}
+	hashes := make([]float64, len(sigA))
+	for i, h := range sigA {
+		hashes[i] = float64(h)
+	}
+	if sig := SparkSignature(hashes); !reflect.DeepEqual(sig, sigA) {
+		t.Fatal(sig)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package lshensemble
+
+import (
+	"io/ioutil"
+)
+
+// mapFile reads the file into memory, as mapping it is not supported.
+func mapFile(path string) ([]byte, func([]byte) error, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func([]byte) error { return nil }, nil
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package lshensemble
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file read-only into memory, shared with the other
+// processes mapping it.
+func mapFile(path string) ([]byte, func([]byte) error, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		// Empty files cannot be mapped
+		return []byte{}, func([]byte) error { return nil }, nil
+	}
+	if int64(int(size)) != size {
+		return nil, nil, ErrCorruptIndex
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, syscall.Munmap, nil
+}
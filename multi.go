@@ -0,0 +1,135 @@
+package lshensemble
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Parameterization is an index of a MultiEnsemble, created by New with
+// the options, e.g. more partitions and a larger maximum K for the high
+// thresholds, and queried for the thresholds closest to Threshold.
+type Parameterization struct {
+	Threshold float64
+	Options   []Option
+}
+
+// MultiEnsemble is a set of indexes of the same domains built with
+// different parameters, each optimized for a threshold, trading memory
+// for the accuracy of the queries across a wide range of thresholds: a
+// query is routed to the index whose threshold is the closest to its own.
+// The indexes share the keys of the domains, and the records of those
+// added by AddDomainE, so the keys and the signatures are in memory once,
+// only the hash tables being repeated.
+type MultiEnsemble struct {
+	thresholds []float64
+	indexes    []*LshEnsemble
+}
+
+// NewMultiEnsemble creates the indexes of the parameterizations. It returns
+// an error if there are none, if a threshold is not in [0, 1], if the
+// options of an index are invalid, or if the indexes do not have the same
+// number of hash functions.
+func NewMultiEnsemble(params ...Parameterization) (*MultiEnsemble, error) {
+	if len(params) == 0 {
+		return nil, invalidParameter("no parameterization")
+	}
+	sorted := append([]Parameterization(nil), params...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Threshold < sorted[j].Threshold
+	})
+	m := &MultiEnsemble{}
+	for _, p := range sorted {
+		if !(p.Threshold >= 0 && p.Threshold <= 1) {
+			return nil, invalidParameter("threshold must be in [0, 1], got %v", p.Threshold)
+		}
+		index, err := New(p.Options...)
+		if err != nil {
+			return nil, err
+		}
+		if len(m.indexes) > 0 && index.numHash != m.indexes[0].numHash {
+			return nil, invalidParameter("the indexes have %d and %d hash functions", m.indexes[0].numHash, index.numHash)
+		}
+		m.thresholds = append(m.thresholds, p.Threshold)
+		m.indexes = append(m.indexes, index)
+	}
+	return m, nil
+}
+
+// Route returns the index a query of the threshold is routed to: the
+// index whose threshold is the closest, or the lower one of a tie.
+func (m *MultiEnsemble) Route(threshold float64) *LshEnsemble {
+	best := 0
+	for i, t := range m.thresholds {
+		if math.Abs(t-threshold) < math.Abs(m.thresholds[best]-threshold) {
+			best = i
+		}
+	}
+	return m.indexes[best]
+}
+
+// Indexes returns the indexes, in increasing order of their thresholds.
+func (m *MultiEnsemble) Indexes() []*LshEnsemble {
+	return append([]*LshEnsemble(nil), m.indexes...)
+}
+
+// AddDomainE adds the domain to every index, in the partition of its size
+// in the index, as AddDomainE. It returns the first error of the indexes,
+// once the domain is added to the others.
+func (m *MultiEnsemble) AddDomainE(rec *DomainRecord) error {
+	var first error
+	for _, index := range m.indexes {
+		if err := index.AddDomainE(rec, index.PartitionIndex(rec.Size)); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Bootstrap builds every index from the channel of domains, sorted by
+// their sizes, as Bootstrap, for indexes created with the number of
+// partitions to create.
+func (m *MultiEnsemble) Bootstrap(totalNumDomains int, sortedDomains chan *DomainRecord) {
+	chans := make([]chan *DomainRecord, len(m.indexes))
+	var wg sync.WaitGroup
+	wg.Add(len(m.indexes))
+	for i, index := range m.indexes {
+		chans[i] = make(chan *DomainRecord, 1000)
+		go func(index *LshEnsemble, domains chan *DomainRecord) {
+			defer wg.Done()
+			index.Bootstrap(totalNumDomains, domains)
+		}(index, chans[i])
+	}
+	for rec := range sortedDomains {
+		for _, c := range chans {
+			c <- rec
+		}
+	}
+	for _, c := range chans {
+		close(c)
+	}
+	wg.Wait()
+}
+
+// Index makes the domains added to every index searchable.
+func (m *MultiEnsemble) Index() {
+	for _, index := range m.indexes {
+		index.Index()
+	}
+}
+
+// Query is like Query of the index the threshold is routed to.
+func (m *MultiEnsemble) Query(sig Signature, size int, threshold float64) ([]string, time.Duration) {
+	return m.Route(threshold).Query(sig, size, threshold)
+}
+
+// QueryE is like QueryE of the index the threshold is routed to.
+func (m *MultiEnsemble) QueryE(sig Signature, size int, threshold float64) ([]string, time.Duration, error) {
+	return m.Route(threshold).QueryE(sig, size, threshold)
+}
+
+// QueryStream is like QueryStream of the index the threshold is routed to.
+func (m *MultiEnsemble) QueryStream(sig Signature, size int, threshold float64, opts *QueryOptions) <-chan string {
+	return m.Route(threshold).QueryStream(sig, size, threshold, opts)
+}
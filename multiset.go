@@ -0,0 +1,129 @@
+package lshensemble
+
+import "math"
+
+// MultisetBuilder builds the record of a domain with multiset semantics,
+// whose values may repeat, e.g. the templates of a log. The containment
+// of a query multiset Q in a domain X is then
+//
+//	sum over the values v of min(Q(v), X(v)) / sum over v of Q(v)
+//
+// where Q(v) and X(v) are the multiplicities of v in Q and X. The n-th
+// occurrence of a value is hashed as a distinct value, the repeats apart
+// from all the values, and the containment of the multisets is the
+// containment of the sets of occurrences, which the index searches
+// unchanged, and the size of a multiset is its number of occurrences.
+// The domains indexed and queried must all be built by MultisetBuilder
+// for the containments to be those of the multisets. A multiset whose
+// values are distinct has the signature of its set.
+//
+// The builder keeps the multiplicity of every distinct value, and the
+// hash values of the repeats of a value of multiplicity n are computed
+// by Record in closed form, in O(log n) time per hash function, so the
+// multiplicities can be in the millions.
+type MultisetBuilder struct {
+	key     string
+	mh      *Minhash
+	numHash int
+	// seed is the seed of the hash values of the repeats.
+	seed   uint64
+	counts map[string]int
+	size   int
+}
+
+// NewMultisetBuilder returns a builder of the record of the multiset of
+// key, with MinHash signatures of the seed and number of hash functions.
+func NewMultisetBuilder(key string, seed, numHash int) *MultisetBuilder {
+	return &MultisetBuilder{
+		key:     key,
+		mh:      NewMinhash(seed, numHash),
+		numHash: numHash,
+		seed:    mix64(uint64(seed)),
+		counts:  make(map[string]int),
+	}
+}
+
+// Push adds an occurrence of the value to the multiset.
+func (b *MultisetBuilder) Push(v []byte) {
+	b.PushCount(v, 1)
+}
+
+// PushCount adds count occurrences of the value to the multiset.
+func (b *MultisetBuilder) PushCount(v []byte, count int) {
+	if count <= 0 {
+		return
+	}
+	n := b.counts[string(v)]
+	if n == 0 {
+		b.mh.Push(v)
+	}
+	b.counts[string(v)] = n + count
+	b.size += count
+}
+
+// repeatsMin returns the minimum of the hash values of the occurrences 2
+// to n of a value, for the hash function of the state. The hash values of
+// the occurrences are uniform and independent, drawn from the state, so
+// only the occurrences lowering the minimum are drawn: the number of
+// occurrences until one hashes below a minimum m is geometric of
+// parameter m, and its hash value is uniform below m.
+func repeatsMin(state uint64, n int) uint64 {
+	uniform := func() float64 {
+		state += 0x9e3779b97f4a7c15
+		return (float64(mix64(state)>>11) + 0.5) / (1 << 53)
+	}
+	m := uniform()
+	for occ := 2.0; ; {
+		occ += math.Floor(math.Log(uniform())/math.Log1p(-m)) + 1
+		if occ > float64(n) {
+			break
+		}
+		m *= uniform()
+	}
+	return uint64(m * (1 << 64))
+}
+
+// Record returns the record of the multiset of the values pushed so far,
+// whose size is the number of occurrences. Its signature is the minimum
+// of the hash values of the values and of their repeats.
+func (b *MultisetBuilder) Record() *DomainRecord {
+	sig := b.mh.Signature()
+	for v, n := range b.counts {
+		if n < 2 {
+			continue
+		}
+		state := seededHash([]byte(v), b.seed)
+		for i := range sig {
+			if h := repeatsMin(state^bandSalt(i), n); h < sig[i] {
+				sig[i] = h
+			}
+		}
+	}
+	return &DomainRecord{
+		Key:       b.key,
+		Size:      b.size,
+		Signature: sig,
+	}
+}
+
+// MultisetContainment returns the exact containment of the multiset q in
+// the multiset x, given the multiplicities of their values, e.g. to verify
+// the candidates of a query.
+func MultisetContainment(q, x map[string]int) float64 {
+	var common, size int
+	for v, n := range q {
+		if n <= 0 {
+			continue
+		}
+		size += n
+		if m := x[v]; m > 0 && m < n {
+			common += m
+		} else if m >= n {
+			common += n
+		}
+	}
+	if size == 0 {
+		return 0
+	}
+	return float64(common) / float64(size)
+}
@@ -0,0 +1,88 @@
+package lshensemble
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalizer transforms the domain values before they are tokenized and
+// hashed, so values differing only in their form are the same element.
+type Normalizer func(value string) string
+
+// Normalize returns the normalizer applying the normalizers in order,
+// such as Normalize(NormalizeNFKC, FoldCase, StripAccents, CollapseSpace)
+// to make "São Paulo " and "sao  paulo" the same.
+func Normalize(normalizers ...Normalizer) Normalizer {
+	return func(value string) string {
+		for _, n := range normalizers {
+			value = n(value)
+		}
+		return value
+	}
+}
+
+// NormalizeNFC normalizes the value to the Unicode normalization form C,
+// so characters with the same canonical composition are the same.
+func NormalizeNFC(value string) string {
+	return norm.NFC.String(value)
+}
+
+// NormalizeNFKC normalizes the value to the Unicode normalization form
+// KC, which also makes compatibility characters, such as ligatures and
+// full-width forms, the same as the characters they stand for.
+func NormalizeNFKC(value string) string {
+	return norm.NFKC.String(value)
+}
+
+// FoldCase applies Unicode simple case folding to the value, so the
+// values differing only in case are the same, including characters
+// such as the Kelvin sign and the long s.
+func FoldCase(value string) string {
+	return strings.Map(foldRune, value)
+}
+
+// foldRune returns the lower case of the smallest rune equivalent to r
+// under simple case folding.
+func foldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return unicode.ToLower(min)
+}
+
+// FoldCaseLocale returns a normalizer lower-casing the values using the
+// case mappings of a language, such as unicode.TurkishCase for the
+// dotted and dotless i.
+func FoldCaseLocale(c unicode.SpecialCase) Normalizer {
+	return func(value string) string {
+		return strings.ToLowerSpecial(c, value)
+	}
+}
+
+// StripAccents removes the combining marks, such as accents, so "São"
+// is the same as "Sao". The result is in the normalization form C.
+func StripAccents(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, norm.NFD.String(value))
+	return norm.NFC.String(value)
+}
+
+// TrimSpace removes the leading and trailing white space.
+func TrimSpace(value string) string {
+	return strings.TrimSpace(value)
+}
+
+// CollapseSpace removes the leading and trailing white space, and
+// replaces the other runs of white space by a single space.
+func CollapseSpace(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
@@ -0,0 +1,218 @@
+package lshensemble
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WithNUMANodes makes the index run its bucket scans on workers pinned to
+// the CPUs of NUMA nodes, for large multi-socket query servers where
+// cross-socket memory accesses dominate the scans. cpus lists the CPUs of
+// every node, as returned by NUMANodes.
+// The partitions are assigned to the nodes in turn, and every partition
+// is indexed and scanned by the workers of its node, so that its hash
+// tables are allocated in the memory of that node as far as the operating
+// system places memory on first use. The candidates are delivered by the
+// querying goroutines, so slow consumers never hold the workers.
+// Pinning is only supported on Linux; elsewhere the workers only group
+// the scans. The workers run until Close.
+func WithNUMANodes(cpus [][]int) Option {
+	return func(c *config) {
+		c.numaNodes = cpus
+	}
+}
+
+// numaNode is the pool of workers of a NUMA node.
+type numaNode struct {
+	tasks chan func()
+	// stop is closed to stop the workers.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newNUMANodes starts the workers of the nodes, one per CPU.
+func newNUMANodes(cpus [][]int) []*numaNode {
+	if len(cpus) == 0 {
+		return nil
+	}
+	nodes := make([]*numaNode, len(cpus))
+	for i, nodeCPUs := range cpus {
+		n := &numaNode{tasks: make(chan func()), stop: make(chan struct{})}
+		workers := len(nodeCPUs)
+		if workers == 0 {
+			workers = 1
+		}
+		for w := 0; w < workers; w++ {
+			go n.work(nodeCPUs)
+		}
+		nodes[i] = n
+	}
+	return nodes
+}
+
+func (n *numaNode) work(cpus []int) {
+	runtime.LockOSThread()
+	if len(cpus) > 0 {
+		// Pinning is a hint: the scans are correct on any CPU
+		setAffinity(cpus)
+	}
+	// The thread locked is terminated when the worker returns
+	for {
+		select {
+		case task := <-n.tasks:
+			task()
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// run runs the task on a worker of the node, and waits for it, or runs it
+// on the calling goroutine once the workers are stopped.
+func (n *numaNode) run(task func()) {
+	done := make(chan struct{})
+	select {
+	case n.tasks <- func() {
+		defer close(done)
+		task()
+	}:
+		<-done
+	case <-n.stop:
+		task()
+	}
+}
+
+// Close stops the workers of the NUMA nodes of the index, if it has any,
+// which are shared with the copies of the index made by Freeze and Clone.
+// The index and its copies remain usable, and run their scans on the
+// querying goroutines instead.
+func (e *LshEnsemble) Close() error {
+	for _, n := range e.numa {
+		n.stopOnce.Do(func() {
+			close(n.stop)
+		})
+	}
+	return nil
+}
+
+// node returns the NUMA node of partition i.
+func (e *LshEnsemble) node(i int) *numaNode {
+	return e.numa[i%len(e.numa)]
+}
+
+// probeNUMA is like probe, but scans every partition on its node.
+// It returns once the scans are done, since the caller holds the read
+// lock of the index, and the scans not started when done is closed are
+// skipped.
+func (e *LshEnsemble) probeNUMA(sig Signature, params []param, done <-chan struct{}, out chan<- string) {
+	results := make(chan []string, len(e.lshes))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var n int
+	for i := range e.lshes {
+		if params[i].l == 0 {
+			continue
+		}
+		n++
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, K := e.lshes[i].forest(params[i].k)
+			var keys []string
+			e.node(i).run(func() {
+				select {
+				case <-done:
+				default:
+					keys = f.candidates(sig, K, params[i].l)
+				}
+			})
+			results <- keys
+		}(i)
+	}
+	for ; n > 0; n-- {
+		var keys []string
+		select {
+		case keys = <-results:
+		case <-done:
+			return
+		}
+		for _, key := range keys {
+			select {
+			case out <- key:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// indexNUMA is like Index, but indexes every partition on its node.
+// progress is called as the partitions are indexed.
+func (e *LshEnsemble) indexNUMA(progress func(Lsh)) {
+	results := make(chan struct{})
+	for i := range e.lshes {
+		go func(i int) {
+			e.node(i).run(func() {
+				for _, f := range lshForests(e.lshes[i]) {
+					for t := range f.hashTables {
+						f.indexTable(t)
+					}
+				}
+			})
+			progress(e.lshes[i])
+			results <- struct{}{}
+		}(i)
+	}
+	for range e.lshes {
+		<-results
+	}
+}
+
+// candidates returns the candidate keys of the query signature, scanning
+// the hash tables sequentially.
+func (f *LshForest) candidates(sig Signature, K, L int) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for i, r := range f.matches(sig, K, L) {
+		ext := f.extension(sig, i)
+		for b := r.start; b < r.end; b++ {
+			scanBucket(r.t, b, ext, func(key string) bool {
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+				return true
+			})
+		}
+	}
+	return keys
+}
+
+// parseCPUList parses a list of CPUs in the format of Linux, such as
+// "0-3,8-11".
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	if list == "" {
+		return cpus, nil
+	}
+	for _, r := range strings.Split(list, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("lshensemble: invalid CPU list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("lshensemble: invalid CPU list %q", list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package lshensemble
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// setAffinity pins the calling thread to the CPUs.
+func setAffinity(cpus []int) {
+	var mask [16]uint64
+	for _, cpu := range cpus {
+		if cpu >= 0 && cpu < 64*len(mask) {
+			mask[cpu/64] |= 1 << uint(cpu%64)
+		}
+	}
+	syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+}
+
+// NUMANodes returns the CPUs of every NUMA node of the machine, for
+// WithNUMANodes, from /sys/devices/system/node.
+func NUMANodes() ([][]int, error) {
+	dirs, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(dirs[i]), "node"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(dirs[j]), "node"))
+		return a < b
+	})
+	var nodes [][]int
+	for _, dir := range dirs {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		cpus, err := parseCPUList(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, cpus)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package lshensemble
+
+import (
+	"errors"
+)
+
+// setAffinity does nothing, as pinning threads is not supported.
+func setAffinity(cpus []int) {}
+
+// NUMANodes returns the CPUs of every NUMA node of the machine, for
+// WithNUMANodes. It is only supported on Linux.
+func NUMANodes() ([][]int, error) {
+	return nil, errors.New("lshensemble: NUMA nodes are only discovered on Linux")
+}
@@ -0,0 +1,240 @@
+package lshensemble
+
+import (
+	"time"
+
+	"github.com/streamrail/concurrent-map"
+)
+
+// config is the configuration of an index being created by New.
+type config struct {
+	parts   []Partition
+	numHash int
+	maxK    int
+	// array makes the LSHs LshForestArrays instead of LshForests.
+	array bool
+	// hashValueSize or hashValueBits, and trim, if set, are the hash
+	// value size and the trim scheme of the forests, which are otherwise
+	// created by NewLshForest.
+	hashValueSize int
+	hashValueBits int
+	trim          *TrimScheme
+	admission     AdmissionController
+	duplicates    DuplicatePolicy
+	empty         EmptyDomainPolicy
+	cache         *QueryCacheOptions
+	numaNodes     [][]int
+	spill         *spiller
+	budget        *MemoryBudget
+	progress      Progress
+	groupBy       func(key string) string
+	deterministic bool
+	sequential    bool
+	parallelism   int
+	partitioner   Partitioner
+	realtime      *time.Duration
+	trie          bool
+	split         *bucketSplit
+	signatures    SignatureStore
+	audit         *AuditOptions
+	release       bool
+	compactSizes  bool
+}
+
+// Option configures an index created by New.
+type Option func(*config)
+
+// WithPartitions sets the domain size partitions of the index.
+// It is the only required option.
+func WithPartitions(parts []Partition) Option {
+	return func(c *config) {
+		c.parts = parts
+	}
+}
+
+// WithNumHash sets the number of hash functions in MinHash,
+// 256 by default.
+func WithNumHash(numHash int) Option {
+	return func(c *config) {
+		c.numHash = numHash
+	}
+}
+
+// WithMaxK sets the maximum value for the MinHash parameter K - the
+// number of hash functions per "band", 4 by default.
+func WithMaxK(maxK int) Option {
+	return func(c *config) {
+		c.maxK = maxK
+	}
+}
+
+// WithForestArray makes the index consist of MinHash LSH implemented
+// using LshForestArray, as NewLshEnsemblePlus does.
+func WithForestArray() Option {
+	return func(c *config) {
+		c.array = true
+	}
+}
+
+// WithHashValueSize sets the number of bytes (2, 4 or 8) of the hash
+// values in the forests, 4 by default.
+func WithHashValueSize(hashValueSize int) Option {
+	return func(c *config) {
+		c.hashValueSize = hashValueSize
+	}
+}
+
+// WithTrimScheme sets the scheme trimming the MinHash values to the
+// hash value size, DefaultTrimScheme by default.
+func WithTrimScheme(scheme TrimScheme) Option {
+	return func(c *config) {
+		c.trim = &scheme
+	}
+}
+
+// WithGroupBy makes the queries of the index return the entities of the
+// candidates given by groupBy instead of their keys, each once, so the
+// keys of an entity, such as the replicas of a column across snapshots,
+// are one result.
+func WithGroupBy(groupBy func(key string) string) Option {
+	return func(c *config) {
+		c.groupBy = groupBy
+	}
+}
+
+// New creates an index configured by the options.
+// It returns an error if the configuration is invalid.
+func New(opts ...Option) (*LshEnsemble, error) {
+	c := &config{
+		numHash: 256,
+		maxK:    4,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := checkEnsembleParams(c.parts, c.numHash, c.maxK); err != nil {
+		return nil, err
+	}
+	switch c.hashValueSize {
+	case 0, 2, 4, 8:
+	default:
+		return nil, invalidParameter("hash value size must be 2, 4 or 8, got %d", c.hashValueSize)
+	}
+	if c.hashValueBits != 0 && (c.hashValueBits < 8 || c.hashValueBits > 64) {
+		return nil, invalidParameter("hash value bits must be in [8, 64], got %d", c.hashValueBits)
+	}
+	if c.hashValueBits != 0 && c.hashValueSize != 0 {
+		return nil, invalidParameter("both a hash value size and bits are set")
+	}
+	if c.trim != nil && !c.trim.valid() {
+		return nil, invalidParameter("unknown trim scheme %d", *c.trim)
+	}
+	if !c.duplicates.valid() {
+		return nil, invalidParameter("unknown duplicate policy %d", c.duplicates)
+	}
+	if !c.empty.valid() {
+		return nil, invalidParameter("unknown empty domain policy %d", c.empty)
+	}
+	if c.spill != nil && c.spill.max <= 0 {
+		return nil, invalidParameter("spill size must be positive, got %d", c.spill.max)
+	}
+	if c.budget != nil && c.budget.Bytes <= 0 {
+		return nil, invalidParameter("memory budget must be positive, got %d", c.budget.Bytes)
+	}
+	if c.parallelism < 0 {
+		return nil, invalidParameter("negative parallelism %d", c.parallelism)
+	}
+	if (c.spill != nil || c.budget != nil) && c.duplicates == ReplaceDuplicates {
+		return nil, invalidParameter("duplicates cannot be replaced in spilled indexes")
+	}
+	if (c.spill != nil || c.budget != nil) && c.realtime != nil {
+		return nil, invalidParameter("spilled indexes cannot be realtime")
+	}
+	if c.audit != nil && !(c.audit.SampleRate > 0 && c.audit.SampleRate <= 1) {
+		return nil, invalidParameter("audit sample rate must be in (0, 1], got %v", c.audit.SampleRate)
+	}
+	if c.split != nil && (c.split.max < 1 || c.split.extra < 1) {
+		return nil, invalidParameter("bucket splitting needs a positive maximum bucket size and extra hash values, got %d and %d", c.split.max, c.split.extra)
+	}
+	if c.compactSizes && c.signatures == nil {
+		return nil, invalidParameter("compact sizes need a signature store")
+	}
+	if c.realtime != nil && *c.realtime < 0 {
+		return nil, invalidParameter("negative merge delay %v", *c.realtime)
+	}
+	return newEnsemble(c), nil
+}
+
+// newEnsemble creates an index from a configuration without validating it.
+func newEnsemble(c *config) *LshEnsemble {
+	lshes := make([]Lsh, len(c.parts))
+	for i := range lshes {
+		if c.array {
+			array := make([]*LshForest, c.maxK)
+			for k := 1; k <= c.maxK; k++ {
+				array[k-1] = c.forest(k, c.numHash/k)
+			}
+			lshes[i] = &LshForestArray{
+				maxK:    c.maxK,
+				numHash: c.numHash,
+				array:   array,
+			}
+		} else {
+			lshes[i] = c.forest(c.maxK, c.numHash/c.maxK)
+		}
+	}
+	e := &LshEnsemble{
+		lshes:         lshes,
+		Partitions:    c.parts,
+		maxK:          c.maxK,
+		numHash:       c.numHash,
+		paramCache:    cmap.New(),
+		admission:     c.admission,
+		duplicates:    c.duplicates,
+		empty:         c.empty,
+		cache:         newQueryCache(c.cache),
+		numa:          newNUMANodes(c.numaNodes),
+		spill:         c.spill,
+		budget:        c.budget,
+		progress:      c.progress,
+		groupBy:       c.groupBy,
+		deterministic: c.deterministic,
+		sequential:    c.sequential,
+		parallelism:   c.parallelism,
+		partitioner:   c.partitioner,
+		realtime:      newRealtimeBuffer(c.realtime),
+		signatures:    c.signatures,
+		audit:         c.audit,
+	}
+	if c.duplicates != AllowDuplicates {
+		e.keyParts = make(map[string]int)
+	}
+	e.releaseOnIndex = c.release
+	e.compactSizes = c.compactSizes
+	return e
+}
+
+func (c *config) forest(k, l int) *LshForest {
+	var f *LshForest
+	if c.hashValueSize == 0 && c.hashValueBits == 0 && c.trim == nil {
+		f = NewLshForest(k, l)
+	} else {
+		hashValueSize, trim := c.hashValueSize, DefaultTrimScheme
+		if hashValueSize == 0 {
+			hashValueSize = 4
+		}
+		if c.trim != nil {
+			trim = *c.trim
+		}
+		if c.hashValueBits != 0 {
+			f = newLshForestBits(k, l, c.hashValueBits, trim)
+		} else {
+			f = newLshForest(k, l, hashValueSize, trim)
+		}
+	}
+	if c.trie {
+		f.tries = make([]*trie, l)
+	}
+	f.setSplit(c.split)
+	return f
+}
@@ -0,0 +1,97 @@
+package lshensemble
+
+import (
+	"math"
+	"sort"
+)
+
+// probeOrdered is like probe, but probes the partitions one after the
+// other, in decreasing order of their yields, the mean numbers of
+// candidates they had when probed by the queries with a Limit. The
+// partitions never probed come first, in order.
+func (e *LshEnsemble) probeOrdered(sig Signature, params []param, done <-chan struct{}, out chan<- string) {
+	if e.realtime != nil && !e.realtime.probe(e, sig, params, done, out) {
+		return
+	}
+	for _, i := range e.stats.order(params) {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		f, K := e.lshes[i].forest(params[i].k)
+		keys := f.candidates(sig, K, params[i].l)
+		e.stats.recordYield(i, len(keys))
+		for _, key := range keys {
+			select {
+			case out <- key:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// partitionYield counts the candidates of a partition in the queries
+// probing it.
+type partitionYield struct {
+	probes, candidates int64
+}
+
+func (y partitionYield) mean() float64 {
+	if y.probes == 0 {
+		return math.Inf(1)
+	}
+	return float64(y.candidates) / float64(y.probes)
+}
+
+// order returns the partitions probed with the parameters, by decreasing
+// yield.
+func (s *queryStats) order(params []param) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var parts []int
+	yields := make([]float64, len(params))
+	for i, p := range params {
+		if p.l == 0 {
+			continue
+		}
+		parts = append(parts, i)
+		yields[i] = math.Inf(1)
+		if i < len(s.yields) {
+			yields[i] = s.yields[i].mean()
+		}
+	}
+	sort.SliceStable(parts, func(a, b int) bool {
+		return yields[parts[a]] > yields[parts[b]]
+	})
+	return parts
+}
+
+// recordYield counts the candidates of a probe of the partition.
+func (s *queryStats) recordYield(part, candidates int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.yields) <= part {
+		s.yields = append(s.yields, partitionYield{})
+	}
+	s.yields[part].probes++
+	s.yields[part].candidates += int64(candidates)
+}
+
+// anyDone returns a channel closed once a or b is closed. b must be
+// closed eventually.
+func anyDone(a, b <-chan struct{}) <-chan struct{} {
+	if a == nil {
+		return b
+	}
+	c := make(chan struct{})
+	go func() {
+		select {
+		case <-a:
+		case <-b:
+		}
+		close(c)
+	}()
+	return c
+}
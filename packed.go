@@ -0,0 +1,151 @@
+package lshensemble
+
+import (
+	"sort"
+)
+
+// WithHashValueBits sets the width in bits of the hash values of the
+// forests, from 8 to 64, instead of WithHashValueSize, trimmed from the
+// MinHash values with the trim scheme. The widths that are not multiples
+// of 8, e.g. 20 bits, are bit-packed in the hash keys, so the width can be
+// the smallest whose collision rate, as estimated by CollisionRateBits, is
+// acceptable for the corpus.
+func WithHashValueBits(bits int) Option {
+	return func(c *config) {
+		c.hashValueBits = bits
+	}
+}
+
+// NewLshForestBits uses hash values of the bits, from 8 to 64, trimmed
+// from the MinHash values using the scheme, and bit-packed in the hash keys
+// unless the bits are a multiple of 8. It returns an error if the
+// parameters are invalid.
+func NewLshForestBits(k, l, bits int, scheme TrimScheme) (*LshForest, error) {
+	if k < 1 || l < 1 {
+		return nil, invalidParameter("k and l must be positive, got k=%d l=%d", k, l)
+	}
+	if bits < 8 || bits > 64 {
+		return nil, invalidParameter("hash value bits must be in [8, 64], got %d", bits)
+	}
+	if !scheme.valid() {
+		return nil, invalidParameter("unknown trim scheme %d", scheme)
+	}
+	return newLshForestBits(k, l, bits, scheme), nil
+}
+
+// newLshForestBits returns a forest of hash values of the bits, whose
+// hash keys are bit-packed unless the bits are a multiple of 8.
+func newLshForestBits(k, l, bits int, trim TrimScheme) *LshForest {
+	if bits%8 == 0 {
+		return newLshForest(k, l, bits/8, trim)
+	}
+	f := newLshForest(k, l, (bits+7)/8, trim)
+	f.hashValueBits = bits
+	for i := range f.hashKeyFuncs {
+		f.hashKeyFuncs[i] = packedHashKeyFuncGen(bits, trim, bandSalt(i))
+	}
+	return f
+}
+
+// HashValueBits returns the width in bits of the hash values of the
+// forest, bit-packed in its hash keys if it is not a multiple of 8.
+func (f *LshForest) HashValueBits() int {
+	if f.hashValueBits != 0 {
+		return f.hashValueBits
+	}
+	return 8 * f.hashValueSize
+}
+
+// trimByte returns the trim scheme byte of the forest persisted, whose
+// bits 3 to 5 are the bits of the last byte of its bit-packed hash values,
+// or 0 for hash values of whole bytes, so the indexes of bit-packed hash
+// values are rejected as corrupt by the earlier versions.
+func (f *LshForest) trimByte() byte {
+	return byte(f.trim) | byte(f.hashValueBits%8)<<3
+}
+
+// unpackTrim returns the trim scheme and the bits of the bit-packed hash
+// values, or 0, of a persisted forest from its trim scheme byte.
+func unpackTrim(b byte, hashValueSize int) (TrimScheme, int) {
+	trim := TrimScheme(b &^ 0x38)
+	if r := int(b >> 3 & 7); r != 0 {
+		return trim, 8*(hashValueSize-1) + r
+	}
+	return trim, 0
+}
+
+// validPacking returns whether the bits of the bit-packed hash values of
+// a persisted forest, or 0, are consistent with its hash value size.
+func validPacking(bits, hashValueSize int) bool {
+	return bits == 0 || bits > 8 && bits < 64 && bits%8 != 0 && (bits+7)/8 == hashValueSize
+}
+
+// keySize returns the number of bytes of the hash keys of the bands.
+func (f *LshForest) keySize() int {
+	if f.hashValueBits == 0 {
+		return f.k * f.hashValueSize
+	}
+	return (f.k*f.hashValueBits + 7) / 8
+}
+
+// packedHashKeyFuncGen generates the hash key function of a band of a
+// forest of bit-packed hash values: the hash values trimmed to the bits
+// are written from the most significant bit, so the hash key of the first
+// K values of a band is a prefix of its hash key, but for the unused low
+// bits of its last byte, which are zero.
+func packedHashKeyFuncGen(bits int, scheme TrimScheme, salt uint64) hashKeyFunc {
+	salted := scheme&SaltBands != 0
+	return func(sig Signature) string {
+		s := make([]byte, (len(sig)*bits+7)/8)
+		pos := 0
+		for _, v := range sig {
+			if salted {
+				v = mix64(v ^ salt)
+			}
+			v = scheme.trimBits(v, uint(bits))
+			for b := bits - 1; b >= 0; b-- {
+				if v>>uint(b)&1 != 0 {
+					s[pos/8] |= 0x80 >> uint(pos%8)
+				}
+				pos++
+			}
+		}
+		return string(s)
+	}
+}
+
+// search returns the range of the buckets of the table whose hash keys
+// start with the hash key of the first K hash values of a band of the
+// forest. For bit-packed hash values ending within a byte, the buckets
+// of the whole bytes are searched first, and then the buckets whose next
+// byte starts with the bits of the prefix.
+func (f *LshForest) search(t table, prefix string, K int) (start, end int) {
+	if f.hashValueBits == 0 || K*f.hashValueBits%8 == 0 {
+		return t.search(prefix)
+	}
+	n := len(prefix) - 1
+	start, end = t.search(prefix[:n])
+	mask := byte(0xff) << uint(8-K*f.hashValueBits%8)
+	last := prefix[n] & mask
+	bits := func(b int) byte {
+		return t.bucketKey(b)[n] & mask
+	}
+	first := start + sort.Search(end-start, func(x int) bool {
+		return bits(start+x) >= last
+	})
+	end = first + sort.Search(end-first, func(x int) bool {
+		return bits(first+x) > last
+	})
+	return first, end
+}
+
+// hasPrefix returns whether the hash key of a band of the forest starts
+// with the hash key of its first K hash values.
+func (f *LshForest) hasPrefix(hashKey, prefix string, K int) bool {
+	if f.hashValueBits == 0 || K*f.hashValueBits%8 == 0 {
+		return hashKey[:len(prefix)] == prefix
+	}
+	n := len(prefix) - 1
+	mask := byte(0xff) << uint(8-K*f.hashValueBits%8)
+	return hashKey[:n] == prefix[:n] && hashKey[n]&mask == prefix[n]
+}
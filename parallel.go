@@ -0,0 +1,112 @@
+package lshensemble
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// WithParallelism sets the maximum number of hash tables Index() builds,
+// sorts and merges at once, runtime.GOMAXPROCS(0) by default, instead of
+// a goroutine per hash table contending for the cores.
+func WithParallelism(n int) Option {
+	return func(c *config) {
+		c.parallelism = n
+	}
+}
+
+// SetParallelism sets the maximum number of hash tables Index() builds at
+// once, as with WithParallelism. A value of 0 restores the default.
+func (e *LshEnsemble) SetParallelism(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.parallelism = n
+}
+
+// parallel calls fn with every i in [0, n) on at most workers goroutines,
+// or runtime.GOMAXPROCS(0) if workers is not positive.
+func parallel(n, workers int, fn func(i int)) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	next := int64(-1)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt64(&next, 1)); i < n; i = int(atomic.AddInt64(&next, 1)) {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// indexForests makes the keys added to the forests searchable, building
+// at most workers hash tables at once.
+func indexForests(forests []*LshForest, workers int) {
+	var tables []tableRef
+	for _, f := range forests {
+		for t := range f.hashTables {
+			tables = append(tables, tableRef{f, t})
+		}
+	}
+	parallel(len(tables), workers, func(i int) {
+		tables[i].f.indexTable(tables[i].t)
+	})
+}
+
+// tableRef is the hash table t of the forest f.
+type tableRef struct {
+	f *LshForest
+	t int
+}
+
+// indexParallel makes the keys added to the partitions searchable,
+// building at most e.parallelism hash tables at once. progress is called
+// as the partitions are indexed.
+func (e *LshEnsemble) indexParallel(progress func(lsh Lsh)) {
+	type task struct {
+		part int
+		tableRef
+	}
+	var tasks []task
+	remaining := make([]int64, len(e.lshes))
+	for i, lsh := range e.lshes {
+		var forests []*LshForest
+		if _, tiered := lsh.(*tieredLsh); !tiered {
+			forests = lshForests(lsh)
+		}
+		if forests == nil {
+			// Tiered partitions are read-only, and other Lsh
+			// implementations index themselves
+			remaining[i] = 1
+			tasks = append(tasks, task{part: i})
+			continue
+		}
+		for _, f := range forests {
+			for t := range f.hashTables {
+				tasks = append(tasks, task{i, tableRef{f, t}})
+			}
+			remaining[i] += int64(len(f.hashTables))
+		}
+		if remaining[i] == 0 {
+			progress(lsh)
+		}
+	}
+	parallel(len(tasks), e.parallelism, func(n int) {
+		task := tasks[n]
+		if task.f == nil {
+			e.lshes[task.part].Index()
+		} else {
+			task.f.indexTable(task.t)
+		}
+		if atomic.AddInt64(&remaining[task.part], -1) == 0 {
+			progress(e.lshes[task.part])
+		}
+	})
+}
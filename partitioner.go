@@ -0,0 +1,31 @@
+package lshensemble
+
+// Partitioner assigns the domains to the partitions of an index created
+// with WithPartitioner, for partitioning strategies other than the size
+// ranges of WithPartitions, e.g. by data source or by column type and
+// size. The forests of the partitions and the optimization of K and L of
+// the queries are unchanged, and use the bounds of the partitions.
+type Partitioner interface {
+	// AssignPartition returns the partition of the domains of the size,
+	// as returned by PartitionIndex.
+	AssignPartition(size int) int
+	// Bounds returns the bounds of the sizes of the domains of partition
+	// i, which may overlap those of other partitions.
+	Bounds(i int) (lower, upper int)
+}
+
+// WithPartitioner makes the index assign the domains to its numPart
+// partitions with the partitioner, whose Bounds are the bounds of the
+// partitions. It replaces WithPartitions.
+// The partitioner is not saved with the index, and Rebalance returns an
+// error wrapping ErrInvalidParameter, as it recomputes the partitions from
+// the domain sizes.
+func WithPartitioner(p Partitioner, numPart int) Option {
+	return func(c *config) {
+		c.partitioner = p
+		c.parts = make([]Partition, numPart)
+		for i := range c.parts {
+			c.parts[i].Lower, c.parts[i].Upper = p.Bounds(i)
+		}
+	}
+}
@@ -0,0 +1,626 @@
+package lshensemble
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/streamrail/concurrent-map"
+)
+
+// The persisted index format starts with formatMagic and the format
+// version, followed by the ensemble header and one segment per partition,
+// each prefixed by its length in bytes.
+// Every integer is a uvarint and every string is prefixed by its length.
+//
+//	header:  numHash maxK numPart (lower upper)*numPart empty
+//	empty:   numEmpty (key size)*numEmpty
+//	segment: kind body
+//
+// A forest body is k, l, hashValueSize, the trim scheme byte, and then for
+// each hash table the number of buckets followed by the buckets, each
+// written as the hash key bytes, the number of keys and the keys.
+// The bits 3 to 5 of the trim scheme byte are the number of bits of the
+// last byte of bit-packed hash values, or 0 for whole bytes.
+// An array body is maxK, numHash, and then its maxK forests as segments.
+//
+// Since version 3, the header and every segment are followed by the
+// CRC-32C checksum of their bytes, 4 bytes little-endian, so corrupt
+// partitions are detected by Load.
+// Since version 4, the header is followed by the keys and sizes of the
+// domains isolated by IsolateEmptyDomains, sorted by key.
+// Version 1 has no trim scheme byte, and its forests use TrimLow.
+const (
+	formatMagic   = "LSHE"
+	formatVersion = 4
+)
+
+// castagnoli is the table of the CRC-32C checksums of the segments.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// appendChecksum appends the checksum of a segment to buf.
+func appendChecksum(buf, seg []byte) []byte {
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(seg, castagnoli))
+	return append(buf, sum[:]...)
+}
+
+func supportedVersion(version uint64) bool {
+	return version >= 1 && version <= formatVersion
+}
+
+// Segment kinds
+const (
+	segmentForest      byte = 'F'
+	segmentForestArray byte = 'A'
+)
+
+// ErrCorruptIndex is returned when loading a persisted index that is
+// malformed or truncated.
+var ErrCorruptIndex = errors.New("lshensemble: corrupt persisted index")
+
+// encoder appends the persisted format to a byte slice.
+type encoder struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.tmp[:], v)
+	e.buf = append(e.buf, e.tmp[:n]...)
+}
+
+func (e *encoder) int(v int) {
+	e.uvarint(uint64(v))
+}
+
+func (e *encoder) string(s string) {
+	e.int(len(s))
+	e.buf = append(e.buf, s...)
+}
+
+// decoder reads the persisted format from a byte slice.
+// After the first error, all reads return zero values and the error
+// is kept in err.
+type decoder struct {
+	buf []byte
+	err error
+	// version is the format version being decoded.
+	version uint64
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrCorruptIndex
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// int reads an integer no greater than max, which bounds the
+// allocations made from corrupt lengths.
+func (d *decoder) int(max int) int {
+	v := d.uvarint()
+	if v > uint64(max) {
+		d.err = ErrCorruptIndex
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) raw(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.buf) {
+		d.err = ErrCorruptIndex
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.raw(d.int(len(d.buf))))
+}
+
+func (d *decoder) byte() byte {
+	b := d.raw(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (e *encoder) header(ens *LshEnsemble) {
+	e.int(ens.numHash)
+	e.int(ens.maxK)
+	e.int(len(ens.Partitions))
+	for _, p := range ens.Partitions {
+		e.int(p.Lower)
+		e.int(p.Upper)
+	}
+}
+
+// emptyDomains encodes the keys and sizes of the isolated domains.
+func (e *encoder) emptyDomains(ens *LshEnsemble) {
+	keys := make([]string, 0, len(ens.isolated))
+	for key := range ens.isolated {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	e.int(len(keys))
+	for _, key := range keys {
+		e.string(key)
+		e.int(ens.isolated[key].Size)
+	}
+}
+
+// emptyDomains decodes the isolated domains of the ensemble, whose records
+// have no signatures, if the format version has them.
+func (d *decoder) emptyDomains(e *LshEnsemble) {
+	if d.version < 4 {
+		return
+	}
+	n := d.int(len(d.buf))
+	for i := 0; i < n && d.err == nil; i++ {
+		rec := &DomainRecord{Key: d.string(), Size: d.int(1)}
+		if e.isolated == nil {
+			e.isolated = make(map[string]*DomainRecord)
+		}
+		e.isolated[rec.Key] = rec
+	}
+}
+
+// maxHeaderValue bounds the integers in a header read from an untrusted source.
+const maxHeaderValue = 1<<31 - 1
+
+const maxInt = int(^uint(0) >> 1)
+
+// header decodes an ensemble header, and returns an ensemble whose
+// LSHs are yet to be decoded.
+func (d *decoder) header() *LshEnsemble {
+	numHash := d.int(maxHeaderValue)
+	maxK := d.int(maxHeaderValue)
+	parts := make([]Partition, d.int(len(d.buf)))
+	for i := range parts {
+		parts[i].Lower = d.int(maxHeaderValue)
+		parts[i].Upper = d.int(maxHeaderValue)
+	}
+	if d.err != nil {
+		return nil
+	}
+	return &LshEnsemble{
+		Partitions: parts,
+		lshes:      make([]Lsh, len(parts)),
+		maxK:       maxK,
+		numHash:    numHash,
+		paramCache: cmap.New(),
+	}
+}
+
+// segment encodes an Lsh as a segment body.
+func (e *encoder) segment(lsh Lsh) error {
+	if splitBuckets(lsh) {
+		return ErrSplitBuckets
+	}
+	switch lsh := resolveLsh(lsh).(type) {
+	case *LshForest:
+		e.buf = append(e.buf, segmentForest)
+		e.forest(lsh)
+	case *LshForestArray:
+		e.buf = append(e.buf, segmentForestArray)
+		e.int(lsh.maxK)
+		e.int(lsh.numHash)
+		for _, f := range lsh.array {
+			sub := encoder{}
+			sub.forest(f)
+			e.int(len(sub.buf))
+			e.buf = append(e.buf, sub.buf...)
+		}
+	default:
+		return fmt.Errorf("lshensemble: cannot persist Lsh of type %T", lsh)
+	}
+	return nil
+}
+
+func (e *encoder) forest(f *LshForest) {
+	e.int(f.k)
+	e.int(f.l)
+	e.int(f.hashValueSize)
+	e.buf = append(e.buf, f.trimByte())
+	for i := 0; i < f.l; i++ {
+		t := f.table(i)
+		e.int(t.buckets())
+		for b := 0; b < t.buckets(); b++ {
+			e.buf = append(e.buf, t.bucketKey(b)...)
+			e.int(t.bucketLen(b))
+			t.scan(b, func(key string) bool {
+				e.string(key)
+				return true
+			})
+		}
+	}
+}
+
+// partition decodes the Lsh of a partition of the ensemble from a segment
+// body, and checks its parameters are consistent with the ensemble, so
+// queries with signatures of numHash values cannot fail, and that it is
+// the whole body, so a corrupt segment of a format without checksums
+// fails rather than loading a partial partition.
+func (d *decoder) partition(e *LshEnsemble) Lsh {
+	lsh := d.segment()
+	if d.err == nil && (len(d.buf) != 0 || !e.consistent(lsh)) {
+		d.err = ErrCorruptIndex
+	}
+	if d.err != nil {
+		return nil
+	}
+	return lsh
+}
+
+// consistent returns whether the parameters of a decoded Lsh are
+// consistent with the ensemble.
+func (e *LshEnsemble) consistent(lsh Lsh) bool {
+	switch lsh := lsh.(type) {
+	case *LshForest:
+		return lsh.k*lsh.l <= e.numHash
+	case *LshForestArray:
+		if lsh.maxK < 1 || lsh.numHash < lsh.maxK || lsh.numHash > e.numHash || len(lsh.array) != lsh.maxK {
+			return false
+		}
+		for i, f := range lsh.array {
+			if f == nil || f.k != i+1 || f.l != lsh.numHash/f.k {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// segment decodes an Lsh from a segment body.
+func (d *decoder) segment() Lsh {
+	switch d.byte() {
+	case segmentForest:
+		return d.forest()
+	case segmentForestArray:
+		maxK := d.int(len(d.buf))
+		numHash := d.int(maxHeaderValue)
+		array := make([]*LshForest, maxK)
+		for i := range array {
+			sub := decoder{buf: d.raw(d.int(len(d.buf))), version: d.version}
+			array[i] = sub.forest()
+			if sub.err != nil {
+				d.err = sub.err
+			}
+		}
+		if d.err != nil {
+			return nil
+		}
+		return &LshForestArray{
+			maxK:    maxK,
+			numHash: numHash,
+			array:   array,
+		}
+	}
+	d.err = ErrCorruptIndex
+	return nil
+}
+
+func (d *decoder) forest() *LshForest {
+	k := d.int(len(d.buf))
+	l := d.int(len(d.buf))
+	hashValueSize := d.int(8)
+	trim, bits := TrimLow, 0
+	if d.version >= 2 {
+		trim, bits = unpackTrim(d.byte(), hashValueSize)
+	}
+	if d.err != nil || k == 0 || hashValueSize == 0 || !trim.valid() || !validPacking(bits, hashValueSize) {
+		d.err = ErrCorruptIndex
+		return nil
+	}
+	f := newLshForest(k, l, hashValueSize, trim)
+	if bits != 0 {
+		f = newLshForestBits(k, l, bits, trim)
+	}
+	keySize := f.keySize()
+	for i := range f.hashTables {
+		ht := make(hashTable, d.int(len(d.buf)))
+		for j := range ht {
+			ht[j].hashKey = string(d.raw(keySize))
+			ht[j].keys = make(keys, d.int(len(d.buf)))
+			for x := range ht[j].keys {
+				ht[j].keys[x] = d.string()
+			}
+			// Keys were not sorted before version 2
+			if !sort.StringsAreSorted(ht[j].keys) {
+				sort.Strings(ht[j].keys)
+			}
+		}
+		f.hashTables[i] = ht
+	}
+	if d.err != nil {
+		return nil
+	}
+	return f
+}
+
+// Save writes the ensemble to w in a binary format that can be read
+// back using Load. Only the domains made searchable by Index() and the
+// domains isolated by IsolateEmptyDomains are saved.
+// Every partition is encoded in memory before it is written.
+func (e *LshEnsemble) Save(w io.Writer) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	bw := bufio.NewWriter(w)
+	if err := writeHeader(bw, e); err != nil {
+		return err
+	}
+	for _, lsh := range e.lshes {
+		if err := writeSegment(bw, lsh); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeHeader writes formatMagic, the format version and the header of
+// the ensemble to w.
+func writeHeader(w io.Writer, e *LshEnsemble) error {
+	enc := encoder{buf: []byte(formatMagic)}
+	enc.int(formatVersion)
+	header := encoder{}
+	header.header(e)
+	header.emptyDomains(e)
+	enc.string(string(header.buf))
+	enc.buf = appendChecksum(enc.buf, header.buf)
+	_, err := w.Write(enc.buf)
+	return err
+}
+
+// writeSegment writes the segment of a partition to w.
+func writeSegment(w io.Writer, lsh Lsh) error {
+	seg := encoder{}
+	if err := seg.segment(lsh); err != nil {
+		return err
+	}
+	enc := encoder{}
+	enc.int(len(seg.buf))
+	if _, err := w.Write(enc.buf); err != nil {
+		return err
+	}
+	_, err := w.Write(appendChecksum(seg.buf, seg.buf))
+	return err
+}
+
+// PartitionFilter selects the partitions loaded by LoadPartitions and
+// LoadSnapshotPartitions.
+type PartitionFilter func(p Partition) bool
+
+// SizeRange selects the partitions with domain sizes in [lower, upper].
+func SizeRange(lower, upper int) PartitionFilter {
+	return func(p Partition) bool {
+		return p.Upper >= lower && p.Lower <= upper
+	}
+}
+
+// selectPartitions returns which partitions of the ensemble are selected
+// by keep, or all of them if keep is nil.
+func (e *LshEnsemble) selectPartitions(keep PartitionFilter) ([]bool, error) {
+	selected := make([]bool, len(e.Partitions))
+	var n int
+	for i, p := range e.Partitions {
+		selected[i] = keep == nil || keep(p)
+		if selected[i] {
+			n++
+		}
+	}
+	if n == 0 && len(e.Partitions) > 0 {
+		return nil, invalidParameter("no partition selected")
+	}
+	return selected, nil
+}
+
+// retainPartitions removes the partitions not selected from the ensemble.
+func (e *LshEnsemble) retainPartitions(selected []bool) {
+	parts := e.Partitions[:0]
+	lshes := e.lshes[:0]
+	for i, p := range e.Partitions {
+		if selected[i] {
+			parts = append(parts, p)
+			lshes = append(lshes, e.lshes[i])
+		}
+	}
+	e.Partitions = parts
+	e.lshes = lshes
+}
+
+// Load reads an ensemble written by Save from r. The partitions are decoded
+// in parallel across the cores while the next ones are read, so r may be
+// a streaming decompressor, e.g. a gzip.Reader of a compressed index.
+func Load(r io.Reader) (*LshEnsemble, error) {
+	return LoadPartitions(r, nil)
+}
+
+// LoadPartitions is like Load, but only loads the partitions selected by
+// keep, e.g. the domain sizes of a workload, to save memory on query
+// nodes. The ensemble only has the partitions loaded, so its queries
+// only return the domains in them.
+// It returns an error wrapping ErrInvalidParameter if no partition is
+// selected.
+func LoadPartitions(r io.Reader, keep PartitionFilter) (*LshEnsemble, error) {
+	br := bufio.NewReader(r)
+	e, version, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := e.selectPartitions(keep)
+	if err != nil {
+		return nil, err
+	}
+	// The segments are read in order, and decoded by at most
+	// runtime.GOMAXPROCS(0) goroutines, which bounds the segments
+	// held in memory
+	errs := make([]error, len(e.lshes))
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i := range e.lshes {
+		if !selected[i] {
+			if err = skipSegment(br, version); err != nil {
+				break
+			}
+			continue
+		}
+		var seg []byte
+		if seg, err = readSegment(br); err != nil {
+			break
+		}
+		if err = checkSegment(br, seg, version); err != nil {
+			err = fmt.Errorf("%w in partition %d", err, i)
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, seg []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			dec := decoder{buf: seg, version: version}
+			e.lshes[i] = dec.partition(e)
+			errs[i] = dec.err
+		}(i, seg)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.retainPartitions(selected)
+	return e, nil
+}
+
+// readHeader reads formatMagic, the format version and the header of an
+// ensemble from r, and returns the ensemble whose LSHs are yet to be
+// decoded and the format version.
+func readHeader(r *bufio.Reader) (*LshEnsemble, uint64, error) {
+	magic := make([]byte, len(formatMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != formatMagic {
+		return nil, 0, ErrCorruptIndex
+	}
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, ErrCorruptIndex
+	}
+	if !supportedVersion(version) {
+		return nil, 0, fmt.Errorf("lshensemble: unsupported index format version %d", version)
+	}
+	header, err := readSegment(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkSegment(r, header, version); err != nil {
+		return nil, 0, fmt.Errorf("%w in the header", err)
+	}
+	dec := decoder{buf: header, version: version}
+	e := dec.header()
+	if e != nil {
+		dec.emptyDomains(e)
+	}
+	if dec.err != nil {
+		return nil, 0, dec.err
+	}
+	return e, version, nil
+}
+
+// MarshalBinary returns the ensemble in the format written by Save.
+func (e *LshEnsemble) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := e.Save(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseIndex parses an ensemble in the format written by Save.
+// The data may come from an untrusted source: malformed data returns
+// an error, and the ensemble returned can be queried with any signature
+// of numHash values.
+func ParseIndex(data []byte) (*LshEnsemble, error) {
+	return Load(bytes.NewReader(data))
+}
+
+// readSegment reads a length-prefixed segment from r.
+// The segment is read in chunks, so a corrupt length fails at the end
+// of the input instead of allocating a huge buffer.
+func readSegment(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorruptIndex
+	}
+	const chunkSize = 1 << 20
+	var seg []byte
+	for remaining := n; remaining > 0; {
+		size := uint64(chunkSize)
+		if remaining < size {
+			size = remaining
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, ErrCorruptIndex
+		}
+		seg = append(seg, chunk...)
+		remaining -= size
+	}
+	return seg, nil
+}
+
+// checkSegment reads the checksum following a segment of the format
+// version from r, and returns an error wrapping ErrCorruptIndex if it is
+// not the checksum of the segment.
+func checkSegment(r *bufio.Reader, seg []byte, version uint64) error {
+	if version < 3 {
+		return nil
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return ErrCorruptIndex
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != crc32.Checksum(seg, castagnoli) {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorruptIndex)
+	}
+	return nil
+}
+
+// skipSegment skips a length-prefixed segment of the format version in r,
+// and its checksum, which is not verified.
+func skipSegment(r *bufio.Reader, version uint64) error {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(maxInt-4) {
+		return ErrCorruptIndex
+	}
+	if version >= 3 {
+		n += 4
+	}
+	if _, err := r.Discard(int(n)); err != nil {
+		return ErrCorruptIndex
+	}
+	return nil
+}
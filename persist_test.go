@@ -0,0 +1,597 @@
+package lshensemble
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func sameResults(t *testing.T, e1, e2 *LshEnsemble, recs []*DomainRecord) {
+	for _, rec := range recs {
+		r1, _ := e1.Query(rec.Signature, rec.Size, 0.5)
+		r2, _ := e2.Query(rec.Signature, rec.Size, 0.5)
+		sort.Strings(r1)
+		sort.Strings(r2)
+		if !reflect.DeepEqual(r1, r2) {
+			t.Fatal(rec.Key, r1, r2)
+		}
+	}
+}
+
+func Test_SaveLoad(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	for _, index := range []*LshEnsemble{
+		BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs)),
+		BootstrapLshEnsemblePlus(4, 64, 4, len(recs), Recs2Chan(recs)),
+	} {
+		var buf bytes.Buffer
+		if err := index.Save(&buf); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		loaded, err := Load(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameResults(t, index, loaded, recs)
+		// Truncated indexes must be rejected
+		for _, n := range []int{0, 5, len(data) / 2, len(data) - 1} {
+			if _, err := Load(bytes.NewReader(data[:n])); err == nil {
+				t.Fatal("truncated index loaded", n)
+			}
+		}
+	}
+}
+
+func Test_SaveHashValueBits(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index, err := New(WithPartitions(make([]Partition, 4)), WithNumHash(64), WithHashValueBits(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Bootstrap(len(recs), Recs2Chan(recs))
+	if c := index.Config().Partitions[0].Forests[0]; c.HashValueBits != 20 || c.HashValueSize != 3 {
+		t.Fatal(c)
+	}
+	data, err := index.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ParseIndex(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameResults(t, index, loaded, recs)
+	var buf bytes.Buffer
+	if err := index.SaveShared(&buf); err != nil {
+		t.Fatal(err)
+	}
+	shared, err := ParseShared(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameResults(t, index, shared, recs)
+	buf.Reset()
+	if err := index.ExportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameResults(t, index, imported, recs)
+	if _, err := New(WithPartitions(make([]Partition, 4)), WithHashValueBits(65)); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_Checksums(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	data, err := index.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every byte altered is detected
+	for i := 0; i < len(data); i += 1 + i/64 {
+		altered := append([]byte(nil), data...)
+		altered[i] ^= 0x10
+		if _, err := ParseIndex(altered); err == nil {
+			t.Fatal("altered index loaded", i)
+		}
+	}
+	altered := append([]byte(nil), data...)
+	altered[len(altered)-10] ^= 1
+	if _, err := ParseIndex(altered); !errors.Is(err, ErrCorruptIndex) || !strings.Contains(err.Error(), "checksum mismatch in partition 3") {
+		t.Fatal(err)
+	}
+	// The partitions skipped are not verified
+	if _, err := LoadPartitions(bytes.NewReader(altered), SizeRange(0, index.Partitions[0].Upper)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := index.SaveShared(&buf); err != nil {
+		t.Fatal(err)
+	}
+	shared := append([]byte(nil), buf.Bytes()...)
+	_, sections, err := parseShared(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SharedIndex{sections: sections}
+	if err := s.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	last := sections.sections[len(sections.sections)-1]
+	last.data[0] ^= 1
+	if err := s.Verify(); !errors.Is(err, ErrCorruptIndex) || !strings.Contains(err.Error(), "partition 3") {
+		t.Fatal(err)
+	}
+	// A corrupt descriptor is detected when the index is parsed
+	shared = append([]byte(nil), buf.Bytes()...)
+	shared[17] ^= 1
+	if _, err := ParseShared(shared); !errors.Is(err, ErrCorruptIndex) {
+		t.Fatal(err)
+	}
+}
+
+// version2 returns the index of the current persisted format in version
+// 2, without the checksums.
+func version2(t *testing.T, data []byte) []byte {
+	r := bufio.NewReader(bytes.NewReader(data[len(formatMagic):]))
+	if version, _ := binary.ReadUvarint(r); version != formatVersion {
+		t.Fatal(version)
+	}
+	old := encoder{buf: []byte(formatMagic)}
+	old.int(2)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return old.buf
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			t.Fatal(err)
+		}
+		r.Discard(4)
+		old.string(string(seg))
+	}
+}
+
+func Test_Migrate(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemblePlus(4, 64, 4, len(recs), Recs2Chan(recs))
+	data, err := index.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := version2(t, data)
+	if _, err := ParseIndex(old); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	version, err := Migrate(&buf, bytes.NewReader(old))
+	if err != nil || version != 2 {
+		t.Fatal(version, err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("migrated index differs")
+	}
+	if _, err := Migrate(ioutil.Discard, bytes.NewReader(old[:len(old)-1])); !errors.Is(err, ErrCorruptIndex) || !strings.Contains(err.Error(), "partition 3") {
+		t.Fatal(err)
+	}
+
+	store := DirStore(t.TempDir())
+	if err := index.SaveSnapshot(store, "old"); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := store.Get("old/manifest")
+	manifest[len(formatMagic)] = 2
+	store.Put("old/manifest", manifest)
+	if version, err := MigrateSnapshot(store, "old", "new"); err != nil || version != 2 {
+		t.Fatal(version, err)
+	}
+	loaded, err := LoadSnapshot(store, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameResults(t, index, loaded, recs)
+	if manifest, _ := store.Get("new/manifest"); manifest[len(formatMagic)] != formatVersion {
+		t.Fatal(manifest[len(formatMagic)])
+	}
+}
+
+func Test_LoadCompressed(t *testing.T) {
+	recs := randomDomains(500, 64, 1)
+	index := BootstrapLshEnsemblePlus(16, 64, 4, len(recs), Recs2Chan(recs))
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := index.Save(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameResults(t, index, loaded, recs)
+	// A corrupt partition fails the load
+	data, _ := index.MarshalBinary()
+	data[len(data)/2] ^= 0xff
+	data[len(data)/2+1] ^= 0xff
+	if _, err := ParseIndex(data); err == nil {
+		t.Fatal("corrupt index loaded")
+	}
+}
+
+func Test_SaveEncrypted(t *testing.T) {
+	recs := randomDomains(2000, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	keys := StaticKey(bytes.Repeat([]byte{7}, 32))
+	var buf bytes.Buffer
+	if err := index.SaveEncrypted(&buf, keys); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if len(data) < 2*encryptedBlockSize || bytes.Contains(data, []byte(recs[0].Key)) {
+		t.Fatal("index not encrypted in blocks", len(data))
+	}
+	loaded, err := LoadEncrypted(bytes.NewReader(data), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameResults(t, index, loaded, recs)
+	if _, err := LoadEncrypted(bytes.NewReader(data), StaticKey(bytes.Repeat([]byte{8}, 32))); !errors.Is(err, ErrCorruptIndex) {
+		t.Fatal("loaded with another key", err)
+	}
+	// Altered and truncated indexes must be rejected, including at a
+	// block boundary
+	altered := append([]byte(nil), data...)
+	altered[len(altered)/2] ^= 1
+	if _, err := LoadEncrypted(bytes.NewReader(altered), keys); !errors.Is(err, ErrCorruptIndex) {
+		t.Fatal("altered index loaded", err)
+	}
+	header := len(encryptedMagic) + 1 + 1 + 12 + 16 + dataKeySize + 8
+	block := 3 + encryptedBlockSize + 16
+	for _, n := range []int{header, header + block, len(data) - 1} {
+		if _, err := LoadEncrypted(bytes.NewReader(data[:n]), keys); !errors.Is(err, ErrCorruptIndex) {
+			t.Fatal("truncated index loaded", n, err)
+		}
+	}
+
+	path := t.TempDir() + "/index.lshs"
+	f, _ := os.Create(path)
+	w, err := NewEncryptWriter(f, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.SaveShared(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	shared, err := MapSharedEncrypted(path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Close()
+	sameResults(t, index, shared.LshEnsemble, recs)
+
+	opts := []Option{WithPartitions([]Partition{{0, 100}, {101, 300}}), WithNumHash(64)}
+	dir := t.TempDir()
+	segmented, err := NewSegmentedIndex(&SegmentOptions{Dir: dir, SegmentSize: 500, Keys: keys}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs[:1000] {
+		if err := segmented.Add(rec.Key, rec.Signature, rec.Size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := segmented.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSegmentedIndex(&SegmentOptions{Dir: dir}, opts...); !errors.Is(err, ErrCorruptIndex) {
+		t.Fatal("encrypted segments loaded without their key", err)
+	}
+	segmented, err = NewSegmentedIndex(&SegmentOptions{Dir: dir, Keys: keys}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := segmented.Segments()[0] + segmented.Segments()[1]; n == 0 {
+		t.Fatal(segmented.Segments())
+	}
+	segmented.Close()
+}
+
+func Test_ExportJSON(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	for _, array := range []bool{false, true} {
+		opts := []Option{WithPartitions(make([]Partition, 4)), WithNumHash(64), WithHashValueSize(2)}
+		if array {
+			opts = append(opts, WithForestArray())
+		}
+		index, _ := New(opts...)
+		index.Bootstrap(len(recs), Recs2Chan(recs))
+		index.AddDomain(recs[0], 0)
+		index.Index()
+		var want, exported bytes.Buffer
+		index.Save(&want)
+		if err := index.ExportJSON(&exported); err != nil {
+			t.Fatal(err)
+		}
+		imported, err := ImportJSON(bytes.NewReader(exported.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		imported.Save(&got)
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatal("different imported index")
+		}
+		if _, err := imported.QueryByKey(recs[0].Key, 0.5, Supersets); err != nil {
+			t.Fatal(err)
+		}
+		// Inconsistent lines are rejected
+		lines := bytes.SplitAfter(exported.Bytes(), []byte("\n"))
+		for _, data := range [][]byte{
+			bytes.Join(lines[1:], nil),
+			bytes.Join(append(lines[:3:3], []byte(`{"type":"bucket","partition":0,"forest":0,"table":0,"hashKey":"00"}`)), nil),
+			bytes.Join(lines[:2], nil),
+		} {
+			if _, err := ImportJSON(bytes.NewReader(data)); !errors.Is(err, ErrCorruptIndex) {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func Test_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lshensemble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	store := DirStore(dir)
+	if err := index.SaveSnapshot(store, "snap"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSnapshot(store, "snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameResults(t, index, loaded, recs)
+	// A corrupt part must be detected
+	part, _ := store.Get(snapshotPart("snap", 1))
+	part[len(part)/2]++
+	store.Put(snapshotPart("snap", 1), part)
+	if _, err := LoadSnapshot(store, "snap"); err == nil {
+		t.Fatal("corrupt snapshot loaded")
+	}
+	// The corrupt part is not read if its partition is not selected
+	first := index.Partitions[0]
+	loaded, err = LoadSnapshotPartitions(store, "snap", SizeRange(first.Lower, first.Upper-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Partitions) != 1 {
+		t.Fatal(loaded.Partitions)
+	}
+}
+
+func Test_LoadPartitions(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	data, err := index.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The partitions share their bounds
+	lower, upper := index.Partitions[1].Lower+1, index.Partitions[2].Upper-1
+	loaded, err := LoadPartitions(bytes.NewReader(data), SizeRange(lower, upper))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Partitions) != 2 {
+		t.Fatal(loaded.Partitions)
+	}
+	inLoaded := make(map[string]bool)
+	for _, lsh := range loaded.lshes {
+		lshForests(lsh)[0].eachKey(func(key string) {
+			inLoaded[key] = true
+		})
+	}
+	for _, rec := range recs {
+		want, _ := index.Query(rec.Signature, rec.Size, 0.5)
+		got, _ := loaded.Query(rec.Signature, rec.Size, 0.5)
+		var n int
+		for _, key := range want {
+			if inLoaded[key] {
+				n++
+			}
+		}
+		if len(got) != n {
+			t.Fatal(rec.Key, got, want)
+		}
+	}
+	if _, err := LoadPartitions(bytes.NewReader(data), SizeRange(-2, -1)); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_DeterministicBuild(t *testing.T) {
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	save := func(rounds int, opts ...Option) []byte {
+		index, err := New(append(opts, WithPartitions(parts), WithNumHash(64), WithDeterministicBuild())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Add the domains in reverse order, calling Index() in between
+		for i := len(recs) - 1; i >= 0; i-- {
+			index.Add(recs[i].Key, recs[i].Signature, index.PartitionIndex(recs[i].Size))
+			if i%(len(recs)/rounds) == 0 {
+				index.Index()
+			}
+		}
+		var buf bytes.Buffer
+		if err := index.Save(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	for _, opts := range [][]Option{nil, {WithForestArray()}} {
+		want := save(1, opts...)
+		if got := save(1, opts...); !bytes.Equal(got, want) {
+			t.Fatal("different indexes built from the same domains")
+		}
+		if got := save(4, opts...); !bytes.Equal(got, want) {
+			t.Fatal("different indexes built in several rounds")
+		}
+	}
+}
+
+func Test_Spill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lshensemble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	defer func(fanIn int) { spillFanIn = fanIn }(spillFanIn)
+	for i, opts := range [][]Option{nil, {WithForestArray()}, nil} {
+		// The runs of the last index are merged in several passes
+		if i == 2 {
+			spillFanIn = 3
+		}
+		opts = append(opts, WithPartitions(parts), WithNumHash(64), WithDeterministicBuild())
+		index, _ := New(opts...)
+		spilled, err := New(append(opts, WithSpill(dir, 100))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, rec := range recs {
+			index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+			spilled.Add(rec.Key, rec.Signature, spilled.PartitionIndex(rec.Size))
+			if i == len(recs)/2 {
+				index.Index()
+				if err := spilled.IndexE(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		index.Index()
+		if err := spilled.IndexE(); err != nil {
+			t.Fatal(err)
+		}
+		var want, got bytes.Buffer
+		index.Save(&want)
+		spilled.Save(&got)
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatal("different spilled index")
+		}
+		if anomalies := spilled.CheckIntegrity(false); len(anomalies) != 0 {
+			t.Fatal(anomalies)
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Fatal("runs not removed", len(files))
+		}
+	}
+	if _, err := New(WithPartitions(parts), WithSpill(dir, 0)); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatal(err)
+	}
+}
+
+func Test_Progress(t *testing.T) {
+	recs := randomDomains(2000, 64, 1)
+	var records, tables []int64
+	index, err := New(WithPartitions(make([]Partition, 4)), WithNumHash(64), WithProgress(Progress{
+		Records: func(done, total int64) {
+			if total != int64(len(recs)) {
+				t.Error(total)
+			}
+			records = append(records, done)
+		},
+		Tables: func(done, total int64) { tables = append(tables, done, total) },
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Bootstrap(len(recs), Recs2Chan(recs))
+	if len(records) != 2 || records[1] != int64(len(recs)) {
+		t.Fatal(records)
+	}
+	// 4 partitions of 16 tables
+	if len(tables) != 8 || tables[6] != 64 || tables[7] != 64 {
+		t.Fatal(tables)
+	}
+	var written, read int64
+	var buf bytes.Buffer
+	if err := index.Save(ProgressWriter(&buf, func(done, total int64) { written = done })); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(buf.Len())
+	if _, err := Load(ProgressReader(&buf, size, func(done, total int64) { read = done })); err != nil {
+		t.Fatal(err)
+	}
+	if written != size || read != size {
+		t.Fatal(written, read, size)
+	}
+}
+
+func Test_MemoryBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lshensemble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	parts := []Partition{{0, 100}, {101, 300}, {301, 1000}}
+	recs := randomDomains(200, 64, 1)
+	opts := []Option{WithPartitions(parts), WithNumHash(64), WithDeterministicBuild()}
+	index, _ := New(opts...)
+	var degraded int
+	budgeted, err := New(append(opts, WithMemoryBudget(MemoryBudget{
+		Bytes:     50000,
+		Dir:       dir,
+		OnDegrade: func(string) { degraded++ },
+	}))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+		budgeted.Add(rec.Key, rec.Signature, budgeted.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	budgeted.Index()
+	if !budgeted.Degraded() || degraded != 1 {
+		t.Fatal(budgeted.Degraded(), degraded)
+	}
+	var want, got bytes.Buffer
+	index.Save(&want)
+	budgeted.Save(&got)
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatal("different index built within the memory budget")
+	}
+}
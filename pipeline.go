@@ -0,0 +1,251 @@
+package lshensemble
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// Result is a candidate domain of a query being post-processed, with its
+// containment estimated from the MinHash signatures in the direction of
+// the query, or NaN if its domain was not retained by AddDomain.
+type Result struct {
+	Key         string
+	Containment float64
+	// Size is the size of the domain, or 0 if it was not retained by
+	// AddDomain, e.g. to rank the candidates by their size ratio to the
+	// query without looking up their metadata.
+	Size int
+}
+
+// Stage is a stage of the post-processing of the results of a query by
+// QueryPipeline: it returns the results passed to the next stage.
+type Stage func(results []Result) []Result
+
+// QueryPipeline runs the query like QueryStream, ignoring opts.Done, and
+// returns its candidate domains post-processed by the stages in order, e.g.
+//
+//	index.QueryPipeline(sig, size, threshold, nil,
+//		lshensemble.Dedup(), lshensemble.Verify(threshold),
+//		lshensemble.Rank(), lshensemble.Limit(10))
+//
+// returns the 10 distinct candidates with the highest estimated
+// containments of at least the threshold.
+func (e *LshEnsemble) QueryPipeline(sig Signature, size int, threshold float64, opts *QueryOptions, stages ...Stage) []Result {
+	if opts == nil {
+		opts = &QueryOptions{}
+	}
+	defer e.rlockQuery()()
+	audited := e.auditQuery(sig, size, threshold, opts.Direction)
+	keys := make(chan string)
+	go func() {
+		e.query(sig, size, e.optimalParams(size, threshold, opts.Direction), opts, keys)
+		close(keys)
+	}()
+	verified := make(chan Result)
+	go e.verify(sig, size, opts, keys, verified, nil)
+	results := make([]Result, 0)
+	for r := range verified {
+		results = append(results, r)
+	}
+	if audited != nil {
+		audited(len(results), nil)
+	}
+	for _, stage := range stages {
+		results = stage(results)
+	}
+	return results
+}
+
+// verify estimates the containments of the candidates of keys, by
+// opts.Verifiers goroutines, and sends their results to out, which it
+// closes once keys is closed and the candidates are verified. The results
+// are sent in the order of keys unless opts.UnorderedVerify is set.
+// If done is closed, verify stops sending, and drains keys.
+func (e *LshEnsemble) verify(sig Signature, size int, opts *QueryOptions, keys <-chan string, out chan<- Result, done <-chan struct{}) {
+	defer close(out)
+	defer func() {
+		for range keys {
+		}
+	}()
+	send := func(r Result) bool {
+		select {
+		case out <- r:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	workers := opts.Verifiers
+	switch {
+	case workers <= 1:
+		for key := range keys {
+			if !send(e.verified(sig, size, opts.Direction, key)) {
+				return
+			}
+		}
+	case opts.UnorderedVerify:
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for key := range keys {
+					if !send(e.verified(sig, size, opts.Direction, key)) {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	default:
+		// Every candidate has a slot, verified by a worker, and the slots
+		// are sent in order: at most workers candidates are verified ahead
+		// of the first one not sent.
+		type job struct {
+			key  string
+			slot chan Result
+		}
+		slots := make(chan chan Result, workers)
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			defer close(slots)
+			jobs := make(chan job)
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := range jobs {
+						j.slot <- e.verified(sig, size, opts.Direction, j.key)
+					}
+				}()
+			}
+			defer wg.Wait()
+			defer close(jobs)
+			for key := range keys {
+				slot := make(chan Result, 1)
+				select {
+				case slots <- slot:
+				case <-done:
+					return
+				}
+				jobs <- job{key, slot}
+			}
+		}()
+		for slot := range slots {
+			if !send(<-slot) {
+				break
+			}
+		}
+		<-finished
+	}
+}
+
+// verified returns the result of the candidate key, with its containment
+// estimated from its retained signature in the direction of the query.
+func (e *LshEnsemble) verified(sig Signature, size int, dir Direction, key string) Result {
+	r := Result{Key: key, Containment: math.NaN()}
+	if rec, exist := e.retained(key); exist {
+		r.Size = rec.Size
+		if dir == Subsets {
+			r.Containment = estimateContainment(rec.Signature, rec.Size, sig, size)
+		} else {
+			r.Containment = estimateContainment(sig, size, rec.Signature, rec.Size)
+		}
+	}
+	return r
+}
+
+// Dedup returns a stage keeping the first result of every key.
+func Dedup() Stage {
+	return func(results []Result) []Result {
+		seen := make(map[string]bool, len(results))
+		kept := results[:0]
+		for _, r := range results {
+			if !seen[r.Key] {
+				seen[r.Key] = true
+				kept = append(kept, r)
+			}
+		}
+		return kept
+	}
+}
+
+// Verify returns a stage removing the false positives: the results whose
+// estimated containment is below the threshold. The results of unknown
+// containment are kept.
+func Verify(threshold float64) Stage {
+	return Filter(func(r Result) bool {
+		return math.IsNaN(r.Containment) || r.Containment >= threshold
+	})
+}
+
+// Filter returns a stage keeping the results for which keep returns true.
+func Filter(keep func(r Result) bool) Stage {
+	return func(results []Result) []Result {
+		kept := results[:0]
+		for _, r := range results {
+			if keep(r) {
+				kept = append(kept, r)
+			}
+		}
+		return kept
+	}
+}
+
+// Rank returns a stage sorting the results by decreasing estimated
+// containment, with the results of unknown containment last.
+func Rank() Stage {
+	return RankBy(func(r Result) float64 { return r.Containment })
+}
+
+// RankBy returns a stage sorting the results by decreasing score, with
+// the results of NaN score last. Results of equal scores are sorted by
+// key, as the results of a query come in no particular order.
+func RankBy(score func(r Result) float64) Stage {
+	return func(results []Result) []Result {
+		sort.Slice(results, func(i, j int) bool {
+			a, b := score(results[i]), score(results[j])
+			switch {
+			case math.IsNaN(a) && math.IsNaN(b), a == b:
+				return results[i].Key < results[j].Key
+			case math.IsNaN(b):
+				return true
+			case math.IsNaN(a):
+				return false
+			}
+			return a > b
+		})
+		return results
+	}
+}
+
+// Limit returns a stage keeping the first n results.
+func Limit(n int) Stage {
+	if n < 0 {
+		n = 0
+	}
+	return func(results []Result) []Result {
+		if len(results) > n {
+			return results[:n]
+		}
+		return results
+	}
+}
+
+// estimateContainment estimates the containment of domain Q in domain X,
+// |Q ∩ X| / |Q|, from the Jaccard similarity of their signatures.
+func estimateContainment(qSig Signature, q int, xSig Signature, x int) float64 {
+	if q == 0 || len(qSig) == 0 {
+		return 0
+	}
+	var same int
+	for i := range qSig {
+		if i < len(xSig) && qSig[i] == xSig[i] {
+			same++
+		}
+	}
+	return jaccardToContainment(float64(same)/float64(len(qSig)), x, q)
+}
@@ -0,0 +1,75 @@
+package lshensemble
+
+// Postings are the keys of the buckets of a hash table matched by a query,
+// a range of consecutive buckets whose keys are read on demand, so they
+// can be counted, sampled or intersected without enumerating them all.
+// The keys of every bucket are sorted, but a key may be in several
+// buckets of the range.
+type Postings struct {
+	// Partition is the partition of the hash table.
+	Partition int
+	// K and L are the numbers of hash values per band and of bands
+	// probed in the partition, and Band is the band of the hash table.
+	K, L, Band int
+	r          tableRange
+}
+
+// QueryPostings returns the postings of the buckets matched by the query
+// in every band probed, with the K and L chosen like Query, instead of the
+// candidate keys. The postings reference the hash tables of the index,
+// and are valid until the next change of the index, e.g. by Index().
+// The domains not yet indexed are not matched, and the queries bypass
+// the admission controller, the query cache and the query statistics.
+func (e *LshEnsemble) QueryPostings(sig Signature, size int, threshold float64) []Postings {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	params := e.optimalParams(size, threshold, Supersets)
+	var postings []Postings
+	for i, lsh := range e.lshes {
+		if params[i].l == 0 {
+			continue
+		}
+		f, K := lsh.forest(params[i].k)
+		if K == -1 {
+			K = f.k
+		}
+		for band, r := range f.matches(sig, K, params[i].l) {
+			postings = append(postings, Postings{
+				Partition: i,
+				K:         K,
+				L:         params[i].l,
+				Band:      band,
+				r:         r,
+			})
+		}
+	}
+	return postings
+}
+
+// Buckets returns the number of buckets of the postings.
+func (p Postings) Buckets() int { return p.r.end - p.r.start }
+
+// BucketLen returns the number of keys of the b-th bucket.
+func (p Postings) BucketLen(b int) int { return p.r.t.bucketLen(p.r.start + b) }
+
+// Len returns the number of keys of the postings, counted once per bucket.
+func (p Postings) Len() int { return p.r.size() }
+
+// Key returns the j-th key of the b-th bucket.
+func (p Postings) Key(b, j int) string { return p.r.t.key(p.r.start+b, j) }
+
+// Scan calls fn with the keys of the buckets in order, until it returns
+// false.
+func (p Postings) Scan(fn func(key string) bool) {
+	more := true
+	for b := p.r.start; more && b < p.r.end; b++ {
+		p.r.t.scan(b, func(key string) bool {
+			more = fn(key)
+			return more
+		})
+	}
+}
+
+// Count returns the number of buckets of the postings with the key, by
+// binary search in the buckets.
+func (p Postings) Count(key string) int { return p.r.count(key) }
@@ -2,9 +2,14 @@ package lshensemble
 
 import "math"
 
-// Compute the integral of function f, lower limit a, upper limit l, and
-// precision defined as the quantize step
-func integral(f func(float64) float64, a, b, precision float64) float64 {
+// DefaultIntegrationPrecision is the quantize step of the integrals of the
+// probabilities computed by OptimalKL.
+const DefaultIntegrationPrecision = integrationPrecision
+
+// Integral computes the integral of function f from the lower limit a to
+// the upper limit b by the midpoint rule, with precision as the quantize
+// step.
+func Integral(f func(float64) float64, a, b, precision float64) float64 {
 	var area float64
 	for x := a; x < b; x += precision {
 		area += f(x+0.5*precision) * precision
@@ -12,44 +17,90 @@ func integral(f func(float64) float64, a, b, precision float64) float64 {
 	return area
 }
 
-// Probability density function for false positive
-func falsePositive(x, q, l, k int) func(float64) float64 {
+// FalsePositive returns the probability density function of false
+// positive of the containment search of a query domain of size q in an
+// index of l bands of k hash values: the probability that a domain of
+// size x, whose containment of the query domain is t, is a candidate.
+// The containment t is converted to the Jaccard similarity
+// t/(1+x/q-t) of the domains.
+func FalsePositive(x, q, l, k int) func(t float64) float64 {
 	return func(t float64) float64 {
 		return 1.0 - math.Pow(1.0-math.Pow(t/(1.0+float64(x)/float64(q)-t), float64(k)), float64(l))
 	}
 }
 
-// Probability density function for false negative
-func falseNegative(x, q, l, k int) func(float64) float64 {
+// FalseNegative returns the probability density function of false
+// negative of the containment search, the probability that a domain of
+// size x of containment t is not a candidate, as FalsePositive.
+func FalseNegative(x, q, l, k int) func(t float64) float64 {
 	return func(t float64) float64 {
 		return 1.0 - (1.0 - math.Pow(1.0-math.Pow(t/(1.0+float64(x)/float64(q)-t), float64(k)), float64(l)))
 	}
 }
 
-// Compute the cummulative probability of false negative
-func probFalseNegative(x, q, l, k int, t, precision float64) float64 {
-	fn := falseNegative(x, q, l, k)
+// ProbFalseNegative computes the cumulative probability of false negative
+// of the containment search of threshold t, the integral of FalseNegative
+// over the containments from t to their maximum, 1 or x/q, or 0 if no
+// domain of size x can meet the threshold. LSH Ensemble chooses the k and
+// l of every partition minimizing its sum with ProbFalsePositive, with x
+// the upper bound of the partition.
+func ProbFalseNegative(x, q, l, k int, t, precision float64) float64 {
+	fn := FalseNegative(x, q, l, k)
 	xq := float64(x) / float64(q)
 	if xq >= 1.0 {
-		return integral(fn, t, 1.0, precision)
+		return Integral(fn, t, 1.0, precision)
 	}
 	if xq >= t {
-		return integral(fn, t, xq, precision)
+		return Integral(fn, t, xq, precision)
 	} else {
 		return 0.0
 	}
 }
 
-// Compute the cummulative probability of false positive
-func probFalsePositive(x, q, l, k int, t, precision float64) float64 {
-	fp := falsePositive(x, q, l, k)
+// ProbFalsePositive computes the cumulative probability of false positive
+// of the containment search of threshold t, the integral of FalsePositive
+// over the containments from 0 to t, or to x/q if it is less.
+func ProbFalsePositive(x, q, l, k int, t, precision float64) float64 {
+	fp := FalsePositive(x, q, l, k)
 	xq := float64(x) / float64(q)
 	if xq >= 1.0 {
-		return integral(fp, 0.0, t, precision)
+		return Integral(fp, 0.0, t, precision)
 	}
 	if xq >= t {
-		return integral(fp, 0.0, t, precision)
+		return Integral(fp, 0.0, t, precision)
 	} else {
-		return integral(fp, 0.0, xq, precision)
+		return Integral(fp, 0.0, xq, precision)
+	}
+}
+
+// JaccardFalsePositive returns the probability density function of false
+// positive of the Jaccard similarity search in l bands of k hash values:
+// the probability that a domain of Jaccard similarity s is a candidate.
+func JaccardFalsePositive(l, k int) func(s float64) float64 {
+	return func(s float64) float64 {
+		return 1.0 - math.Pow(1.0-math.Pow(s, float64(k)), float64(l))
 	}
 }
+
+// JaccardFalseNegative returns the probability density function of false
+// negative of the Jaccard similarity search, the probability that a
+// domain of Jaccard similarity s is not a candidate.
+func JaccardFalseNegative(l, k int) func(s float64) float64 {
+	return func(s float64) float64 {
+		return math.Pow(1.0-math.Pow(s, float64(k)), float64(l))
+	}
+}
+
+// ProbJaccardFalsePositive computes the cumulative probability of false
+// positive of the Jaccard similarity search of threshold t, the integral
+// of JaccardFalsePositive from 0 to t.
+func ProbJaccardFalsePositive(l, k int, t, precision float64) float64 {
+	return Integral(JaccardFalsePositive(l, k), 0.0, t, precision)
+}
+
+// ProbJaccardFalseNegative computes the cumulative probability of false
+// negative of the Jaccard similarity search of threshold t, the integral
+// of JaccardFalseNegative from t to 1.
+func ProbJaccardFalseNegative(l, k int, t, precision float64) float64 {
+	return Integral(JaccardFalseNegative(l, k), t, 1.0, precision)
+}
@@ -0,0 +1,165 @@
+package lshensemble
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Profile bundles the recommended settings for indexing a type of
+// table columns: how the column values are tokenized into the values of
+// a domain, the index parameters, and the query containment threshold.
+type Profile struct {
+	Name string
+	// Normalize, if not nil, normalizes the column values before they
+	// are tokenized.
+	Normalize Normalizer
+	// Tokenize returns the domain values of a column value.
+	Tokenize func(value string) []string
+	// Seed and NumHash are the parameters of the MinHash signatures.
+	Seed    int
+	NumHash int
+	// MaxK and NumPart are the parameters of the index.
+	MaxK    int
+	NumPart int
+	// Threshold is the recommended containment threshold of queries.
+	Threshold float64
+	// SampleRate, if in (0, 1), is the rate at which the tokens of very
+	// large columns are sampled by Record, using a Sampler.
+	SampleRate float64
+}
+
+// The profiles of common types of columns.
+var (
+	// DataDiscoveryProfile suits catalogs with columns of mixed types,
+	// compared as case-insensitive strings.
+	DataDiscoveryProfile = Profile{
+		Name:      "data-discovery",
+		Tokenize:  tokenizeCategorical,
+		Seed:      42,
+		NumHash:   256,
+		MaxK:      4,
+		NumPart:   8,
+		Threshold: 0.5,
+	}
+	// NumericProfile suits numeric columns. Numbers are compared by value,
+	// and the higher threshold compensates for the chance overlap of
+	// small integers such as IDs and counts.
+	NumericProfile = Profile{
+		Name:      "numeric",
+		Tokenize:  tokenizeNumeric,
+		Seed:      42,
+		NumHash:   256,
+		MaxK:      4,
+		NumPart:   8,
+		Threshold: 0.7,
+	}
+	// CategoricalProfile suits columns of short strings, such as codes
+	// and names, compared case-insensitively.
+	CategoricalProfile = Profile{
+		Name:      "categorical",
+		Tokenize:  tokenizeCategorical,
+		Seed:      42,
+		NumHash:   256,
+		MaxK:      4,
+		NumPart:   8,
+		Threshold: 0.5,
+	}
+	// TextProfile suits columns of long text, tokenized into words.
+	// The domains are large and skewed in size, so more hash functions
+	// and partitions are used, and the threshold is lower as texts share
+	// fewer words.
+	TextProfile = Profile{
+		Name:      "text",
+		Tokenize:  tokenizeText,
+		Seed:      42,
+		NumHash:   512,
+		MaxK:      4,
+		NumPart:   16,
+		Threshold: 0.3,
+	}
+	// URLProfile suits columns of URLs, compared by host and path.
+	URLProfile = Profile{
+		Name:      "url",
+		Tokenize:  tokenizeURL,
+		Seed:      42,
+		NumHash:   256,
+		MaxK:      4,
+		NumPart:   8,
+		Threshold: 0.5,
+	}
+)
+
+// NewForDataDiscovery creates an index for data discovery using
+// DataDiscoveryProfile.
+func NewForDataDiscovery(parts []Partition) *LshEnsemble {
+	return DataDiscoveryProfile.New(parts)
+}
+
+// New creates an index with the parameters of the profile.
+func (p *Profile) New(parts []Partition) *LshEnsemble {
+	return NewLshEnsemble(parts, p.NumHash, p.MaxK)
+}
+
+// Bootstrap builds an index with the parameters of the profile from a
+// channel of domains sorted by their sizes, like BootstrapLshEnsemble.
+func (p *Profile) Bootstrap(totalNumDomains int, sortedDomains chan *DomainRecord) *LshEnsemble {
+	return BootstrapLshEnsemble(p.NumPart, p.NumHash, p.MaxK, totalNumDomains, sortedDomains)
+}
+
+// Record creates the domain record of a column from its values,
+// normalized and tokenized, whose size is the number of distinct tokens,
+// estimated if they are sampled.
+func (p *Profile) Record(key string, values []string) *DomainRecord {
+	var sampler *Sampler
+	if p.SampleRate > 0 && p.SampleRate < 1 {
+		sampler = NewSampler(p.SampleRate, p.Seed)
+	}
+	b := NewDomainBuilder(key, p.Seed, p.NumHash, sampler)
+	for _, v := range values {
+		if p.Normalize != nil {
+			v = p.Normalize(v)
+		}
+		for _, token := range p.Tokenize(v) {
+			b.Push([]byte(token))
+		}
+	}
+	return b.Record()
+}
+
+func tokenizeCategorical(value string) []string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+// tokenizeNumeric formats numbers canonically using EncodeFloat, so 1,
+// 1.0 and 1e0 are the same value.
+func tokenizeNumeric(value string) []string {
+	value = strings.TrimSpace(value)
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return []string{string(EncodeFloat(f, -1))}
+	}
+	return tokenizeCategorical(value)
+}
+
+func tokenizeText(value string) []string {
+	return strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// tokenizeURL ignores the scheme, the query and the fragment, and the
+// "www." prefix of the host.
+func tokenizeURL(value string) []string {
+	value = strings.TrimSpace(value)
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return tokenizeCategorical(value)
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	return []string{host + strings.TrimSuffix(u.Path, "/")}
+}
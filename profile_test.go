@@ -0,0 +1,124 @@
+package lshensemble
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+	"unicode"
+)
+
+func Test_NewForDataDiscovery(t *testing.T) {
+	index := NewForDataDiscovery([]Partition{{0, 10}})
+	if index.numHash != DataDiscoveryProfile.NumHash || index.maxK != DataDiscoveryProfile.MaxK {
+		t.Fatal(index.numHash, index.maxK)
+	}
+}
+
+func Test_ProfileTokenize(t *testing.T) {
+	cases := []struct {
+		profile *Profile
+		value   string
+		tokens  []string
+	}{
+		{&NumericProfile, " 1.0 ", []string{"1"}},
+		{&NumericProfile, "1e3", []string{"1000"}},
+		{&NumericProfile, "N/A", []string{"n/a"}},
+		{&CategoricalProfile, " Toronto", []string{"toronto"}},
+		{&CategoricalProfile, "  ", nil},
+		{&TextProfile, "Hello, world!", []string{"hello", "world"}},
+		{&URLProfile, "https://www.Example.com/a/?q=1", []string{"example.com/a"}},
+	}
+	for _, c := range cases {
+		if tokens := c.profile.Tokenize(c.value); !reflect.DeepEqual(tokens, c.tokens) {
+			t.Error(c.profile.Name, c.value, tokens)
+		}
+	}
+}
+
+func Test_ProfileRecord(t *testing.T) {
+	p := &NumericProfile
+	var values1, values2 []string
+	for i := 1000; i < 1100; i++ {
+		values1 = append(values1, strconv.Itoa(i), strconv.Itoa(i))
+		values2 = append(values2, strconv.Itoa(i)+".0")
+	}
+	values2 = append(values2, "1e4")
+	rec1 := p.Record("a", values1)
+	rec2 := p.Record("b", values2)
+	if rec1.Size != 100 || rec2.Size != 101 {
+		t.Fatal(rec1.Size, rec2.Size)
+	}
+	index := p.New([]Partition{{0, 200}})
+	index.Add(rec2.Key, rec2.Signature, 0)
+	index.Index()
+	result, _ := index.Query(rec1.Signature, rec1.Size, p.Threshold)
+	if len(result) != 1 || result[0] != "b" {
+		t.Fatal(result)
+	}
+}
+
+func Test_Normalize(t *testing.T) {
+	n := Normalize(NormalizeNFKC, FoldCase, StripAccents, CollapseSpace)
+	cases := []struct {
+		normalizer Normalizer
+		value      string
+		want       string
+	}{
+		{n, " São  Paulo ", "sao paulo"},
+		{n, "ﬁeld", "field"},
+		{NormalizeNFC, "e\u0301", "\u00e9"},
+		{NormalizeNFKC, "Ｔｏｋｙｏ", "Tokyo"},
+		{FoldCase, "\u212Aelvin", "kelvin"},
+		{FoldCaseLocale(unicode.TurkishCase), "İstanbul", "istanbul"},
+		{StripAccents, "Ångström", "Angstrom"},
+		{TrimSpace, " a b ", "a b"},
+	}
+	for _, c := range cases {
+		if got := c.normalizer(c.value); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.value, got, c.want)
+		}
+	}
+
+	p := CategoricalProfile
+	p.Normalize = n
+	rec1 := p.Record("a", []string{"São Paulo", "Zürich"})
+	rec2 := p.Record("b", []string{"sao paulo", "ZURICH"})
+	if !reflect.DeepEqual(rec1.Signature, rec2.Signature) {
+		t.Fatal("different signatures")
+	}
+}
+
+func Test_Sampler(t *testing.T) {
+	s := NewSampler(0.1, 1)
+	// A query domain of 20000 values, half of them in the other domain
+	query := NewDomainBuilder("q", 1, 256, s)
+	other := NewDomainBuilder("x", 1, 256, s)
+	var sampled int
+	for i := 0; i < 20000; i++ {
+		v := []byte(strconv.Itoa(i))
+		query.Push(v)
+		query.Push(v)
+		if i%2 == 0 {
+			other.Push(v)
+		}
+		if s.Sample(v) {
+			sampled++
+		}
+	}
+	q, x := query.Record(), other.Record()
+	if q.Size != s.EstimateSize(sampled) || math.Abs(float64(q.Size)-20000) > 1000 {
+		t.Fatal(q.Size, sampled)
+	}
+	// The samples overlap as much as the domains
+	got := float64(len(other.seen)) / float64(len(query.seen))
+	if math.Abs(got-0.5) > 3*s.StdError(20000, 0.5) {
+		t.Fatal(got, s.StdError(20000, 0.5))
+	}
+	if x.Size > q.Size {
+		t.Fatal(x.Size, q.Size)
+	}
+	if rate := SampleRateFor(1000000, 10000); rate != 0.01 {
+		t.Fatal(rate)
+	}
+}
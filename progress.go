@@ -0,0 +1,106 @@
+package lshensemble
+
+import (
+	"io"
+	"sync"
+)
+
+// ProgressFunc is called with the work done so far by a long operation,
+// and the total work, or 0 if it is unknown, e.g. to show a progress bar.
+type ProgressFunc func(done, total int64)
+
+// Progress holds the callbacks reporting the progress of the operations
+// of an index. Nil callbacks are not called.
+type Progress struct {
+	// Records is called by Bootstrap with the number of domains added.
+	Records ProgressFunc
+	// Tables is called by Index() with the number of hash tables
+	// indexed, as the partitions are indexed.
+	Tables ProgressFunc
+}
+
+// progressInterval is the number of records between two calls to
+// Progress.Records.
+const progressInterval = 1024
+
+// WithProgress sets the callbacks reporting the progress of the index.
+func WithProgress(p Progress) Option {
+	return func(c *config) {
+		c.progress = p
+	}
+}
+
+// SetProgress sets the callbacks reporting the progress of the index.
+func (e *LshEnsemble) SetProgress(p Progress) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.progress = p
+}
+
+// tableProgress returns a function reporting that the hash tables of a
+// partition were indexed, which is safe to call from multiple goroutines.
+func (e *LshEnsemble) tableProgress() func(lsh Lsh) {
+	fn := e.progress.Tables
+	if fn == nil {
+		return func(Lsh) {}
+	}
+	var total int64
+	for _, lsh := range e.lshes {
+		for _, f := range lshForests(lsh) {
+			total += int64(f.l)
+		}
+	}
+	var mu sync.Mutex
+	var done int64
+	return func(lsh Lsh) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range lshForests(lsh) {
+			done += int64(f.l)
+		}
+		fn(done, total)
+	}
+}
+
+// ProgressReader returns a reader reading from r, calling fn with the
+// number of bytes read and total, e.g. to report the progress of Load.
+func ProgressReader(r io.Reader, total int64, fn ProgressFunc) io.Reader {
+	return &progressReader{r: r, total: total, fn: fn}
+}
+
+type progressReader struct {
+	r     io.Reader
+	done  int64
+	total int64
+	fn    ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		p.fn(p.done, p.total)
+	}
+	return n, err
+}
+
+// ProgressWriter returns a writer writing to w, calling fn with the number
+// of bytes written, e.g. to report the progress of Save.
+func ProgressWriter(w io.Writer, fn ProgressFunc) io.Writer {
+	return &progressWriter{w: w, fn: fn}
+}
+
+type progressWriter struct {
+	w    io.Writer
+	done int64
+	fn   ProgressFunc
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if n > 0 {
+		p.done += int64(n)
+		p.fn(p.done, 0)
+	}
+	return n, err
+}
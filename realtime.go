@@ -0,0 +1,132 @@
+package lshensemble
+
+import (
+	"time"
+)
+
+// WithRealtime makes the domains added to the index searchable at once,
+// instead of after the next Index(): they are also kept in a buffer
+// scanned linearly by the queries alongside the hash tables, which Index()
+// empties. The index calls Index() in the background within mergeDelay of
+// the first domain added to the buffer, so the buffer stays small and the
+// queries fast. Index() can still be called at any time.
+// Every domain added invalidates the query cache. The indexes
+// spilling to disk, with WithSpill or WithMemoryBudget, are not supported.
+func WithRealtime(mergeDelay time.Duration) Option {
+	return func(c *config) {
+		c.realtime = &mergeDelay
+	}
+}
+
+// realtimeBuffer holds the domains added to a realtime index since the
+// last Index().
+type realtimeBuffer struct {
+	delay   time.Duration
+	domains []bufferedDomain
+	// timer calls Index() once the delay of the first domain buffered
+	// has elapsed.
+	timer *time.Timer
+}
+
+// bufferedDomain is a domain added to the partition of a realtime index,
+// with the hash keys of its bands in the forests of the partition, as
+// returned by BandKeys.
+type bufferedDomain struct {
+	key      string
+	part     int
+	bandKeys [][]byte
+}
+
+func newRealtimeBuffer(delay *time.Duration) *realtimeBuffer {
+	if delay == nil {
+		return nil
+	}
+	return &realtimeBuffer{delay: *delay}
+}
+
+// add buffers the domain added to the partition of the index, given its
+// signature or the hash keys of its bands, and schedules the next Index().
+func (b *realtimeBuffer) add(e *LshEnsemble, key string, sig Signature, bandKeys [][]byte, part int) {
+	if bandKeys == nil {
+		for _, f := range lshForests(e.lshes[part]) {
+			bandKeys = append(bandKeys, f.BandKeys(sig)...)
+		}
+	}
+	b.domains = append(b.domains, bufferedDomain{key, part, bandKeys})
+	e.generation++
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.delay, func() {
+			e.Index()
+		})
+	}
+}
+
+// remove removes the key from the buffer.
+func (b *realtimeBuffer) remove(key string) {
+	domains := b.domains[:0]
+	for _, d := range b.domains {
+		if d.key != key {
+			domains = append(domains, d)
+		}
+	}
+	b.domains = domains
+}
+
+// reset empties the buffer once its domains are indexed.
+func (b *realtimeBuffer) reset() {
+	b.domains = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+// probe writes the domains of the buffer which are candidates of the
+// query to out, until all are written or done is closed, and returns
+// false if done was closed. A domain is a candidate if it matches the
+// query in one of the bands probed in the forest of its partition.
+func (b *realtimeBuffer) probe(e *LshEnsemble, sig Signature, params []param, done <-chan struct{}, out chan<- string) bool {
+	// The hash keys of the query in every partition, and the offset of
+	// the bands of the forest probed in the band keys of the partition
+	hashKeys := make([][]string, len(params))
+	offsets := make([]int, len(params))
+	forests := make([]*LshForest, len(params))
+	ks := make([]int, len(params))
+	for _, d := range b.domains {
+		p := params[d.part]
+		if p.l == 0 {
+			continue
+		}
+		if hashKeys[d.part] == nil {
+			f, K := e.lshes[d.part].forest(p.k)
+			if K == -1 {
+				K = f.k
+			}
+			forests[d.part], ks[d.part] = f, K
+			hashKeys[d.part] = make([]string, f.bands(sig, K, p.l))
+			for i := range hashKeys[d.part] {
+				hashKeys[d.part][i] = f.hashKeyFuncs[i](sig[i*f.k : i*f.k+K])
+			}
+			for _, g := range lshForests(e.lshes[d.part]) {
+				if g == f {
+					break
+				}
+				offsets[d.part] += g.l
+			}
+		}
+		for i, hk := range hashKeys[d.part] {
+			// The hash key of the first K values of the band is a
+			// prefix of the hash key of the band
+			if !forests[d.part].hasPrefix(string(d.bandKeys[offsets[d.part]+i]), hk, ks[d.part]) {
+				continue
+			}
+			select {
+			case out <- d.key:
+			case <-done:
+				return false
+			}
+			break
+		}
+	}
+	return true
+}
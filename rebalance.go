@@ -0,0 +1,135 @@
+package lshensemble
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/streamrail/concurrent-map"
+)
+
+// Rebalance recomputes the partition boundaries of the index to be
+// equi-depth for the current sizes of its domains, as BootstrapLshEnsemble
+// does, and migrates the domains to their new partitions, e.g. after
+// skewed growth or heavy replacements made the partitions drift.
+// The new partitions are built in the background, while the index keeps
+// answering queries and adding domains on the current partitions, and the
+// index switches to them at once, with the domains added in the meantime.
+// The domains added since the last Index() become searchable, as with
+// Index().
+// Every key of the index must have been added by AddDomain, so its size
+// and signature are known: Rebalance returns an error wrapping
+// ErrKeyNotRetained otherwise, leaving the index unchanged.
+func (e *LshEnsemble) Rebalance() error {
+	if e.frozen {
+		return ErrFrozenIndex
+	}
+	if e.partitioner != nil {
+		return invalidParameter("cannot rebalance the partitions of a partitioner")
+	}
+	// The records added during the build are kept in domains
+	atomic.AddInt32(&e.rebalancing, 1)
+	defer atomic.AddInt32(&e.rebalancing, -1)
+	e.mu.RLock()
+	domains := make(map[string]*DomainRecord, len(e.domains)+e.sizes.len())
+	e.eachRecord(func(rec *DomainRecord) {
+		domains[rec.Key] = rec
+	})
+	err := e.checkRetained()
+	n := &LshEnsemble{
+		Partitions:  make([]Partition, len(e.Partitions)),
+		lshes:       make([]Lsh, len(e.lshes)),
+		maxK:        e.maxK,
+		numHash:     e.numHash,
+		paramCache:  cmap.New(),
+		sequential:  e.sequential,
+		parallelism: e.parallelism,
+	}
+	for i, lsh := range e.lshes {
+		n.lshes[i] = emptyLsh(lsh)
+	}
+	e.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	recs := make([]*DomainRecord, 0, len(domains))
+	for _, rec := range domains {
+		sig, err := e.signature(rec)
+		if err != nil {
+			return err
+		}
+		recs = append(recs, &DomainRecord{Key: rec.Key, Size: rec.Size, Signature: sig})
+	}
+	sort.Sort(BySize(recs))
+	bootstrap(n, len(recs), Recs2Chan(recs))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.spill != nil {
+		// The keys spilled are checked in the hash tables
+		if err := e.spill.merge(e); err != nil {
+			return err
+		}
+	}
+	if err := e.checkRetained(); err != nil {
+		return err
+	}
+	// Migrate the domains added or replaced during the build
+	for key, rec := range e.domains {
+		old, exist := domains[key]
+		if exist && old == rec {
+			continue
+		}
+		if exist {
+			for _, f := range lshForests(n.lshes[n.PartitionIndex(old.Size)]) {
+				f.remove(key)
+			}
+		}
+		sig, err := e.signature(rec)
+		if err != nil {
+			return err
+		}
+		n.Add(key, sig, n.PartitionIndex(rec.Size))
+	}
+	n.Index()
+	e.Partitions = n.Partitions
+	e.lshes = n.lshes
+	e.paramCache = n.paramCache
+	if e.keyParts != nil {
+		e.keyParts = e.indexedKeys()
+	}
+	e.pending = 0
+	if e.realtime != nil {
+		e.realtime.reset()
+	}
+	if e.compactSizes {
+		e.packSizes()
+	}
+	if e.released {
+		e.release()
+	}
+	e.generation++
+	return nil
+}
+
+// checkRetained returns an error if a key of the index, indexed or not,
+// was not added by AddDomain.
+func (e *LshEnsemble) checkRetained() error {
+	for i, lsh := range e.lshes {
+		if _, tiered := lsh.(*tieredLsh); tiered {
+			return ErrFrozenIndex
+		}
+		var missing string
+		if forests := lshForests(lsh); len(forests) > 0 {
+			forests[0].eachKey(func(key string) {
+				if _, exist := e.record(key); !exist && missing == "" {
+					missing = key
+				}
+			})
+		}
+		if missing != "" {
+			return fmt.Errorf("%w: %q in partition %d", ErrKeyNotRetained, missing, i)
+		}
+	}
+	return nil
+}
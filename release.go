@@ -0,0 +1,47 @@
+package lshensemble
+
+// WithReleaseOnIndex makes the next Index() final: once the domains are
+// indexed, the structures used only to add domains are released, i.e. the
+// init hash tables of the forests, the extensions of their split buckets,
+// the key dictionary of the duplicate policy, the realtime buffer and the
+// spill runs, for the memory to be reclaimed by the garbage collector
+// instead of holding the empty maps of a bootstrapped index.
+// The index then rejects the domains added with ErrFrozenIndex, as a
+// frozen index does, while it can still be queried, cloned and
+// rebalanced.
+func WithReleaseOnIndex() Option {
+	return func(c *config) {
+		c.release = true
+	}
+}
+
+// release releases the bootstrapping structures of the index, which
+// rejects the domains added afterwards.
+func (e *LshEnsemble) release() {
+	e.released = true
+	e.keyParts = nil
+	e.realtime = nil
+	e.spill = nil
+	e.pending = 0
+	for _, lsh := range e.lshes {
+		for _, f := range lshForests(lsh) {
+			f.release()
+		}
+	}
+}
+
+// release releases the init hash tables of the forest, and the
+// extensions of its split buckets, so the keys added are ignored.
+func (f *LshForest) release() {
+	f.initHashTables = nil
+	f.initExtensions = nil
+}
+
+// initTable returns the i-th init hash table of the forest, or nil if it
+// was released.
+func (f *LshForest) initTable(i int) initHashTable {
+	if f.initHashTables == nil {
+		return nil
+	}
+	return f.initHashTables[i]
+}
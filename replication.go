@@ -0,0 +1,231 @@
+package lshensemble
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Replication log entry kinds
+const (
+	logAdd   byte = 'A'
+	logIndex byte = 'I'
+)
+
+// ErrReplicationGap is returned by CatchUp for the log entries following
+// a missing entry, e.g. deltas starting after the snapshot of the replica.
+var ErrReplicationGap = errors.New("lshensemble: gap in the replication log")
+
+// ReplicationLog wraps the index of a writer node, and records every Add
+// and Index into a log of deltas. Read replicas bootstrap from a snapshot
+// written by WriteSnapshot, and catch up by replaying the log.
+// All updates to the index must go through the ReplicationLog.
+//
+// Every log entry is prefixed by its length, and consists of the entry kind,
+// its sequence number, and for additions, the key, the partition index and
+// the signature. The log is flushed after every Index, so replicas only
+// see complete batches.
+type ReplicationLog struct {
+	index *LshEnsemble
+	w     *bufio.Writer
+	// seq is the sequence number of the last entry, and indexed is the
+	// sequence number of the last Index entry.
+	seq     uint64
+	indexed uint64
+	mu      sync.Mutex
+}
+
+// NewReplicationLog creates a replication log for the index, writing
+// the deltas to w.
+func NewReplicationLog(index *LshEnsemble, w io.Writer) *ReplicationLog {
+	return &ReplicationLog{
+		index: index,
+		w:     bufio.NewWriter(w),
+	}
+}
+
+func (l *ReplicationLog) append(entry *encoder) error {
+	frame := encoder{}
+	frame.int(len(entry.buf))
+	if _, err := l.w.Write(frame.buf); err != nil {
+		return err
+	}
+	_, err := l.w.Write(entry.buf)
+	return err
+}
+
+// Add adds a domain to the index and records it in the log. It returns
+// the errors of AddE, in which case nothing is recorded.
+func (l *ReplicationLog) Add(key string, sig Signature, partInd int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.index.AddE(key, sig, partInd); err != nil {
+		return err
+	}
+	l.seq++
+	entry := encoder{buf: []byte{logAdd}}
+	entry.uvarint(l.seq)
+	entry.string(key)
+	entry.int(partInd)
+	entry.int(len(sig))
+	for _, v := range sig {
+		entry.uvarint(v)
+	}
+	return l.append(&entry)
+}
+
+// Index makes the added domains searchable, records it in the log,
+// and flushes the log.
+func (l *ReplicationLog) Index() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	entry := encoder{buf: []byte{logIndex}}
+	entry.uvarint(l.seq)
+	if err := l.append(&entry); err != nil {
+		return err
+	}
+	l.index.Index()
+	l.indexed = l.seq
+	return l.w.Flush()
+}
+
+// WriteSnapshot writes the sequence number of the last Index entry,
+// followed by the index in the format written by Save.
+// Replicas loading the snapshot only replay the entries after it.
+func (l *ReplicationLog) WriteSnapshot(w io.Writer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	header := encoder{}
+	header.uvarint(l.indexed)
+	if _, err := w.Write(header.buf); err != nil {
+		return err
+	}
+	return l.index.Save(w)
+}
+
+// Replica is a read-only copy of an index, kept up to date by applying
+// the snapshots and the replication log of a writer node.
+// It is safe to query a Replica while it is catching up.
+type Replica struct {
+	index *LshEnsemble
+	seq   uint64
+	mu    sync.RWMutex
+	// updating serializes the snapshots and log entries being applied.
+	updating sync.Mutex
+}
+
+// NewReplica creates a replica from a snapshot written by WriteSnapshot.
+func NewReplica(snapshot io.Reader) (*Replica, error) {
+	r := &Replica{}
+	if err := r.ApplySnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ApplySnapshot replaces the index of the replica with a snapshot
+// written by WriteSnapshot.
+func (r *Replica) ApplySnapshot(snapshot io.Reader) error {
+	r.updating.Lock()
+	defer r.updating.Unlock()
+	br := bufio.NewReader(snapshot)
+	seq, err := binary.ReadUvarint(br)
+	if err != nil {
+		return ErrCorruptIndex
+	}
+	index, err := Load(br)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.index = index
+	r.seq = seq
+	r.mu.Unlock()
+	return nil
+}
+
+// CatchUp replays the log entries read from deltas until the end of the
+// input, skipping the entries already applied. It returns an error
+// wrapping ErrReplicationGap at the first entry not following the last
+// one applied, and the errors of AddE for the domains added.
+func (r *Replica) CatchUp(deltas io.Reader) error {
+	r.updating.Lock()
+	defer r.updating.Unlock()
+	br := bufio.NewReader(deltas)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return nil
+		}
+		entry, err := readSegment(br)
+		if err != nil {
+			return err
+		}
+		if err := r.apply(entry); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Replica) apply(entry []byte) error {
+	d := decoder{buf: entry}
+	kind := d.byte()
+	seq := d.uvarint()
+	if d.err != nil {
+		return d.err
+	}
+	index := r.index
+	if seq <= r.seq {
+		return nil
+	}
+	if seq != r.seq+1 {
+		return fmt.Errorf("%w: entry %d after %d", ErrReplicationGap, seq, r.seq)
+	}
+	switch kind {
+	case logAdd:
+		key := d.string()
+		partInd := d.int(len(index.lshes) - 1)
+		sig := make(Signature, d.int(len(d.buf)))
+		for i := range sig {
+			sig[i] = d.uvarint()
+		}
+		if d.err != nil {
+			return d.err
+		}
+		if err := index.AddE(key, sig, partInd); err != nil {
+			return err
+		}
+	case logIndex:
+		index.Index()
+	default:
+		return ErrCorruptIndex
+	}
+	r.mu.Lock()
+	r.seq = seq
+	r.mu.Unlock()
+	return nil
+}
+
+// Seq returns the sequence number of the last log entry applied.
+func (r *Replica) Seq() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.seq
+}
+
+// Ensemble returns the current index of the replica, which must
+// only be queried.
+func (r *Replica) Ensemble() *LshEnsemble {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.index
+}
+
+// Query queries the current index of the replica.
+func (r *Replica) Query(sig Signature, size int, threshold float64) ([]string, time.Duration) {
+	return r.Ensemble().Query(sig, size, threshold)
+}
@@ -0,0 +1,60 @@
+package lshensemble
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func Test_Replica(t *testing.T) {
+	recs := randomDomains(100, 64, 1)
+	parts := []Partition{{0, 100}, {100, 1000}}
+	index := NewLshEnsemble(parts, 64, 4)
+	var deltas bytes.Buffer
+	log := NewReplicationLog(index, &deltas)
+	for _, rec := range recs[:50] {
+		log.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+	}
+	if err := log.Index(); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := log.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs[50:] {
+		log.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+	}
+	log.Index()
+
+	replica, err := NewReplica(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica.Seq() != 51 {
+		t.Fatal(replica.Seq())
+	}
+	if err := replica.CatchUp(bytes.NewReader(deltas.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if replica.Seq() != 102 {
+		t.Fatal(replica.Seq())
+	}
+	sameResults(t, index, replica.Ensemble(), recs)
+
+	// Rejected additions are not recorded
+	n := deltas.Len()
+	if err := log.Add("short", recs[0].Signature[:1], 0); !errors.Is(err, ErrInvalidSignature) || deltas.Len() != n {
+		t.Fatal(err, deltas.Len())
+	}
+
+	// The deltas must follow the last entry applied
+	var gap bytes.Buffer
+	log = NewReplicationLog(NewLshEnsemble(parts, 64, 4), &gap)
+	log.seq = replica.Seq() + 1
+	log.Add(recs[0].Key, recs[0].Signature, 0)
+	log.Index()
+	if err := replica.CatchUp(&gap); !errors.Is(err, ErrReplicationGap) || replica.Seq() != 102 {
+		t.Fatal(err, replica.Seq())
+	}
+}
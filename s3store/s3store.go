@@ -0,0 +1,60 @@
+//go:build s3
+// +build s3
+
+// Package s3store implements lshensemble.BlobStore on Amazon S3, so index
+// snapshots can be shared through object storage.
+// It is only built with the "s3" build tag.
+package s3store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Store is a BlobStore keeping objects in an S3 bucket under a key prefix.
+type Store struct {
+	Client s3iface.S3API
+	Bucket string
+	Prefix string
+}
+
+// New returns a Store for the bucket using the client.
+func New(client s3iface.S3API, bucket, prefix string) *Store {
+	return &Store{
+		Client: client,
+		Bucket: bucket,
+		Prefix: prefix,
+	}
+}
+
+func (s *Store) key(name string) *string {
+	return aws.String(path.Join(s.Prefix, name))
+}
+
+// Put uploads data as the object name.
+func (s *Store) Put(name string, data []byte) error {
+	_, err := s.Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    s.key(name),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// Get downloads the object name.
+func (s *Store) Get(name string) ([]byte, error) {
+	out, err := s.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    s.key(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
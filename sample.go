@@ -0,0 +1,123 @@
+package lshensemble
+
+import (
+	"math"
+)
+
+// Sampler selects the values of very large domains hashed into their
+// signatures, to bound the cost of computing them.
+// A value is sampled if its hash is below the sampling rate, so the same
+// values are sampled in every domain: the samples of two domains overlap
+// as much as the domains, and the containment of the samples estimates the
+// containment of the domains. The domains of an index must be sampled at
+// the same rate with the same seed.
+type Sampler struct {
+	rate      float64
+	seed      uint64
+	threshold uint64
+}
+
+// NewSampler returns a sampler of the given rate in (0, 1].
+// It panics if the rate is out of range.
+func NewSampler(rate float64, seed int) *Sampler {
+	if !(rate > 0 && rate <= 1) {
+		panic("lshensemble: sampling rate must be in (0, 1]")
+	}
+	threshold := uint64(math.MaxUint64)
+	if rate < 1 {
+		threshold = uint64(rate * (1 << 64))
+	}
+	return &Sampler{rate: rate, seed: mix64(uint64(seed)), threshold: threshold}
+}
+
+// SampleRateFor returns the sampling rate so that domains of up to
+// maxSize values have at most sampleSize values sampled on average.
+func SampleRateFor(maxSize, sampleSize int) float64 {
+	if maxSize <= sampleSize || maxSize <= 0 {
+		return 1
+	}
+	return float64(sampleSize) / float64(maxSize)
+}
+
+// hash returns the sampling hash of a value.
+func (s *Sampler) hash(v []byte) uint64 {
+	return seededHash(v, s.seed)
+}
+
+// Sample returns true if the value is sampled.
+func (s *Sampler) Sample(v []byte) bool {
+	return s.sampled(s.hash(v))
+}
+
+func (s *Sampler) sampled(h uint64) bool {
+	return s.threshold == math.MaxUint64 || h < s.threshold
+}
+
+// Rate returns the sampling rate.
+func (s *Sampler) Rate() float64 {
+	return s.rate
+}
+
+// EstimateSize returns the estimated size of a domain with the given
+// number of distinct values sampled.
+func (s *Sampler) EstimateSize(sampled int) int {
+	return int(math.Round(float64(sampled) / s.rate))
+}
+
+// StdError returns the standard error of the containment t of a query
+// domain of the given size estimated from the samples, which is the
+// accuracy lost by sampling: the samples of the query have about
+// rate*size values, of which a fraction t is in the other domain.
+func (s *Sampler) StdError(size int, t float64) float64 {
+	n := s.rate * float64(size)
+	if n == 0 {
+		return 1
+	}
+	return math.Sqrt(t * (1 - t) * (1 - s.rate) / n)
+}
+
+// DomainBuilder builds the record of a domain from a stream of its
+// values, which may repeat. Only the distinct values are hashed, and if
+// it has a Sampler, only the sampled ones, the size of the domain being
+// estimated from the number of distinct values sampled. The values seen
+// are remembered as 64-bit hashes.
+type DomainBuilder struct {
+	key     string
+	mh      *Minhash
+	sampler *Sampler
+	seen    map[uint64]bool
+}
+
+// NewDomainBuilder returns a builder of the record of the domain of key,
+// with MinHash signatures of the seed and number of hash functions.
+// The sampler may be nil to hash all the values.
+func NewDomainBuilder(key string, seed, numHash int, sampler *Sampler) *DomainBuilder {
+	if sampler == nil {
+		sampler = NewSampler(1, seed)
+	}
+	return &DomainBuilder{
+		key:     key,
+		mh:      NewMinhash(seed, numHash),
+		sampler: sampler,
+		seen:    make(map[uint64]bool),
+	}
+}
+
+// Push adds a value to the domain.
+func (b *DomainBuilder) Push(v []byte) {
+	h := b.sampler.hash(v)
+	if !b.sampler.sampled(h) || b.seen[h] {
+		return
+	}
+	b.seen[h] = true
+	b.mh.Push(v)
+}
+
+// Record returns the record of the domain of the values pushed so far.
+func (b *DomainBuilder) Record() *DomainRecord {
+	return &DomainRecord{
+		Key:       b.key,
+		Size:      b.sampler.EstimateSize(len(b.seen)),
+		Signature: b.mh.Signature(),
+	}
+}
@@ -0,0 +1,382 @@
+package lshensemble
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// SegmentOptions configures a SegmentedIndex.
+type SegmentOptions struct {
+	// Dir, if set, is the directory the sealed segments are saved in,
+	// one file per segment, and loaded from by NewSegmentedIndex.
+	Dir string
+	// SegmentSize is the number of domains added to the active segment
+	// before it is sealed, 10000 by default.
+	SegmentSize int
+	// Fanout is the number of segments of a level merged into a segment
+	// of the next level, 4 by default.
+	Fanout int
+	// Keys, if set, encrypt the segments saved in Dir, as SaveEncrypted
+	// does, and decrypt them when they are loaded.
+	Keys KeyProvider
+}
+
+// SegmentedIndex is an index made of segments, like a log-structured
+// merge tree: the domains are added to a small active segment, which is
+// sealed once full, and the sealed segments of a level are merged in the
+// background into a larger segment of the next level, so the additions
+// stay fast while the number of segments read by the queries grows
+// logarithmically with the number of domains.
+// The segments are indexes created by New with the same options, which
+// must set the partitions, so the hash tables of sealed segments can be
+// merged bucket by bucket without the signatures of their domains.
+// A key added twice, to different segments, is returned once.
+type SegmentedIndex struct {
+	opts SegmentOptions
+	// indexOpts are the options of the segments.
+	indexOpts []Option
+	config    Config
+	mu        sync.RWMutex
+	// active is the segment being added to, with n domains.
+	active *LshEnsemble
+	n      int
+	// segments are the sealed segments, from the oldest.
+	segments []*segment
+	nextID   uint64
+	// merging is true while a merge runs, and err is the first error of
+	// the merges.
+	merging bool
+	merged  sync.WaitGroup
+	err     error
+}
+
+// segment is a sealed segment, saved in file if the index has a Dir.
+type segment struct {
+	index *LshEnsemble
+	level int
+	id    uint64
+	file  string
+}
+
+// NewSegmentedIndex creates a segmented index whose segments are created
+// by New with the options, loading the segments saved in the Dir of opts
+// if any. It returns an error wrapping ErrCorruptIndex if a saved segment
+// does not have the configuration of the options.
+func NewSegmentedIndex(opts *SegmentOptions, indexOpts ...Option) (*SegmentedIndex, error) {
+	s := &SegmentedIndex{indexOpts: indexOpts}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.SegmentSize <= 0 {
+		s.opts.SegmentSize = 10000
+	}
+	if s.opts.Fanout < 2 {
+		s.opts.Fanout = 4
+	}
+	active, err := New(indexOpts...)
+	if err != nil {
+		return nil, err
+	}
+	s.active = active
+	s.config = active.Config()
+	if s.opts.Dir != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// load loads the segments saved in the directory, in the order of their
+// ids.
+func (s *SegmentedIndex) load() error {
+	files, err := filepath.Glob(filepath.Join(s.opts.Dir, "segment-*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		var level int
+		var id uint64
+		if _, err := fmt.Sscanf(filepath.Base(file), "segment-%d-%x", &level, &id); err != nil {
+			// Not a segment, e.g. a temporary file
+			continue
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		var index *LshEnsemble
+		if s.opts.Keys != nil {
+			index, err = LoadEncrypted(f, s.opts.Keys)
+		} else {
+			index, err = Load(f)
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if !reflect.DeepEqual(index.Config(), s.config) {
+			return fmt.Errorf("%w: %s has another configuration", ErrCorruptIndex, file)
+		}
+		s.segments = append(s.segments, &segment{index: index, level: level, id: id, file: file})
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+	return nil
+}
+
+// Add adds a domain to the active segment, sealing it if full. The domain
+// is searchable once its segment is sealed, by Add or Flush.
+func (s *SegmentedIndex) Add(key string, sig Signature, size int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.active.AddE(key, sig, s.active.PartitionIndex(size)); err != nil {
+		return err
+	}
+	s.n++
+	if s.n < s.opts.SegmentSize {
+		return nil
+	}
+	return s.seal()
+}
+
+// Flush seals the active segment, making the domains added searchable.
+func (s *SegmentedIndex) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n == 0 {
+		return nil
+	}
+	return s.seal()
+}
+
+// seal indexes the active segment, saves it and replaces it by an empty
+// segment, then starts merging the segments if needed.
+func (s *SegmentedIndex) seal() error {
+	if err := s.active.IndexE(); err != nil {
+		return err
+	}
+	seg := &segment{index: s.active, id: s.nextID}
+	if err := s.save(seg); err != nil {
+		return err
+	}
+	active, err := New(s.indexOpts...)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+	s.segments = append(s.segments, seg)
+	s.active, s.n = active, 0
+	s.merge()
+	return nil
+}
+
+// save writes the segment to its file if the index has a directory.
+// The segment is written to a temporary file first, so a crash never
+// leaves a partial segment.
+func (s *SegmentedIndex) save(seg *segment) error {
+	if s.opts.Dir == "" {
+		return nil
+	}
+	file, err := ioutil.TempFile(s.opts.Dir, "tmp-segment-")
+	if err != nil {
+		return err
+	}
+	if s.opts.Keys != nil {
+		err = seg.index.SaveEncrypted(file, s.opts.Keys)
+	} else {
+		err = seg.index.Save(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	name := filepath.Join(s.opts.Dir, fmt.Sprintf("segment-%d-%016x", seg.level, seg.id))
+	if err == nil {
+		err = os.Rename(file.Name(), name)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	seg.file = name
+	return nil
+}
+
+// merge starts merging the segments in the background, unless a merge is
+// running already. It is called with s.mu locked.
+func (s *SegmentedIndex) merge() {
+	if s.merging || s.err != nil {
+		return
+	}
+	inputs := s.mergeInputs()
+	if inputs == nil {
+		return
+	}
+	s.merging = true
+	s.merged.Add(1)
+	go func() {
+		defer s.merged.Done()
+		for inputs != nil {
+			err := s.mergeSegments(inputs)
+			s.mu.Lock()
+			if err != nil {
+				s.err = err
+				inputs = nil
+			} else {
+				inputs = s.mergeInputs()
+			}
+			s.merging = inputs != nil
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// mergeInputs returns the oldest Fanout segments of the lowest level
+// having that many, or nil.
+func (s *SegmentedIndex) mergeInputs() []*segment {
+	levels := make(map[int][]*segment)
+	lowest := -1
+	for _, seg := range s.segments {
+		levels[seg.level] = append(levels[seg.level], seg)
+		if len(levels[seg.level]) == s.opts.Fanout && (lowest < 0 || seg.level < lowest) {
+			lowest = seg.level
+		}
+	}
+	if lowest < 0 {
+		return nil
+	}
+	return levels[lowest][:s.opts.Fanout]
+}
+
+// mergeSegments merges the segments into a segment of the next level,
+// which replaces them.
+func (s *SegmentedIndex) mergeSegments(inputs []*segment) error {
+	index, err := New(s.indexOpts...)
+	if err != nil {
+		return err
+	}
+	for i, lsh := range index.lshes {
+		for j, f := range lshForests(lsh) {
+			for t := range f.hashTables {
+				tables := make([]hashTable, len(inputs))
+				for n, seg := range inputs {
+					tables[n] = lshForests(seg.index.lshes[i])[j].hashTables[t]
+				}
+				f.setTable(t, mergeTables(tables))
+			}
+		}
+	}
+	s.mu.Lock()
+	seg := &segment{index: index, level: inputs[0].level + 1, id: s.nextID}
+	s.nextID++
+	s.mu.Unlock()
+	if err := s.save(seg); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	// The merged segment takes the place of the oldest input
+	merged := make(map[*segment]bool, len(inputs))
+	for _, in := range inputs {
+		merged[in] = true
+	}
+	segments := make([]*segment, 0, len(s.segments)-len(inputs)+1)
+	for _, old := range s.segments {
+		if old == inputs[0] {
+			segments = append(segments, seg)
+		} else if !merged[old] {
+			segments = append(segments, old)
+		}
+	}
+	s.segments = segments
+	s.mu.Unlock()
+	for _, in := range inputs {
+		if in.file != "" {
+			os.Remove(in.file)
+		}
+	}
+	return nil
+}
+
+// mergeTables merges sorted hash tables into a sorted hash table, with one
+// bucket per hash key.
+func mergeTables(tables []hashTable) hashTable {
+	var n int
+	for _, ht := range tables {
+		n += len(ht)
+	}
+	merged := make(hashTable, 0, n)
+	pos := make([]int, len(tables))
+	for {
+		// Find the smallest hash key at the heads of the tables
+		var hashKey string
+		found := false
+		for i, ht := range tables {
+			if pos[i] < len(ht) && (!found || ht[pos[i]].hashKey < hashKey) {
+				hashKey, found = ht[pos[i]].hashKey, true
+			}
+		}
+		if !found {
+			return merged
+		}
+		var ks keys
+		for i, ht := range tables {
+			for pos[i] < len(ht) && ht[pos[i]].hashKey == hashKey {
+				ks = append(ks, ht[pos[i]].keys...)
+				pos[i]++
+			}
+		}
+		sort.Strings(ks)
+		merged = append(merged, bucket{hashKey: hashKey, keys: ks})
+	}
+}
+
+// Query returns the keys of the candidate domains of every sealed segment,
+// as QueryE does for an index.
+func (s *SegmentedIndex) Query(sig Signature, size int, threshold float64) ([]string, error) {
+	s.mu.RLock()
+	segments := s.segments
+	s.mu.RUnlock()
+	seen := make(map[string]bool)
+	var result []string
+	for _, seg := range segments {
+		keys, _, err := seg.index.QueryE(sig, size, threshold)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				result = append(result, key)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Segments returns the number of sealed segments of every level.
+func (s *SegmentedIndex) Segments() map[int]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	levels := make(map[int]int)
+	for _, seg := range s.segments {
+		levels[seg.level]++
+	}
+	return levels
+}
+
+// Close waits for the running merges, and returns the first error of the
+// merges. The domains added since the last seal are not saved: Flush
+// seals them first.
+func (s *SegmentedIndex) Close() error {
+	s.merged.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,78 @@
+package lshensemble
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_SegmentedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lshensemble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recs := randomDomains(200, 64, 1)
+	opts := []Option{WithPartitions([]Partition{{0, 100}, {101, 300}, {301, 1000}}), WithNumHash(64)}
+	index, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmented, err := NewSegmentedIndex(&SegmentOptions{Dir: dir, SegmentSize: 10, Fanout: 3}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		index.Add(rec.Key, rec.Signature, index.PartitionIndex(rec.Size))
+		if err := segmented.Add(rec.Key, rec.Signature, rec.Size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.Index()
+	if err := segmented.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := segmented.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 20 segments of level 0 are merged down to 2 of level 0, 0 of
+	// level 1 and 2 of level 2
+	var n int
+	for level, count := range segmented.Segments() {
+		if count >= 3 {
+			t.Fatal(level, segmented.Segments())
+		}
+		n += count
+	}
+	if n != 4 {
+		t.Fatal(segmented.Segments())
+	}
+	sameSegmentedResults(t, index, segmented, recs)
+
+	// The segments are loaded back
+	loaded, err := NewSegmentedIndex(&SegmentOptions{Dir: dir}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameSegmentedResults(t, index, loaded, recs)
+	if files, _ := ioutil.ReadDir(dir); len(files) != n {
+		t.Fatal(len(files))
+	}
+	if _, err := NewSegmentedIndex(&SegmentOptions{Dir: dir}, WithPartitions([]Partition{{0, 1000}}), WithNumHash(64)); !errors.Is(err, ErrCorruptIndex) {
+		t.Fatal(err)
+	}
+}
+
+func sameSegmentedResults(t *testing.T, index *LshEnsemble, segmented *SegmentedIndex, recs []*DomainRecord) {
+	for _, rec := range recs {
+		want, _ := index.Query(rec.Signature, rec.Size, 0.5)
+		got, err := segmented.Query(rec.Signature, rec.Size, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatal(rec.Key, got, want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+//go:build go1.23
+// +build go1.23
+
+package lshensemble
+
+import "iter"
+
+// QuerySeq is like QueryStream, but returns the candidate domains as an
+// iterator. Breaking out of the loop abandons the query, so opts.Done is
+// not used. The index cannot be updated during the loop.
+func (e *LshEnsemble) QuerySeq(sig Signature, size int, threshold float64, opts *QueryOptions) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		done := make(chan struct{})
+		defer close(done)
+		for key := range e.QueryStream(sig, size, threshold, seqOptions(opts, done)) {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// QueryScored is like QuerySeq, but also yields the containment of every
+// candidate domain estimated from the MinHash signatures, in the direction
+// of opts. The containment of candidates whose domains were not retained
+// by AddDomain is NaN. It is QueryScoredE ignoring the error of the query.
+func (e *LshEnsemble) QueryScored(sig Signature, size int, threshold float64, opts *QueryOptions) iter.Seq2[string, float64] {
+	seq, _ := e.QueryScoredE(sig, size, threshold, opts)
+	return seq
+}
+
+// QueryScoredE is like QueryScored, and also returns a function returning
+// the error of the query once the loop has ended, e.g. if an admission
+// controller rejected it, or nil if the loop was broken.
+func (e *LshEnsemble) QueryScoredE(sig Signature, size int, threshold float64, opts *QueryOptions) (iter.Seq2[string, float64], func() error) {
+	var err error
+	seq := func(yield func(string, float64) bool) {
+		err = nil
+		done := make(chan struct{})
+		defer close(done)
+		o := seqOptions(opts, done)
+		out := make(chan Result, o.Buffer)
+		errs := make(chan error, 1)
+		unlock := e.rlockQuery()
+		go func() {
+			defer unlock()
+			keys := make(chan string)
+			go func() {
+				errs <- e.stream(sig, size, threshold, o, keys)
+				close(keys)
+			}()
+			e.verify(sig, size, o, keys, out, done)
+		}()
+		for r := range out {
+			if !yield(r.Key, r.Containment) {
+				return
+			}
+		}
+		err = <-errs
+	}
+	return seq, func() error { return err }
+}
+
+// seqOptions returns a copy of opts with done.
+func seqOptions(opts *QueryOptions, done chan struct{}) *QueryOptions {
+	o := QueryOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.Done = done
+	return &o
+}
@@ -0,0 +1,110 @@
+//go:build go1.23
+// +build go1.23
+
+package lshensemble
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func Test_QuerySeq(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemble(4, 64, 4, len(recs), Recs2Chan(recs))
+	expected, _ := index.Query(recs[10].Signature, recs[10].Size, 0.1)
+	var count int
+	for range index.QuerySeq(recs[10].Signature, recs[10].Size, 0.1, nil) {
+		count++
+	}
+	if count != len(expected) {
+		t.Fatal(count, len(expected))
+	}
+	for range index.QuerySeq(recs[10].Signature, recs[10].Size, 0.1, nil) {
+		break
+	}
+	// The index can be updated once the loop is broken
+	index.Index()
+}
+
+func Test_QueryScored(t *testing.T) {
+	recs := randomDomains(200, 256, 1)
+	index := NewLshEnsemble([]Partition{{0, 100}, {101, 300}}, 256, 4)
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	q := recs[50]
+	var found bool
+	for key, score := range index.QueryScored(q.Signature, q.Size, 0.5, nil) {
+		if math.IsNaN(score) || score < 0 || score > 1 {
+			t.Fatal(key, score)
+		}
+		if key == q.Key {
+			found = true
+			if score != 1 {
+				t.Fatal(score)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("query domain not found")
+	}
+
+	// The thresholds of the partitions are those of the options
+	opts := &QueryOptions{Threshold: func(upper int) float64 { return 0.1 }}
+	var want int
+	for range index.QueryStream(q.Signature, q.Size, 0.5, opts) {
+		want++
+	}
+	seq, err := index.QueryScoredE(q.Signature, q.Size, 0.5, opts)
+	var got int
+	for range seq {
+		got++
+	}
+	if got != want || err() != nil {
+		t.Fatal(got, want, err())
+	}
+	index.SetAdmissionController(NewAdmissionLimiter(0, 1))
+	seq, err = index.QueryScoredE(q.Signature, q.Size, 0.5, nil)
+	for range seq {
+		t.Fatal("rejected query yielded a candidate")
+	}
+	if !errors.Is(err(), ErrQueryRejected) {
+		t.Fatal(err())
+	}
+}
+
+func Test_QueryScoredVerifiers(t *testing.T) {
+	recs := randomDomains(200, 64, 1)
+	index := NewLshEnsemble([]Partition{{0, 100}, {101, 300}}, 64, 4)
+	for _, rec := range recs {
+		index.AddDomain(rec, index.PartitionIndex(rec.Size))
+	}
+	index.Index()
+	q := recs[50]
+	want := make(map[string]float64)
+	for key, score := range index.QueryScored(q.Signature, q.Size, 0.1, nil) {
+		want[key] = score
+	}
+	for _, unordered := range []bool{false, true} {
+		opts := &QueryOptions{Verifiers: 4, UnorderedVerify: unordered}
+		got := make(map[string]float64)
+		for key, score := range index.QueryScored(q.Signature, q.Size, 0.1, opts) {
+			got[key] = score
+		}
+		if len(got) != len(want) {
+			t.Fatal(len(got), len(want))
+		}
+		for key, score := range got {
+			if want[key] != score {
+				t.Fatal(key, score, want[key])
+			}
+		}
+		for range index.QueryScored(q.Signature, q.Size, 0.1, opts) {
+			break
+		}
+		// The index can be updated once the loop is broken
+		index.Index()
+	}
+}
@@ -0,0 +1,74 @@
+package lshensemble
+
+// WithSequential makes the index add, index and probe its partitions and
+// hash tables on the calling goroutine, instead of a goroutine per
+// partition and hash table, for single-threaded targets such as
+// WebAssembly where the goroutines only add scheduling overhead.
+func WithSequential() Option {
+	return func(c *config) {
+		c.sequential = true
+	}
+}
+
+// SetSequential sets whether the index runs sequentially, as with
+// WithSequential, e.g. for an index loaded by Load.
+func (e *LshEnsemble) SetSequential(sequential bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sequential = sequential
+}
+
+// addSequential adds the key to the forests of the partition.
+func (e *LshEnsemble) addSequential(key string, band bandKey, partInd int) {
+	var n int
+	for _, f := range lshForests(e.lshes[partInd]) {
+		if f.frozen != nil {
+			panic(ErrFrozenIndex)
+		}
+		for t, ht := range f.initHashTables {
+			hk := band(n, f, t)
+			ht[hk] = append(ht[hk], key)
+			n++
+		}
+	}
+}
+
+// indexSequential makes the keys added to the partitions searchable.
+func (e *LshEnsemble) indexSequential(progress func(lsh Lsh)) {
+	for _, lsh := range e.lshes {
+		if _, tiered := lsh.(*tieredLsh); tiered {
+			// The partitions of tiered indexes are read-only
+			continue
+		}
+		for _, f := range lshForests(lsh) {
+			for i := range f.hashTables {
+				f.indexTable(i)
+			}
+		}
+		progress(lsh)
+	}
+}
+
+// probeSequential is like probe, scanning the partitions one after the
+// other.
+func (e *LshEnsemble) probeSequential(sig Signature, params []param, done <-chan struct{}, out chan<- string) {
+	for i, lsh := range e.lshes {
+		if params[i].l == 0 {
+			// The partition is skipped
+			continue
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+		f, K := lsh.forest(params[i].k)
+		for _, key := range f.candidates(sig, K, params[i].l) {
+			select {
+			case out <- key:
+			case <-done:
+				return
+			}
+		}
+	}
+}
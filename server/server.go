@@ -0,0 +1,201 @@
+// Package server runs an LSH Ensemble index as a long-running HTTP
+// service: the endpoints of cluster.NewHandler to add domains, index and
+// query them, and admin endpoints to snapshot, compact, inspect,
+// rebalance and reload the index, behind an authentication hook.
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ekzhu/lshensemble"
+	"github.com/ekzhu/lshensemble/cluster"
+)
+
+var (
+	// ErrNoStore is returned when snapshotting or reloading the index of
+	// a server without a snapshot store.
+	ErrNoStore = errors.New("server: no snapshot store")
+	// ErrUnauthorized is returned by the hooks of BearerTokens for the
+	// requests without the expected token.
+	ErrUnauthorized = errors.New("server: unauthorized")
+)
+
+// Stats is the body of the response to /admin/stats.
+type Stats struct {
+	Queries lshensemble.QueryStats `json:"queries"`
+	Index   lshensemble.IndexStats `json:"index"`
+}
+
+// Server serves an index, which it replaces by the snapshot reloaded.
+// Server is a cluster.Node of its current index, whose domains are added
+// by AddDomainE to the partitions covering their sizes, so they can be
+// rebalanced, and it can be a node of a cluster.Router as well.
+type Server struct {
+	// Store and Prefix are where the snapshots of the index are saved by
+	// Snapshot and read by Reload.
+	Store  lshensemble.BlobStore
+	Prefix string
+	// Authenticate, if not nil, authenticates every request before it
+	// is served, admin being true for the admin endpoints: the requests
+	// it returns an error for are rejected as unauthorized, e.g. those
+	// without the bearer token of an operator for the admin endpoints.
+	Authenticate func(r *http.Request, admin bool) error
+
+	mu    sync.RWMutex
+	index *lshensemble.LshEnsemble
+}
+
+// New returns a server of the index, whose snapshots are saved in the
+// store under prefix. The store may be nil if the index is never
+// snapshotted nor reloaded.
+func New(index *lshensemble.LshEnsemble, store lshensemble.BlobStore, prefix string) *Server {
+	return &Server{Store: store, Prefix: prefix, index: index}
+}
+
+// Ensemble returns the index currently served.
+func (s *Server) Ensemble() *lshensemble.LshEnsemble {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index
+}
+
+func (s *Server) Add(rec *lshensemble.DomainRecord) error {
+	index := s.Ensemble()
+	return index.AddDomainE(rec, index.PartitionIndex(rec.Size))
+}
+
+func (s *Server) Index() error {
+	return s.Ensemble().IndexE()
+}
+
+func (s *Server) Query(sig lshensemble.Signature, size int, threshold float64) ([]string, error) {
+	result, _, err := s.Ensemble().QueryE(sig, size, threshold)
+	return result, err
+}
+
+// Snapshot saves the index in the store under the prefix, replacing the
+// previous snapshot.
+func (s *Server) Snapshot() error {
+	if s.Store == nil {
+		return ErrNoStore
+	}
+	return s.Ensemble().SaveSnapshot(s.Store, s.Prefix)
+}
+
+// Reload replaces the index served by the snapshot in the store under
+// the prefix, e.g. one built offline. The queries running on the previous
+// index complete on it, and the domains added to it since its last
+// snapshot are lost. The index is unchanged if the snapshot fails to load.
+func (s *Server) Reload() error {
+	if s.Store == nil {
+		return ErrNoStore
+	}
+	index, err := lshensemble.LoadSnapshot(s.Store, s.Prefix)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index = index
+	return nil
+}
+
+// Stats returns the statistics of the queries and of the hash tables of
+// the index.
+func (s *Server) Stats() Stats {
+	index := s.Ensemble()
+	return Stats{Queries: index.QueryStats(), Index: index.IndexStats()}
+}
+
+// Handler returns an HTTP handler serving the index with the endpoints of
+// cluster.NewHandler, and the admin endpoints:
+//
+//	POST /admin/snapshot   saves the index, as Snapshot
+//	POST /admin/compact    merges the buckets of the hash tables, as Compact
+//	GET  /admin/stats      answers with the Stats of the index in JSON
+//	POST /admin/rebalance  rebalances the partitions, as Rebalance
+//	POST /admin/reload     replaces the index by its snapshot, as Reload
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", s.authenticated(false, cluster.NewHandler(s)))
+	admin := func(path string, op func() error) {
+		mux.Handle(path, s.authenticated(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := op(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		})))
+	}
+	admin("/admin/snapshot", s.Snapshot)
+	admin("/admin/compact", func() error {
+		return s.Ensemble().Compact()
+	})
+	admin("/admin/rebalance", func() error {
+		return s.Ensemble().Rebalance()
+	})
+	admin("/admin/reload", s.Reload)
+	mux.Handle("/admin/stats", s.authenticated(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Stats())
+	})))
+	return mux
+}
+
+// authenticated returns the handler serving the requests authenticated
+// by the hook of the server.
+func (s *Server) authenticated(admin bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Authenticate != nil {
+			if err := s.Authenticate(r, admin); err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// BearerTokens returns an authentication hook accepting the requests with
+// a bearer token in their Authorization header, "Bearer " followed by the
+// token: adminToken for the admin endpoints, and token or adminToken for
+// the others, or any request if token is empty.
+func BearerTokens(token, adminToken string) func(r *http.Request, admin bool) error {
+	const scheme = "Bearer "
+	return func(r *http.Request, admin bool) error {
+		if !admin && token == "" {
+			return nil
+		}
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, scheme) {
+			return ErrUnauthorized
+		}
+		got := header[len(scheme):]
+		if matches(got, adminToken) || (!admin && matches(got, token)) {
+			return nil
+		}
+		return ErrUnauthorized
+	}
+}
+
+// matches compares the tokens in constant time.
+func matches(got, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// ListenAndServe serves the handler of the server on the TCP address
+// until it fails, as http.ListenAndServe.
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.Handler())
+}
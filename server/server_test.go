@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ekzhu/lshensemble"
+	"github.com/ekzhu/lshensemble/cluster"
+)
+
+func randomRecord(key string, r *rand.Rand) *lshensemble.DomainRecord {
+	mh := lshensemble.NewMinhash(1, 64)
+	for i := 0; i < 50; i++ {
+		mh.Push([]byte{byte(r.Intn(256)), byte(r.Intn(256))})
+	}
+	return &lshensemble.DomainRecord{Key: key, Size: 50, Signature: mh.Signature()}
+}
+
+func Test_Server(t *testing.T) {
+	index, err := lshensemble.New(lshensemble.WithPartitions([]lshensemble.Partition{{Lower: 0, Upper: 1000}}), lshensemble.WithNumHash(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(index, lshensemble.DirStore(t.TempDir()), "index")
+	s.Authenticate = BearerTokens("", "secret")
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	admin := func(method, path, header string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader("{}"))
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	node := cluster.NewHTTPNode(server.URL)
+	r := rand.New(rand.NewSource(1))
+	rec := randomRecord("a", r)
+	for _, rec := range []*lshensemble.DomainRecord{rec, randomRecord("b", r)} {
+		if err := node.Add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := node.Index(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := admin("POST", "/admin/snapshot", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal(resp.Status)
+	}
+	// The token must follow the bearer scheme
+	for _, header := range []string{"Bearer other", "secret", "Basic secret", "bearer secret"} {
+		if resp := admin("POST", "/admin/snapshot", header); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatal(header, resp.Status)
+		}
+	}
+	for _, path := range []string{"/admin/snapshot", "/admin/compact", "/admin/rebalance"} {
+		if resp := admin("POST", path, "Bearer secret"); resp.StatusCode != http.StatusOK {
+			t.Fatal(path, resp.Status)
+		}
+	}
+	if resp := admin("GET", "/admin/compact", "Bearer secret"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal(resp.Status)
+	}
+
+	// The domains added after the snapshot are dropped by the reload
+	if err := node.Add(randomRecord("c", r)); err != nil {
+		t.Fatal(err)
+	}
+	if resp := admin("POST", "/admin/reload", "Bearer secret"); resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	if s.Ensemble() == index {
+		t.Fatal("index not reloaded")
+	}
+	keys, err := node.Query(rec.Signature, rec.Size, 0.9)
+	if err != nil || len(keys) != 1 || keys[0] != "a" {
+		t.Fatal(keys, err)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Index.Partitions) != 1 || stats.Index.Partitions[0].Keys != 2 || stats.Queries.Queries != 1 {
+		t.Fatal(stats)
+	}
+
+	if err := New(index, nil, "").Reload(); err != ErrNoStore {
+		t.Fatal(err)
+	}
+}
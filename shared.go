@@ -0,0 +1,423 @@
+package lshensemble
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"unsafe"
+)
+
+// The shared index format is the layout of a frozen index in memory, so
+// the index can be queried in place from a mapped file. It starts with
+// sharedMagic and the 32-bit little-endian format version, followed by
+// sections, each a 64-bit little-endian length and the bytes, padded to
+// a multiple of 8 bytes, so the arrays of 32-bit integers are aligned.
+//
+// The first section is the descriptor: the ensemble header of the
+// persisted format, and for every partition the kind of its segment,
+// followed for a forest by k, l, hashValueSize and the trim scheme byte
+// of the persisted format, and for an array by maxK, numHash and the
+// parameters of its forests.
+// The data of the forests follow in the same order: the keys and the
+// offsets of the keys of the forest, and for each hash table its hash
+// keys, the offsets of its buckets and its postings.
+//
+// Since version 2, the last section is the CRC-32C checksums of the other
+// sections, as 32-bit integers, verified for the descriptor by ParseShared
+// and for the data by SharedIndex.Verify.
+const (
+	sharedMagic   = "LSHS"
+	sharedVersion = 2
+)
+
+// SaveShared writes the index frozen to w in the shared index format, in
+// which MapShared queries it in place from a file, e.g. in /dev/shm, so
+// the worker processes of a host mapping the same file share a single
+// physical copy of the index. The index is frozen first unless it already
+// is, as by Freeze, or was frozen by FreezeCompact.
+// The domains retained by AddDomain, the domains isolated by
+// IsolateEmptyDomains and the Bloom filters are not saved.
+func (e *LshEnsemble) SaveShared(w io.Writer) error {
+	if !e.frozen || e.compacted() {
+		e = e.Freeze()
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	desc := encoder{}
+	desc.header(e)
+	var forests []*LshForest
+	for _, lsh := range e.lshes {
+		if splitBuckets(lsh) {
+			return ErrSplitBuckets
+		}
+		switch lsh := resolveLsh(lsh).(type) {
+		case *LshForest:
+			desc.buf = append(desc.buf, segmentForest)
+			desc.sharedForest(lsh)
+			forests = append(forests, lsh)
+		case *LshForestArray:
+			desc.buf = append(desc.buf, segmentForestArray)
+			desc.int(lsh.maxK)
+			desc.int(lsh.numHash)
+			for _, f := range lsh.array {
+				desc.sharedForest(f)
+			}
+			forests = append(forests, lsh.array...)
+		default:
+			return fmt.Errorf("lshensemble: cannot share Lsh of type %T", lsh)
+		}
+	}
+	sw := sharedWriter{w: bufio.NewWriter(w)}
+	version := make([]byte, 4)
+	binary.LittleEndian.PutUint32(version, sharedVersion)
+	sw.write([]byte(sharedMagic))
+	sw.write(version)
+	sw.section(desc.buf)
+	for _, f := range forests {
+		// The frozen tables of a forest share its keys
+		dict := &keyDict{offsets: []uint32{0}}
+		if len(f.frozen) > 0 {
+			dict = f.frozen[0].dict
+		}
+		sw.section([]byte(dict.data))
+		sw.uint32s(dict.offsets)
+		for _, t := range f.frozen {
+			sw.section(t.hashKeys)
+			sw.uint32s(t.offsets)
+			sw.section(t.postings)
+		}
+	}
+	sw.uint32s(sw.sums)
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+func (e *encoder) sharedForest(f *LshForest) {
+	e.int(f.k)
+	e.int(f.l)
+	e.int(f.hashValueSize)
+	e.buf = append(e.buf, f.trimByte())
+}
+
+// sharedWriter writes the sections of the shared index format, keeping
+// the first error and the checksums of the sections.
+type sharedWriter struct {
+	w    *bufio.Writer
+	err  error
+	sums []uint32
+}
+
+func (w *sharedWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *sharedWriter) section(b []byte) {
+	w.sums = append(w.sums, crc32.Checksum(b, castagnoli))
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(b)))
+	w.write(n[:])
+	w.write(b)
+	w.write(n[:sectionPadding(len(b))])
+}
+
+func (w *sharedWriter) uint32s(v []uint32) {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], x)
+	}
+	w.section(b)
+}
+
+// sectionPadding returns the number of bytes padding a section of n bytes.
+func sectionPadding(n int) int {
+	return (8 - n%8) % 8
+}
+
+// ParseShared returns the frozen index in the shared index format written
+// by SaveShared, which references data instead of copying it, so data must
+// not be modified while the index is used.
+// The structure of the index is checked, but not the postings of its
+// buckets, so data must come from a trusted source.
+func ParseShared(data []byte) (*LshEnsemble, error) {
+	e, _, err := parseShared(data)
+	return e, err
+}
+
+// parseShared is ParseShared, also returning the sections of the index
+// to verify.
+func parseShared(data []byte) (*LshEnsemble, *sharedReader, error) {
+	if len(data) < 8 || string(data[:4]) != sharedMagic {
+		return nil, nil, ErrCorruptIndex
+	}
+	version := binary.LittleEndian.Uint32(data[4:])
+	if version < 1 || version > sharedVersion {
+		return nil, nil, fmt.Errorf("lshensemble: unsupported shared index format version %d", version)
+	}
+	r := &sharedReader{buf: data[8:], part: -1}
+	desc := decoder{buf: r.section()}
+	e := desc.header()
+	if desc.err != nil {
+		return nil, nil, desc.err
+	}
+	for i := range e.lshes {
+		r.part = i
+		var lsh Lsh
+		switch desc.byte() {
+		case segmentForest:
+			lsh = r.forest(&desc)
+		case segmentForestArray:
+			maxK := desc.int(len(desc.buf))
+			numHash := desc.int(maxHeaderValue)
+			array := make([]*LshForest, maxK)
+			for k := range array {
+				array[k] = r.forest(&desc)
+			}
+			lsh = &LshForestArray{
+				maxK:    maxK,
+				numHash: numHash,
+				array:   array,
+			}
+		default:
+			desc.err = ErrCorruptIndex
+		}
+		if desc.err == nil && r.err == nil && !e.consistent(lsh) {
+			desc.err = ErrCorruptIndex
+		}
+		if desc.err != nil {
+			return nil, nil, desc.err
+		}
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+		e.lshes[i] = lsh
+	}
+	if version >= 2 {
+		sections := r.sections
+		r.sums = r.uint32s()
+		if r.err != nil || len(r.sums) != len(sections) {
+			return nil, nil, ErrCorruptIndex
+		}
+		r.sections = sections
+		if err := r.verify(0); err != nil {
+			return nil, nil, err
+		}
+	}
+	e.frozen = true
+	return e, r, nil
+}
+
+// sharedReader reads the sections of the shared index format from a
+// byte slice. After the first error, all reads return nil and the error
+// is kept in err. The sections read are kept with their checksums, if
+// any, to be verified.
+type sharedReader struct {
+	buf []byte
+	err error
+	// part is the partition of the sections being read, -1 for the
+	// descriptor.
+	part     int
+	sections []sharedSection
+	sums     []uint32
+}
+
+// sharedSection is a section of the data of a partition.
+type sharedSection struct {
+	data []byte
+	part int
+}
+
+// verify verifies the checksum of the section i, and returns an error
+// wrapping ErrCorruptIndex identifying its partition if it is corrupt.
+func (r *sharedReader) verify(i int) error {
+	if r.sums == nil {
+		return nil
+	}
+	s := r.sections[i]
+	if crc32.Checksum(s.data, castagnoli) == r.sums[i] {
+		return nil
+	}
+	if s.part < 0 {
+		return fmt.Errorf("%w: checksum mismatch in the descriptor", ErrCorruptIndex)
+	}
+	return fmt.Errorf("%w: checksum mismatch in partition %d", ErrCorruptIndex, s.part)
+}
+
+func (r *sharedReader) section() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < 8 {
+		r.err = ErrCorruptIndex
+		return nil
+	}
+	n := binary.LittleEndian.Uint64(r.buf)
+	if n > uint64(len(r.buf)-8) || int(n)+sectionPadding(int(n)) > len(r.buf)-8 {
+		r.err = ErrCorruptIndex
+		return nil
+	}
+	b := r.buf[8 : 8+n : 8+n]
+	r.buf = r.buf[8+int(n)+sectionPadding(int(n)):]
+	r.sections = append(r.sections, sharedSection{b, r.part})
+	return b
+}
+
+// uint32s reads a section of little-endian 32-bit integers, in place on
+// little-endian machines.
+func (r *sharedReader) uint32s() []uint32 {
+	b := r.section()
+	if r.err != nil || len(b) == 0 {
+		return nil
+	}
+	if len(b)%4 != 0 {
+		r.err = ErrCorruptIndex
+		return nil
+	}
+	if littleEndian && uintptr(unsafe.Pointer(&b[0]))%4 == 0 {
+		var v []uint32
+		h := (*reflect.SliceHeader)(unsafe.Pointer(&v))
+		h.Data = uintptr(unsafe.Pointer(&b[0]))
+		h.Len = len(b) / 4
+		h.Cap = h.Len
+		return v
+	}
+	v := make([]uint32, len(b)/4)
+	for i := range v {
+		v[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return v
+}
+
+// littleEndian is true on little-endian machines.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// offsetsValid returns whether offsets are the increasing offsets of the
+// parts of n bytes, starting at zero.
+func offsetsValid(offsets []uint32, n int) bool {
+	if len(offsets) == 0 || offsets[0] != 0 || int(offsets[len(offsets)-1]) != n {
+		return false
+	}
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] < offsets[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// forest reads a frozen forest, whose parameters are read from desc.
+func (r *sharedReader) forest(desc *decoder) *LshForest {
+	k := desc.int(len(desc.buf))
+	// Every hash table has three sections
+	l := desc.int(len(r.buf) / 24)
+	hashValueSize := desc.int(8)
+	trim, bits := unpackTrim(desc.byte(), hashValueSize)
+	if desc.err != nil || k == 0 || hashValueSize == 0 || !trim.valid() || !validPacking(bits, hashValueSize) {
+		desc.err = ErrCorruptIndex
+		return nil
+	}
+	data := r.section()
+	dict := &keyDict{offsets: r.uint32s(), borrowed: true}
+	// The keys are referenced in place, and copied when returned
+	dict.data = *(*string)(unsafe.Pointer(&data))
+	if r.err == nil && !offsetsValid(dict.offsets, len(data)) {
+		r.err = ErrCorruptIndex
+	}
+	f := &LshForest{
+		k:             k,
+		l:             l,
+		hashKeyFuncs:  make([]hashKeyFunc, l),
+		hashValueSize: hashValueSize,
+		hashValueBits: bits,
+		trim:          trim,
+		frozen:        make([]*frozenTable, l),
+	}
+	keySize := f.keySize()
+	for i := range f.frozen {
+		if r.err != nil {
+			return nil
+		}
+		t := &frozenTable{
+			keySize:  keySize,
+			hashKeys: r.section(),
+			offsets:  r.uint32s(),
+			postings: r.section(),
+			dict:     dict,
+		}
+		if r.err == nil && (!offsetsValid(t.offsets, len(t.postings)) || len(t.hashKeys) != t.buckets()*keySize) {
+			r.err = ErrCorruptIndex
+		}
+		f.hashKeyFuncs[i] = hashKeyFuncGen(hashValueSize, trim, bandSalt(i))
+		if bits != 0 {
+			f.hashKeyFuncs[i] = packedHashKeyFuncGen(bits, trim, bandSalt(i))
+		}
+		f.frozen[i] = t
+	}
+	if r.err != nil {
+		return nil
+	}
+	return f
+}
+
+// SharedIndex is a frozen index queried in place from a file mapped by
+// MapShared.
+type SharedIndex struct {
+	*LshEnsemble
+	data  []byte
+	unmap func([]byte) error
+	// sections are the sections of data to verify.
+	sections *sharedReader
+}
+
+// MapShared maps the file written by SaveShared read-only into memory,
+// and returns the frozen index queried in place, as by ParseShared. The
+// processes mapping the same file share its pages, which are loaded on
+// demand by the operating system. A file in the POSIX shared memory of
+// Linux, /dev/shm, is never written back to disk.
+// On systems without mmap, the file is read into memory instead.
+func MapShared(path string) (*SharedIndex, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e, sections, err := parseShared(data)
+	if err != nil {
+		unmap(data)
+		return nil, err
+	}
+	return &SharedIndex{LshEnsemble: e, data: data, unmap: unmap, sections: sections}, nil
+}
+
+// Verify verifies the checksums of the data of the index, which reads the
+// whole file, e.g. in the background once mapped, or before serving the
+// queries of a file copied from another host. It returns an error
+// wrapping ErrCorruptIndex identifying the first corrupt partition, and
+// nil for the files written before the checksums.
+func (s *SharedIndex) Verify() error {
+	for i := range s.sections.sections {
+		if err := s.sections.verify(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close unmaps the file of the index, which must not be used afterwards.
+// The keys returned by its queries are copies, which remain valid.
+func (s *SharedIndex) Close() error {
+	if s.data == nil {
+		return nil
+	}
+	data := s.data
+	s.data = nil
+	return s.unmap(data)
+}
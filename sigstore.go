@@ -0,0 +1,348 @@
+package lshensemble
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// SignatureStore holds the signatures of the domains retained by
+// AddDomain, for the indexes whose retained signatures do not fit in
+// memory. Get returns an error wrapping ErrKeyNotRetained for the keys
+// never put. A SignatureStore must be safe for concurrent use, as the
+// signatures are read by concurrent queries.
+type SignatureStore interface {
+	// Put stores the signature of key, replacing any existing one.
+	Put(key string, sig Signature) error
+	Get(key string) (Signature, error)
+}
+
+// WithSignatureStore makes the index keep the signatures of the domains
+// added by AddDomain in the store, and only their keys and sizes in
+// memory. The signatures are read from the store by the queries
+// verifying the candidates, like QueryPipeline and QueryScored, and by
+// QueryByKey, Rebalance, Doctor and ExportJSON, which treat the
+// signatures the store fails to return as not retained, or return its
+// errors. Wrap a slow store with NewCachedSignatureStore to keep the
+// signatures of the hot candidates in memory.
+func WithSignatureStore(store SignatureStore) Option {
+	return func(c *config) {
+		c.signatures = store
+	}
+}
+
+// signature returns the signature of the retained record, from the
+// signature store of the index if the record does not hold it.
+func (e *LshEnsemble) signature(rec *DomainRecord) (Signature, error) {
+	if rec.Signature != nil || e.signatures == nil {
+		return rec.Signature, nil
+	}
+	return e.signatures.Get(rec.Key)
+}
+
+// retained returns the record retained by AddDomain for key, with its
+// signature, or false if there is none or its signature cannot be read.
+func (e *LshEnsemble) retained(key string) (*DomainRecord, bool) {
+	rec, exist := e.record(key)
+	if !exist || rec.Signature != nil || e.signatures == nil {
+		return rec, exist
+	}
+	sig, err := e.signatures.Get(key)
+	if err != nil {
+		return nil, false
+	}
+	return &DomainRecord{Key: rec.Key, Size: rec.Size, Signature: sig}, true
+}
+
+// MemorySignatureStore is a SignatureStore in memory.
+type MemorySignatureStore struct {
+	mu   sync.RWMutex
+	sigs map[string]Signature
+}
+
+func NewMemorySignatureStore() *MemorySignatureStore {
+	return &MemorySignatureStore{sigs: make(map[string]Signature)}
+}
+
+func (s *MemorySignatureStore) Put(key string, sig Signature) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sigs[key] = sig
+	return nil
+}
+
+func (s *MemorySignatureStore) Get(key string) (Signature, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sig, exist := s.sigs[key]
+	if !exist {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotRetained, key)
+	}
+	return sig, nil
+}
+
+// overlaySignatureStore is the SignatureStore of a clone, which puts the
+// signatures in memory and gets the others from the store of the index
+// it was cloned from, so the clone does not replace those of the index.
+type overlaySignatureStore struct {
+	own  *MemorySignatureStore
+	base SignatureStore
+}
+
+func newOverlaySignatureStore(base SignatureStore) *overlaySignatureStore {
+	return &overlaySignatureStore{own: NewMemorySignatureStore(), base: base}
+}
+
+func (s *overlaySignatureStore) Put(key string, sig Signature) error {
+	return s.own.Put(key, sig)
+}
+
+func (s *overlaySignatureStore) Get(key string) (Signature, error) {
+	if sig, err := s.own.Get(key); err == nil {
+		return sig, nil
+	}
+	return s.base.Get(key)
+}
+
+// FileSignatureStore is a SignatureStore appending the signatures to a
+// file, of which only the offsets of the signatures are kept in memory.
+// The signatures replaced are not reclaimed.
+// Every record of the file is the uvarint length of the key, the key, the
+// uvarint number of hash values and the signature serialized.
+type FileSignatureStore struct {
+	mu      sync.RWMutex
+	f       *os.File
+	size    int64
+	offsets map[string]fileSpan
+}
+
+// fileSpan is the offset and the number of hash values of a signature.
+type fileSpan struct {
+	offset int64
+	n      int
+}
+
+// OpenFileSignatureStore opens the store of the file at path, created if
+// it does not exist. The signatures already in the file are indexed, and
+// an incomplete record at its end, written by a process interrupted, is
+// truncated.
+func OpenFileSignatureStore(path string) (*FileSignatureStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileSignatureStore{f: f, offsets: make(map[string]fileSpan)}
+	if err := s.scan(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// scan indexes the records of the file, and truncates it after the last
+// complete one.
+func (s *FileSignatureStore) scan() error {
+	stat, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, stat.Size()))
+	var offset int64
+	for {
+		n, key, err := readSignatureRecord(r)
+		if err != nil {
+			break
+		}
+		length := int64(uvarintLen(uint64(len(key))) + len(key) + uvarintLen(uint64(n)))
+		s.offsets[key] = fileSpan{offset + length, n}
+		offset += length + int64(n*HashValueSize)
+	}
+	s.size = offset
+	if offset < stat.Size() {
+		return s.f.Truncate(offset)
+	}
+	return nil
+}
+
+// readSignatureRecord reads the key and the number of hash values of a
+// record, and skips its signature.
+func readSignatureRecord(r *bufio.Reader) (int, string, error) {
+	keyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", err
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return 0, "", err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", err
+	}
+	skip := int(n) * HashValueSize
+	if skipped, err := r.Discard(skip); err != nil || skipped < skip {
+		return 0, "", io.ErrUnexpectedEOF
+	}
+	return int(n), string(key), nil
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+func (s *FileSignatureStore) Put(key string, sig Signature) error {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(key)+sig.ByteLen())
+	var varint [binary.MaxVarintLen64]byte
+	buf = append(buf, varint[:binary.PutUvarint(varint[:], uint64(len(key)))]...)
+	buf = append(buf, key...)
+	buf = append(buf, varint[:binary.PutUvarint(varint[:], uint64(len(sig)))]...)
+	header := len(buf)
+	buf = buf[:header+sig.ByteLen()]
+	sig.Write(buf[header:])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.WriteAt(buf, s.size); err != nil {
+		return err
+	}
+	s.offsets[key] = fileSpan{s.size + int64(header), len(sig)}
+	s.size += int64(len(buf))
+	return nil
+}
+
+func (s *FileSignatureStore) Get(key string) (Signature, error) {
+	s.mu.RLock()
+	span, exist := s.offsets[key]
+	s.mu.RUnlock()
+	if !exist {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotRetained, key)
+	}
+	buf := make([]byte, span.n*HashValueSize)
+	if _, err := s.f.ReadAt(buf, span.offset); err != nil {
+		return nil, err
+	}
+	return DeserializeSignature(buf), nil
+}
+
+// Close closes the file of the store.
+func (s *FileSignatureStore) Close() error {
+	return s.f.Close()
+}
+
+// BlobSignatureStore is a SignatureStore keeping every signature as an
+// object of a BlobStore, such as a key-value store or an object storage
+// bucket, named by the hexadecimal key under Prefix. The errors of Get
+// for the objects not found are those of the BlobStore.
+type BlobSignatureStore struct {
+	Store  BlobStore
+	Prefix string
+}
+
+func (s *BlobSignatureStore) name(key string) string {
+	return path.Join(s.Prefix, hex.EncodeToString([]byte(key)))
+}
+
+func (s *BlobSignatureStore) Put(key string, sig Signature) error {
+	return s.Store.Put(s.name(key), SerializeSignature(sig))
+}
+
+func (s *BlobSignatureStore) Get(key string) (Signature, error) {
+	data, err := s.Store.Get(s.name(key))
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeSignatureE(data)
+}
+
+// CachedSignatureStore is a SignatureStore caching the signatures of
+// another store, the least recently used being evicted first, so the
+// signatures of the hot candidates are read from memory while the memory
+// used is bounded.
+type CachedSignatureStore struct {
+	store    SignatureStore
+	capacity int
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	hits     int64
+	misses   int64
+}
+
+type cachedSignature struct {
+	key string
+	sig Signature
+}
+
+// NewCachedSignatureStore returns a cache of at most capacity signatures
+// of the store.
+func NewCachedSignatureStore(store SignatureStore, capacity int) *CachedSignatureStore {
+	return &CachedSignatureStore{
+		store:    store,
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Put writes the signature through to the store, and replaces it in the
+// cache if it is cached.
+func (s *CachedSignatureStore) Put(key string, sig Signature) error {
+	if err := s.store.Put(key, sig); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, exist := s.entries[key]; exist {
+		el.Value.(*cachedSignature).sig = sig
+	}
+	return nil
+}
+
+func (s *CachedSignatureStore) Get(key string) (Signature, error) {
+	s.mu.Lock()
+	if el, exist := s.entries[key]; exist {
+		s.lru.MoveToFront(el)
+		s.hits++
+		sig := el.Value.(*cachedSignature).sig
+		s.mu.Unlock()
+		return sig, nil
+	}
+	s.misses++
+	s.mu.Unlock()
+	sig, err := s.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exist := s.entries[key]; !exist && s.capacity > 0 {
+		s.entries[key] = s.lru.PushFront(&cachedSignature{key, sig})
+		if s.lru.Len() > s.capacity {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.entries, oldest.Value.(*cachedSignature).key)
+		}
+	}
+	return sig, nil
+}
+
+// Stats returns the numbers of the signatures got from the cache and
+// from the store.
+func (s *CachedSignatureStore) Stats() (hits, misses int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits, s.misses
+}
+
+// Len returns the number of signatures cached.
+func (s *CachedSignatureStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
@@ -0,0 +1,140 @@
+package lshensemble
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// Simhash computes the SimHash fingerprint of a text, e.g. of its words or
+// shingles, for the near-duplicate detection by Hamming distance: every
+// bit of the fingerprint is the sign of the sum of the weights of the
+// features whose hash values have the bit set, minus those which do not,
+// so similar texts have fingerprints differing in few bits.
+type Simhash struct {
+	seed    uint64
+	weights [64]float64
+}
+
+// NewSimhash returns a SimHash of no features. Fingerprints are
+// comparable only with the same seed.
+func NewSimhash(seed int) *Simhash {
+	return &Simhash{seed: mix64(uint64(seed))}
+}
+
+// Push adds a feature of weight 1, serialized to a byte slice.
+func (s *Simhash) Push(b []byte) {
+	s.PushWeighted(b, 1)
+}
+
+// PushWeighted adds a feature of the weight, e.g. its frequency in the
+// text or its TF-IDF.
+func (s *Simhash) PushWeighted(b []byte, weight float64) {
+	h := seededHash(b, s.seed)
+	for i := range s.weights {
+		if h>>uint(i)&1 != 0 {
+			s.weights[i] += weight
+		} else {
+			s.weights[i] -= weight
+		}
+	}
+}
+
+// Fingerprint returns the 64-bit fingerprint of the features added.
+func (s *Simhash) Fingerprint() uint64 {
+	var fp uint64
+	for i, w := range s.weights {
+		if w > 0 {
+			fp |= 1 << uint(i)
+		}
+	}
+	return fp
+}
+
+// HammingDistance returns the number of bits differing between the
+// fingerprints.
+func HammingDistance(fp1, fp2 uint64) int {
+	return bits.OnesCount64(fp1 ^ fp2)
+}
+
+// SimhashIndex represents an LSH index of SimHash fingerprints for
+// near-duplicate detection by Hamming distance.
+// It uses a single LshForest, whose bands are the disjoint ranges of bits
+// of the fingerprints, bit-packed as the hash values of bands of K=1: two
+// fingerprints within a Hamming distance less than the number of bands
+// agree on all the bits of at least one band, so they collide in its hash
+// table. The candidates are verified with the fingerprints of the keys.
+type SimhashIndex struct {
+	forest       *LshForest
+	bands        int
+	fingerprints map[string]uint64
+}
+
+// NewSimhashIndex initializes an index of SimHash fingerprints whose
+// bands are ranges of 64/bands bits, finding the fingerprints within a
+// Hamming distance less than the number of bands, from 1 to 8, so that
+// every band has at least 8 bits. More bands find more distant
+// fingerprints, at the cost of more candidates and a larger index.
+func NewSimhashIndex(bands int) (*SimhashIndex, error) {
+	if bands < 1 || bands > 8 {
+		return nil, invalidParameter("bands must be in [1, 8], got %d", bands)
+	}
+	width := (64 + bands - 1) / bands
+	return &SimhashIndex{
+		forest:       newLshForestBits(1, bands, width, TrimLow),
+		bands:        bands,
+		fingerprints: make(map[string]uint64),
+	}, nil
+}
+
+// Bands returns the number of bands of the index.
+func (s *SimhashIndex) Bands() int {
+	return s.bands
+}
+
+// signature returns the bands of the fingerprint as the hash values of
+// a signature, the last band having the remaining bits.
+func (s *SimhashIndex) signature(fp uint64) Signature {
+	width := uint(s.forest.HashValueBits())
+	sig := make(Signature, s.bands)
+	for i := range sig {
+		sig[i] = fp >> (uint(i) * width)
+		if width < 64 {
+			sig[i] &= 1<<width - 1
+		}
+	}
+	return sig
+}
+
+// Add a key with SimHash fingerprint into the index. A key added again
+// replaces its fingerprint in the verification of the candidates.
+// The key won't be searchable until Index() is called.
+func (s *SimhashIndex) Add(key string, fp uint64) {
+	s.forest.Add(key, s.signature(fp))
+	s.fingerprints[key] = fp
+}
+
+// Makes all the keys added searchable.
+func (s *SimhashIndex) Index() {
+	s.forest.Index()
+}
+
+// Fingerprint returns the fingerprint of the key, if it was added.
+func (s *SimhashIndex) Fingerprint(key string) (uint64, bool) {
+	fp, exist := s.fingerprints[key]
+	return fp, exist
+}
+
+// Query returns the keys whose fingerprints are within the Hamming
+// distance of the query fingerprint, sorted. The keys within a distance
+// of at least the number of bands are found only if they collide in a
+// band.
+func (s *SimhashIndex) Query(fp uint64, maxDistance int) []string {
+	result := make([]string, 0)
+	for _, key := range s.forest.candidates(s.signature(fp), 1, s.bands) {
+		if HammingDistance(s.fingerprints[key], fp) <= maxDistance {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
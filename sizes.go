@@ -0,0 +1,217 @@
+package lshensemble
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// WithCompactSizes makes Index() move the sizes of the domains retained
+// by AddDomain from their records to a compact store: the keys are sorted
+// and front-coded in blocks, and the sizes are codes of a dictionary of
+// the distinct sizes, so a key and its size take a few bytes more than
+// the suffix of the key instead of a record and a map entry, and are
+// looked up by a binary search of the blocks. The signatures are in the
+// signature store, which the option requires.
+func WithCompactSizes() Option {
+	return func(c *config) {
+		c.compactSizes = true
+	}
+}
+
+// sizeBlock is the number of keys of a block of a size store.
+const sizeBlock = 16
+
+// sizeStore is an immutable store of the sizes of domains, sorted by key
+// in blocks of sizeBlock keys. The first key of every block is in heads,
+// and the block in data at its offset is the dictionary code of the size
+// of every key, preceded, but for the first, by the length of the prefix
+// shared with the previous key and the rest of the key.
+type sizeStore struct {
+	n       int
+	heads   []string
+	offsets []int
+	data    []byte
+	dict    []int
+}
+
+// sizeStoreBuilder builds a size store from keys added in order.
+type sizeStoreBuilder struct {
+	s     *sizeStore
+	codes map[int]uint64
+	prev  string
+	tmp   [binary.MaxVarintLen64]byte
+}
+
+func newSizeStoreBuilder() *sizeStoreBuilder {
+	return &sizeStoreBuilder{s: &sizeStore{}, codes: make(map[int]uint64)}
+}
+
+func (b *sizeStoreBuilder) uvarint(v uint64) {
+	n := binary.PutUvarint(b.tmp[:], v)
+	b.s.data = append(b.s.data, b.tmp[:n]...)
+}
+
+// add adds the key, greater than the keys added before, and its size.
+func (b *sizeStoreBuilder) add(key string, size int) {
+	s := b.s
+	code, exist := b.codes[size]
+	if !exist {
+		code = uint64(len(s.dict))
+		b.codes[size] = code
+		s.dict = append(s.dict, size)
+	}
+	if s.n%sizeBlock == 0 {
+		s.heads = append(s.heads, key)
+		s.offsets = append(s.offsets, len(s.data))
+	} else {
+		shared := 0
+		for shared < len(key) && shared < len(b.prev) && key[shared] == b.prev[shared] {
+			shared++
+		}
+		b.uvarint(uint64(shared))
+		b.uvarint(uint64(len(key) - shared))
+		s.data = append(s.data, key[shared:]...)
+	}
+	b.uvarint(code)
+	b.prev = key
+	s.n++
+}
+
+// len returns the number of keys of the store.
+func (s *sizeStore) len() int {
+	if s == nil {
+		return 0
+	}
+	return s.n
+}
+
+// scan calls fn with the keys of block i and their sizes, in order, until
+// it returns false.
+func (s *sizeStore) scan(i int, fn func(key string, size int) bool) {
+	data := s.data[s.offsets[i]:]
+	key := s.heads[i]
+	for j := i * sizeBlock; j < s.n && j < (i+1)*sizeBlock; j++ {
+		if j > i*sizeBlock {
+			shared, n := binary.Uvarint(data)
+			data = data[n:]
+			rest, n := binary.Uvarint(data)
+			data = data[n:]
+			key = key[:shared] + string(data[:rest])
+			data = data[rest:]
+		}
+		code, n := binary.Uvarint(data)
+		data = data[n:]
+		if !fn(key, s.dict[code]) {
+			return
+		}
+	}
+}
+
+// get returns the size of the key, or false if it is not in the store.
+func (s *sizeStore) get(key string) (int, bool) {
+	if s == nil {
+		return 0, false
+	}
+	i := sort.Search(len(s.heads), func(i int) bool {
+		return s.heads[i] > key
+	}) - 1
+	if i < 0 {
+		return 0, false
+	}
+	size, found := 0, false
+	s.scan(i, func(k string, v int) bool {
+		if k == key {
+			size, found = v, true
+		}
+		return k < key
+	})
+	return size, found
+}
+
+// each calls fn with the keys of the store and their sizes, in order,
+// until it returns false.
+func (s *sizeStore) each(fn func(key string, size int) bool) {
+	if s == nil {
+		return
+	}
+	open := true
+	for i := 0; i < len(s.heads) && open; i++ {
+		s.scan(i, func(key string, size int) bool {
+			open = fn(key, size)
+			return open
+		})
+	}
+}
+
+// merge returns a store of the keys of the store and of the sizes, whose
+// sizes replace those of the store.
+func (s *sizeStore) merge(sizes map[string]int) *sizeStore {
+	keys := make([]string, 0, len(sizes))
+	for key := range sizes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b := newSizeStoreBuilder()
+	j := 0
+	s.each(func(key string, size int) bool {
+		for ; j < len(keys) && keys[j] < key; j++ {
+			b.add(keys[j], sizes[keys[j]])
+		}
+		if j < len(keys) && keys[j] == key {
+			size = sizes[key]
+			j++
+		}
+		b.add(key, size)
+		return true
+	})
+	for ; j < len(keys); j++ {
+		b.add(keys[j], sizes[keys[j]])
+	}
+	return b.s
+}
+
+// packSizes moves the sizes of the records without signatures to the
+// size store of the index.
+func (e *LshEnsemble) packSizes() {
+	sizes := make(map[string]int)
+	for key, rec := range e.domains {
+		if rec.Signature == nil {
+			sizes[key] = rec.Size
+			delete(e.domains, key)
+		}
+	}
+	if len(sizes) > 0 {
+		e.sizes = e.sizes.merge(sizes)
+	}
+}
+
+// record returns the record retained by AddDomain for key, without its
+// signature if it is in the signature store.
+func (e *LshEnsemble) record(key string) (*DomainRecord, bool) {
+	if rec, exist := e.domains[key]; exist {
+		return rec, true
+	}
+	if size, exist := e.sizes.get(key); exist {
+		return &DomainRecord{Key: key, Size: size}, true
+	}
+	return nil, false
+}
+
+// hasRecords returns whether records are retained by the index.
+func (e *LshEnsemble) hasRecords() bool {
+	return e.domains != nil || e.sizes != nil
+}
+
+// eachRecord calls fn with the records retained by the index, as returned
+// by record.
+func (e *LshEnsemble) eachRecord(fn func(rec *DomainRecord)) {
+	for _, rec := range e.domains {
+		fn(rec)
+	}
+	e.sizes.each(func(key string, size int) bool {
+		if _, shadowed := e.domains[key]; !shadowed {
+			fn(&DomainRecord{Key: key, Size: size})
+		}
+		return true
+	})
+}
@@ -0,0 +1,183 @@
+package lshensemble
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// BlobStore is a store of named binary objects, such as a local directory
+// or an object storage bucket, for holding index snapshots.
+type BlobStore interface {
+	// Put stores data under name, replacing any existing object.
+	Put(name string, data []byte) error
+	// Get returns the data stored under name.
+	Get(name string) ([]byte, error)
+}
+
+// DirStore is a BlobStore keeping objects as files in a local directory.
+// Object names containing slashes are stored in sub-directories.
+type DirStore string
+
+// Put writes the object to a temporary file, then renames it,
+// so readers never see a partially written object.
+func (d DirStore) Put(name string, data []byte) error {
+	path := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d DirStore) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// A snapshot consists of one part per partition, named
+// prefix/part-<partition index>, and a manifest named prefix/manifest.
+// The manifest starts with formatMagic and the format version, followed by
+// the ensemble header with the isolated domains, and the name, length and CRC-32 checksum of every part.
+// The parts are the segments of the persisted index format.
+
+func snapshotPart(prefix string, i int) string {
+	return fmt.Sprintf("%s/part-%05d", prefix, i)
+}
+
+// SaveSnapshot writes the ensemble to the store as a snapshot under prefix.
+// The parts are written before the manifest, so a snapshot is only visible
+// to LoadSnapshot once all its parts are stored.
+// Only the domains made searchable by Index() and the domains isolated by
+// IsolateEmptyDomains are saved.
+func (e *LshEnsemble) SaveSnapshot(store BlobStore, prefix string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return saveSnapshot(store, prefix, e, func(i int) (Lsh, error) {
+		return e.lshes[i], nil
+	})
+}
+
+// saveSnapshot writes a snapshot of the ensemble, whose partitions are
+// returned by part one at a time.
+func saveSnapshot(store BlobStore, prefix string, e *LshEnsemble, part func(i int) (Lsh, error)) error {
+	manifest := encoder{buf: []byte(formatMagic)}
+	manifest.int(formatVersion)
+	header := encoder{}
+	header.header(e)
+	header.emptyDomains(e)
+	manifest.int(len(header.buf))
+	manifest.buf = append(manifest.buf, header.buf...)
+	for i := range e.lshes {
+		lsh, err := part(i)
+		if err != nil {
+			return err
+		}
+		seg := encoder{}
+		if err := seg.segment(lsh); err != nil {
+			return err
+		}
+		name := snapshotPart(prefix, i)
+		if err := store.Put(name, seg.buf); err != nil {
+			return err
+		}
+		manifest.string(name)
+		manifest.int(len(seg.buf))
+		manifest.uvarint(uint64(crc32.ChecksumIEEE(seg.buf)))
+	}
+	return store.Put(prefix+"/manifest", manifest.buf)
+}
+
+// LoadSnapshot reads the snapshot saved under prefix in the store.
+// Every part is verified against the checksum in the manifest.
+func LoadSnapshot(store BlobStore, prefix string) (*LshEnsemble, error) {
+	return LoadSnapshotPartitions(store, prefix, nil)
+}
+
+// LoadSnapshotPartitions is like LoadSnapshot, but only reads the parts
+// of the partitions selected by keep, as LoadPartitions does.
+func LoadSnapshotPartitions(store BlobStore, prefix string, keep PartitionFilter) (*LshEnsemble, error) {
+	e, refs, version, err := readManifest(store, prefix)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := e.selectPartitions(keep)
+	if err != nil {
+		return nil, err
+	}
+	for i, ref := range refs {
+		if !selected[i] {
+			continue
+		}
+		if e.lshes[i], err = loadPart(store, ref, version, e); err != nil {
+			return nil, err
+		}
+	}
+	e.retainPartitions(selected)
+	return e, nil
+}
+
+// partRef is the entry of a part in a snapshot manifest.
+type partRef struct {
+	name     string
+	length   int
+	checksum uint64
+}
+
+// readManifest reads the manifest of the snapshot saved under prefix, and
+// returns the ensemble whose LSHs are yet to be loaded, the parts of its
+// partitions and the format version.
+func readManifest(store BlobStore, prefix string) (*LshEnsemble, []partRef, uint64, error) {
+	data, err := store.Get(prefix + "/manifest")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if len(data) < len(formatMagic) || string(data[:len(formatMagic)]) != formatMagic {
+		return nil, nil, 0, ErrCorruptIndex
+	}
+	manifest := decoder{buf: data[len(formatMagic):]}
+	version := manifest.uvarint()
+	if manifest.err == nil && !supportedVersion(version) {
+		return nil, nil, 0, fmt.Errorf("lshensemble: unsupported index format version %d", version)
+	}
+	header := decoder{buf: manifest.raw(manifest.int(len(manifest.buf))), version: version}
+	e := header.header()
+	if e != nil {
+		header.emptyDomains(e)
+	}
+	if manifest.err != nil || header.err != nil {
+		return nil, nil, 0, ErrCorruptIndex
+	}
+	refs := make([]partRef, len(e.lshes))
+	for i := range refs {
+		refs[i].name = manifest.string()
+		refs[i].length = manifest.int(maxInt)
+		refs[i].checksum = manifest.uvarint()
+	}
+	if manifest.err != nil {
+		return nil, nil, 0, manifest.err
+	}
+	return e, refs, version, nil
+}
+
+// loadPart reads a part of the snapshot of the ensemble e, verifies it
+// against its checksum and decodes its Lsh.
+func loadPart(store BlobStore, ref partRef, version uint64, e *LshEnsemble) (Lsh, error) {
+	part, err := store.Get(ref.name)
+	if err != nil {
+		return nil, err
+	}
+	if len(part) != ref.length || uint64(crc32.ChecksumIEEE(part)) != ref.checksum {
+		return nil, fmt.Errorf("lshensemble: snapshot part %s is corrupt", ref.name)
+	}
+	seg := decoder{buf: part, version: version}
+	lsh := seg.partition(e)
+	if seg.err != nil {
+		return nil, fmt.Errorf("lshensemble: snapshot part %s is corrupt", ref.name)
+	}
+	return lsh, nil
+}
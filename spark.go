@@ -0,0 +1,101 @@
+package lshensemble
+
+import "math"
+
+// sparkHashPrime is the prime of the hash functions of Spark MinHashLSH.
+const sparkHashPrime = 2038074743
+
+// SparkDefaultSeed is the default seed of MinHashLSH in Spark MLlib, the
+// hash code of its class name.
+const SparkDefaultSeed int64 = 328749633
+
+// SparkMinhash computes the MinHash signatures of Spark MLlib's
+// MinHashLSH, so the signatures of domains sketched in Spark jobs can be
+// queried with the signatures of domains sketched here, and vice versa.
+// The values of a domain are the indexes of the non-zero entries of its
+// Spark feature vector, e.g. as computed by HashingTF or CountVectorizer.
+type SparkMinhash struct {
+	// coefs are the coefficients a and b of the hash functions
+	// (1 + x) * a + b modulo sparkHashPrime.
+	coefs [][2]int64
+	sig   Signature
+}
+
+// NewSparkMinhash initializes a MinHash object reproducing a MinHashLSH
+// model of Spark with the seed and numHash hash tables, such as
+//
+//	new MinHashLSH().setSeed(seed).setNumHashTables(numHash)
+//
+// whose seed is SparkDefaultSeed unless set.
+func NewSparkMinhash(seed int64, numHash int) *SparkMinhash {
+	r := newJavaRandom(seed)
+	coefs := make([][2]int64, numHash)
+	for i := range coefs {
+		coefs[i][0] = int64(1 + r.nextInt(sparkHashPrime-1))
+		coefs[i][1] = int64(r.nextInt(sparkHashPrime - 1))
+	}
+	sig := make(Signature, numHash)
+	for i := range sig {
+		sig[i] = math.MaxUint64
+	}
+	return &SparkMinhash{coefs: coefs, sig: sig}
+}
+
+// Push a new value, the index of a non-zero entry of the feature vector,
+// to the MinHash object.
+func (m *SparkMinhash) Push(index int) {
+	for i, c := range m.coefs {
+		if h := uint64(((1+int64(index))*c[0] + c[1]) % sparkHashPrime); h < m.sig[i] {
+			m.sig[i] = h
+		}
+	}
+}
+
+// Signature exports the MinHash signature, which is the same as the
+// hashes of the feature vector computed by the Spark model.
+func (m *SparkMinhash) Signature() Signature {
+	sig := make(Signature, len(m.sig))
+	copy(sig, m.sig)
+	return sig
+}
+
+// SparkSignature converts the hashes of a feature vector computed by a
+// Spark MinHashLSH model, one per hash table, to a MinHash signature.
+func SparkSignature(hashes []float64) Signature {
+	sig := make(Signature, len(hashes))
+	for i, h := range hashes {
+		sig[i] = uint64(h)
+	}
+	return sig
+}
+
+// javaRandom is the linear congruential generator of java.util.Random,
+// which seeds the hash functions of Spark.
+type javaRandom struct {
+	seed int64
+}
+
+func newJavaRandom(seed int64) *javaRandom {
+	return &javaRandom{seed: (seed ^ 0x5DEECE66D) & (1<<48 - 1)}
+}
+
+func (r *javaRandom) next(bits uint) int32 {
+	r.seed = (r.seed*0x5DEECE66D + 0xB) & (1<<48 - 1)
+	return int32(r.seed >> (48 - bits))
+}
+
+// nextInt returns a value in [0, bound), like Random.nextInt(bound).
+func (r *javaRandom) nextInt(bound int32) int32 {
+	if bound&-bound == bound {
+		return int32((int64(bound) * int64(r.next(31))) >> 31)
+	}
+	for {
+		bits := r.next(31)
+		val := bits % bound
+		// Reject the values of the last incomplete range, as Java does
+		// when bits-val+(bound-1) overflows
+		if int64(bits)-int64(val)+int64(bound-1) <= math.MaxInt32 {
+			return val
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package lshensemble
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// WithSpill makes the index build its hash tables with bounded memory:
+// the hash keys of the domains added are buffered, and written to sorted
+// runs of temporary files in dir every maxEntries hash keys, instead of
+// being held in memory until Index(), which merges the runs into the
+// hash tables. The memory used by the construction is then bounded by
+// maxEntries hash keys on top of the index itself.
+// A key has one hash key per band of every forest of its partition.
+// The ReplaceDuplicates policy is not supported, as the keys spilled
+// cannot be removed.
+func WithSpill(dir string, maxEntries int) Option {
+	return func(c *config) {
+		c.spill = &spiller{dir: dir, max: maxEntries}
+	}
+}
+
+// spillEntry is a key added to a hash table of a forest of a partition.
+type spillEntry struct {
+	part, forest, table int
+	hashKey, key        string
+}
+
+func (a *spillEntry) less(b *spillEntry) bool {
+	switch {
+	case a.part != b.part:
+		return a.part < b.part
+	case a.forest != b.forest:
+		return a.forest < b.forest
+	case a.table != b.table:
+		return a.table < b.table
+	case a.hashKey != b.hashKey:
+		return a.hashKey < b.hashKey
+	}
+	return a.key < b.key
+}
+
+// spiller buffers the entries added to an index, and spills them to runs.
+type spiller struct {
+	dir  string
+	max  int
+	buf  []spillEntry
+	runs []string
+}
+
+// add buffers the hash keys of the key added to the partition, and
+// spills the buffer if it is full.
+func (s *spiller) add(e *LshEnsemble, key string, band bandKey, partInd int) error {
+	var n int
+	for i, f := range lshForests(e.lshes[partInd]) {
+		for t := 0; t < f.l; t++ {
+			s.buf = append(s.buf, spillEntry{
+				part:    partInd,
+				forest:  i,
+				table:   t,
+				hashKey: band(n, f, t),
+				key:     key,
+			})
+			n++
+		}
+	}
+	if len(s.buf) < s.max {
+		return nil
+	}
+	return s.spill()
+}
+
+// spillFanIn is the maximum number of runs merged at once, which bounds
+// the files open while merging.
+var spillFanIn = 64
+
+// spill writes the buffered entries to a new run, sorted.
+func (s *spiller) spill() error {
+	sort.Slice(s.buf, func(i, j int) bool { return s.buf[i].less(&s.buf[j]) })
+	w, err := s.newRun()
+	if err != nil {
+		return err
+	}
+	for i := range s.buf {
+		if err = w.write(&s.buf[i]); err != nil {
+			break
+		}
+	}
+	run, err := w.close(err)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// runWriter writes the entries of a run to a temporary file.
+type runWriter struct {
+	file *os.File
+	w    *bufio.Writer
+	enc  encoder
+}
+
+// newRun creates a temporary file for a new run.
+func (s *spiller) newRun() (*runWriter, error) {
+	file, err := ioutil.TempFile(s.dir, "lshensemble-run-")
+	if err != nil {
+		return nil, err
+	}
+	return &runWriter{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// write appends the entry to the run, in order.
+func (w *runWriter) write(entry *spillEntry) error {
+	w.enc.buf = w.enc.buf[:0]
+	w.enc.int(entry.part)
+	w.enc.int(entry.forest)
+	w.enc.int(entry.table)
+	w.enc.string(entry.hashKey)
+	w.enc.string(entry.key)
+	_, err := w.w.Write(w.enc.buf)
+	return err
+}
+
+// close flushes and closes the run, and returns its file name, or removes
+// it and returns the error if err, the error of the writes, is not nil or
+// the run fails to be written.
+func (w *runWriter) close(err error) (string, error) {
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+		return "", err
+	}
+	return w.file.Name(), nil
+}
+
+// merge merges the runs and the buffered entries into the hash tables of
+// the index, and removes the runs. The runs are merged spillFanIn at a
+// time into longer runs, until they can be merged at once.
+func (s *spiller) merge(e *LshEnsemble) error {
+	if len(s.runs) == 0 && len(s.buf) == 0 {
+		return nil
+	}
+	if len(s.buf) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		for _, run := range s.runs {
+			os.Remove(run)
+		}
+		s.runs = nil
+	}()
+	for len(s.runs) > spillFanIn {
+		w, err := s.newRun()
+		if err != nil {
+			return err
+		}
+		merged := s.runs[:spillFanIn]
+		run, err := w.close(mergeRuns(merged, w.write))
+		if err != nil {
+			return err
+		}
+		for _, run := range merged {
+			os.Remove(run)
+		}
+		s.runs = append(s.runs[spillFanIn:], run)
+	}
+	var f *LshForest
+	var part, forest, t, start int
+	var ht hashTable
+	// flush makes the buckets merged into the current table searchable
+	flush := func() {
+		if f != nil {
+			sort.Sort(ht)
+			f.setTable(t, ht)
+		}
+	}
+	err := mergeRuns(s.runs, func(entry *spillEntry) error {
+		if f == nil || entry.part != part || entry.forest != forest || entry.table != t {
+			flush()
+			part, forest, t = entry.part, entry.forest, entry.table
+			f = lshForests(e.lshes[part])[forest]
+			// The table may be shared with a clone
+			ht = f.hashTables[t]
+			ht = ht[:len(ht):len(ht)]
+			start = len(ht)
+		}
+		if len(ht) == start || ht[len(ht)-1].hashKey != entry.hashKey {
+			ht = append(ht, bucket{hashKey: entry.hashKey})
+		}
+		b := &ht[len(ht)-1]
+		b.keys = append(b.keys, entry.key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+// mergeRuns calls fn with the entries of the runs in order, until it
+// returns an error. Every run is closed once read.
+func mergeRuns(runs []string, fn func(entry *spillEntry) error) error {
+	var h runHeap
+	defer func() {
+		for _, r := range h {
+			r.file.Close()
+		}
+	}()
+	for _, run := range runs {
+		file, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		r := &runReader{file: file, r: bufio.NewReader(file)}
+		if !r.next() {
+			file.Close()
+			if r.err != nil {
+				return r.err
+			}
+			continue
+		}
+		h = append(h, r)
+	}
+	heap.Init(&h)
+	for len(h) > 0 {
+		r := h[0]
+		if err := fn(&r.entry); err != nil {
+			return err
+		}
+		if r.next() {
+			heap.Fix(&h, 0)
+			continue
+		}
+		if r.err != nil {
+			return r.err
+		}
+		heap.Pop(&h)
+		r.file.Close()
+	}
+	return nil
+}
+
+// runReader reads the entries of a run.
+type runReader struct {
+	file  *os.File
+	r     *bufio.Reader
+	entry spillEntry
+	err   error
+}
+
+// next reads the next entry, and returns false at the end of the run
+// or on error.
+func (r *runReader) next() bool {
+	part, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if err != io.EOF {
+			r.err = err
+		}
+		return false
+	}
+	r.entry = spillEntry{
+		part:    int(part),
+		forest:  r.int(),
+		table:   r.int(),
+		hashKey: r.string(),
+		key:     r.string(),
+	}
+	return r.err == nil
+}
+
+func (r *runReader) int() int {
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil && r.err == nil {
+		r.err = io.ErrUnexpectedEOF
+	}
+	return int(v)
+}
+
+func (r *runReader) string() string {
+	buf := make([]byte, r.int())
+	if _, err := io.ReadFull(r.r, buf); err != nil && r.err == nil {
+		r.err = io.ErrUnexpectedEOF
+	}
+	return string(buf)
+}
+
+// runHeap orders the runs by their next entries.
+type runHeap []*runReader
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].entry.less(&h[j].entry) }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
@@ -0,0 +1,203 @@
+package lshensemble
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrSplitBuckets is returned when persisting an index with buckets split
+// by WithBucketSplitting, whose splits the persisted formats do not keep.
+var ErrSplitBuckets = errors.New("lshensemble: cannot persist split buckets")
+
+// WithBucketSplitting splits the buckets of more than maxBucket keys of
+// every hash table, e.g. the buckets of the domains of a low-entropy
+// column, when they are indexed: the keys of a split bucket are sorted
+// into sub-buckets by the hash key of the first extra hash values of the
+// next band, and a query probing the bucket only reads the sub-bucket of
+// its own extra hash values, as if the K of the bucket was extended by
+// extra, so the cost of the hot buckets stays bounded. The candidates of
+// a split bucket must then match the extra hash values as well, exactly
+// as for a larger K, so some of them are missed.
+// The buckets of the keys added by AddHashed or spilled by WithSpill are
+// not split, nor counted by EstimateCandidates. The splits are kept by
+// Freeze and FreezeCompact, but not by the persisted formats, so Save,
+// SaveShared and the snapshots of an index with split buckets fail with
+// ErrSplitBuckets.
+func WithBucketSplitting(maxBucket, extra int) Option {
+	return func(c *config) {
+		c.split = &bucketSplit{max: maxBucket, extra: extra}
+	}
+}
+
+// bucketSplit configures the splitting of the buckets of a forest.
+type bucketSplit struct {
+	max   int
+	extra int
+}
+
+// forForest returns the splitting of the buckets of a forest with k hash
+// values per band, whose extra hash values are at most k.
+func (s *bucketSplit) forForest(k int) *bucketSplit {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	if c.extra > k {
+		c.extra = k
+	}
+	return &c
+}
+
+// setSplit sets the splitting of the buckets of the forest.
+func (f *LshForest) setSplit(s *bucketSplit) {
+	f.split = s.forForest(f.k)
+	if f.split == nil {
+		return
+	}
+	f.initExtensions = make([]map[string][]string, f.l)
+	for i := range f.initExtensions {
+		f.initExtensions[i] = make(map[string][]string)
+	}
+}
+
+// extension returns the hash key of the extra hash values of the i-th
+// band of the signature, read from the next band, or "" if the buckets
+// of the forest are not split or the signature is too short.
+func (f *LshForest) extension(sig Signature, i int) string {
+	if f.split == nil {
+		return ""
+	}
+	start := ((i + 1) % f.l) * f.k
+	if start+f.split.extra > len(sig) {
+		return ""
+	}
+	return f.hashKeyFuncs[i](sig[start : start+f.split.extra])
+}
+
+// newBucket returns the bucket of the keys added to the i-th hash table
+// with the hash key, sorted, and split if the forest splits the buckets
+// and it has more than the maximum number of keys.
+func (f *LshForest) newBucket(i int, hashKey string, ks keys) bucket {
+	b := bucket{hashKey: hashKey, keys: ks}
+	if f.split != nil && len(ks) > f.split.max {
+		// The extensions are not known for the keys added by AddHashed
+		if exts := f.initExtensions[i][hashKey]; len(exts) == len(ks) {
+			b.split = splitBucket(ks, exts)
+		}
+	}
+	// Sorted keys can be counted by EstimateCandidates
+	sort.Strings(b.keys)
+	return b
+}
+
+// removeExtensions removes the extensions of the key from those of the
+// keys added to the i-th hash table with the hash key.
+func (f *LshForest) removeExtensions(i int, hashKey string, ks keys, key string) {
+	exts := f.initExtensions[i][hashKey]
+	if len(exts) != len(ks) {
+		return
+	}
+	var rest []string
+	for j, ext := range exts {
+		if ks[j] != key {
+			rest = append(rest, ext)
+		}
+	}
+	if len(rest) == 0 {
+		delete(f.initExtensions[i], hashKey)
+	} else {
+		f.initExtensions[i][hashKey] = rest
+	}
+}
+
+// splitBucket returns the sub-buckets of the keys by their extensions.
+func splitBucket(ks keys, exts []string) hashTable {
+	subs := make(map[string]keys)
+	for j, ext := range exts {
+		subs[ext] = append(subs[ext], ks[j])
+	}
+	split := make(hashTable, 0, len(subs))
+	for ext, sub := range subs {
+		sort.Strings(sub)
+		split = append(split, bucket{hashKey: ext, keys: sub})
+	}
+	sort.Sort(split)
+	return split
+}
+
+// splitOf returns the sub-buckets of bucket b of the table, or nil if
+// the bucket is not split.
+func splitOf(t table, b int) hashTable {
+	switch t := t.(type) {
+	case hashTable:
+		return t[b].split
+	case trieTable:
+		return t.hashTable[b].split
+	case *frozenTable:
+		return t.splits[b]
+	}
+	return nil
+}
+
+// hasSplits returns whether a bucket of the forest is split.
+func (f *LshForest) hasSplits() bool {
+	if f.split == nil {
+		return false
+	}
+	for i := 0; i < f.l; i++ {
+		t := f.table(i)
+		for b := 0; b < t.buckets(); b++ {
+			if splitOf(t, b) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scanBucket calls fn with the keys of bucket b of the table, or of its
+// sub-bucket of the extension if it is split, until it returns false.
+func scanBucket(t table, b int, ext string, fn func(key string) bool) {
+	split := splitOf(t, b)
+	if split == nil || ext == "" {
+		t.scan(b, fn)
+		return
+	}
+	open := true
+	start, end := split.search(ext)
+	for s := start; s < end && open; s++ {
+		split.scan(s, func(key string) bool {
+			open = fn(key)
+			return open
+		})
+	}
+}
+
+// without returns the sub-buckets without the key.
+func (h hashTable) without(key string) hashTable {
+	if h == nil {
+		return nil
+	}
+	rest := make(hashTable, 0, len(h))
+	for _, b := range h {
+		if ks := without(b.keys, key); len(ks) > 0 {
+			rest = append(rest, bucket{hashKey: b.hashKey, keys: ks})
+		}
+	}
+	return rest
+}
+
+// splitBuckets returns whether a bucket of the forests of the Lsh is split.
+func splitBuckets(lsh Lsh) bool {
+	switch lsh := resolveLsh(lsh).(type) {
+	case *LshForest:
+		return lsh.hasSplits()
+	case *LshForestArray:
+		for _, f := range lsh.array {
+			if f.hasSplits() {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package lshensemble
+
+import (
+	"sync"
+)
+
+// QueryStats are the statistics of the queries run by an index.
+type QueryStats struct {
+	// Queries is the number of queries run, not counting the queries
+	// answered by the query cache.
+	Queries int64
+	// Probed and Skipped are the numbers of partitions probed and
+	// skipped by the queries. A partition is skipped if none of its
+	// domains can meet the containment threshold given the query domain
+	// size, if it is outside the size bounds of the query, or if there
+	// are no LSH parameters for the threshold.
+	Probed  int64
+	Skipped int64
+	// ShortSignatures is the number of queries whose signature was
+	// shorter than the signatures of the index, which were run with the
+	// bands of the partitions the signature is long enough for, so with a
+	// lower recall. QueryE returns an error for them instead.
+	ShortSignatures int64
+	// PartitionYields are the mean numbers of candidates of every
+	// partition probed by the queries with a Limit, by which they order
+	// the partitions, or +Inf for the partitions never probed by them.
+	PartitionYields []float64
+}
+
+// QueryStats returns the statistics of the queries run by the index since
+// it was created.
+func (e *LshEnsemble) QueryStats() QueryStats {
+	return e.stats.statistics()
+}
+
+// queryStats accumulates the statistics of the queries of an index.
+type queryStats struct {
+	mu    sync.Mutex
+	stats QueryStats
+	// yields are the yields of the partitions, by partition index.
+	yields []partitionYield
+}
+
+// record counts a query with the parameters of its partitions.
+func (s *queryStats) record(params []param) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Queries++
+	for _, p := range params {
+		if p.l == 0 {
+			s.stats.Skipped++
+		} else {
+			s.stats.Probed++
+		}
+	}
+}
+
+// recordShort counts a query of a short signature.
+func (s *queryStats) recordShort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.ShortSignatures++
+}
+
+func (s *queryStats) statistics() QueryStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	for _, y := range s.yields {
+		stats.PartitionYields = append(stats.PartitionYields, y.mean())
+	}
+	return stats
+}
@@ -0,0 +1,32 @@
+package lshensemble
+
+// PartitionsBetween returns the indexes of the partitions which may hold
+// domains of sizes between lower and upper, both inclusive, for the
+// Partitions of QueryOptions. The last partition also holds the domains
+// larger than its upper bound.
+func (e *LshEnsemble) PartitionsBetween(lower, upper int) []int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	parts := make([]int, 0)
+	for i, p := range e.Partitions {
+		if withinBounds(p, i == len(e.Partitions)-1, lower, upper) {
+			parts = append(parts, i)
+		}
+	}
+	return parts
+}
+
+// selected returns which of the partitions of the index are in the
+// Partitions of the options, or nil if all are queried.
+func (opts *QueryOptions) selected(numParts int) []bool {
+	if opts.Partitions == nil {
+		return nil
+	}
+	selected := make([]bool, numParts)
+	for _, i := range opts.Partitions {
+		if i >= 0 && i < numParts {
+			selected[i] = true
+		}
+	}
+	return selected
+}
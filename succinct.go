@@ -0,0 +1,305 @@
+package lshensemble
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// FreezeCompact returns an immutable copy of the index like Freeze, whose
+// hash tables also store the hash keys and the offsets of their buckets
+// in Elias-Fano code: the sorted hash keys of n buckets share their first
+// log2(n) bits, stored in about 2 bits per bucket instead, and the offsets
+// of the buckets take a few bits instead of 32. The hash keys and offsets
+// are decoded by the queries, which are slightly slower than on a frozen
+// index. The postings are compressed as by Freeze.
+// SaveShared saves the index frozen by Freeze instead.
+func (e *LshEnsemble) FreezeCompact() *LshEnsemble {
+	return e.freeze(func(f *LshForest) *LshForest {
+		return f.freeze().compact()
+	})
+}
+
+// compact returns the frozen forest with compact tables.
+func (f *LshForest) compact() *LshForest {
+	c := *f
+	c.frozen = make([]*frozenTable, len(f.frozen))
+	for i, t := range f.frozen {
+		c.frozen[i] = &frozenTable{
+			keySize:  t.keySize,
+			postings: t.postings,
+			dict:     t.dict,
+			splits:   t.splits,
+			compact: &compactTable{
+				keys:    newCompactKeys(t.hashKeys, t.keySize),
+				offsets: newEliasFano(t.offsets),
+			},
+		}
+	}
+	return &c
+}
+
+// compacted returns whether the tables of the forest are compact.
+func (f *LshForest) compacted() bool {
+	return len(f.frozen) > 0 && f.frozen[0].compact != nil
+}
+
+// compacted returns whether the index was frozen by FreezeCompact.
+func (e *LshEnsemble) compacted() bool {
+	for _, lsh := range e.lshes {
+		for _, f := range lshForests(lsh) {
+			if f.compacted() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compactTable replaces the hash keys and the offsets of the buckets of
+// a frozenTable.
+type compactTable struct {
+	keys    *compactKeys
+	offsets *eliasFano
+}
+
+// size returns the number of bytes of the table.
+func (c *compactTable) size() int {
+	return c.keys.size() + c.offsets.size()
+}
+
+// rankBlock is the number of words of the blocks of a bitVector whose
+// ranks are stored.
+const rankBlock = 8
+
+// bitVector is a vector of bits supporting select queries.
+type bitVector struct {
+	words []uint64
+	// ranks are the numbers of ones before every block of rankBlock words.
+	ranks []uint32
+}
+
+func newBitVector(n int) *bitVector {
+	return &bitVector{words: make([]uint64, (n+63)/64)}
+}
+
+func (v *bitVector) set(i int) {
+	v.words[i/64] |= 1 << uint(i%64)
+}
+
+// index computes the ranks of the blocks once the bits are set.
+func (v *bitVector) index() {
+	v.ranks = make([]uint32, (len(v.words)+rankBlock-1)/rankBlock)
+	var r int
+	for w, x := range v.words {
+		if w%rankBlock == 0 {
+			v.ranks[w/rankBlock] = checkedUint32(r)
+		}
+		r += bits.OnesCount64(x)
+	}
+}
+
+// selectBit returns the position of the i-th one bit if one is true, or
+// of the i-th zero bit otherwise, counting from zero.
+func (v *bitVector) selectBit(i int, one bool) int {
+	before := func(b int) int {
+		r := int(v.ranks[b])
+		if !one {
+			r = b*rankBlock*64 - r
+		}
+		return r
+	}
+	b := sort.Search(len(v.ranks), func(b int) bool {
+		return before(b) > i
+	}) - 1
+	i -= before(b)
+	for w := b * rankBlock; ; w++ {
+		x := v.words[w]
+		if !one {
+			x = ^x
+		}
+		if c := bits.OnesCount64(x); i >= c {
+			i -= c
+			continue
+		}
+		for ; i > 0; i-- {
+			x &= x - 1
+		}
+		return 64*w + bits.TrailingZeros64(x)
+	}
+}
+
+func (v *bitVector) size() int {
+	return 8*len(v.words) + 4*len(v.ranks)
+}
+
+// getBits returns the width bits of b from bit off, the bits of every
+// byte being numbered from the most significant, so the bits of the hash
+// keys are in order. The width is at most 64.
+func getBits(b []byte, off, width int) uint64 {
+	var v uint64
+	for width > 0 {
+		n := 8 - off%8
+		if n > width {
+			n = width
+		}
+		x := uint64(b[off/8]>>uint(8-off%8-n)) & (1<<uint(n) - 1)
+		v = v<<uint(n) | x
+		off += n
+		width -= n
+	}
+	return v
+}
+
+// putBits sets the width bits of b from bit off, which must be zero, to v,
+// as read by getBits.
+func putBits(b []byte, off, width int, v uint64) {
+	for width > 0 {
+		n := 8 - off%8
+		if n > width {
+			n = width
+		}
+		x := byte(v>>uint(width-n)) & (1<<uint(n) - 1)
+		b[off/8] |= x << uint(8-off%8-n)
+		off += n
+		width -= n
+	}
+}
+
+// copyBits copies the width bits of src from bit srcOff to the bits of
+// dst from bit dstOff, which must be zero.
+func copyBits(dst []byte, dstOff int, src []byte, srcOff, width int) {
+	for width > 0 {
+		n := 56
+		if n > width {
+			n = width
+		}
+		putBits(dst, dstOff, n, getBits(src, srcOff, n))
+		dstOff += n
+		srcOff += n
+		width -= n
+	}
+}
+
+// eliasFano is the Elias-Fano code of a non-decreasing sequence of
+// integers: the low bits of every integer are stored as is, and its high
+// bits in unary code, as the number of zeros before its one bit in high.
+type eliasFano struct {
+	lowBits int
+	lows    []byte
+	high    *bitVector
+}
+
+func newEliasFano(values []uint32) *eliasFano {
+	n := len(values)
+	f := &eliasFano{}
+	if n > 0 && int(values[n-1]) > n {
+		f.lowBits = bits.Len(uint(int(values[n-1])/n)) - 1
+	}
+	f.lows = make([]byte, (n*f.lowBits+7)/8)
+	var maxHigh int
+	if n > 0 {
+		maxHigh = int(values[n-1]) >> uint(f.lowBits)
+	}
+	f.high = newBitVector(n + maxHigh + 1)
+	for i, v := range values {
+		putBits(f.lows, i*f.lowBits, f.lowBits, uint64(v))
+		f.high.set(int(v)>>uint(f.lowBits) + i)
+	}
+	f.high.index()
+	return f
+}
+
+// get returns the i-th integer.
+func (f *eliasFano) get(i int) uint32 {
+	high := f.high.selectBit(i, true) - i
+	return uint32(high<<uint(f.lowBits)) | uint32(getBits(f.lows, i*f.lowBits, f.lowBits))
+}
+
+func (f *eliasFano) size() int {
+	return len(f.lows) + f.high.size()
+}
+
+// compactKeys are the sorted fixed-size hash keys of the buckets of a
+// table, whose first highBits bits are in Elias-Fano code.
+type compactKeys struct {
+	keySize, n int
+	highBits   int
+	// high has a one bit for every hash key, after as many zeros as the
+	// value of its first highBits bits.
+	high *bitVector
+	// lows are the bits of the hash keys after the first highBits.
+	lows []byte
+}
+
+func newCompactKeys(hashKeys []byte, keySize int) *compactKeys {
+	n := len(hashKeys) / keySize
+	c := &compactKeys{keySize: keySize, n: n}
+	if n > 1 {
+		c.highBits = bits.Len(uint(n)) - 1
+	}
+	if c.highBits > 8*keySize {
+		c.highBits = 8 * keySize
+	}
+	lowBits := 8*keySize - c.highBits
+	c.lows = make([]byte, (n*lowBits+7)/8)
+	c.high = newBitVector(n + 1<<uint(c.highBits))
+	for i := 0; i < n; i++ {
+		key := hashKeys[i*keySize : (i+1)*keySize]
+		c.high.set(int(getBits(key, 0, c.highBits)) + i)
+		copyBits(c.lows, i*lowBits, key, c.highBits, lowBits)
+	}
+	c.high.index()
+	return c
+}
+
+// key decodes the i-th hash key into buf, of keySize zero bytes.
+func (c *compactKeys) key(i int, buf []byte) []byte {
+	lowBits := 8*c.keySize - c.highBits
+	putBits(buf, 0, c.highBits, uint64(c.high.selectBit(i, true)-i))
+	copyBits(buf, c.highBits, c.lows, i*lowBits, lowBits)
+	return buf
+}
+
+// below returns the number of hash keys whose first highBits bits are
+// less than v.
+func (c *compactKeys) below(v uint64) int {
+	if v == 0 {
+		return 0
+	}
+	if v > 1<<uint(c.highBits) {
+		return c.n
+	}
+	// The keys less than v are before the zero ending the keys of v-1
+	return c.high.selectBit(int(v-1), false) - int(v-1)
+}
+
+func (c *compactKeys) search(prefix string) (start, end int) {
+	n := len(prefix)
+	p := []byte(prefix)
+	if 8*n <= c.highBits {
+		// The prefix is within the high bits
+		shift := uint(c.highBits - 8*n)
+		v := getBits(p, 0, 8*n) << shift
+		return c.below(v), c.below(v + 1<<shift)
+	}
+	v := getBits(p, 0, c.highBits)
+	start, end = c.below(v), c.below(v+1)
+	buf := make([]byte, c.keySize)
+	prefixOf := func(i int) string {
+		for j := range buf {
+			buf[j] = 0
+		}
+		return string(c.key(i, buf)[:n])
+	}
+	start += sort.Search(end-start, func(x int) bool {
+		return prefixOf(start+x) >= prefix
+	})
+	end = start + sort.Search(end-start, func(x int) bool {
+		return prefixOf(start+x) > prefix
+	})
+	return start, end
+}
+
+func (c *compactKeys) size() int {
+	return len(c.lows) + c.high.size()
+}
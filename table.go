@@ -0,0 +1,264 @@
+package lshensemble
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// table is a hash table of a forest, whose buckets are sorted by their
+// hash keys, and whose keys are sorted within every bucket.
+// It is implemented by hashTable, and by frozenTable for frozen forests.
+type table interface {
+	// buckets returns the number of buckets.
+	buckets() int
+	// search returns the range of the buckets whose hash keys start
+	// with prefix.
+	search(prefix string) (start, end int)
+	// bucketKey returns the hash key of bucket i.
+	bucketKey(i int) string
+	// bucketLen returns the number of keys in bucket i.
+	bucketLen(i int) int
+	// key returns the j-th key of bucket i.
+	key(i, j int) string
+	// scan calls fn with the keys of bucket i in order, until it
+	// returns false. It is faster than key for reading a whole bucket.
+	scan(i int, fn func(key string) bool)
+}
+
+func (h hashTable) buckets() int { return len(h) }
+
+func (h hashTable) search(prefix string) (start, end int) {
+	n := len(prefix)
+	start = sort.Search(len(h), func(x int) bool {
+		return h[x].hashKey[:n] >= prefix
+	})
+	end = start
+	for end < len(h) && h[end].hashKey[:n] == prefix {
+		end++
+	}
+	return start, end
+}
+
+func (h hashTable) bucketKey(i int) string { return h[i].hashKey }
+func (h hashTable) bucketLen(i int) int    { return len(h[i].keys) }
+func (h hashTable) key(i, j int) string    { return h[i].keys[j] }
+
+func (h hashTable) scan(i int, fn func(key string) bool) {
+	for _, key := range h[i].keys {
+		if !fn(key) {
+			return
+		}
+	}
+}
+
+// tableRange is a range of the buckets of a table.
+type tableRange struct {
+	t          table
+	start, end int
+}
+
+// size returns the number of keys in the buckets.
+func (r tableRange) size() int {
+	var n int
+	for b := r.start; b < r.end; b++ {
+		n += r.t.bucketLen(b)
+	}
+	return n
+}
+
+// count returns the number of times key is in the buckets.
+func (r tableRange) count(key string) int {
+	var c int
+	for b := r.start; b < r.end; b++ {
+		n := r.t.bucketLen(b)
+		j := sort.Search(n, func(j int) bool {
+			return r.t.key(b, j) >= key
+		})
+		for ; j < n && r.t.key(b, j) == key; j++ {
+			c++
+		}
+	}
+	return c
+}
+
+// keyDict stores the keys of a frozen forest in a single string.
+// The ids of the keys are in the order of the keys.
+type keyDict struct {
+	data    string
+	offsets []uint32
+	// borrowed is whether data references the buffer of a shared index,
+	// e.g. a mapped file, so the keys are copied out of it and remain
+	// valid after the file is unmapped.
+	borrowed bool
+}
+
+func (d *keyDict) key(id uint32) string {
+	key := d.ref(id)
+	if d.borrowed {
+		return string([]byte(key))
+	}
+	return key
+}
+
+// ref returns the key of the id in place.
+func (d *keyDict) ref(id uint32) string {
+	return d.data[d.offsets[id]:d.offsets[id+1]]
+}
+
+// len returns the number of keys of the dictionary.
+func (d *keyDict) len() int {
+	return len(d.offsets) - 1
+}
+
+// id returns the id of the key, or false if it is not in the dictionary.
+func (d *keyDict) id(key string) (int, bool) {
+	n := d.len()
+	i := sort.Search(n, func(i int) bool { return d.ref(uint32(i)) >= key })
+	return i, i < n && d.ref(uint32(i)) == key
+}
+
+// postingsBlock is the number of keys in the blocks of the postings of
+// a bucket.
+const postingsBlock = 64
+
+// frozenTable is a hash table flattened into arrays: the fixed-size hash
+// keys of the buckets are concatenated, and the keys of every bucket are
+// postings, the ids of the keys in a keyDict, compressed as varints.
+// The postings of a bucket are the number of keys, followed by the
+// little-endian 32-bit offsets of its blocks after the first, relative to
+// the start of the bucket, and by the blocks: the id of the first key of
+// the block, and the deltas of the next ids. The ids being sorted, the
+// deltas of the popular buckets take one or two bytes, and the blocks
+// bound the decoding of a random key.
+type frozenTable struct {
+	keySize  int
+	hashKeys []byte
+	// offsets are the starts of the buckets in postings, followed by
+	// the size of postings.
+	offsets  []uint32
+	postings []byte
+	dict     *keyDict
+	// compact, if not nil, replaces hashKeys and offsets, in the indexes
+	// frozen by FreezeCompact.
+	compact *compactTable
+	// splits are the sub-buckets of the split buckets, by bucket.
+	splits map[int]hashTable
+}
+
+// offset returns the start of bucket i in postings.
+func (t *frozenTable) offset(i int) uint32 {
+	if t.compact != nil {
+		return t.compact.offsets.get(i)
+	}
+	return t.offsets[i]
+}
+
+// postings encodes the postings of a bucket of sorted ids.
+func (e *encoder) postings(ids []uint32) {
+	start := len(e.buf)
+	e.int(len(ids))
+	skips := len(e.buf)
+	for b := postingsBlock; b < len(ids); b += postingsBlock {
+		e.buf = append(e.buf, 0, 0, 0, 0)
+	}
+	var prev uint32
+	for j, id := range ids {
+		if j%postingsBlock == 0 {
+			if j > 0 {
+				binary.LittleEndian.PutUint32(e.buf[skips:], checkedUint32(len(e.buf)-start))
+				skips += 4
+			}
+			e.uvarint(uint64(id))
+		} else {
+			e.uvarint(uint64(id - prev))
+		}
+		prev = id
+	}
+}
+
+// bucket returns the postings of bucket i, the number of its keys and
+// the offsets of its block offsets and of its first block.
+func (t *frozenTable) bucket(i int) (postings []byte, n, skips, first int) {
+	postings = t.postings[t.offset(i):t.offset(i+1)]
+	v, skips := binary.Uvarint(postings)
+	n = int(v)
+	first = skips
+	if n > 0 {
+		first += 4 * ((n - 1) / postingsBlock)
+	}
+	return postings, n, skips, first
+}
+
+func (t *frozenTable) buckets() int {
+	if t.compact != nil {
+		return t.compact.keys.n
+	}
+	return len(t.offsets) - 1
+}
+
+func (t *frozenTable) search(prefix string) (start, end int) {
+	if t.compact != nil {
+		return t.compact.keys.search(prefix)
+	}
+	n := len(prefix)
+	prefixOf := func(i int) []byte {
+		return t.hashKeys[i*t.keySize : i*t.keySize+n]
+	}
+	buckets := t.buckets()
+	start = sort.Search(buckets, func(x int) bool {
+		return string(prefixOf(x)) >= prefix
+	})
+	end = start
+	for end < buckets && string(prefixOf(end)) == prefix {
+		end++
+	}
+	return start, end
+}
+
+func (t *frozenTable) bucketKey(i int) string {
+	if t.compact != nil {
+		return string(t.compact.keys.key(i, make([]byte, t.keySize)))
+	}
+	return string(t.hashKeys[i*t.keySize : (i+1)*t.keySize])
+}
+
+func (t *frozenTable) bucketLen(i int) int {
+	_, n, _, _ := t.bucket(i)
+	return n
+}
+
+func (t *frozenTable) key(i, j int) string {
+	postings, n, skips, p := t.bucket(i)
+	if j < 0 || j >= n {
+		panic("lshensemble: key index out of range")
+	}
+	if b := j / postingsBlock; b > 0 {
+		p = int(binary.LittleEndian.Uint32(postings[skips+4*(b-1):]))
+	}
+	v, w := binary.Uvarint(postings[p:])
+	p += w
+	id := uint32(v)
+	for r := j % postingsBlock; r > 0; r-- {
+		v, w := binary.Uvarint(postings[p:])
+		p += w
+		id += uint32(v)
+	}
+	return t.dict.key(id)
+}
+
+func (t *frozenTable) scan(i int, fn func(key string) bool) {
+	postings, n, _, p := t.bucket(i)
+	var id uint32
+	for j := 0; j < n; j++ {
+		v, w := binary.Uvarint(postings[p:])
+		p += w
+		if j%postingsBlock == 0 {
+			id = uint32(v)
+		} else {
+			id += uint32(v)
+		}
+		if !fn(t.dict.key(id)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package lshensemble
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// TierOptions configures the tiering of an index loaded by
+// LoadSnapshotTiered.
+type TierOptions struct {
+	// MaxHot is the maximum number of partitions kept in memory,
+	// 1 by default.
+	MaxHot int
+	// HalfLife is the number of partition accesses after which the
+	// access counts are halved, so the partitions no longer queried
+	// become cold. It is 1024 by default.
+	HalfLife int
+}
+
+// TierStats are the statistics of the tiering of an index.
+type TierStats struct {
+	// Hot are the indexes of the partitions in memory.
+	Hot []int
+	// Loads and Evictions are the numbers of times a partition was
+	// loaded from the store and removed from memory.
+	Loads     int
+	Evictions int
+	// LoadErrors is the number of failed loads, and LastError the
+	// error of the last one. The queries probing a partition failing
+	// to load fail with its error, which QueryE returns.
+	LoadErrors int
+	LastError  error
+}
+
+// LoadSnapshotTiered reads the snapshot saved under prefix in the store,
+// keeping only the most frequently queried partitions in memory: the
+// others are cold, and loaded from the store when queried, which evicts
+// the least frequently queried partition from memory if there are more
+// than MaxHot. This serves indexes larger than the memory, such as
+// snapshots in a DirStore on local disk.
+// Every part is read once to be verified, and the partitions loaded
+// first stay hot. The index is read-only: Add panics and AddE returns
+// ErrFrozenIndex.
+func LoadSnapshotTiered(store BlobStore, prefix string, opts *TierOptions) (*LshEnsemble, error) {
+	if opts == nil {
+		opts = &TierOptions{}
+	}
+	e, refs, version, err := readManifest(store, prefix)
+	if err != nil {
+		return nil, err
+	}
+	m := &tierManager{
+		maxHot:   opts.MaxHot,
+		halfLife: opts.HalfLife,
+		parts:    make([]*tieredLsh, len(refs)),
+	}
+	if m.maxHot <= 0 {
+		m.maxHot = 1
+	}
+	if m.halfLife <= 0 {
+		m.halfLife = 1024
+	}
+	for i, ref := range refs {
+		lsh, err := loadPart(store, ref, version, e)
+		if err != nil {
+			return nil, err
+		}
+		ref := ref
+		t := &tieredLsh{
+			m:     m,
+			shape: emptyLsh(lsh),
+			load: func() (Lsh, error) {
+				return loadPart(store, ref, version, e)
+			},
+		}
+		if m.hot < m.maxHot {
+			t.lsh = lsh
+			m.hot++
+		}
+		m.parts[i] = t
+		e.lshes[i] = t
+	}
+	e.tiers = m
+	e.frozen = true
+	return e, nil
+}
+
+// TierStats returns the statistics of the tiering of an index loaded by
+// LoadSnapshotTiered, or zero statistics for other indexes.
+func (e *LshEnsemble) TierStats() TierStats {
+	if e.tiers == nil {
+		return TierStats{}
+	}
+	return e.tiers.statistics()
+}
+
+// tierManager tracks the accesses to the partitions of a tiered index,
+// and promotes and demotes them.
+type tierManager struct {
+	maxHot   int
+	halfLife int
+	// mu guards the fields below and the partitions.
+	mu       sync.Mutex
+	parts    []*tieredLsh
+	hot      int
+	accesses int
+	stats    TierStats
+}
+
+func (m *tierManager) statistics() TierStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	stats.Hot = nil
+	for i, t := range m.parts {
+		if t.lsh != nil {
+			stats.Hot = append(stats.Hot, i)
+		}
+	}
+	return stats
+}
+
+// get returns the Lsh of the partition as acquire, or the empty shape of
+// the partition if it fails to load. The queries pin the partitions they
+// probe first, so their errors are returned.
+func (m *tierManager) get(t *tieredLsh) Lsh {
+	lsh, err := m.acquire(t, false)
+	if err != nil {
+		return t.shape
+	}
+	return lsh
+}
+
+// acquire records an access to the partition, and returns its Lsh,
+// loading it if it is cold, and pinning it in memory if pin is true.
+// The loads are made outside the mutex, so the queries of the hot
+// partitions are not stalled, and a partition is loaded once by
+// concurrent queries. The accesses of a pinned partition are recorded
+// when it is pinned.
+func (m *tierManager) acquire(t *tieredLsh, pin bool) (Lsh, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pin || t.pins == 0 {
+		m.access(t)
+	}
+	for t.lsh == nil {
+		if l := t.loading; l != nil {
+			m.mu.Unlock()
+			<-l.done
+			m.mu.Lock()
+			if l.err != nil {
+				return nil, l.err
+			}
+			continue
+		}
+		l := &tierLoad{done: make(chan struct{})}
+		t.loading = l
+		m.mu.Unlock()
+		lsh, err := t.load()
+		m.mu.Lock()
+		t.loading = nil
+		l.err = err
+		close(l.done)
+		if err != nil {
+			m.stats.LoadErrors++
+			m.stats.LastError = err
+			return nil, err
+		}
+		m.stats.Loads++
+		t.lsh = lsh
+		m.hot++
+		if m.hot > m.maxHot {
+			m.evict(t)
+		}
+	}
+	if pin {
+		t.pins++
+	}
+	return t.lsh, nil
+}
+
+// access records an access to the partition.
+func (m *tierManager) access(t *tieredLsh) {
+	t.hits++
+	m.accesses++
+	if m.accesses >= m.halfLife {
+		for _, p := range m.parts {
+			p.hits /= 2
+		}
+		m.accesses = 0
+	}
+}
+
+// pin loads and pins the partitions of the Lshs probed with the params,
+// and returns the function unpinning them, or the error of the first
+// partition failing to load.
+func (m *tierManager) pin(lshes []Lsh, params []param) (func(), error) {
+	var pinned []*tieredLsh
+	unpin := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, t := range pinned {
+			t.pins--
+		}
+		for m.hot > m.maxHot && m.evict(nil) {
+		}
+	}
+	for i, lsh := range lshes {
+		t, tiered := lsh.(*tieredLsh)
+		if !tiered || params[i].l == 0 {
+			continue
+		}
+		if _, err := m.acquire(t, true); err != nil {
+			unpin()
+			return nil, fmt.Errorf("lshensemble: partition %d failed to load: %w", i, err)
+		}
+		pinned = append(pinned, t)
+	}
+	return unpin, nil
+}
+
+// evict removes the least frequently accessed partition other than
+// keep and the pinned partitions from memory, and returns whether one
+// was removed. The queries using it keep their references.
+func (m *tierManager) evict(keep *tieredLsh) bool {
+	hot := make([]*tieredLsh, 0, m.hot)
+	for _, p := range m.parts {
+		if p.lsh != nil && p != keep && p.pins == 0 {
+			hot = append(hot, p)
+		}
+	}
+	if len(hot) == 0 {
+		return false
+	}
+	sort.Slice(hot, func(i, j int) bool { return hot[i].hits < hot[j].hits })
+	hot[0].lsh = nil
+	m.hot--
+	m.stats.Evictions++
+	return true
+}
+
+// tierLoad is a load of a partition in progress.
+type tierLoad struct {
+	done chan struct{}
+	err  error
+}
+
+// tieredLsh is a partition of a tiered index.
+type tieredLsh struct {
+	m *tierManager
+	// shape is an empty Lsh with the parameters of the partition,
+	// for computing the optimal parameters without loading it.
+	shape Lsh
+	load  func() (Lsh, error)
+	// lsh is the loaded Lsh, or nil if the partition is cold, and
+	// loading the load in progress, if any.
+	lsh     Lsh
+	loading *tierLoad
+	hits    int
+	// pins is the number of queries probing the partition, which is
+	// not evicted while they run.
+	pins int
+}
+
+func (t *tieredLsh) Add(key string, sig Signature) {
+	panic(ErrFrozenIndex)
+}
+
+func (t *tieredLsh) Index() {}
+
+func (t *tieredLsh) Query(sig Signature, k, l int, out chan string) {
+	t.m.get(t).Query(sig, k, l, out)
+}
+
+func (t *tieredLsh) OptimalKL(x, q int, th float64) (optK, optL int, fp, fn float64) {
+	return t.shape.OptimalKL(x, q, th)
+}
+
+func (t *tieredLsh) forest(k int) (*LshForest, int) {
+	return t.m.get(t).forest(k)
+}
+
+// resolve returns the loaded Lsh of the partition.
+func (t *tieredLsh) resolve() Lsh {
+	return t.m.get(t)
+}
+
+// resolveLsh returns the Lsh of a partition of a tiered index loaded in
+// memory, or lsh itself for other indexes.
+func resolveLsh(lsh Lsh) Lsh {
+	if t, ok := lsh.(*tieredLsh); ok {
+		return t.resolve()
+	}
+	return lsh
+}
+
+// empty returns a forest with no keys and the same parameters as f.
+func (f *LshForest) empty() *LshForest {
+	e := newLshForest(f.k, f.l, f.hashValueSize, f.trim)
+	if f.hashValueBits != 0 {
+		e = newLshForestBits(f.k, f.l, f.hashValueBits, f.trim)
+	}
+	if f.tries != nil {
+		e.tries = make([]*trie, f.l)
+	}
+	e.setSplit(f.split)
+	return e
+}
+
+// emptyLsh returns an Lsh with no keys and the same parameters as lsh.
+func emptyLsh(lsh Lsh) Lsh {
+	switch lsh := lsh.(type) {
+	case *LshForest:
+		return lsh.empty()
+	case *LshForestArray:
+		array := make([]*LshForest, len(lsh.array))
+		for i, f := range lsh.array {
+			array[i] = f.empty()
+		}
+		return &LshForestArray{
+			maxK:    lsh.maxK,
+			numHash: lsh.numHash,
+			array:   array,
+		}
+	}
+	return lsh
+}
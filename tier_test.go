@@ -0,0 +1,70 @@
+package lshensemble
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func Test_LoadSnapshotTiered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lshensemble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recs := randomDomains(200, 64, 1)
+	index := BootstrapLshEnsemblePlus(4, 64, 4, len(recs), Recs2Chan(recs))
+	store := DirStore(dir)
+	if err := index.SaveSnapshot(store, "snap"); err != nil {
+		t.Fatal(err)
+	}
+	tiered, err := LoadSnapshotTiered(store, "snap", &TierOptions{MaxHot: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameResults(t, index, tiered, recs)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, rec := range recs[i*50 : (i+1)*50] {
+				tiered.Query(rec.Signature, rec.Size, 0.5)
+			}
+		}(i)
+	}
+	wg.Wait()
+	stats := tiered.TierStats()
+	if len(stats.Hot) > 2 || stats.Loads == 0 || stats.Evictions == 0 || stats.LoadErrors != 0 {
+		t.Fatalf("%+v", stats)
+	}
+	if err := tiered.AddE("new", recs[0].Signature, 0); !errors.Is(err, ErrFrozenIndex) {
+		t.Fatal(err)
+	}
+
+	// The queries of partitions failing to load fail
+	for i := range index.Partitions {
+		os.Remove(filepath.Join(dir, filepath.FromSlash(snapshotPart("snap", i))))
+	}
+	var failed int
+	for _, rec := range recs {
+		got, _, err := tiered.QueryE(rec.Signature, rec.Size, 0.5)
+		if err != nil {
+			failed++
+			continue
+		}
+		want, _ := index.Query(rec.Signature, rec.Size, 0.5)
+		if len(got) != len(want) {
+			t.Fatal(got, want)
+		}
+	}
+	if failed == 0 {
+		t.Fatal("no query failed")
+	}
+	if stats := tiered.TierStats(); stats.LoadErrors == 0 || stats.LastError == nil {
+		t.Fatalf("%+v", stats)
+	}
+}
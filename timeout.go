@@ -0,0 +1,58 @@
+package lshensemble
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errPartial is returned by query when the timeout of the query elapsed
+// before all the partitions were probed.
+var errPartial = errors.New("lshensemble: query timed out")
+
+// QueryTimeout is like Query, but stops probing the partitions once the
+// timeout elapses, and returns the candidates found by then. partial is
+// true if the query timed out, or was rejected by the admission
+// controller, so the results may miss candidates. The results are not
+// cached.
+func (e *LshEnsemble) QueryTimeout(sig Signature, size int, threshold float64, timeout time.Duration) (result []string, partial bool) {
+	defer e.rlockQuery()()
+	keys := make(chan string)
+	var err error
+	go func() {
+		err = e.query(sig, size, e.optimalParams(size, threshold, Supersets), &QueryOptions{Timeout: timeout}, keys)
+		close(keys)
+	}()
+	result = make([]string, 0)
+	for key := range keys {
+		result = append(result, key)
+	}
+	return result, err != nil
+}
+
+// deadline returns the channel abandoning the probing of a query, closed
+// with opts.Done or once opts.Timeout elapses, and a function to call
+// once the probing ends, which returns whether the timeout elapsed.
+func (opts *QueryOptions) deadline() (done <-chan struct{}, stop func() bool) {
+	if opts.Timeout <= 0 {
+		return opts.Done, func() bool { return false }
+	}
+	expired := make(chan struct{})
+	var once sync.Once
+	expire := func() { once.Do(func() { close(expired) }) }
+	timer := time.AfterFunc(opts.Timeout, expire)
+	if opts.Done != nil {
+		go func() {
+			select {
+			case <-opts.Done:
+				expire()
+			case <-expired:
+			}
+		}()
+	}
+	return expired, func() bool {
+		timedOut := !timer.Stop()
+		expire()
+		return timedOut
+	}
+}
@@ -0,0 +1,189 @@
+package lshensemble
+
+import (
+	"sort"
+)
+
+// WithTrieTables indexes the hash keys of every hash table of the index
+// in a compressed trie, in addition to the sorted buckets: the buckets of
+// a prefix are then found by descending the trie along the prefix, in
+// time proportional to the length of the prefix instead of a binary
+// search, and Index() inserts the new buckets in the tries and reads the
+// buckets back in order, instead of sorting the whole hash tables.
+// The tries take more memory than the sorted buckets, and are not saved
+// with the index.
+func WithTrieTables() Option {
+	return func(c *config) {
+		c.trie = true
+	}
+}
+
+// trie is a compressed trie of the hash keys of the buckets of a hash
+// table. As the hash keys have the same length, the buckets are at the
+// leaves, which are in the order of the buckets in the hash table.
+type trie struct {
+	root trieNode
+}
+
+// trieNode is a node of a trie, whose buckets are the range
+// [first, first+count) of the hash table.
+type trieNode struct {
+	// label is the part of the hash keys of the node after the label of
+	// its parent.
+	label string
+	// children are the children of an inner node, sorted by the first
+	// byte of their labels.
+	children     []*trieNode
+	first, count int
+	// pending are the buckets inserted in a leaf, which are appended to
+	// its buckets by flatten.
+	pending []bucket
+}
+
+// newTrie returns the trie of the buckets of the hash table, pending
+// insertion.
+func newTrie(ht hashTable) *trie {
+	t := &trie{}
+	for _, b := range ht {
+		t.insert(b)
+	}
+	return t
+}
+
+// child returns the index of the child of the node whose label starts
+// with c, or where it would be inserted, and whether it exists.
+func (n *trieNode) child(c byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].label[0] >= c
+	})
+	return i, i < len(n.children) && n.children[i].label[0] == c
+}
+
+// insert inserts the bucket in the trie, in the leaf of its hash key,
+// until the next flatten.
+func (t *trie) insert(b bucket) {
+	n, key := &t.root, b.hashKey
+	for len(key) > 0 {
+		i, exist := n.child(key[0])
+		if !exist {
+			leaf := &trieNode{label: key, first: n.first + n.count}
+			if i < len(n.children) {
+				leaf.first = n.children[i].first
+			}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = leaf
+			n = leaf
+			break
+		}
+		c := n.children[i]
+		common := 1
+		for common < len(c.label) && common < len(key) && c.label[common] == key[common] {
+			common++
+		}
+		if common < len(c.label) {
+			// Split the label of the child
+			inner := &trieNode{
+				label:    c.label[:common],
+				children: []*trieNode{c},
+				first:    c.first,
+				count:    c.count,
+			}
+			c.label = c.label[common:]
+			n.children[i] = inner
+			c = inner
+		}
+		n, key = c, key[common:]
+	}
+	n.pending = append(n.pending, b)
+}
+
+// flatten returns the hash table of the buckets of the trie in order,
+// given the hash table of its last flatten, and clears the buckets
+// pending insertion.
+func (t *trie) flatten(old hashTable) hashTable {
+	ht := make(hashTable, 0, len(old))
+	var walk func(n *trieNode)
+	walk = func(n *trieNode) {
+		first := len(ht)
+		if len(n.children) == 0 {
+			ht = append(ht, old[n.first:n.first+n.count]...)
+			ht = append(ht, n.pending...)
+			n.pending = nil
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+		n.first, n.count = first, len(ht)-first
+	}
+	walk(&t.root)
+	return ht
+}
+
+// search returns the range of the buckets whose hash keys start with
+// prefix, as search of hashTable.
+func (t *trie) search(prefix string) (start, end int) {
+	n := &t.root
+	for len(prefix) > 0 {
+		i, exist := n.child(prefix[0])
+		if !exist {
+			pos := n.first + n.count
+			if i < len(n.children) {
+				pos = n.children[i].first
+			}
+			return pos, pos
+		}
+		c := n.children[i]
+		m := len(c.label)
+		if len(prefix) < m {
+			m = len(prefix)
+		}
+		if label := c.label[:m]; label != prefix[:m] {
+			if prefix[:m] < label {
+				return c.first, c.first
+			}
+			return c.first + c.count, c.first + c.count
+		}
+		n, prefix = c, prefix[m:]
+	}
+	return n.first, n.first + n.count
+}
+
+// trieTable is a hash table searched with its trie.
+type trieTable struct {
+	hashTable
+	trie *trie
+}
+
+func (t trieTable) search(prefix string) (start, end int) {
+	return t.trie.search(prefix)
+}
+
+// indexTrie is like indexTable, inserting the new buckets in the trie of
+// the hash table, which is built first if the table has none.
+func (f *LshForest) indexTrie(i int) {
+	t := f.tries[i]
+	if t == nil {
+		t = newTrie(f.hashTables[i])
+		f.tries[i] = t
+		f.hashTables[i] = t.flatten(f.hashTables[i])
+	}
+	initHt := f.initTable(i)
+	if len(initHt) == 0 {
+		return
+	}
+	for hashKey, ks := range initHt {
+		t.insert(f.newBucket(i, hashKey, ks))
+	}
+	f.hashTables[i] = t.flatten(f.hashTables[i])
+	f.resetInitTable(i)
+}
+
+// setTable replaces the i-th hash table of the forest, whose trie, if
+// any, is rebuilt by the next Index().
+func (f *LshForest) setTable(i int, ht hashTable) {
+	f.hashTables[i] = ht
+	if f.tries != nil {
+		f.tries[i] = nil
+	}
+}
@@ -4,16 +4,132 @@ import (
 	"encoding/binary"
 )
 
+// TrimScheme is how the 64-bit MinHash values are trimmed to the
+// hash value size of an LshForest.
+type TrimScheme byte
+
+const (
+	// TrimLow keeps the low-order bits of the hash values.
+	// It is the scheme of the indexes created before trim schemes
+	// were introduced.
+	TrimLow TrimScheme = iota
+	// TrimHigh keeps the high-order bits of the hash values.
+	TrimHigh
+	// TrimRehash mixes all the bits of the hash values before
+	// keeping the low-order bits, for signatures whose bits are not
+	// uniformly distributed.
+	TrimRehash
+)
+
+// SaltBands can be combined with a trim scheme, e.g. TrimHigh|SaltBands,
+// to re-hash the hash values of every band with a different salt before
+// they are trimmed. It breaks the correlations between signature
+// positions, such as those of densified one-permutation MinHash, which
+// would otherwise make the same domains collide in many bands.
+const SaltBands TrimScheme = 0x80
+
+// DefaultTrimScheme is the trim scheme of the new LshForests, unless
+// another is given by NewLshForestTrimmed or the WithTrimScheme option
+// of an index.
+const DefaultTrimScheme = TrimHigh
+
+func (s TrimScheme) valid() bool {
+	return s&^SaltBands <= TrimRehash
+}
+
+// trim returns the hash value trimmed to hashValueSize bytes.
+// The band salt is ignored.
+func (s TrimScheme) trim(v uint64, hashValueSize int) uint64 {
+	return s.trimBits(v, uint(8*hashValueSize))
+}
+
+// trimBits returns the hash value trimmed to the bits.
+// The band salt is ignored.
+func (s TrimScheme) trimBits(v uint64, bits uint) uint64 {
+	if bits >= 64 {
+		return v
+	}
+	switch s &^ SaltBands {
+	case TrimHigh:
+		return v >> (64 - bits)
+	case TrimRehash:
+		v = mix64(v)
+	}
+	return v & (1<<bits - 1)
+}
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(v uint64) uint64 {
+	v ^= v >> 30
+	v *= 0xbf58476d1ce4e5b9
+	v ^= v >> 27
+	v *= 0x94d049bb133111eb
+	v ^= v >> 31
+	return v
+}
+
+// bandSalt returns the salt of the i-th band.
+func bandSalt(i int) uint64 {
+	return mix64(uint64(i+1) * 0x9e3779b97f4a7c15)
+}
+
 type hashKeyFunc func(Signature) string
 
-func hashKeyFuncGen(hashValueSize int) hashKeyFunc {
+// hashKeyFuncGen generates the hash key function of a band,
+// which salts the hash values if the scheme has SaltBands set.
+func hashKeyFuncGen(hashValueSize int, scheme TrimScheme, salt uint64) hashKeyFunc {
+	salted := scheme&SaltBands != 0
 	return func(sig Signature) string {
 		s := make([]byte, hashValueSize*len(sig))
 		buf := make([]byte, 8)
 		for i, v := range sig {
-			binary.LittleEndian.PutUint64(buf, v)
+			if salted {
+				v = mix64(v ^ salt)
+			}
+			binary.LittleEndian.PutUint64(buf, scheme.trim(v, hashValueSize))
 			copy(s[i*hashValueSize:(i+1)*hashValueSize], buf[:hashValueSize])
 		}
 		return string(s)
 	}
 }
+
+// CollisionRate estimates from a sample of signatures the probability
+// that two different MinHash values at the same position become equal
+// once trimmed to hashValueSize bytes using the scheme.
+// For uniformly distributed values it is close to 1/2^(8*hashValueSize);
+// a much higher rate means the width or the scheme does not suit
+// the signatures, and will result in more false positives.
+func CollisionRate(sample []Signature, hashValueSize int, scheme TrimScheme) float64 {
+	return CollisionRateBits(sample, 8*hashValueSize, scheme)
+}
+
+// CollisionRateBits is like CollisionRate, for hash values trimmed to the
+// bits, e.g. to pick the width of WithHashValueBits. For uniformly
+// distributed values it is close to 1/2^bits.
+func CollisionRateBits(sample []Signature, bits int, scheme TrimScheme) float64 {
+	if len(sample) == 0 {
+		return 0
+	}
+	var pairs, collisions float64
+	for i := range sample[0] {
+		// The distinct values at the position, grouped by trimmed value
+		seen := make(map[uint64]bool)
+		groups := make(map[uint64]float64)
+		for _, sig := range sample {
+			if i >= len(sig) || seen[sig[i]] {
+				continue
+			}
+			seen[sig[i]] = true
+			groups[scheme.trimBits(sig[i], uint(bits))]++
+		}
+		n := float64(len(seen))
+		pairs += n * (n - 1) / 2
+		for _, c := range groups {
+			collisions += c * (c - 1) / 2
+		}
+	}
+	if pairs == 0 {
+		return 0
+	}
+	return collisions / pairs
+}
@@ -0,0 +1,115 @@
+//go:build js && wasm
+// +build js,wasm
+
+// Command wasm exposes LSH Ensemble to JavaScript as a WebAssembly module,
+// for in-browser dataset similarity and edge deployments. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o lshensemble.wasm ./wasm
+//
+// and load it with the wasm_exec.js of the Go distribution. The module
+// defines the global object lshensemble, with the functions
+//
+//	lshensemble.signature(values, seed, numHash)
+//	lshensemble.newIndex(numPart, numHash, maxK)
+//
+// signature returns the MinHash signature of an array of string values,
+// as a BigUint64Array. newIndex returns an index, with the methods
+// add(key, size, signature), index() and query(signature, size, threshold),
+// the latter returning an array of keys. An index is built by index() from
+// the domains added, sequentially. add returns an Error for the records
+// of an empty key, a size that is not positive or a signature shorter
+// than numHash, which it does not add.
+package main
+
+import (
+	"sort"
+	"syscall/js"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+func main() {
+	js.Global().Set("lshensemble", js.ValueOf(map[string]interface{}{
+		"signature": js.FuncOf(signature),
+		"newIndex":  js.FuncOf(newIndex),
+	}))
+	// Keep the functions callable
+	select {}
+}
+
+// toSignature copies a BigUint64Array signature.
+func toSignature(v js.Value) lshensemble.Signature {
+	b := make([]byte, v.Get("byteLength").Int())
+	js.CopyBytesToGo(b, js.Global().Get("Uint8Array").New(v.Get("buffer"), v.Get("byteOffset"), len(b)))
+	sig := make(lshensemble.Signature, len(b)/lshensemble.HashValueSize)
+	sig.Read(b)
+	return sig
+}
+
+// fromSignature returns the signature as a BigUint64Array.
+func fromSignature(sig lshensemble.Signature) js.Value {
+	b := make([]byte, sig.ByteLen())
+	sig.Write(b)
+	u8 := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(u8, b)
+	return js.Global().Get("BigUint64Array").New(u8.Get("buffer"))
+}
+
+func signature(this js.Value, args []js.Value) interface{} {
+	values, seed, numHash := args[0], args[1].Int(), args[2].Int()
+	mh := lshensemble.NewMinhash(seed, numHash)
+	for i := 0; i < values.Length(); i++ {
+		mh.Push([]byte(values.Index(i).String()))
+	}
+	return fromSignature(mh.Signature())
+}
+
+func newIndex(this js.Value, args []js.Value) interface{} {
+	numPart, numHash, maxK := args[0].Int(), args[1].Int(), args[2].Int()
+	var recs []*lshensemble.DomainRecord
+	var index *lshensemble.LshEnsemble
+	return js.ValueOf(map[string]interface{}{
+		"add": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			rec, err := lshensemble.NewDomainRecord(args[0].String(), args[1].Int(), toSignature(args[2]), numHash)
+			if err != nil {
+				return js.Global().Get("Error").New(err.Error())
+			}
+			recs = append(recs, rec)
+			return nil
+		}),
+		"index": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			sort.Slice(recs, func(i, j int) bool { return recs[i].Size < recs[j].Size })
+			e, err := lshensemble.New(
+				lshensemble.WithPartitions(make([]lshensemble.Partition, numPart)),
+				lshensemble.WithNumHash(numHash),
+				lshensemble.WithMaxK(maxK),
+				lshensemble.WithForestArray(),
+				lshensemble.WithSequential())
+			if err != nil {
+				return js.Global().Get("Error").New(err.Error())
+			}
+			ch := make(chan *lshensemble.DomainRecord, len(recs))
+			for _, rec := range recs {
+				ch <- rec
+			}
+			close(ch)
+			e.Bootstrap(len(recs), ch)
+			index, recs = e, nil
+			return nil
+		}),
+		"query": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			if index == nil {
+				return js.Global().Get("Error").New("index not built")
+			}
+			result, _, err := index.QueryE(toSignature(args[0]), args[1].Int(), args[2].Float())
+			if err != nil {
+				return js.Global().Get("Error").New(err.Error())
+			}
+			keys := make([]interface{}, len(result))
+			for i, key := range result {
+				keys[i] = key
+			}
+			return js.ValueOf(keys)
+		}),
+	})
+}